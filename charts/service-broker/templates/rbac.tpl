@@ -41,6 +41,12 @@ rules:
   verbs:
   - get
   - list
+- apiGroups:
+  - authorization.k8s.io
+  resources:
+  - subjectaccessreviews
+  verbs:
+  - create
 ---
 apiVersion: rbac.authorization.k8s.io/v1
 kind: ClusterRoleBinding
@@ -159,6 +165,12 @@ rules:
   verbs:
   - get
   - list
+- apiGroups:
+  - authorization.k8s.io
+  resources:
+  - subjectaccessreviews
+  verbs:
+  - create
 - apiGroups:
   - apps
   - autoscaling
@@ -177,6 +189,11 @@ rules:
   resources:
   - poddisruptionbudgets
   verbs: ["*"]
+- apiGroups:
+  - cert-manager.io
+  resources:
+  - certificates
+  verbs: ["*"]
 ---
 apiVersion: rbac.authorization.k8s.io/v1
 kind: ClusterRoleBinding
@@ -17,6 +17,7 @@ import (
 	"k8s.io/client-go/tools/clientcmd"
 
 	"github.com/AdeAttwood/service-broker/pkg/broker"
+	"github.com/AdeAttwood/service-broker/pkg/service"
 	"github.com/pmorie/osb-broker-lib/pkg/metrics"
 	"github.com/pmorie/osb-broker-lib/pkg/rest"
 	"github.com/pmorie/osb-broker-lib/pkg/server"
@@ -82,6 +83,7 @@ func runWithContext(ctx context.Context) error {
 		return err
 	}
 	options.K8sClient = k8sClient
+	options.HelmActionConfig = service.NewHelmActionConfig(options.KubeConfig)
 
 	if options.ServiceNamespace == "" {
 		options.ServiceNamespace = os.Getenv("SERVICE_NAMESPACE")
@@ -92,10 +94,15 @@ func runWithContext(ctx context.Context) error {
 		return err
 	}
 
+	if flag.Arg(0) == "rotate-credentials" {
+		return rotateCredentials(businessLogic, flag.Args()[1:])
+	}
+
 	// Prom. metrics
 	reg := prom.NewRegistry()
 	osbMetrics := metrics.New()
 	reg.MustRegister(osbMetrics)
+	broker.RegisterUsageMetrics(reg)
 
 	api, err := rest.NewAPISurface(businessLogic, osbMetrics)
 	if err != nil {
@@ -103,6 +110,17 @@ func runWithContext(ctx context.Context) error {
 	}
 
 	s := server.New(api, reg)
+	s.Router.HandleFunc("/v2/service_instances/{instance_id}", businessLogic.GetInstanceHandler).Methods("GET")
+	s.Router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", businessLogic.GetBindingHandler).Methods("GET")
+	s.Router.Use(businessLogic.CatalogMiddleware)
+
+	if options.UsageInterval > 0 {
+		go businessLogic.MonitorUsage(ctx, options.UsageInterval)
+	}
+
+	if options.SweepInterval > 0 {
+		go businessLogic.Sweep(ctx, options.SweepInterval)
+	}
 	// if options.AuthenticateK8SToken {
 	// 	// Create a User Info Authorizer.
 	// 	authz := middleware.SARUserInfoAuthorizer{
@@ -137,6 +155,31 @@ func runWithContext(ctx context.Context) error {
 	return err
 }
 
+// Rotates the credentials of an instance from the command line, this is run
+// with the same config as the broker e.g.
+// "service-broker --config config.yaml rotate-credentials --scope bindings <instance-id>"
+func rotateCredentials(businessLogic *broker.BusinessLogic, args []string) error {
+	flags := flag.NewFlagSet("rotate-credentials", flag.ExitOnError)
+	scope := flags.String("scope", broker.RotateAll, "What is rotated, 'all', 'instance' or 'bindings'.")
+	gracePeriod := flags.Duration("grace-period", 0, "How long the old credentials keep working.")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("Usage: rotate-credentials [--scope all|instance|bindings] [--grace-period 1h] <instance-id>")
+	}
+
+	if *scope != broker.RotateAll && *scope != broker.RotateInstance && *scope != broker.RotateBindings {
+		return fmt.Errorf("Invalid scope '%s'", *scope)
+	}
+
+	if err := businessLogic.RotateCredentials(flags.Arg(0), *scope, *gracePeriod); err != nil {
+		return err
+	}
+
+	fmt.Printf("Rotated the credentials of instance %q\n", flags.Arg(0))
+	return nil
+}
+
 func getKubernetesClient(kubeConfigPath string) (clientset.Interface, error) {
 	var clientConfig *clientrest.Config
 	var err error
@@ -160,7 +203,7 @@ func getKubernetesClient(kubeConfigPath string) (clientset.Interface, error) {
 }
 
 func cancelOnInterrupt(ctx context.Context, f context.CancelFunc) {
-	term := make(chan os.Signal)
+	term := make(chan os.Signal, 1)
 	signal.Notify(term, os.Interrupt, syscall.SIGTERM)
 
 	for {
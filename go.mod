@@ -3,10 +3,12 @@ module github.com/AdeAttwood/service-broker
 go 1.13
 
 require (
+	github.com/go-sql-driver/mysql v1.5.0
 	github.com/gofrs/flock v0.8.0
 	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b
 	github.com/golang/protobuf v1.4.3 // indirect
 	github.com/google/go-cmp v0.5.2 // indirect
+	github.com/gorilla/mux v1.7.3
 	github.com/gregjones/httpcache v0.0.0-20190611155906-901d90724c79 // indirect
 	github.com/kubernetes/client-go v11.0.0+incompatible // indirect
 	github.com/pkg/errors v0.9.1
@@ -23,6 +25,7 @@ require (
 	helm.sh/helm/v3 v3.4.2
 	k8s.io/api v0.19.4
 	k8s.io/apimachinery v0.19.4
+	k8s.io/cli-runtime v0.19.4
 	k8s.io/client-go v0.19.4
 	k8s.io/klog v1.0.0 // indirect
 	k8s.io/kubernetes v1.13.0
@@ -0,0 +1,108 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+	authorizationV1 "k8s.io/api/authorization/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/AdeAttwood/service-broker/pkg/service"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+// Creates an osb error that will be returned to the platform with the status
+// code and message
+func httpError(statusCode int, format string, a ...interface{}) error {
+	errorMessage := fmt.Sprintf(format, a...)
+	return osb.HTTPStatusCodeError{
+		StatusCode:   statusCode,
+		ErrorMessage: &errorMessage,
+	}
+}
+
+// Tests if the user that made the request can read the secrets in a namespace.
+// Users can always read the namespace the request was made in, for any other
+// namespace the kubernetes identity of the user is checked with a subject
+// access review
+func (b *BusinessLogic) canReadNamespace(identity *osb.OriginatingIdentity, requestNamespace string, namespace string) (bool, error) {
+	if requestNamespace == namespace {
+		return true, nil
+	}
+
+	if identity == nil || identity.Platform != osb.PlatformKubernetes {
+		return false, nil
+	}
+
+	userIdentity, err := broker.ParseIdentity(*identity)
+	if err != nil {
+		return false, err
+	}
+
+	user := userIdentity.Kubernetes
+	extra := map[string]authorizationV1.ExtraValue{}
+	for key, value := range user.Extra {
+		extra[key] = authorizationV1.ExtraValue(value)
+	}
+
+	review, err := b.k8sClient.AuthorizationV1().SubjectAccessReviews().Create(context.TODO(), &authorizationV1.SubjectAccessReview{
+		Spec: authorizationV1.SubjectAccessReviewSpec{
+			User:   user.Username,
+			UID:    user.UID,
+			Groups: user.Groups,
+			Extra:  extra,
+			ResourceAttributes: &authorizationV1.ResourceAttributes{
+				Namespace: namespace,
+				Verb:      "get",
+				Resource:  "secrets",
+			},
+		},
+	}, v1.CreateOptions{})
+	if err != nil {
+		return false, err
+	}
+
+	return review.Status.Allowed, nil
+}
+
+// Gets the instance that a new instance will be cloned from with the
+// "clone_from_instance" parameter. Cloning copies all of the data out of the
+// source instance so the user must be able to read the namespace the source
+// was provisioned in
+func (b *BusinessLogic) getSourceInstance(request *osb.ProvisionRequest, namespace string) (*service.SourceInstance, error) {
+	sourceID, ok := request.Parameters["clone_from_instance"].(string)
+	if !ok || sourceID == "" {
+		return nil, nil
+	}
+
+	secrets, err := b.getInstanceSecrets(sourceID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(secrets) == 0 {
+		return nil, httpError(http.StatusBadRequest, "Unknown instance '%s' to clone from", sourceID)
+	}
+
+	if secrets[0].Labels["service-id"] != request.ServiceID {
+		return nil, httpError(http.StatusBadRequest, "Instance '%s' is not an instance of the same service", sourceID)
+	}
+
+	allowed, err := b.canReadNamespace(request.OriginatingIdentity, namespace, secrets[0].Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	if !allowed {
+		return nil, httpError(http.StatusForbidden, "You do not have access to the instance '%s'", sourceID)
+	}
+
+	return &service.SourceInstance{
+		ID:        sourceID,
+		Namespace: secrets[0].Namespace,
+		Secrets:   secrets,
+	}, nil
+}
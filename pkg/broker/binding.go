@@ -0,0 +1,82 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The bind parameter that sets how long a binding lasts before it is removed
+const ttlParameter = "ttl"
+
+// The annotation on the binding secret that holds when the binding expires
+const bindingExpiresAnnotation = "service-binding-expires"
+
+// Gets the ttl of a binding from the bind parameters. This is a duration like
+// "2h" or a number of seconds, zero is returned when the binding doesn't
+// expire
+func bindingTTL(parameters map[string]interface{}) (time.Duration, error) {
+	value, ok := parameters[ttlParameter]
+	if !ok || value == nil {
+		return 0, nil
+	}
+
+	ttl := time.Duration(0)
+	switch value := value.(type) {
+	case float64:
+		ttl = time.Duration(value) * time.Second
+	case int:
+		ttl = time.Duration(value) * time.Second
+	case string:
+		var err error
+		if ttl, err = time.ParseDuration(value); err != nil {
+			return 0, fmt.Errorf("Invalid %s '%s', this must be a duration like '2h' or a number of seconds", ttlParameter, value)
+		}
+	}
+
+	if ttl <= 0 {
+		return 0, fmt.Errorf("Invalid %s '%v', this must be more than zero", ttlParameter, value)
+	}
+
+	return ttl, nil
+}
+
+// Unbinds all of the bindings where the ttl has passed. The bindings are
+// removed with the same debind spec as an unbind request
+func (b *BusinessLogic) expireBindings(now time.Time) {
+	list, err := b.k8sClient.CoreV1().Secrets(v1.NamespaceAll).List(context.TODO(), v1.ListOptions{
+		LabelSelector: "service-binding-id",
+	})
+	if err != nil {
+		glog.Errorf("Unable to list the bindings: %v", err)
+		return
+	}
+
+	expired := map[string]string{}
+	for _, secret := range list.Items {
+		expires, err := time.Parse(time.RFC3339, secret.Annotations[bindingExpiresAnnotation])
+		if err == nil && now.After(expires) {
+			expired[secret.Labels["service-binding-id"]] = secret.Labels["service-instance-id"]
+		}
+	}
+
+	for bindingID, instanceID := range expired {
+		request := &osb.UnbindRequest{InstanceID: instanceID, BindingID: bindingID}
+		if secrets, _ := b.getInstanceSecrets(instanceID); len(secrets) > 0 {
+			request.PlanID = secrets[0].Labels["service-plan"]
+		}
+
+		// The service id is left out so the namespace of the binding is found
+		// from the binding resources
+		if _, err := b.Unbind(request, nil); err != nil {
+			glog.Errorf("Unable to remove the expired binding '%s': %v", bindingID, err)
+			continue
+		}
+
+		glog.Infof("Removed the expired binding '%s' of instance '%s'", bindingID, instanceID)
+	}
+}
@@ -2,8 +2,11 @@ package broker
 
 import (
 	"flag"
+	"time"
 
 	clientset "k8s.io/client-go/kubernetes"
+
+	"github.com/AdeAttwood/service-broker/pkg/service"
 )
 
 // Options holds the options specified by the broker's code on the command
@@ -18,6 +21,14 @@ type Options struct {
 	// Kubernetes client-go instance for
 	K8sClient  clientset.Interface
 	ConfigFile string
+	// Creates the helm config that is used to install the helm services
+	HelmActionConfig service.HelmActionConfig
+	// How often the usage of the instances is checked, zero disables the
+	// usage monitor
+	UsageInterval time.Duration
+	// How often the background tasks like removing the old credentials of
+	// rotations are run, zero disables them
+	SweepInterval time.Duration
 }
 
 // AddFlags is a hook called to initialize the CLI flags for broker options.
@@ -26,4 +37,6 @@ type Options struct {
 func AddFlags(o *Options) {
 	flag.StringVar(&o.CatalogPath, "catalogPath", "", "The path to the catalog")
 	flag.BoolVar(&o.Async, "async", false, "Indicates whether the broker is handling the requests asynchronously.")
+	flag.DurationVar(&o.SweepInterval, "sweepInterval", time.Minute, "How often the background tasks like removing the old credentials of rotations are run, 0 disables them.")
+	flag.DurationVar(&o.UsageInterval, "usageInterval", 5*time.Minute, "How often the usage of the instances is checked, 0 disables the usage monitor.")
 }
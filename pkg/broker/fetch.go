@@ -0,0 +1,166 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/gorilla/mux"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+
+	"github.com/AdeAttwood/service-broker/pkg/service"
+)
+
+// The response when an instance is fetched. The usage is only set for the
+// services that measure it
+type GetInstanceResponse struct {
+	ServiceID  string                 `json:"service_id"`
+	PlanID     string                 `json:"plan_id"`
+	Parameters map[string]interface{} `json:"parameters"`
+	Usage      *service.InstanceUsage `json:"usage,omitempty"`
+}
+
+// Gets an instance from its secrets
+func (b *BusinessLogic) GetInstance(instanceID string) (*GetInstanceResponse, error) {
+	secrets, err := b.getInstanceSecrets(instanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(secrets) == 0 {
+		return nil, httpError(http.StatusNotFound, "Instance '%s' not found", instanceID)
+	}
+
+	response := &GetInstanceResponse{
+		ServiceID:  secrets[0].Labels["service-id"],
+		PlanID:     secrets[0].Labels["service-plan"],
+		Parameters: instanceParameters(secrets[0]),
+	}
+
+	for _, secret := range secrets {
+		if value, ok := secret.Annotations[usageAnnotation]; ok {
+			usage := service.InstanceUsage{InstanceID: instanceID}
+			if err := json.Unmarshal([]byte(value), &usage); err == nil {
+				response.Usage = &usage
+			}
+		}
+	}
+
+	return response, nil
+}
+
+// The response when a binding is fetched. The metadata is the binding metadata
+// of the osb spec, it is only set for the bindings that expire
+type GetBindingResponse struct {
+	Credentials map[string]interface{} `json:"credentials"`
+	Metadata    *BindingMetadata       `json:"metadata,omitempty"`
+}
+
+type BindingMetadata struct {
+	ExpiresAt string `json:"expires_at,omitempty"`
+}
+
+// Gets a binding from its binding secret
+func (b *BusinessLogic) GetBinding(instanceID string, bindingID string) (*GetBindingResponse, error) {
+	secrets, err := b.getBindingSecrets(instanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, secret := range secrets {
+		if secret.Labels["service-binding-id"] != bindingID {
+			continue
+		}
+
+		response := &GetBindingResponse{Credentials: map[string]interface{}{}}
+		for key, value := range secret.Data {
+			response.Credentials[key] = string(value)
+		}
+
+		if expires, ok := secret.Annotations[bindingExpiresAnnotation]; ok {
+			response.Metadata = &BindingMetadata{ExpiresAt: expires}
+		}
+
+		return response, nil
+	}
+
+	return nil, httpError(http.StatusNotFound, "Binding '%s' not found", bindingID)
+}
+
+// Handles the requests to fetch a binding, like the instances these are added
+// to the router of the broker server
+func (b *BusinessLogic) GetBindingHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	response, err := b.GetBinding(vars["instance_id"], vars["binding_id"])
+	writeResponse(w, response, err)
+}
+
+// Handles the requests to fetch an instance, these are not routed by the osb
+// library so this is added to the router of the broker server
+func (b *BusinessLogic) GetInstanceHandler(w http.ResponseWriter, r *http.Request) {
+	response, err := b.GetInstance(mux.Vars(r)["instance_id"])
+	writeResponse(w, response, err)
+}
+
+// A service in the catalog with the instances_retrievable field of the osb
+// spec, the osb client only has the bindings_retrievable field. The instances
+// of every service are read from their secrets so they can all be fetched
+type catalogService struct {
+	osb.Service
+	InstancesRetrievable bool `json:"instances_retrievable"`
+}
+
+// Adds the instances_retrievable field to the services of the catalog. The
+// catalog is still handled by the osb library so the api version is checked
+// and the request is counted, only its successful response is rewritten
+func (b *BusinessLogic) CatalogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/v2/catalog" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		recorder := httptest.NewRecorder()
+		next.ServeHTTP(recorder, r)
+
+		catalog := struct {
+			Services []catalogService `json:"services"`
+		}{}
+		if recorder.Code != http.StatusOK || json.Unmarshal(recorder.Body.Bytes(), &catalog) != nil {
+			for key, values := range recorder.Header() {
+				w.Header()[key] = values
+			}
+
+			w.WriteHeader(recorder.Code)
+			w.Write(recorder.Body.Bytes())
+			return
+		}
+
+		for i := range catalog.Services {
+			catalog.Services[i].InstancesRetrievable = true
+		}
+
+		writeResponse(w, catalog, nil)
+	})
+}
+
+// Writes a json response or the status of the error
+func writeResponse(w http.ResponseWriter, response interface{}, err error) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err != nil {
+		status, description := http.StatusInternalServerError, err.Error()
+		if statusErr, ok := err.(osb.HTTPStatusCodeError); ok {
+			status = statusErr.StatusCode
+			if statusErr.ErrorMessage != nil {
+				description = *statusErr.ErrorMessage
+			}
+		}
+
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"description": description})
+		return
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,109 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	coreV1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/AdeAttwood/service-broker/pkg/kube"
+	"github.com/AdeAttwood/service-broker/pkg/service"
+)
+
+// The annotation the provision parameters are stored in on the instance
+// resources so they can be used when the instance is deprovisioned
+const parametersAnnotation = "service-parameters"
+
+// Gets the secrets that were created when an instance was provisioned. The
+// secrets hold the parameters of the instance and the namespace the instance
+// was provisioned in
+func (b *BusinessLogic) getInstanceSecrets(instanceID string) ([]coreV1.Secret, error) {
+	list, err := b.k8sClient.CoreV1().Secrets(v1.NamespaceAll).List(context.TODO(), v1.ListOptions{
+		LabelSelector: fmt.Sprintf("service-instance-id=%s,!service-binding-id", instanceID),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return list.Items, nil
+}
+
+// Gets the parameters an instance was provisioned with from one of the
+// instance resources
+func instanceParameters(secret coreV1.Secret) map[string]interface{} {
+	parameters := map[string]interface{}{}
+	if value, ok := secret.Annotations[parametersAnnotation]; ok {
+		json.Unmarshal([]byte(value), &parameters)
+	}
+
+	return parameters
+}
+
+// Stores the new plan and parameters of an instance after it has been updated
+func (b *BusinessLogic) updateInstanceSecrets(secrets []coreV1.Secret, options service.ServiceOptions) error {
+	parameters, err := json.Marshal(options.Parameters)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(secrets); i++ {
+		secret := secrets[i].DeepCopy()
+		if secret.Annotations == nil {
+			secret.Annotations = map[string]string{}
+		}
+
+		secret.Labels["service-plan"] = options.PlanID
+		secret.Annotations[parametersAnnotation] = string(parameters)
+		if _, err := b.k8sClient.CoreV1().Secrets(secret.Namespace).Update(context.TODO(), secret, v1.UpdateOptions{}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Creates the resources of a new instance. Errors creating the spec are
+// ignored like they always have been, the instance manager errors are returned
+func (b *BusinessLogic) createInstance(requestedService service.Service, spec *kube.Spec, options service.ServiceOptions) error {
+	spec.Create(b.k8sClient)
+
+	if manager, ok := requestedService.(service.InstanceManager); ok {
+		return manager.CreateInstance(options)
+	}
+
+	return nil
+}
+
+// Gets the provision spec of an instance, the errors of the services that can
+// fail to build it are returned
+func provisionSpec(requestedService service.Service, options service.ServiceOptions) (*kube.Spec, error) {
+	if builder, ok := requestedService.(service.ProvisionSpecBuilder); ok {
+		return builder.BuildProvisionSpec(options)
+	}
+
+	return requestedService.GetProvisionSpec(options), nil
+}
+
+// Removes all of the resources of an instance, only the instance manager
+// errors are returned
+func (b *BusinessLogic) deleteInstance(requestedService service.Service, spec *kube.Spec, deprovisionSpec *kube.Spec, options service.ServiceOptions) error {
+	deprovisionSpec.Create(b.k8sClient)
+
+	if manager, ok := requestedService.(service.InstanceManager); ok {
+		if err := manager.DeleteInstance(options); err != nil {
+			return err
+		}
+	}
+
+	spec.Delete(b.k8sClient)
+
+	return nil
+}
+
+// Helper function to get a pointer to an operation key for the async responses
+func operationKey(operation osb.OperationKey) *osb.OperationKey {
+	return &operation
+}
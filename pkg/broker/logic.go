@@ -2,24 +2,101 @@ package broker
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"path/filepath"
 	"sync"
+	"time"
 
+	"github.com/golang/glog"
 	"gopkg.in/yaml.v2"
 
 	"github.com/pmorie/osb-broker-lib/pkg/broker"
+	coreV1 "k8s.io/api/core/v1"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 
+	"github.com/AdeAttwood/service-broker/pkg/kube"
 	"github.com/AdeAttwood/service-broker/pkg/service"
 
 	osb "github.com/pmorie/go-open-service-broker-client/v2"
 )
 
 type Config struct {
-	SharedMysql []service.SharedMysqlConfig `yaml:"sharedMysql"`
+	MysqlInstance    service.InstanceConfig          `yaml:"mysqlInstance"`
+	MinioInstance    service.InstanceConfig          `yaml:"minioInstance"`
+	PostgresInstance service.InstanceConfig          `yaml:"postgresInstance"`
+	RedisInstance    service.InstanceConfig          `yaml:"redisInstance"`
+	RabbitMQInstance service.InstanceConfig          `yaml:"rabbitmqInstance"`
+	MongoInstance    service.InstanceConfig          `yaml:"mongoInstance"`
+	SharedMysql      []service.SharedMysqlConfig     `yaml:"sharedMysql"`
+	SharedMysqlPools []service.SharedMysqlPoolConfig `yaml:"sharedMysqlPools"`
+	SharedPostgres   []service.SharedPostgresConfig  `yaml:"sharedPostgres"`
+	SharedS3         []service.SharedS3Config        `yaml:"sharedS3"`
+	Helm             []service.HelmConfig            `yaml:"helm"`
+	Templates        []service.TemplateConfig        `yaml:"templates"`
+	External         []service.ExternalConfig        `yaml:"external"`
+	// The pod security of all the services, each service can override this
+	// in its own config
+	PodSecurity service.PodSecurityConfig `yaml:"podSecurity"`
+}
+
+// Validates all of the plans in the config so any errors are found when the
+// broker starts and not when an instance is provisioned
+func (c *Config) Validate() error {
+	for _, instanceConfig := range []service.InstanceConfig{c.MysqlInstance, c.MinioInstance, c.PostgresInstance, c.RedisInstance, c.RabbitMQInstance, c.MongoInstance} {
+		for _, plan := range instanceConfig.Plans {
+			if err := plan.Validate(); err != nil {
+				return err
+			}
+		}
+
+		if err := instanceConfig.Credentials.Validate(); err != nil {
+			return err
+		}
+
+		if err := instanceConfig.ValidateTLS(); err != nil {
+			return err
+		}
+
+		if err := instanceConfig.PodSecurity.Validate(); err != nil {
+			return err
+		}
+	}
+
+	for _, sharedMysql := range c.SharedMysql {
+		for _, plan := range sharedMysql.Plans {
+			if err := plan.Validate(); err != nil {
+				return err
+			}
+		}
+
+		if err := sharedMysql.Credentials.Validate(); err != nil {
+			return err
+		}
+	}
+
+	for _, sharedS3 := range c.SharedS3 {
+		if err := sharedS3.Credentials.Validate(); err != nil {
+			return err
+		}
+	}
+
+	for _, sharedPostgres := range c.SharedPostgres {
+		if err := sharedPostgres.Credentials.Validate(); err != nil {
+			return err
+		}
+	}
+
+	for _, templateConfig := range c.Templates {
+		if err := templateConfig.Credentials.Validate(); err != nil {
+			return err
+		}
+	}
+
+	return c.validatePodSecurity()
 }
 
 // NewBusinessLogic is a hook that is called with the Options the program is run
@@ -39,27 +116,117 @@ func NewBusinessLogic(o Options) (*BusinessLogic, error) {
 		}
 	}
 
-	services := map[string]service.Service{}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
 
-	// Add the mysql service
-	mysql := service.NewMysqlInstance()
-	services[mysql.Definition().ID] = mysql
+	// The services are kept in a list as well as the map so the catalog is
+	// always returned in the same order
+	catalog := []service.Service{
+		service.NewMysqlInstance(config.MysqlInstance, o.K8sClient),
+		service.NewMinioInstance(config.MinioInstance, o.K8sClient),
+		service.NewPostgresInstance(config.PostgresInstance, o.K8sClient),
+		service.NewRedisInstance(config.RedisInstance, o.K8sClient),
+		service.NewRabbitMQInstance(config.RabbitMQInstance, o.K8sClient),
+		service.NewMongoInstance(config.MongoInstance, o.K8sClient),
+	}
 
-	// Add the minio service
-	minio := service.NewMinioInstance()
-	services[minio.Definition().ID] = minio
+	// The pod security overrides of the services by the service id
+	podSecurity := map[string]service.PodSecurityConfig{}
+	for i, instanceConfig := range []service.InstanceConfig{config.MysqlInstance, config.MinioInstance, config.PostgresInstance, config.RedisInstance, config.RabbitMQInstance, config.MongoInstance} {
+		podSecurity[catalog[i].Definition().ID] = instanceConfig.PodSecurity
+	}
 
 	// Add the shared mysql instances to the service list
 	for i := 0; i < len(config.SharedMysql); i++ {
-		sharedMysql := service.NewSharedMysql(config.SharedMysql[i])
-		services[sharedMysql.Definition().ID] = sharedMysql
+		sharedMysql, err := service.NewSharedMysql(config.SharedMysql[i], o.K8sClient)
+		if err != nil {
+			return nil, err
+		}
+
+		podSecurity[sharedMysql.Definition().ID] = config.SharedMysql[i].PodSecurity
+		catalog = append(catalog, sharedMysql)
+	}
+
+	// Add the pools of shared mysql servers to the service list
+	for i := 0; i < len(config.SharedMysqlPools); i++ {
+		pool, err := service.NewSharedMysqlPool(config.SharedMysqlPools[i], o.K8sClient)
+		if err != nil {
+			return nil, err
+		}
+
+		podSecurity[pool.Definition().ID] = config.SharedMysqlPools[i].PodSecurity
+		catalog = append(catalog, pool)
+	}
+
+	// Add the shared postgres servers to the service list
+	for i := 0; i < len(config.SharedPostgres); i++ {
+		sharedPostgres := service.NewSharedPostgres(config.SharedPostgres[i])
+		podSecurity[sharedPostgres.Definition().ID] = config.SharedPostgres[i].PodSecurity
+		catalog = append(catalog, sharedPostgres)
+	}
+
+	// Add the shared s3 servers to the service list
+	for i := 0; i < len(config.SharedS3); i++ {
+		sharedS3 := service.NewSharedS3(config.SharedS3[i])
+		podSecurity[sharedS3.Definition().ID] = config.SharedS3[i].PodSecurity
+		catalog = append(catalog, sharedS3)
+	}
+
+	// Add the helm chart services to the service list
+	for i := 0; i < len(config.Helm); i++ {
+		helm, err := service.NewHelmService(config.Helm[i], o.K8sClient, o.HelmActionConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		catalog = append(catalog, helm)
+	}
+
+	// Add the services that are defined by templates to the service list
+	for i := 0; i < len(config.Templates); i++ {
+		templateService, err := service.NewTemplateService(config.Templates[i])
+		if err != nil {
+			return nil, err
+		}
+
+		podSecurity[templateService.Definition().ID] = config.Templates[i].PodSecurity
+		catalog = append(catalog, templateService)
+	}
+
+	// Add the services that are backed by an external api to the service list
+	for i := 0; i < len(config.External); i++ {
+		externalService, err := service.NewExternalService(config.External[i])
+		if err != nil {
+			return nil, err
+		}
+
+		catalog = append(catalog, externalService)
+	}
+
+	services := map[string]service.Service{}
+	for _, s := range catalog {
+		services[s.Definition().ID] = s
+		podSecurity[s.Definition().ID] = config.PodSecurity.Merge(podSecurity[s.Definition().ID])
+	}
+
+	// The resources shared by all of the instances of a service are created
+	// once when the broker starts
+	for _, s := range catalog {
+		if manager, ok := s.(service.SharedResourceManager); ok {
+			if err := manager.EnsureSharedResources(o.K8sClient, o.ServiceNamespace); err != nil {
+				return nil, fmt.Errorf("Unable to create the shared resources of '%s': %v", s.Definition().Name, err)
+			}
+		}
 	}
 
 	return &BusinessLogic{
-		async:     o.Async,
-		k8sClient: o.K8sClient,
-		namespace: o.ServiceNamespace,
-		services:  services,
+		async:       o.Async,
+		k8sClient:   o.K8sClient,
+		namespace:   o.ServiceNamespace,
+		services:    services,
+		catalog:     catalog,
+		podSecurity: podSecurity,
 	}, nil
 }
 
@@ -72,11 +239,15 @@ type BusinessLogic struct {
 	sync.RWMutex
 	// The available services in this service broker
 	services map[string]service.Service
+	// The available services in the order they are shown in the catalog
+	catalog []service.Service
 	// The kubernetes client that will be used to create all of the service in
 	// the cluster
 	k8sClient kubernetes.Interface
 	// The namespace that all of the global services will be created in
 	namespace string
+	// The pod security of the pods the services create by the service id
+	podSecurity map[string]service.PodSecurityConfig
 }
 
 var _ broker.Interface = &BusinessLogic{}
@@ -90,7 +261,7 @@ func (b *BusinessLogic) GetCatalog(c *broker.RequestContext) (*broker.CatalogRes
 	response := &broker.CatalogResponse{}
 
 	services := make([]osb.Service, 0)
-	for _, s := range b.services {
+	for _, s := range b.catalog {
 		services = append(services, s.Definition())
 	}
 
@@ -110,22 +281,65 @@ func (b *BusinessLogic) Provision(request *osb.ProvisionRequest, c *broker.Reque
 		namespace = request.Context["namespace"].(string)
 	}
 
-	spec := requestedService.GetProvisionSpec(service.ServiceOptions{
+	source, err := b.getSourceInstance(request, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	options := service.ServiceOptions{
 		ID:              request.InstanceID,
 		PlanID:          request.PlanID,
 		Namespace:       namespace,
 		GlobalNamespace: b.namespace,
-	})
+		Parameters:      request.Parameters,
+		Source:          source,
+	}
 
+	// The spec is generated and the instance secrets are created under the
+	// lock so services that place instances by the instances that already
+	// exist see the other provisions
 	b.Lock()
 	defer b.Unlock()
 
+	if validator, ok := requestedService.(service.ProvisionValidator); ok {
+		if err := validator.ValidateProvision(options); err != nil {
+			return nil, httpError(http.StatusBadRequest, "%s", err.Error())
+		}
+	}
+
+	spec, err := provisionSpec(requestedService, options)
+	if err != nil {
+		return nil, httpError(http.StatusInternalServerError, "Unable to provision the instance: %s", err.Error())
+	}
+
+	spec.NetworkPolicies = append(spec.NetworkPolicies, instanceNetworkPolicies(requestedService, options)...)
+	b.secure(request.ServiceID, spec)
+
+	// Store the parameters with the instance so the same spec can be generated
+	// when the instance is deprovisioned
+	if parameters, err := json.Marshal(request.Parameters); err == nil {
+		spec.Annotations = map[string]string{parametersAnnotation: string(parameters)}
+	}
+
 	response := broker.ProvisionResponse{}
 	if request.AcceptsIncomplete {
+		// Only the secrets are created before the response, the rest of the
+		// instance is created in the background
+		secrets := &kube.Spec{Namespace: spec.Namespace, Lables: spec.Lables, Annotations: spec.Annotations, Secrets: spec.Secrets}
+		if err := secrets.Create(b.k8sClient); err != nil {
+			return nil, httpError(http.StatusInternalServerError, "Unable to provision the instance: %s", err.Error())
+		}
+
+		spec.Secrets = nil
 		response.Async = b.async
-		go spec.Create(b.k8sClient)
-	} else {
-		spec.Create(b.k8sClient)
+		response.OperationKey = operationKey(service.ProvisionOperation)
+		go func() {
+			if err := b.createInstance(requestedService, spec, options); err != nil {
+				glog.Errorf("Unable to provision instance '%s': %s", options.ID, err)
+			}
+		}()
+	} else if err := b.createInstance(requestedService, spec, options); err != nil {
+		return nil, httpError(http.StatusInternalServerError, "Unable to provision the instance: %s", err.Error())
 	}
 
 	return &response, nil
@@ -137,26 +351,34 @@ func (b *BusinessLogic) Deprovision(request *osb.DeprovisionRequest, c *broker.R
 	// Get the service instance resource from the cluster. This is done to test
 	// if that instance exists and to get the namespace that the instance was
 	// provisioned in
-	list, _ := b.k8sClient.CoreV1().Secrets(v1.NamespaceAll).List(context.TODO(), v1.ListOptions{
-		LabelSelector: fmt.Sprintf("service-instance-id=%s", request.InstanceID),
-	})
+	secrets, _ := b.getInstanceSecrets(request.InstanceID)
 
 	// If there are no resources in the list with the requested service instance
 	// id then just skip deprivation. This is because the resources have been
 	// deleted by something else and there is nothing to deprivation
-	if len(list.Items) == 0 {
+	if len(secrets) == 0 {
 		return &broker.DeprovisionResponse{}, nil
 	}
 
 	specOptions := service.ServiceOptions{
 		ID:              request.InstanceID,
 		PlanID:          request.PlanID,
-		Namespace:       list.Items[0].Namespace,
+		Namespace:       secrets[0].Namespace,
 		GlobalNamespace: b.namespace,
+		Parameters:      instanceParameters(secrets[0]),
+		InstanceSecrets: secrets,
+	}
+
+	if validator, ok := requestedService.(service.DeprovisionValidator); ok {
+		if err := validator.ValidateDeprovision(specOptions); err != nil {
+			return nil, httpError(http.StatusInternalServerError, "Unable to deprovision the instance: %s", err.Error())
+		}
 	}
 
 	spec := requestedService.GetProvisionSpec(specOptions)
+	spec.NetworkPolicies = append(spec.NetworkPolicies, instanceNetworkPolicies(requestedService, specOptions)...)
 	deprovisionSpec := requestedService.GetDeprovisionSpec(specOptions)
+	b.secure(request.ServiceID, deprovisionSpec)
 
 	b.Lock()
 	defer b.Unlock()
@@ -164,22 +386,56 @@ func (b *BusinessLogic) Deprovision(request *osb.DeprovisionRequest, c *broker.R
 	response := broker.DeprovisionResponse{}
 	if request.AcceptsIncomplete {
 		response.Async = b.async
+		response.OperationKey = operationKey(service.DeprovisionOperation)
 		go func() {
-			deprovisionSpec.Create(b.k8sClient)
-			spec.Delete(b.k8sClient)
+			if err := b.deleteInstance(requestedService, spec, deprovisionSpec, specOptions); err != nil {
+				glog.Errorf("Unable to deprovision instance '%s': %s", specOptions.ID, err)
+			}
 		}()
-	} else {
-		deprovisionSpec.Create(b.k8sClient)
-		spec.Delete(b.k8sClient)
+	} else if err := b.deleteInstance(requestedService, spec, deprovisionSpec, specOptions); err != nil {
+		return nil, httpError(http.StatusInternalServerError, "Unable to deprovision the instance: %s", err.Error())
 	}
 
 	return &response, nil
 }
 
 func (b *BusinessLogic) LastOperation(request *osb.LastOperationRequest, c *broker.RequestContext) (*broker.LastOperationResponse, error) {
-	// Your last-operation business logic goes here
+	// The service id is optional, when it is not sent it is read from the
+	// instance secrets
+	serviceID := ""
+	if request.ServiceID != nil {
+		serviceID = *request.ServiceID
+	} else if secrets, _ := b.getInstanceSecrets(request.InstanceID); len(secrets) > 0 {
+		serviceID = secrets[0].Labels["service-id"]
+	}
+
+	// Only the services that create their instances outside of the cluster
+	// report the state of the operations
+	reporter, ok := b.services[serviceID].(service.OperationReporter)
+	if !ok {
+		return nil, nil
+	}
+
+	options := service.ServiceOptions{
+		ID:              request.InstanceID,
+		GlobalNamespace: b.namespace,
+	}
+
+	if request.PlanID != nil {
+		options.PlanID = *request.PlanID
+	}
+
+	operation := service.ProvisionOperation
+	if request.OperationKey != nil {
+		operation = *request.OperationKey
+	}
 
-	return nil, nil
+	state, err := reporter.LastOperation(options, operation)
+	if err != nil {
+		return nil, httpError(http.StatusInternalServerError, "Unable to get the last operation: %s", err.Error())
+	}
+
+	return &broker.LastOperationResponse{LastOperationResponse: *state}, nil
 }
 
 func (b *BusinessLogic) Bind(request *osb.BindRequest, c *broker.RequestContext) (*broker.BindResponse, error) {
@@ -191,12 +447,49 @@ func (b *BusinessLogic) Bind(request *osb.BindRequest, c *broker.RequestContext)
 		namespace = request.Context["namespace"].(string)
 	}
 
-	spec := requestedService.GetBindSpec(service.BindOptions{
+	ttl, err := bindingTTL(request.Parameters)
+	if err != nil {
+		return nil, httpError(http.StatusBadRequest, "%s", err.Error())
+	}
+
+	options := service.BindOptions{
 		ID:              request.BindingID,
 		InstanceID:      request.InstanceID,
 		Namespace:       namespace,
 		GlobalNamespace: b.namespace,
-	})
+		Parameters:      request.Parameters,
+		PlanID:          request.PlanID,
+	}
+
+	if secrets, _ := b.getInstanceSecrets(request.InstanceID); len(secrets) > 0 {
+		options.InstanceParameters = instanceParameters(secrets[0])
+		options.InstanceSecrets = secrets
+	}
+
+	if validator, ok := requestedService.(service.BindValidator); ok {
+		if err := validator.ValidateBind(options); err != nil {
+			return nil, httpError(http.StatusBadRequest, "%s", err.Error())
+		}
+	}
+
+	spec := requestedService.GetBindSpec(options)
+	b.secure(request.ServiceID, spec)
+
+	// The expiry is stored on the binding secret so the binding can be removed
+	// by the sweeper once the ttl has passed
+	if ttl > 0 {
+		if spec.Secrets[0].Annotations == nil {
+			spec.Secrets[0].Annotations = map[string]string{}
+		}
+
+		spec.Secrets[0].Annotations[bindingExpiresAnnotation] = time.Now().Add(ttl).UTC().Format(time.RFC3339)
+	}
+
+	if manager, ok := requestedService.(service.BindingManager); ok {
+		if err := manager.CreateBinding(options, spec.Secrets[0].Data); err != nil {
+			return nil, httpError(http.StatusInternalServerError, "Unable to create the binding: %s", err.Error())
+		}
+	}
 
 	b.Lock()
 	defer b.Unlock()
@@ -211,6 +504,12 @@ func (b *BusinessLogic) Bind(request *osb.BindRequest, c *broker.RequestContext)
 		response.Async = b.async
 	}
 
+	// The namespace is allowed to connect to the instance before the binding
+	// is created so the bind jobs and the applications can reach it
+	if err := b.updateNetworkPolicy(request.InstanceID, namespace, ""); err != nil {
+		return nil, httpError(http.StatusInternalServerError, "Unable to update the network policy of the instance: %s", err.Error())
+	}
+
 	// Always throw the binding request into the background to ensure this
 	// request dose not timeout
 	go spec.Create(b.k8sClient)
@@ -261,9 +560,22 @@ func (b *BusinessLogic) Unbind(request *osb.UnbindRequest, c *broker.RequestCont
 		InstanceID:      request.InstanceID,
 		Namespace:       namespace,
 		GlobalNamespace: b.namespace,
+		PlanID:          request.PlanID,
+	}
+
+	if secrets, _ := b.getInstanceSecrets(request.InstanceID); len(secrets) > 0 {
+		bindingOptions.InstanceParameters = instanceParameters(secrets[0])
+		bindingOptions.InstanceSecrets = secrets
 	}
 	bindSpec := requestedService.GetBindSpec(bindingOptions)
 	debindSpec := requestedService.GetDebindSpec(bindingOptions)
+	b.secure(request.ServiceID, debindSpec)
+
+	if manager, ok := requestedService.(service.BindingManager); ok {
+		if err := manager.DeleteBinding(bindingOptions); err != nil {
+			return nil, httpError(http.StatusInternalServerError, "Unable to delete the binding: %s", err.Error())
+		}
+	}
 
 	b.Lock()
 	defer b.Unlock()
@@ -271,19 +583,176 @@ func (b *BusinessLogic) Unbind(request *osb.UnbindRequest, c *broker.RequestCont
 	debindSpec.Create(b.k8sClient)
 	bindSpec.Delete(b.k8sClient)
 
+	if err := b.updateNetworkPolicy(request.InstanceID, "", request.BindingID); err != nil {
+		glog.Errorf("Unable to update the network policy of instance '%s': %s", request.InstanceID, err)
+	}
+
 	return &broker.UnbindResponse{}, nil
 }
 
 func (b *BusinessLogic) Update(request *osb.UpdateInstanceRequest, c *broker.RequestContext) (*broker.UpdateInstanceResponse, error) {
-	// Your logic for updating a service goes here.
+	requestedService := b.services[request.ServiceID]
+
 	response := broker.UpdateInstanceResponse{}
 	if request.AcceptsIncomplete {
 		response.Async = b.async
 	}
 
+	// The credentials are rotated before the instance is updated, the rotation
+	// parameters are removed so they are not stored with the instance
+	scope, gracePeriod, err := rotationParameters(request.Parameters)
+	if err != nil {
+		return nil, httpError(http.StatusBadRequest, "%s", err.Error())
+	}
+
+	rotate := func() error { return nil }
+	if scope != "" {
+		if rotate, err = b.prepareRotation(request.InstanceID, scope, gracePeriod); err != nil {
+			if _, ok := err.(osb.HTTPStatusCodeError); ok {
+				return nil, err
+			}
+
+			return nil, httpError(http.StatusInternalServerError, "Unable to rotate the credentials: %s", err.Error())
+		}
+	}
+
+	// Only services that can be updated in place have anything to update
+	updater, ok := requestedService.(service.Updater)
+	if !ok {
+		if err := b.runUpdate(request, rotate); err != nil {
+			return nil, httpError(http.StatusInternalServerError, "Unable to rotate the credentials: %s", err.Error())
+		}
+
+		return &response, nil
+	}
+
+	secrets, err := b.getInstanceSecrets(request.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(secrets) == 0 {
+		return nil, httpError(http.StatusBadRequest, "Unknown instance '%s'", request.InstanceID)
+	}
+
+	options, previous := b.updateOptions(request, secrets)
+	if err := updater.ValidateUpdate(options, previous); err != nil {
+		return nil, httpError(http.StatusBadRequest, "%s", err.Error())
+	}
+
+	update := func() error {
+		if err := rotate(); err != nil {
+			return fmt.Errorf("Unable to rotate the credentials: %v", err)
+		}
+
+		b.Lock()
+		defer b.Unlock()
+
+		// The specs are built after the rotation so they hold the rotated
+		// credentials and not the ones the request was validated with
+		if scope != "" {
+			if secrets, err = b.getInstanceSecrets(request.InstanceID); err != nil {
+				return err
+			}
+
+			options, previous = b.updateOptions(request, secrets)
+		}
+
+		preUpdateSpec := updater.GetPreUpdateSpec(options, previous)
+		previousSpec := requestedService.GetProvisionSpec(previous)
+		spec, err := provisionSpec(requestedService, options)
+		if err != nil {
+			return err
+		}
+
+		b.secure(request.ServiceID, preUpdateSpec)
+		b.secure(request.ServiceID, spec)
+
+		// Any instance secrets that are created by the update get the parameters
+		// like the secrets created when the instance was provisioned
+		if parameters, err := json.Marshal(options.Parameters); err == nil {
+			spec.Annotations = map[string]string{parametersAnnotation: string(parameters)}
+		}
+
+		if err := preUpdateSpec.Create(b.k8sClient); err != nil {
+			return err
+		}
+
+		if succeeded, err := preUpdateSpec.JobsSucceeded(b.k8sClient); err != nil || !succeeded {
+			return fmt.Errorf("Not updating instance %q, the pre update jobs did not succeed", request.InstanceID)
+		}
+
+		if err := spec.Apply(b.k8sClient); err != nil {
+			return err
+		}
+
+		// The ingress of the previous exposure would still be used by the
+		// bindings if it was left
+		if err := spec.PruneIngresses(b.k8sClient, previousSpec); err != nil {
+			return err
+		}
+
+		if err := b.updateInstanceSecrets(secrets, options); err != nil {
+			return err
+		}
+
+		// The network policy allows the clients of the new exposure
+		return b.updateNetworkPolicy(request.InstanceID, "", "")
+	}
+
+	if err := b.runUpdate(request, update); err != nil {
+		return nil, err
+	}
+
 	return &response, nil
 }
 
+// Gets the options an instance is updated to and the options it was
+// provisioned with from the secrets of the instance
+func (b *BusinessLogic) updateOptions(request *osb.UpdateInstanceRequest, secrets []coreV1.Secret) (service.ServiceOptions, service.ServiceOptions) {
+	previous := service.ServiceOptions{
+		ID:              request.InstanceID,
+		PlanID:          secrets[0].Labels["service-plan"],
+		Namespace:       secrets[0].Namespace,
+		GlobalNamespace: b.namespace,
+		Parameters:      instanceParameters(secrets[0]),
+		InstanceSecrets: secrets,
+	}
+
+	// The new parameters are merged into the parameters the instance was
+	// provisioned with so only the changed values need to be sent
+	options := previous
+	options.Parameters = map[string]interface{}{}
+	for key, value := range previous.Parameters {
+		options.Parameters[key] = value
+	}
+	for key, value := range request.Parameters {
+		options.Parameters[key] = value
+	}
+
+	if request.PlanID != nil && *request.PlanID != "" {
+		options.PlanID = *request.PlanID
+	}
+
+	return options, previous
+}
+
+// Runs an update in the background when the platform accepts asynchronous
+// operations, otherwise the request waits for the update
+func (b *BusinessLogic) runUpdate(request *osb.UpdateInstanceRequest, update func() error) error {
+	if !request.AcceptsIncomplete {
+		return update()
+	}
+
+	go func() {
+		if err := update(); err != nil {
+			glog.Errorf("Unable to update instance '%s': %v", request.InstanceID, err)
+		}
+	}()
+
+	return nil
+}
+
 func (b *BusinessLogic) ValidateBrokerAPIVersion(version string) error {
 	return nil
 }
@@ -1,10 +1,19 @@
 package broker
 
 import (
+	"context"
+	"encoding/json"
 	"net/http/httptest"
 	"testing"
+	"time"
 
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
 	"github.com/pmorie/osb-broker-lib/pkg/broker"
+	"github.com/pmorie/osb-broker-lib/pkg/metrics"
+	"github.com/pmorie/osb-broker-lib/pkg/rest"
+	"github.com/pmorie/osb-broker-lib/pkg/server"
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes/fake"
 )
 
@@ -31,3 +40,380 @@ func TestGetCatalog(t *testing.T) {
 		t.Errorf("Invalid service name '%s'", res.Services[0].Name)
 	}
 }
+
+func TestCatalogMiddleware(t *testing.T) {
+	api, _ := rest.NewAPISurface(logic, metrics.New())
+	handler := logic.CatalogMiddleware(server.NewHTTPHandler(api))
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "http://test.com/v2/catalog", nil))
+
+	response := struct {
+		Services []map[string]interface{} `json:"services"`
+	}{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+
+	if response.Services[0]["instances_retrievable"] != true || response.Services[0]["bindings_retrievable"] != true {
+		t.Errorf("The instances and bindings of the services should be retrievable")
+	}
+}
+
+func TestProvisionAsyncSecrets(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	asyncLogic, _ := NewBusinessLogic(Options{
+		Async:            true,
+		ServiceNamespace: "service-broker",
+		K8sClient:        client,
+	})
+
+	_, err := asyncLogic.Provision(&osb.ProvisionRequest{
+		InstanceID:        "async-id",
+		ServiceID:         "4f6e6cf6-ffdd-425f-a2c7-3c9258ad246a",
+		PlanID:            "86064792-7ea2-467b-af93-ac9694d96d5b",
+		AcceptsIncomplete: true,
+		Context:           map[string]interface{}{"namespace": "test-ns"},
+	}, mocRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if secrets, _ := asyncLogic.getInstanceSecrets("async-id"); len(secrets) == 0 {
+		t.Errorf("The instance secrets should be created before the async provision returns")
+	}
+}
+
+func TestProvisionCloneAccess(t *testing.T) {
+	client := fake.NewSimpleClientset(&coreV1.Secret{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name:      "mysql-instance-source-id-root-secret",
+			Namespace: "production",
+			Labels: map[string]string{
+				"service-instance-id": "source-id",
+				"service-id":          "4f6e6cf6-ffdd-425f-a2c7-3c9258ad246a",
+			},
+		},
+	})
+
+	cloneLogic, _ := NewBusinessLogic(Options{
+		ServiceNamespace: "service-broker",
+		K8sClient:        client,
+	})
+
+	request := &osb.ProvisionRequest{
+		InstanceID: "clone-id",
+		ServiceID:  "4f6e6cf6-ffdd-425f-a2c7-3c9258ad246a",
+		PlanID:     "86064792-7ea2-467b-af93-ac9694d96d5b",
+		Context:    map[string]interface{}{"namespace": "staging"},
+		Parameters: map[string]interface{}{"clone_from_instance": "source-id"},
+	}
+
+	_, err := cloneLogic.Provision(request, mocRequest())
+	if statusErr, ok := err.(osb.HTTPStatusCodeError); !ok || statusErr.StatusCode != 403 {
+		t.Errorf("Cloning from another namespace should be forbidden without access, got '%v'", err)
+	}
+
+	request.Context["namespace"] = "production"
+	if _, err := cloneLogic.Provision(request, mocRequest()); err != nil {
+		t.Errorf("Cloning from the same namespace should be allowed, got '%v'", err)
+	}
+
+	request.Parameters = map[string]interface{}{"clone_from_instance": "unknown-id"}
+	_, err = cloneLogic.Provision(request, mocRequest())
+	if statusErr, ok := err.(osb.HTTPStatusCodeError); !ok || statusErr.StatusCode != 400 {
+		t.Errorf("Cloning from an unknown instance should be a bad request, got '%v'", err)
+	}
+}
+
+func TestUpdateMysqlVersion(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	updateLogic, _ := NewBusinessLogic(Options{
+		ServiceNamespace: "service-broker",
+		K8sClient:        client,
+	})
+
+	updateLogic.Provision(&osb.ProvisionRequest{
+		InstanceID: "update-id",
+		ServiceID:  "4f6e6cf6-ffdd-425f-a2c7-3c9258ad246a",
+		PlanID:     "86064792-7ea2-467b-af93-ac9694d96d5b",
+		Context:    map[string]interface{}{"namespace": "test-ns"},
+	}, mocRequest())
+
+	_, err := updateLogic.Update(&osb.UpdateInstanceRequest{
+		InstanceID: "update-id",
+		ServiceID:  "4f6e6cf6-ffdd-425f-a2c7-3c9258ad246a",
+		Parameters: map[string]interface{}{"version": "8.0"},
+	}, mocRequest())
+	if err != nil {
+		t.Fatalf("Unable to update the instance '%s'", err.Error())
+	}
+
+	deployment, _ := client.AppsV1().Deployments("test-ns").Get(context.TODO(), "mysql-instance-update-id", metaV1.GetOptions{})
+	if image := deployment.Spec.Template.Spec.Containers[0].Image; image != "mysql:8.0" {
+		t.Errorf("Invalid deployment image after the update '%s'", image)
+	}
+
+	jobs, _ := client.BatchV1().Jobs("test-ns").List(context.TODO(), metaV1.ListOptions{})
+	if len(jobs.Items) != 1 {
+		t.Errorf("A backup should be taken before the version is upgraded")
+	}
+
+	_, err = updateLogic.Update(&osb.UpdateInstanceRequest{
+		InstanceID: "update-id",
+		ServiceID:  "4f6e6cf6-ffdd-425f-a2c7-3c9258ad246a",
+		Parameters: map[string]interface{}{"version": "5.7"},
+	}, mocRequest())
+	if statusErr, ok := err.(osb.HTTPStatusCodeError); !ok || statusErr.StatusCode != 400 {
+		t.Errorf("Downgrading the instance should be a bad request, got '%v'", err)
+	}
+}
+
+func TestGetInstanceUsage(t *testing.T) {
+	client := fake.NewSimpleClientset(&coreV1.Secret{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name:      "mysql-shared-instance-test-id-secret",
+			Namespace: "service-broker",
+			Labels: map[string]string{
+				"service-instance-id": "test-id",
+				"service-id":          "shared-mysql-id",
+				"service-plan":        "small-id",
+			},
+			Annotations: map[string]string{
+				usageAnnotation: `{"storage_bytes":2048,"storage_quota":1024,"over_quota":true,"locked":false}`,
+			},
+		},
+	})
+
+	fetchLogic, _ := NewBusinessLogic(Options{ServiceNamespace: "service-broker", K8sClient: client})
+
+	instance, err := fetchLogic.GetInstance("test-id")
+	if err != nil {
+		t.Fatalf("Unable to get the instance: %v", err)
+	}
+
+	if instance.PlanID != "small-id" || instance.Usage == nil || !instance.Usage.OverQuota || instance.Usage.StorageBytes != 2048 {
+		t.Errorf("Invalid instance '%v'", instance)
+	}
+
+	_, err = fetchLogic.GetInstance("unknown-id")
+	if statusErr, ok := err.(osb.HTTPStatusCodeError); !ok || statusErr.StatusCode != 404 {
+		t.Errorf("Unknown instances should not be found, got '%v'", err)
+	}
+}
+
+func TestRotateCredentials(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	rotateLogic, _ := NewBusinessLogic(Options{ServiceNamespace: "service-broker", K8sClient: client})
+
+	rotateLogic.Provision(&osb.ProvisionRequest{
+		InstanceID: "rotate-id",
+		ServiceID:  "4f6e6cf6-ffdd-425f-a2c7-3c9258ad246a",
+		PlanID:     "86064792-7ea2-467b-af93-ac9694d96d5b",
+		Parameters: map[string]interface{}{"version": "8.0"},
+		Context:    map[string]interface{}{"namespace": "test-ns"},
+	}, mocRequest())
+
+	// The bind spec is created in the background so the binding secret is
+	// added directly
+	client.Tracker().Add(&coreV1.Secret{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name:      "binding-secret-binding-id",
+			Namespace: "test-ns",
+			Labels:    map[string]string{"service-instance-id": "rotate-id", "service-binding-id": "binding-id"},
+		},
+		Data: map[string][]byte{"user": []byte("user-binding"), "password": []byte("binding-password")},
+	})
+
+	getSecret := func(name string) *coreV1.Secret {
+		secret, _ := client.CoreV1().Secrets("test-ns").Get(context.TODO(), name, metaV1.GetOptions{})
+		return secret
+	}
+
+	root := getSecret("mysql-instance-rotate-id-root-secret")
+	binding := getSecret("binding-secret-binding-id")
+
+	_, err := rotateLogic.Update(&osb.UpdateInstanceRequest{
+		InstanceID: "rotate-id",
+		ServiceID:  "4f6e6cf6-ffdd-425f-a2c7-3c9258ad246a",
+		Parameters: map[string]interface{}{rotateParameter: true, gracePeriodParameter: "1h"},
+	}, mocRequest())
+	if err != nil {
+		t.Fatalf("Unable to rotate the credentials: %v", err)
+	}
+
+	rotatedRoot := getSecret("mysql-instance-rotate-id-root-secret")
+	if string(rotatedRoot.Data["password"]) == string(root.Data["password"]) {
+		t.Errorf("The root password should be rotated")
+	}
+
+	if string(getSecret("binding-secret-binding-id").Data["password"]) == string(binding.Data["password"]) {
+		t.Errorf("The binding password should be rotated")
+	}
+
+	if _, ok := rotatedRoot.Annotations[rotationExpiresAnnotation]; !ok {
+		t.Errorf("The end of the grace period should be stored on the instance")
+	}
+
+	if parameters := instanceParameters(*rotatedRoot); parameters[rotateParameter] != nil || parameters["version"] != "8.0" {
+		t.Errorf("Only the instance parameters should be stored '%v'", parameters)
+	}
+
+	rotateLogic.expireRotations(time.Now().Add(2 * time.Hour))
+	if _, ok := getSecret("mysql-instance-rotate-id-root-secret").Annotations[rotationExpiresAnnotation]; ok {
+		t.Errorf("The old credentials should be removed after the grace period")
+	}
+
+	_, err = rotateLogic.Update(&osb.UpdateInstanceRequest{
+		InstanceID: "rotate-id",
+		ServiceID:  "4f6e6cf6-ffdd-425f-a2c7-3c9258ad246a",
+		Parameters: map[string]interface{}{rotateParameter: "everything"},
+	}, mocRequest())
+	if statusErr, ok := err.(osb.HTTPStatusCodeError); !ok || statusErr.StatusCode != 400 {
+		t.Errorf("Invalid rotation scopes should be a bad request, got '%v'", err)
+	}
+}
+
+func TestBindingTTL(t *testing.T) {
+	expires := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	client := fake.NewSimpleClientset(
+		&coreV1.Secret{
+			ObjectMeta: metaV1.ObjectMeta{
+				Name:      "mysql-instance-ttl-id-root-secret",
+				Namespace: "test-ns",
+				Labels:    map[string]string{"service-instance-id": "ttl-id", "service-id": "4f6e6cf6-ffdd-425f-a2c7-3c9258ad246a"},
+			},
+		},
+		&coreV1.Secret{
+			ObjectMeta: metaV1.ObjectMeta{
+				Name:        "binding-secret-binding-id",
+				Namespace:   "app-ns",
+				Labels:      map[string]string{"service-instance-id": "ttl-id", "service-binding-id": "binding-id", "service-id": "4f6e6cf6-ffdd-425f-a2c7-3c9258ad246a"},
+				Annotations: map[string]string{bindingExpiresAnnotation: expires},
+			},
+			Data: map[string][]byte{"user": []byte("user-binding")},
+		},
+	)
+
+	ttlLogic, _ := NewBusinessLogic(Options{ServiceNamespace: "service-broker", K8sClient: client})
+
+	binding, err := ttlLogic.GetBinding("ttl-id", "binding-id")
+	if err != nil || binding.Metadata == nil || binding.Metadata.ExpiresAt != expires || binding.Credentials["user"] != "user-binding" {
+		t.Fatalf("Invalid binding '%v' %v", binding, err)
+	}
+
+	ttlLogic.expireBindings(time.Now())
+	if _, err := ttlLogic.GetBinding("ttl-id", "binding-id"); err != nil {
+		t.Fatalf("The binding should not be removed before it expires")
+	}
+
+	ttlLogic.expireBindings(time.Now().Add(2 * time.Hour))
+	if _, err := ttlLogic.GetBinding("ttl-id", "binding-id"); err == nil {
+		t.Errorf("The binding should be removed once it has expired")
+	}
+
+	for _, ttl := range []interface{}{"2h", float64(60)} {
+		if value, err := bindingTTL(map[string]interface{}{ttlParameter: ttl}); err != nil || value <= 0 {
+			t.Errorf("The ttl '%v' should be valid", ttl)
+		}
+	}
+
+	_, err = ttlLogic.Bind(&osb.BindRequest{
+		BindingID:  "other-binding-id",
+		InstanceID: "ttl-id",
+		ServiceID:  "4f6e6cf6-ffdd-425f-a2c7-3c9258ad246a",
+		Parameters: map[string]interface{}{ttlParameter: "-1h"},
+	}, mocRequest())
+	if statusErr, ok := err.(osb.HTTPStatusCodeError); !ok || statusErr.StatusCode != 400 {
+		t.Errorf("Invalid ttls should be a bad request, got '%v'", err)
+	}
+}
+
+func TestNetworkPolicy(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		&coreV1.Secret{
+			ObjectMeta: metaV1.ObjectMeta{
+				Name:      "mysql-instance-policy-id-root-secret",
+				Namespace: "test-ns",
+				Labels:    map[string]string{"service-instance-id": "policy-id", "service-id": "4f6e6cf6-ffdd-425f-a2c7-3c9258ad246a"},
+			},
+		},
+		&coreV1.Secret{
+			ObjectMeta: metaV1.ObjectMeta{
+				Name:      "binding-secret-binding-id",
+				Namespace: "app-ns",
+				Labels:    map[string]string{"service-instance-id": "policy-id", "service-binding-id": "binding-id", "service-id": "4f6e6cf6-ffdd-425f-a2c7-3c9258ad246a"},
+			},
+		},
+	)
+
+	policyLogic, _ := NewBusinessLogic(Options{ServiceNamespace: "service-broker", K8sClient: client})
+
+	namespaces := func() []string {
+		policy, err := client.NetworkingV1().NetworkPolicies("test-ns").Get(context.TODO(), "mysql-instance-policy-id", metaV1.GetOptions{})
+		if err != nil {
+			t.Fatalf("The network policy should be created, got '%v'", err)
+		}
+
+		peers := policy.Spec.Ingress[0].From
+		if len(peers) < 3 {
+			return []string{}
+		}
+
+		return peers[2].NamespaceSelector.MatchExpressions[0].Values
+	}
+
+	_, err := policyLogic.Bind(&osb.BindRequest{
+		BindingID:  "other-binding-id",
+		InstanceID: "policy-id",
+		ServiceID:  "4f6e6cf6-ffdd-425f-a2c7-3c9258ad246a",
+		Context:    map[string]interface{}{"namespace": "other-ns"},
+	}, mocRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if allowed := namespaces(); len(allowed) != 2 || allowed[0] != "app-ns" || allowed[1] != "other-ns" {
+		t.Errorf("The bound namespaces should be allowed, got '%v'", allowed)
+	}
+
+	_, err = policyLogic.Unbind(&osb.UnbindRequest{
+		BindingID:  "binding-id",
+		InstanceID: "policy-id",
+		ServiceID:  "4f6e6cf6-ffdd-425f-a2c7-3c9258ad246a",
+	}, mocRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, namespace := range namespaces() {
+		if namespace == "app-ns" {
+			t.Errorf("The unbound namespace should not be allowed")
+		}
+	}
+}
+
+func TestProvisionPodSecurity(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	securityLogic, _ := NewBusinessLogic(Options{ServiceNamespace: "service-broker", K8sClient: client})
+
+	_, err := securityLogic.Provision(&osb.ProvisionRequest{
+		InstanceID: "secure-id",
+		ServiceID:  "4f6e6cf6-ffdd-425f-a2c7-3c9258ad246a",
+		PlanID:     "86064792-7ea2-467b-af93-ac9694d96d5b",
+		Context:    map[string]interface{}{"namespace": "test-ns"},
+	}, mocRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deployment, err := client.AppsV1().Deployments("test-ns").Get(context.TODO(), "mysql-instance-secure-id", metaV1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	podSpec := deployment.Spec.Template.Spec
+	if podSpec.SecurityContext == nil || !*podSpec.SecurityContext.RunAsNonRoot || *podSpec.AutomountServiceAccountToken {
+		t.Errorf("The instance pods should be hardened")
+	}
+}
@@ -0,0 +1,72 @@
+package broker
+
+import (
+	networkingV1 "k8s.io/api/networking/v1"
+
+	"github.com/AdeAttwood/service-broker/pkg/kube"
+	"github.com/AdeAttwood/service-broker/pkg/service"
+)
+
+// Gets the network policies of an instance when the service isolates its
+// instances. The policy is added to the provision spec with no bound
+// namespaces so it is created and deleted with the instance
+func instanceNetworkPolicies(requestedService service.Service, options service.ServiceOptions) []networkingV1.NetworkPolicy {
+	isolator, ok := requestedService.(service.NetworkIsolator)
+	if !ok {
+		return nil
+	}
+
+	return []networkingV1.NetworkPolicy{isolator.GetNetworkPolicy(options, nil)}
+}
+
+// Updates the network policy of an instance so it allows the namespaces of all
+// the instance bindings. The namespace of a new binding is passed in as the
+// binding secret is created in the background, a binding that is being removed
+// is skipped as its secret may not be deleted yet
+func (b *BusinessLogic) updateNetworkPolicy(instanceID string, bindNamespace string, unbindID string) error {
+	secrets, err := b.getInstanceSecrets(instanceID)
+	if err != nil || len(secrets) == 0 {
+		return err
+	}
+
+	isolator, ok := b.services[secrets[0].Labels["service-id"]].(service.NetworkIsolator)
+	if !ok {
+		return nil
+	}
+
+	bindings, err := b.getBindingSecrets(instanceID)
+	if err != nil {
+		return err
+	}
+
+	namespaces := []string{}
+	if bindNamespace != "" {
+		namespaces = append(namespaces, bindNamespace)
+	}
+
+	for _, binding := range bindings {
+		if binding.Labels["service-binding-id"] != unbindID {
+			namespaces = append(namespaces, binding.Namespace)
+		}
+	}
+
+	options := service.ServiceOptions{
+		ID:              instanceID,
+		PlanID:          secrets[0].Labels["service-plan"],
+		Namespace:       secrets[0].Namespace,
+		GlobalNamespace: b.namespace,
+		Parameters:      instanceParameters(secrets[0]),
+	}
+
+	spec := kube.Spec{
+		Namespace: options.Namespace,
+		Lables: map[string]string{
+			"service-instance-id": instanceID,
+			"service-id":          secrets[0].Labels["service-id"],
+			"service-name":        secrets[0].Labels["service-name"],
+		},
+		NetworkPolicies: []networkingV1.NetworkPolicy{isolator.GetNetworkPolicy(options, namespaces)},
+	}
+
+	return spec.Apply(b.k8sClient)
+}
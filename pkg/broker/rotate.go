@@ -0,0 +1,305 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	coreV1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/AdeAttwood/service-broker/pkg/service"
+)
+
+// The update parameters that rotate the credentials of an instance. These are
+// not stored with the instance parameters as they only apply to one update
+const (
+	rotateParameter      = "rotate_credentials"
+	gracePeriodParameter = "rotation_grace_period"
+)
+
+// What is rotated, the admin credentials of the instance, the credentials of
+// all its bindings or both
+const (
+	RotateAll      = "all"
+	RotateInstance = "instance"
+	RotateBindings = "bindings"
+)
+
+// The annotation on the instance secrets that holds when the old credentials
+// of the last rotation stop working
+const rotationExpiresAnnotation = "service-rotation-expires"
+
+// Removes the rotation parameters from the parameters of an update request and
+// gets the scope and grace period of the rotation. The scope is empty when
+// the credentials are not rotated
+func rotationParameters(parameters map[string]interface{}) (string, time.Duration, error) {
+	value, ok := parameters[rotateParameter]
+	if !ok {
+		return "", 0, nil
+	}
+
+	scope := ""
+	switch value := value.(type) {
+	case bool:
+		if value {
+			scope = RotateAll
+		}
+	case string:
+		scope = value
+	}
+
+	gracePeriod := time.Duration(0)
+	if value, ok := parameters[gracePeriodParameter]; ok {
+		var err error
+		if gracePeriod, err = time.ParseDuration(fmt.Sprint(value)); err != nil || gracePeriod < 0 {
+			return "", 0, fmt.Errorf("Invalid %s '%v', this must be a duration like '1h'", gracePeriodParameter, value)
+		}
+	}
+
+	delete(parameters, rotateParameter)
+	delete(parameters, gracePeriodParameter)
+
+	if scope != "" && scope != RotateAll && scope != RotateInstance && scope != RotateBindings {
+		return "", 0, fmt.Errorf("Invalid %s '%v', this must be true, '%s', '%s' or '%s'", rotateParameter, value, RotateAll, RotateInstance, RotateBindings)
+	}
+
+	return scope, gracePeriod, nil
+}
+
+// Gets the binding secrets of an instance, these hold the credentials that
+// were returned when the instance was bound
+func (b *BusinessLogic) getBindingSecrets(instanceID string) ([]coreV1.Secret, error) {
+	list, err := b.k8sClient.CoreV1().Secrets(v1.NamespaceAll).List(context.TODO(), v1.ListOptions{
+		LabelSelector: fmt.Sprintf("service-instance-id=%s,service-binding-id", instanceID),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := []coreV1.Secret{}
+	for _, secret := range list.Items {
+		if strings.HasPrefix(secret.Name, "binding-secret-") {
+			secrets = append(secrets, secret)
+		}
+	}
+
+	return secrets, nil
+}
+
+// Gets the options to rotate or expire the credentials of an instance
+func (b *BusinessLogic) rotateOptions(secrets []coreV1.Secret, scope string) (service.RotateOptions, error) {
+	options := service.RotateOptions{
+		ServiceOptions: service.ServiceOptions{
+			ID:              secrets[0].Labels["service-instance-id"],
+			PlanID:          secrets[0].Labels["service-plan"],
+			Namespace:       secrets[0].Namespace,
+			GlobalNamespace: b.namespace,
+			Parameters:      instanceParameters(secrets[0]),
+			InstanceSecrets: secrets,
+		},
+		Instance: scope != RotateBindings,
+	}
+
+	if scope != RotateInstance {
+		bindings, err := b.getBindingSecrets(options.ID)
+		if err != nil {
+			return options, err
+		}
+
+		options.Bindings = bindings
+	}
+
+	return options, nil
+}
+
+// Rotates the credentials of an instance. The new credentials are applied to
+// the instance before the secrets are updated, the secrets are left as they
+// are when the rotation jobs fail
+func (b *BusinessLogic) RotateCredentials(instanceID string, scope string, gracePeriod time.Duration) error {
+	rotate, err := b.prepareRotation(instanceID, scope, gracePeriod)
+	if err != nil {
+		return err
+	}
+
+	return rotate()
+}
+
+// Validates a rotation and gets the function that runs it, this lets the
+// request be rejected before the rotation is run in the background
+func (b *BusinessLogic) prepareRotation(instanceID string, scope string, gracePeriod time.Duration) (func() error, error) {
+	secrets, err := b.getInstanceSecrets(instanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(secrets) == 0 {
+		return nil, httpError(http.StatusNotFound, "Instance '%s' not found", instanceID)
+	}
+
+	requestedService := b.services[secrets[0].Labels["service-id"]]
+	rotator, ok := requestedService.(service.CredentialRotator)
+	if !ok {
+		return nil, httpError(http.StatusBadRequest, "The credentials of the service '%s' can't be rotated", secrets[0].Labels["service-name"])
+	}
+
+	options, err := b.rotateOptions(secrets, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	options.GracePeriod = gracePeriod
+	rotation, err := rotator.RotateCredentials(options)
+	if err != nil {
+		return nil, httpError(http.StatusBadRequest, "%s", err.Error())
+	}
+
+	b.secure(secrets[0].Labels["service-id"], rotation.Spec)
+
+	return func() error {
+		// The rotation spec holds the new credentials so it is always removed
+		defer rotation.Spec.Delete(b.k8sClient)
+
+		// The jobs can take minutes so the lock is only held once they are
+		// done and the secrets are updated
+		if err := rotation.Spec.Create(b.k8sClient); err != nil {
+			return err
+		}
+
+		if succeeded, err := rotation.Spec.JobsSucceeded(b.k8sClient); err != nil || !succeeded {
+			return fmt.Errorf("Not rotating the credentials of instance %q, the rotation jobs did not succeed", instanceID)
+		}
+
+		b.Lock()
+		defer b.Unlock()
+
+		for i := range rotation.Secrets {
+			if _, err := b.k8sClient.CoreV1().Secrets(rotation.Secrets[i].Namespace).Update(context.TODO(), &rotation.Secrets[i], v1.UpdateOptions{}); err != nil {
+				return err
+			}
+		}
+
+		for _, name := range rotation.Restart {
+			if err := b.restartDeployment(options.Namespace, name); err != nil {
+				return err
+			}
+		}
+
+		if gracePeriod > 0 {
+			return b.annotateInstance(instanceID, rotationExpiresAnnotation, time.Now().Add(gracePeriod).UTC().Format(time.RFC3339))
+		}
+
+		return nil
+	}, nil
+}
+
+// Restarts the pods of a deployment by changing the pod template
+func (b *BusinessLogic) restartDeployment(namespace string, name string) error {
+	deployments := b.k8sClient.AppsV1().Deployments(namespace)
+	deployment, err := deployments.Get(context.TODO(), name, v1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	if deployment.Spec.Template.Annotations == nil {
+		deployment.Spec.Template.Annotations = map[string]string{}
+	}
+
+	deployment.Spec.Template.Annotations["service-broker/restarted-at"] = time.Now().UTC().Format(time.RFC3339)
+	_, err = deployments.Update(context.TODO(), deployment, v1.UpdateOptions{})
+
+	return err
+}
+
+// Sets or removes an annotation on the secrets of an instance, an empty value
+// removes the annotation. The secrets are read again so the rotated
+// credentials are not overwritten
+func (b *BusinessLogic) annotateInstance(instanceID string, annotation string, value string) error {
+	secrets, err := b.getInstanceSecrets(instanceID)
+	if err != nil {
+		return err
+	}
+
+	for i := range secrets {
+		secret := &secrets[i]
+		if secret.Annotations == nil {
+			secret.Annotations = map[string]string{}
+		}
+
+		if value == "" {
+			delete(secret.Annotations, annotation)
+		} else {
+			secret.Annotations[annotation] = value
+		}
+
+		if _, err := b.k8sClient.CoreV1().Secrets(secret.Namespace).Update(context.TODO(), secret, v1.UpdateOptions{}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Removes the old credentials of the instances where the grace period of the
+// last rotation is over
+func (b *BusinessLogic) expireRotations(now time.Time) {
+	list, err := b.k8sClient.CoreV1().Secrets(v1.NamespaceAll).List(context.TODO(), v1.ListOptions{
+		LabelSelector: "service-instance-id,!service-binding-id",
+	})
+	if err != nil {
+		glog.Errorf("Unable to list the instances: %v", err)
+		return
+	}
+
+	expired := map[string]bool{}
+	for _, secret := range list.Items {
+		expires, err := time.Parse(time.RFC3339, secret.Annotations[rotationExpiresAnnotation])
+		if err == nil && now.After(expires) {
+			expired[secret.Labels["service-instance-id"]] = true
+		}
+	}
+
+	for instanceID := range expired {
+		if err := b.expireRotation(instanceID); err != nil {
+			glog.Errorf("Unable to remove the old credentials of instance '%s': %v", instanceID, err)
+		}
+	}
+}
+
+func (b *BusinessLogic) expireRotation(instanceID string) error {
+	secrets, err := b.getInstanceSecrets(instanceID)
+	if err != nil || len(secrets) == 0 {
+		return err
+	}
+
+	rotator, ok := b.services[secrets[0].Labels["service-id"]].(service.CredentialRotator)
+	if !ok {
+		return b.annotateInstance(instanceID, rotationExpiresAnnotation, "")
+	}
+
+	options, err := b.rotateOptions(secrets, RotateAll)
+	if err != nil {
+		return err
+	}
+
+	spec := rotator.GetExpireSpec(options)
+	b.secure(secrets[0].Labels["service-id"], spec)
+
+	defer spec.Delete(b.k8sClient)
+
+	if err := spec.Create(b.k8sClient); err != nil {
+		return err
+	}
+
+	if succeeded, err := spec.JobsSucceeded(b.k8sClient); err != nil || !succeeded {
+		return fmt.Errorf("The expire jobs did not succeed")
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	return b.annotateInstance(instanceID, rotationExpiresAnnotation, "")
+}
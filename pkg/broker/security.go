@@ -0,0 +1,44 @@
+package broker
+
+import (
+	"github.com/AdeAttwood/service-broker/pkg/kube"
+	"github.com/AdeAttwood/service-broker/pkg/service"
+)
+
+// Validates the pod security of the broker and all of the services
+func (c *Config) validatePodSecurity() error {
+	configs := []service.PodSecurityConfig{c.PodSecurity}
+	for _, sharedMysql := range c.SharedMysql {
+		configs = append(configs, sharedMysql.PodSecurity)
+	}
+
+	for _, pool := range c.SharedMysqlPools {
+		configs = append(configs, pool.PodSecurity)
+	}
+
+	for _, sharedPostgres := range c.SharedPostgres {
+		configs = append(configs, sharedPostgres.PodSecurity)
+	}
+
+	for _, sharedS3 := range c.SharedS3 {
+		configs = append(configs, sharedS3.PodSecurity)
+	}
+
+	for _, template := range c.Templates {
+		configs = append(configs, template.PodSecurity)
+	}
+
+	for _, config := range configs {
+		if err := config.Validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Hardens the pods of a spec with the pod security of the service that
+// created it. Services that are not in the broker get the defaults
+func (b *BusinessLogic) secure(serviceID string, spec *kube.Spec) {
+	b.podSecurity[serviceID].Secure(spec)
+}
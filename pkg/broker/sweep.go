@@ -0,0 +1,26 @@
+package broker
+
+import (
+	"context"
+	"time"
+)
+
+// Runs the background tasks that are due every interval until the context is
+// done. This removes the old credentials of rotations and the bindings that
+// have expired
+func (b *BusinessLogic) Sweep(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		now := time.Now()
+		b.expireRotations(now)
+		b.expireBindings(now)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
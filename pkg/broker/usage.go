@@ -0,0 +1,122 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	prom "github.com/prometheus/client_golang/prometheus"
+	coreV1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/AdeAttwood/service-broker/pkg/service"
+)
+
+// The annotation the last usage of an instance is stored in on the instance
+// secrets so it can be returned when the instance is fetched
+const usageAnnotation = "service-usage"
+
+var (
+	storageBytesMetric = prom.NewGaugeVec(prom.GaugeOpts{
+		Name: "service_broker_instance_storage_bytes",
+		Help: "The storage used by an instance",
+	}, []string{"service", "instance_id"})
+	storageQuotaMetric = prom.NewGaugeVec(prom.GaugeOpts{
+		Name: "service_broker_instance_storage_quota_bytes",
+		Help: "The storage quota of the plan of an instance",
+	}, []string{"service", "instance_id"})
+	overQuotaMetric = prom.NewGaugeVec(prom.GaugeOpts{
+		Name: "service_broker_instance_over_quota",
+		Help: "If an instance is using more storage than its quota",
+	}, []string{"service", "instance_id"})
+)
+
+// Registers the metrics of the instance usage that is measured by
+// MonitorUsage
+func RegisterUsageMetrics(reg prom.Registerer) {
+	reg.MustRegister(storageBytesMetric, storageQuotaMetric, overQuotaMetric)
+}
+
+// Checks the usage of the instances of all the services that can report it
+// every interval until the context is done
+func (b *BusinessLogic) MonitorUsage(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		b.checkUsage()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (b *BusinessLogic) checkUsage() {
+	for _, s := range b.catalog {
+		reporter, ok := s.(service.UsageReporter)
+		if !ok {
+			continue
+		}
+
+		list, err := b.k8sClient.CoreV1().Secrets(v1.NamespaceAll).List(context.TODO(), v1.ListOptions{
+			LabelSelector: fmt.Sprintf("service-id=%s,!service-binding-id", s.Definition().ID),
+		})
+		if err != nil {
+			glog.Errorf("Unable to list the instances of '%s': %v", s.Definition().Name, err)
+			continue
+		}
+
+		for _, usage := range reporter.CheckUsage(list.Items) {
+			overQuota := 0.0
+			if usage.OverQuota {
+				overQuota = 1
+			}
+
+			storageBytesMetric.WithLabelValues(s.Definition().Name, usage.InstanceID).Set(float64(usage.StorageBytes))
+			storageQuotaMetric.WithLabelValues(s.Definition().Name, usage.InstanceID).Set(float64(usage.StorageQuota))
+			overQuotaMetric.WithLabelValues(s.Definition().Name, usage.InstanceID).Set(overQuota)
+
+			if err := b.storeUsage(list.Items, usage); err != nil {
+				glog.Errorf("Unable to store the usage of instance '%s': %v", usage.InstanceID, err)
+			}
+		}
+	}
+}
+
+// Stores the usage on the secrets of an instance. The secrets are read again
+// before they are updated because the services can change them when they
+// check the usage, like the locks of the shared mysql databases
+func (b *BusinessLogic) storeUsage(secrets []coreV1.Secret, usage service.InstanceUsage) error {
+	value, err := json.Marshal(usage)
+	if err != nil {
+		return err
+	}
+
+	for _, listed := range secrets {
+		if listed.Labels["service-instance-id"] != usage.InstanceID || listed.Annotations[usageAnnotation] == string(value) {
+			continue
+		}
+
+		client := b.k8sClient.CoreV1().Secrets(listed.Namespace)
+		secret, err := client.Get(context.TODO(), listed.Name, v1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		if secret.Annotations == nil {
+			secret.Annotations = map[string]string{}
+		}
+
+		secret.Annotations[usageAnnotation] = string(value)
+		if _, err := client.Update(context.TODO(), secret, v1.UpdateOptions{}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
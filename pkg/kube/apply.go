@@ -0,0 +1,244 @@
+package kube
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Applies the spec to the resources that already exist in the cluster. This
+// is used when an instance is updated so only the resources that describe how
+// the instance runs are updated. The secrets and pvcs hold the instance
+// credentials and data so they are left as they are, as are the custom
+// resources. Any resources that don't exist yet will be created
+func (s *Spec) Apply(client kubernetes.Interface) error {
+	s.InjectLabels(s.Lables)
+	s.InjectAnnotations(s.Annotations)
+	createOptions := metaV1.CreateOptions{}
+	updateOptions := metaV1.UpdateOptions{}
+
+	for i := 0; i < len(s.Secrets); i++ {
+		secretSpec := &s.Secrets[i]
+		secretsClient := client.CoreV1().Secrets(s.Namespace)
+		_, getErr := secretsClient.Get(context.TODO(), secretSpec.Name, metaV1.GetOptions{})
+		if errors.IsNotFound(getErr) {
+			if _, err := secretsClient.Create(context.TODO(), secretSpec, createOptions); err != nil {
+				return err
+			}
+			fmt.Printf("Created secret %q.\n", secretSpec.Name)
+		} else if getErr != nil {
+			return getErr
+		}
+	}
+
+	for i := 0; i < len(s.CustomResources); i++ {
+		resource := &s.CustomResources[i]
+		created, err := resource.ensure(client, s.Namespace)
+		if err != nil {
+			return err
+		}
+
+		if created {
+			fmt.Printf("Created %s %q.\n", resource.Object.GetKind(), resource.Object.GetName())
+		}
+	}
+
+	for i := 0; i < len(s.ConfigMaps); i++ {
+		configMapSpec := &s.ConfigMaps[i]
+		configMapClient := client.CoreV1().ConfigMaps(s.Namespace)
+		existing, getErr := configMapClient.Get(context.TODO(), configMapSpec.Name, metaV1.GetOptions{})
+		if errors.IsNotFound(getErr) {
+			if _, err := configMapClient.Create(context.TODO(), configMapSpec, createOptions); err != nil {
+				return err
+			}
+			fmt.Printf("Created config map %q.\n", configMapSpec.Name)
+			continue
+		} else if getErr != nil {
+			return getErr
+		}
+
+		configMapSpec.ResourceVersion = existing.ResourceVersion
+		if _, err := configMapClient.Update(context.TODO(), configMapSpec, updateOptions); err != nil {
+			return err
+		}
+		fmt.Printf("Updated config map %q.\n", configMapSpec.Name)
+	}
+
+	for i := 0; i < len(s.NetworkPolicies); i++ {
+		networkPolicySpec := &s.NetworkPolicies[i]
+		networkPolicyClient := client.NetworkingV1().NetworkPolicies(s.Namespace)
+		existing, getErr := networkPolicyClient.Get(context.TODO(), networkPolicySpec.Name, metaV1.GetOptions{})
+		if errors.IsNotFound(getErr) {
+			if _, err := networkPolicyClient.Create(context.TODO(), networkPolicySpec, createOptions); err != nil {
+				return err
+			}
+			fmt.Printf("Created network policy %q.\n", networkPolicySpec.Name)
+			continue
+		} else if getErr != nil {
+			return getErr
+		}
+
+		networkPolicySpec.ResourceVersion = existing.ResourceVersion
+		if _, err := networkPolicyClient.Update(context.TODO(), networkPolicySpec, updateOptions); err != nil {
+			return err
+		}
+		fmt.Printf("Updated network policy %q.\n", networkPolicySpec.Name)
+	}
+
+	var deployments = make([]string, 0)
+	deploymentClient := client.AppsV1().Deployments(s.Namespace)
+	for i := 0; i < len(s.Deployments); i++ {
+		deploymentSpec := &s.Deployments[i]
+		existing, getErr := deploymentClient.Get(context.TODO(), deploymentSpec.Name, metaV1.GetOptions{})
+		if errors.IsNotFound(getErr) {
+			if _, err := deploymentClient.Create(context.TODO(), deploymentSpec, createOptions); err != nil {
+				return err
+			}
+			fmt.Printf("Created deployment %q.\n", deploymentSpec.Name)
+		} else if getErr != nil {
+			return getErr
+		} else {
+			deploymentSpec.ResourceVersion = existing.ResourceVersion
+			if _, err := deploymentClient.Update(context.TODO(), deploymentSpec, updateOptions); err != nil {
+				return err
+			}
+			fmt.Printf("Updated deployment %q.\n", deploymentSpec.Name)
+		}
+
+		deployments = append(deployments, deploymentSpec.Name)
+	}
+
+	var statefulSets = make([]string, 0)
+	statefulSetClient := client.AppsV1().StatefulSets(s.Namespace)
+	for i := 0; i < len(s.StatefulSets); i++ {
+		statefulSetSpec := &s.StatefulSets[i]
+		existing, getErr := statefulSetClient.Get(context.TODO(), statefulSetSpec.Name, metaV1.GetOptions{})
+		if errors.IsNotFound(getErr) {
+			if _, err := statefulSetClient.Create(context.TODO(), statefulSetSpec, createOptions); err != nil {
+				return err
+			}
+			fmt.Printf("Created stateful set %q.\n", statefulSetSpec.Name)
+		} else if getErr != nil {
+			return getErr
+		} else {
+			// The volume claim templates of a stateful set can't be updated
+			statefulSetSpec.ResourceVersion = existing.ResourceVersion
+			statefulSetSpec.Spec.VolumeClaimTemplates = existing.Spec.VolumeClaimTemplates
+			if _, err := statefulSetClient.Update(context.TODO(), statefulSetSpec, updateOptions); err != nil {
+				return err
+			}
+			fmt.Printf("Updated stateful set %q.\n", statefulSetSpec.Name)
+		}
+
+		statefulSets = append(statefulSets, statefulSetSpec.Name)
+	}
+
+	for i := 0; i < len(deployments); i++ {
+		deploymentName := deployments[i]
+		waitFunc := isDeploymentReady(deploymentClient, deploymentName)
+		fmt.Printf("Waiting for %q\n", deploymentName)
+		if err := wait.PollImmediate(time.Second, time.Duration(5)*time.Minute, waitFunc); err != nil {
+			return err
+		}
+	}
+
+	for i := 0; i < len(statefulSets); i++ {
+		statefulSetName := statefulSets[i]
+		waitFunc := isStatefulSetReady(statefulSetClient, statefulSetName)
+		fmt.Printf("Waiting for %q\n", statefulSetName)
+		if err := wait.PollImmediate(time.Second, time.Duration(5)*time.Minute, waitFunc); err != nil {
+			return err
+		}
+	}
+
+	for i := 0; i < len(s.Services); i++ {
+		serviceSpec := &s.Services[i]
+		serviceClient := client.CoreV1().Services(s.Namespace)
+		existing, getErr := serviceClient.Get(context.TODO(), serviceSpec.Name, metaV1.GetOptions{})
+		if errors.IsNotFound(getErr) {
+			if _, err := serviceClient.Create(context.TODO(), serviceSpec, createOptions); err != nil {
+				return err
+			}
+			fmt.Printf("Created service %q.\n", serviceSpec.Name)
+			continue
+		} else if getErr != nil {
+			return getErr
+		}
+
+		// The cluster ip can't be changed once it has been allocated
+		serviceSpec.ResourceVersion = existing.ResourceVersion
+		serviceSpec.Spec.ClusterIP = existing.Spec.ClusterIP
+		if _, err := serviceClient.Update(context.TODO(), serviceSpec, updateOptions); err != nil {
+			return err
+		}
+		fmt.Printf("Updated service %q.\n", serviceSpec.Name)
+	}
+
+	for i := 0; i < len(s.Ingresses); i++ {
+		ingressSpec := &s.Ingresses[i]
+		ingressClient := client.NetworkingV1().Ingresses(s.Namespace)
+		existing, getErr := ingressClient.Get(context.TODO(), ingressSpec.Name, metaV1.GetOptions{})
+		if errors.IsNotFound(getErr) {
+			if _, err := ingressClient.Create(context.TODO(), ingressSpec, createOptions); err != nil {
+				return err
+			}
+			fmt.Printf("Created ingress %q.\n", ingressSpec.Name)
+			continue
+		} else if getErr != nil {
+			return getErr
+		}
+
+		ingressSpec.ResourceVersion = existing.ResourceVersion
+		if _, err := ingressClient.Update(context.TODO(), ingressSpec, updateOptions); err != nil {
+			return err
+		}
+		fmt.Printf("Updated ingress %q.\n", ingressSpec.Name)
+	}
+
+	for i := 0; i < len(s.CronJobs); i++ {
+		cronJobSpec := &s.CronJobs[i]
+		cronJobClient := client.BatchV1beta1().CronJobs(s.Namespace)
+		existing, getErr := cronJobClient.Get(context.TODO(), cronJobSpec.Name, metaV1.GetOptions{})
+		if errors.IsNotFound(getErr) {
+			if _, err := cronJobClient.Create(context.TODO(), cronJobSpec, createOptions); err != nil {
+				return err
+			}
+			fmt.Printf("Created cron job %q.\n", cronJobSpec.Name)
+			continue
+		} else if getErr != nil {
+			return getErr
+		}
+
+		cronJobSpec.ResourceVersion = existing.ResourceVersion
+		if _, err := cronJobClient.Update(context.TODO(), cronJobSpec, updateOptions); err != nil {
+			return err
+		}
+		fmt.Printf("Updated cron job %q.\n", cronJobSpec.Name)
+	}
+
+	return nil
+}
+
+// Deletes the ingresses of a previous spec that are not in this spec, like the
+// ingress of an instance that is no longer exposed with one. Apply never
+// deletes anything so this is run after it when an instance is updated
+func (s *Spec) PruneIngresses(client kubernetes.Interface, previous *Spec) error {
+	current := map[string]bool{}
+	for _, ingress := range s.Ingresses {
+		current[ingress.Name] = true
+	}
+
+	removed := &Spec{Namespace: previous.Namespace}
+	for _, ingress := range previous.Ingresses {
+		if !current[ingress.Name] {
+			removed.Ingresses = append(removed.Ingresses, ingress)
+		}
+	}
+
+	return removed.Delete(client)
+}
@@ -0,0 +1,92 @@
+package kube
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	apiErrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// A resource of a custom resource definition like a cert-manager certificate.
+// These are sent to the api as json so the broker doesn't need the clients of
+// every resource it creates
+type CustomResource struct {
+	// The plural name of the resource in the api e.g. "certificates"
+	Resource string
+	Object   unstructured.Unstructured
+}
+
+// Gets the api path of the resources in a namespace
+func (r *CustomResource) path(namespace string) string {
+	group := "/apis/" + r.Object.GetAPIVersion()
+	if !strings.Contains(r.Object.GetAPIVersion(), "/") {
+		group = "/api/" + r.Object.GetAPIVersion()
+	}
+
+	return fmt.Sprintf("%s/namespaces/%s/%s", group, namespace, r.Resource)
+}
+
+// The custom resources are sent with the rest client of the discovery client
+// as it isn't tied to any api group. The fake clients don't have one
+func customResourceClient(client kubernetes.Interface) (rest.Interface, error) {
+	restClient := client.Discovery().RESTClient()
+	if restClient == nil {
+		return nil, errors.New("The client can't create custom resources")
+	}
+
+	return restClient, nil
+}
+
+func (r *CustomResource) create(client kubernetes.Interface, namespace string) error {
+	restClient, err := customResourceClient(client)
+	if err != nil {
+		return err
+	}
+
+	r.Object.SetNamespace(namespace)
+	body, err := r.Object.MarshalJSON()
+	if err != nil {
+		return err
+	}
+
+	return restClient.Post().
+		AbsPath(r.path(namespace)).
+		SetHeader("Content-Type", "application/json").
+		Body(body).
+		Do(context.TODO()).
+		Error()
+}
+
+// Creates the resource when it doesn't exist, existing resources are left as
+// they are
+func (r *CustomResource) ensure(client kubernetes.Interface, namespace string) (bool, error) {
+	restClient, err := customResourceClient(client)
+	if err != nil {
+		return false, err
+	}
+
+	err = restClient.Get().AbsPath(r.path(namespace), r.Object.GetName()).Do(context.TODO()).Error()
+	if err == nil {
+		return false, nil
+	}
+
+	if !apiErrors.IsNotFound(err) {
+		return false, err
+	}
+
+	return true, r.create(client, namespace)
+}
+
+func (r *CustomResource) delete(client kubernetes.Interface, namespace string) error {
+	restClient, err := customResourceClient(client)
+	if err != nil {
+		return err
+	}
+
+	return restClient.Delete().AbsPath(r.path(namespace), r.Object.GetName()).Do(context.TODO()).Error()
+}
@@ -7,21 +7,32 @@ import (
 
 	appsV1 "k8s.io/api/apps/v1"
 	batchV1 "k8s.io/api/batch/v1"
+	batchV1beta1 "k8s.io/api/batch/v1beta1"
 	coreV1 "k8s.io/api/core/v1"
+	networkingV1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
 )
 
 type Spec struct {
-	Namespace   string
-	Lables      map[string]string
-	Secrets     []coreV1.Secret
-	ConfigMaps  []coreV1.ConfigMap
-	PVCS        []coreV1.PersistentVolumeClaim
-	Deployments []appsV1.Deployment
-	Services    []coreV1.Service
-	Jobs        []batchV1.Job
+	Namespace       string
+	Lables          map[string]string
+	Annotations     map[string]string
+	Secrets         []coreV1.Secret
+	ConfigMaps      []coreV1.ConfigMap
+	PVCS            []coreV1.PersistentVolumeClaim
+	NetworkPolicies []networkingV1.NetworkPolicy
+	Deployments     []appsV1.Deployment
+	StatefulSets    []appsV1.StatefulSet
+	Services        []coreV1.Service
+	Ingresses       []networkingV1.Ingress
+	CronJobs        []batchV1beta1.CronJob
+	Jobs            []batchV1.Job
+	// Resources of custom resource definitions, these are created after the
+	// secrets and before the pods
+	CustomResources []CustomResource
 }
 
 func (s *Spec) InjectLabels(labels map[string]string) {
@@ -50,6 +61,24 @@ func (s *Spec) InjectLabels(labels map[string]string) {
 			s.PVCS[i].ObjectMeta.Labels[label] = value
 		}
 
+		for i := 0; i < len(s.CustomResources); i++ {
+			labels := s.CustomResources[i].Object.GetLabels()
+			if labels == nil {
+				labels = map[string]string{}
+			}
+
+			labels[label] = value
+			s.CustomResources[i].Object.SetLabels(labels)
+		}
+
+		for i := 0; i < len(s.NetworkPolicies); i++ {
+			if s.NetworkPolicies[i].ObjectMeta.Labels == nil {
+				s.NetworkPolicies[i].ObjectMeta.Labels = map[string]string{}
+			}
+
+			s.NetworkPolicies[i].ObjectMeta.Labels[label] = value
+		}
+
 		for i := 0; i < len(s.Deployments); i++ {
 			if s.Deployments[i].ObjectMeta.Labels == nil {
 				s.Deployments[i].ObjectMeta.Labels = map[string]string{}
@@ -58,6 +87,14 @@ func (s *Spec) InjectLabels(labels map[string]string) {
 			s.Deployments[i].ObjectMeta.Labels[label] = value
 		}
 
+		for i := 0; i < len(s.StatefulSets); i++ {
+			if s.StatefulSets[i].ObjectMeta.Labels == nil {
+				s.StatefulSets[i].ObjectMeta.Labels = map[string]string{}
+			}
+
+			s.StatefulSets[i].ObjectMeta.Labels[label] = value
+		}
+
 		for i := 0; i < len(s.Services); i++ {
 			if s.Services[i].ObjectMeta.Labels == nil {
 				s.Services[i].ObjectMeta.Labels = map[string]string{}
@@ -66,12 +103,58 @@ func (s *Spec) InjectLabels(labels map[string]string) {
 			s.Services[i].ObjectMeta.Labels[label] = value
 		}
 
+		for i := 0; i < len(s.Ingresses); i++ {
+			if s.Ingresses[i].ObjectMeta.Labels == nil {
+				s.Ingresses[i].ObjectMeta.Labels = map[string]string{}
+			}
+
+			s.Ingresses[i].ObjectMeta.Labels[label] = value
+		}
+
+		for i := 0; i < len(s.CronJobs); i++ {
+			if s.CronJobs[i].ObjectMeta.Labels == nil {
+				s.CronJobs[i].ObjectMeta.Labels = map[string]string{}
+			}
+
+			s.CronJobs[i].ObjectMeta.Labels[label] = value
+
+			// The job pods are labelled too so they can be matched by the
+			// network policies of the instance
+			podTemplate := &s.CronJobs[i].Spec.JobTemplate.Spec.Template
+			if podTemplate.Labels == nil {
+				podTemplate.Labels = map[string]string{}
+			}
+
+			podTemplate.Labels[label] = value
+		}
+
 		for i := 0; i < len(s.Jobs); i++ {
 			if s.Jobs[i].ObjectMeta.Labels == nil {
 				s.Jobs[i].ObjectMeta.Labels = map[string]string{}
 			}
 
 			s.Jobs[i].ObjectMeta.Labels[label] = value
+
+			if s.Jobs[i].Spec.Template.Labels == nil {
+				s.Jobs[i].Spec.Template.Labels = map[string]string{}
+			}
+
+			s.Jobs[i].Spec.Template.Labels[label] = value
+		}
+	}
+}
+
+// Adds the annotations to all of the secrets in the spec. The secrets are the
+// only resource that every service creates so they are used to store any
+// metadata about the instance that needs to be read back later on
+func (s *Spec) InjectAnnotations(annotations map[string]string) {
+	for annotation, value := range annotations {
+		for i := 0; i < len(s.Secrets); i++ {
+			if s.Secrets[i].ObjectMeta.Annotations == nil {
+				s.Secrets[i].ObjectMeta.Annotations = map[string]string{}
+			}
+
+			s.Secrets[i].ObjectMeta.Annotations[annotation] = value
 		}
 	}
 }
@@ -79,21 +162,44 @@ func (s *Spec) InjectLabels(labels map[string]string) {
 func (s *Spec) Delete(client kubernetes.Interface) error {
 	deletePolicy := metaV1.DeletePropagationForeground
 	deleteOptions := metaV1.DeleteOptions{PropagationPolicy: &deletePolicy}
+
+	// Resources that have already been removed are skipped so the rest of the
+	// spec can still be cleaned up
+	for i := 0; i < len(s.CronJobs); i++ {
+		cronJobSpec := &s.CronJobs[i]
+		cronJobClient := client.BatchV1beta1().CronJobs(s.Namespace)
+		cronJobErr := cronJobClient.Delete(context.TODO(), cronJobSpec.Name, deleteOptions)
+		if cronJobErr != nil && !errors.IsNotFound(cronJobErr) {
+			return cronJobErr
+		}
+		fmt.Printf("Deleted cron job %q.\n", cronJobSpec.Name)
+	}
+
 	for i := 0; i < len(s.Jobs); i++ {
 		jobSpec := &s.Jobs[i]
 		jobClient := client.BatchV1().Jobs(s.Namespace)
 		jobErr := jobClient.Delete(context.TODO(), jobSpec.Name, deleteOptions)
-		if jobErr != nil {
+		if jobErr != nil && !errors.IsNotFound(jobErr) {
 			return jobErr
 		}
 		fmt.Printf("Deleted job %q.\n", jobSpec.Name)
 	}
 
+	for i := 0; i < len(s.Ingresses); i++ {
+		ingressSpec := &s.Ingresses[i]
+		ingressClient := client.NetworkingV1().Ingresses(s.Namespace)
+		ingressErr := ingressClient.Delete(context.TODO(), ingressSpec.Name, deleteOptions)
+		if ingressErr != nil && !errors.IsNotFound(ingressErr) {
+			return ingressErr
+		}
+		fmt.Printf("Deleted ingress %q.\n", ingressSpec.Name)
+	}
+
 	for i := 0; i < len(s.Services); i++ {
 		serviceSpec := &s.Services[i]
 		serviceClient := client.CoreV1().Services(s.Namespace)
 		serviceErr := serviceClient.Delete(context.TODO(), serviceSpec.Name, deleteOptions)
-		if serviceErr != nil {
+		if serviceErr != nil && !errors.IsNotFound(serviceErr) {
 			return serviceErr
 		}
 		fmt.Printf("Deleted service %q.\n", serviceSpec.Name)
@@ -103,27 +209,56 @@ func (s *Spec) Delete(client kubernetes.Interface) error {
 		deploymentSpec := &s.Deployments[i]
 		deploymentClient := client.AppsV1().Deployments(s.Namespace)
 		deploymentErr := deploymentClient.Delete(context.TODO(), deploymentSpec.Name, deleteOptions)
-		if deploymentErr != nil {
+		if deploymentErr != nil && !errors.IsNotFound(deploymentErr) {
 			return deploymentErr
 		}
 		fmt.Printf("Deleted deployment %q.\n", deploymentSpec.Name)
 	}
 
+	for i := 0; i < len(s.StatefulSets); i++ {
+		statefulSetSpec := &s.StatefulSets[i]
+		statefulSetClient := client.AppsV1().StatefulSets(s.Namespace)
+		statefulSetErr := statefulSetClient.Delete(context.TODO(), statefulSetSpec.Name, deleteOptions)
+		if statefulSetErr != nil && !errors.IsNotFound(statefulSetErr) {
+			return statefulSetErr
+		}
+		fmt.Printf("Deleted stateful set %q.\n", statefulSetSpec.Name)
+	}
+
 	for i := 0; i < len(s.PVCS); i++ {
 		pvcSpec := &s.PVCS[i]
 		pvcClient := client.CoreV1().PersistentVolumeClaims(s.Namespace)
 		pvcErr := pvcClient.Delete(context.TODO(), pvcSpec.Name, deleteOptions)
-		if pvcErr != nil {
+		if pvcErr != nil && !errors.IsNotFound(pvcErr) {
 			return pvcErr
 		}
 		fmt.Printf("Deleted pvc %q.\n", pvcSpec.Name)
 	}
 
+	for i := 0; i < len(s.NetworkPolicies); i++ {
+		networkPolicySpec := &s.NetworkPolicies[i]
+		networkPolicyClient := client.NetworkingV1().NetworkPolicies(s.Namespace)
+		networkPolicyErr := networkPolicyClient.Delete(context.TODO(), networkPolicySpec.Name, deleteOptions)
+		if networkPolicyErr != nil && !errors.IsNotFound(networkPolicyErr) {
+			return networkPolicyErr
+		}
+		fmt.Printf("Deleted network policy %q.\n", networkPolicySpec.Name)
+	}
+
+	for i := 0; i < len(s.CustomResources); i++ {
+		resource := &s.CustomResources[i]
+		resourceErr := resource.delete(client, s.Namespace)
+		if resourceErr != nil && !errors.IsNotFound(resourceErr) {
+			return resourceErr
+		}
+		fmt.Printf("Deleted %s %q.\n", resource.Object.GetKind(), resource.Object.GetName())
+	}
+
 	for i := 0; i < len(s.ConfigMaps); i++ {
 		configMapSpec := &s.ConfigMaps[i]
 		configMapClient := client.CoreV1().ConfigMaps(s.Namespace)
 		configMapErr := configMapClient.Delete(context.TODO(), configMapSpec.Name, deleteOptions)
-		if configMapErr != nil {
+		if configMapErr != nil && !errors.IsNotFound(configMapErr) {
 			return configMapErr
 		}
 		fmt.Printf("Deleted config map %q.\n", configMapSpec.Name)
@@ -133,7 +268,7 @@ func (s *Spec) Delete(client kubernetes.Interface) error {
 		secretSpec := &s.Secrets[i]
 		secretsClient := client.CoreV1().Secrets(s.Namespace)
 		secretErr := secretsClient.Delete(context.TODO(), secretSpec.Name, deleteOptions)
-		if secretErr != nil {
+		if secretErr != nil && !errors.IsNotFound(secretErr) {
 			return secretErr
 		}
 		fmt.Printf("Deleted secret %q.\n", secretSpec.Name)
@@ -144,6 +279,7 @@ func (s *Spec) Delete(client kubernetes.Interface) error {
 
 func (s *Spec) Create(client kubernetes.Interface) error {
 	s.InjectLabels(s.Lables)
+	s.InjectAnnotations(s.Annotations)
 	createOptions := metaV1.CreateOptions{}
 
 	for i := 0; i < len(s.Secrets); i++ {
@@ -156,6 +292,14 @@ func (s *Spec) Create(client kubernetes.Interface) error {
 		fmt.Printf("Created secret %q.\n", secret.GetObjectMeta().GetName())
 	}
 
+	for i := 0; i < len(s.CustomResources); i++ {
+		resource := &s.CustomResources[i]
+		if err := resource.create(client, s.Namespace); err != nil {
+			return err
+		}
+		fmt.Printf("Created %s %q.\n", resource.Object.GetKind(), resource.Object.GetName())
+	}
+
 	for i := 0; i < len(s.ConfigMaps); i++ {
 		configMapSpec := &s.ConfigMaps[i]
 		configMapClient := client.CoreV1().ConfigMaps(s.Namespace)
@@ -176,6 +320,18 @@ func (s *Spec) Create(client kubernetes.Interface) error {
 		fmt.Printf("Created pvc %q.\n", pvc.GetObjectMeta().GetName())
 	}
 
+	// The network policies are created before the pods so they are never
+	// running without them
+	for i := 0; i < len(s.NetworkPolicies); i++ {
+		networkPolicySpec := &s.NetworkPolicies[i]
+		networkPolicyClient := client.NetworkingV1().NetworkPolicies(s.Namespace)
+		networkPolicy, networkPolicyErr := networkPolicyClient.Create(context.TODO(), networkPolicySpec, createOptions)
+		if networkPolicyErr != nil {
+			return networkPolicyErr
+		}
+		fmt.Printf("Created network policy %q.\n", networkPolicy.GetObjectMeta().GetName())
+	}
+
 	var deployments = make([]string, 0)
 	deploymentClient := client.AppsV1().Deployments(s.Namespace)
 	for i := 0; i < len(s.Deployments); i++ {
@@ -197,6 +353,27 @@ func (s *Spec) Create(client kubernetes.Interface) error {
 		}
 	}
 
+	var statefulSets = make([]string, 0)
+	statefulSetClient := client.AppsV1().StatefulSets(s.Namespace)
+	for i := 0; i < len(s.StatefulSets); i++ {
+		statefulSetSpec := &s.StatefulSets[i]
+		statefulSet, statefulSetErr := statefulSetClient.Create(context.TODO(), statefulSetSpec, createOptions)
+		if statefulSetErr != nil {
+			return statefulSetErr
+		}
+		fmt.Printf("Created stateful set %q.\n", statefulSet.GetObjectMeta().GetName())
+		statefulSets = append(statefulSets, statefulSet.GetObjectMeta().GetName())
+	}
+
+	for i := 0; i < len(statefulSets); i++ {
+		statefulSetName := statefulSets[i]
+		waitFunc := isStatefulSetReady(statefulSetClient, statefulSetName)
+		fmt.Printf("Waiting for %q\n", statefulSetName)
+		if err := wait.PollImmediate(time.Second, time.Duration(5)*time.Minute, waitFunc); err != nil {
+			return err
+		}
+	}
+
 	for i := 0; i < len(s.Services); i++ {
 		serviceSpec := &s.Services[i]
 		serviceClient := client.CoreV1().Services(s.Namespace)
@@ -207,6 +384,26 @@ func (s *Spec) Create(client kubernetes.Interface) error {
 		fmt.Printf("Created service %q.\n", service.GetObjectMeta().GetName())
 	}
 
+	for i := 0; i < len(s.Ingresses); i++ {
+		ingressSpec := &s.Ingresses[i]
+		ingressClient := client.NetworkingV1().Ingresses(s.Namespace)
+		ingress, ingressErr := ingressClient.Create(context.TODO(), ingressSpec, createOptions)
+		if ingressErr != nil {
+			return ingressErr
+		}
+		fmt.Printf("Created ingress %q.\n", ingress.GetObjectMeta().GetName())
+	}
+
+	for i := 0; i < len(s.CronJobs); i++ {
+		cronJobSpec := &s.CronJobs[i]
+		cronJobClient := client.BatchV1beta1().CronJobs(s.Namespace)
+		cronJob, cronJobErr := cronJobClient.Create(context.TODO(), cronJobSpec, createOptions)
+		if cronJobErr != nil {
+			return cronJobErr
+		}
+		fmt.Printf("Created cron job %q.\n", cronJob.GetObjectMeta().GetName())
+	}
+
 	var jobs = make([]string, 0)
 	jobClient := client.BatchV1().Jobs(s.Namespace)
 	for i := 0; i < len(s.Jobs); i++ {
@@ -0,0 +1,183 @@
+package kube
+
+import (
+	"strings"
+
+	coreV1 "k8s.io/api/core/v1"
+)
+
+// The security settings of the pods in a spec. Hardened pods pass the
+// "restricted" pod security standard as long as every container runs as a
+// user that isn't root
+type PodSecurity struct {
+	// The user and group the containers run as by the repository of their
+	// image e.g. "mysql" or "minio/mc"
+	ImageUsers map[string]int64
+	// The user of the containers with images that are not in the image users,
+	// the user of the image is kept when this is nil
+	RunAsUser *int64
+	// The service account of the pods, the token is only mounted when
+	// AutomountServiceAccountToken is set
+	ServiceAccountName           string
+	AutomountServiceAccountToken bool
+	// The requests and limits of the containers that don't set their own
+	Requests coreV1.ResourceList
+	Limits   coreV1.ResourceList
+}
+
+// Hardens the pods of all the deployments, stateful sets, cron jobs and jobs
+// in the spec
+func (s *Spec) Harden(security PodSecurity) {
+	for i := 0; i < len(s.Deployments); i++ {
+		security.HardenPodSpec(&s.Deployments[i].Spec.Template.Spec)
+	}
+
+	for i := 0; i < len(s.StatefulSets); i++ {
+		security.HardenPodSpec(&s.StatefulSets[i].Spec.Template.Spec)
+	}
+
+	for i := 0; i < len(s.CronJobs); i++ {
+		security.HardenPodSpec(&s.CronJobs[i].Spec.JobTemplate.Spec.Template.Spec)
+	}
+
+	for i := 0; i < len(s.Jobs); i++ {
+		security.HardenPodSpec(&s.Jobs[i].Spec.Template.Spec)
+	}
+}
+
+// Sets the security context of a pod and its containers. Anything that has
+// already been set on the pod is kept so the services can override it
+func (p PodSecurity) HardenPodSpec(podSpec *coreV1.PodSpec) {
+	automount := p.AutomountServiceAccountToken
+	if podSpec.AutomountServiceAccountToken == nil {
+		podSpec.AutomountServiceAccountToken = &automount
+	}
+
+	if podSpec.ServiceAccountName == "" {
+		podSpec.ServiceAccountName = p.ServiceAccountName
+	}
+
+	if podSpec.SecurityContext == nil {
+		podSpec.SecurityContext = &coreV1.PodSecurityContext{}
+	}
+
+	context := podSpec.SecurityContext
+	if context.RunAsNonRoot == nil {
+		context.RunAsNonRoot = boolPtr(true)
+	}
+
+	if context.SeccompProfile == nil {
+		context.SeccompProfile = &coreV1.SeccompProfile{Type: coreV1.SeccompProfileTypeRuntimeDefault}
+	}
+
+	// The volumes are owned by the group of the first container so the
+	// servers can write to their pvcs. The ownership is only changed when the
+	// root of the volume doesn't match as some servers check the permissions
+	// of their files
+	containers := podSpec.Containers
+	if len(podSpec.InitContainers) > 0 {
+		containers = podSpec.InitContainers
+	}
+
+	if context.FSGroup == nil && len(containers) > 0 {
+		context.FSGroup = p.user(containers[0].Image)
+	}
+
+	if context.FSGroup != nil && context.FSGroupChangePolicy == nil {
+		policy := coreV1.FSGroupChangeOnRootMismatch
+		context.FSGroupChangePolicy = &policy
+	}
+
+	for i := range podSpec.InitContainers {
+		p.hardenContainer(&podSpec.InitContainers[i])
+	}
+
+	for i := range podSpec.Containers {
+		p.hardenContainer(&podSpec.Containers[i])
+	}
+}
+
+func (p PodSecurity) hardenContainer(container *coreV1.Container) {
+	if container.SecurityContext == nil {
+		container.SecurityContext = &coreV1.SecurityContext{}
+	}
+
+	context := container.SecurityContext
+	if context.Privileged == nil {
+		context.Privileged = boolPtr(false)
+	}
+
+	if context.AllowPrivilegeEscalation == nil {
+		context.AllowPrivilegeEscalation = boolPtr(false)
+	}
+
+	if context.Capabilities == nil {
+		context.Capabilities = &coreV1.Capabilities{Drop: []coreV1.Capability{"ALL"}}
+	}
+
+	if context.RunAsUser == nil {
+		if user := p.user(container.Image); user != nil {
+			context.RunAsUser = user
+			context.RunAsGroup = user
+		}
+	}
+
+	if container.Resources.Requests == nil {
+		container.Resources.Requests = coreV1.ResourceList{}
+	}
+
+	// Containers with a limit and no request get a request of the limit from
+	// kubernetes so they don't get the default request
+	for name, quantity := range p.Requests {
+		_, hasRequest := container.Resources.Requests[name]
+		_, hasLimit := container.Resources.Limits[name]
+		if !hasRequest && !hasLimit {
+			container.Resources.Requests[name] = quantity
+		}
+	}
+
+	// A default limit is not set when the container requests more than it
+	// as the pod would be invalid
+	for name, quantity := range p.Limits {
+		if _, ok := container.Resources.Limits[name]; ok {
+			continue
+		}
+
+		if request, ok := container.Resources.Requests[name]; ok && request.Cmp(quantity) > 0 {
+			continue
+		}
+
+		if container.Resources.Limits == nil {
+			container.Resources.Limits = coreV1.ResourceList{}
+		}
+
+		container.Resources.Limits[name] = quantity
+	}
+}
+
+// Gets the user a container with an image runs as, nil is returned when the
+// user of the image is kept
+func (p PodSecurity) user(image string) *int64 {
+	if user, ok := p.ImageUsers[ImageRepository(image)]; ok {
+		return &user
+	}
+
+	return p.RunAsUser
+}
+
+// Gets the repository of an image without the tag, digest or the docker hub
+// registry e.g. "docker.io/library/mysql:5.7" is "mysql"
+func ImageRepository(image string) string {
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+
+	image = strings.TrimPrefix(image, "docker.io/")
+	return strings.TrimPrefix(image, "library/")
+}
+
+func boolPtr(b bool) *bool { return &b }
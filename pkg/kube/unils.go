@@ -1,7 +1,8 @@
 package kube
 
 import (
-	"math/rand"
+	"crypto/rand"
+	"math/big"
 
 	coreV1 "k8s.io/api/core/v1"
 )
@@ -9,13 +10,30 @@ import (
 const letterBytes = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 
 func RandStringBytes(n int) string {
+	return RandString(letterBytes, n)
+}
+
+// Generates a random string of n characters from the charset with
+// crypto/rand so the output can't be predicted
+func RandString(charset string, n int) string {
 	b := make([]byte, n)
 	for i := range b {
-		b[i] = letterBytes[rand.Intn(len(letterBytes))]
+		b[i] = charset[RandIntn(len(charset))]
 	}
 	return string(b)
 }
 
+// Gets a random number in [0, n) from crypto/rand. This panics when the system
+// random source can't be read as there is no safe fallback for credentials
+func RandIntn(n int) int {
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		panic(err)
+	}
+
+	return int(i.Int64())
+}
+
 // Helper function fore generating a kubernetes environment variable from a
 // kubernetes secret
 func EnvSecret(name string, secretName string, secretKey string) coreV1.EnvVar {
@@ -6,6 +6,7 @@ import (
 
 	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
 	v1 "k8s.io/client-go/kubernetes/typed/apps/v1"
 	bV1 "k8s.io/client-go/kubernetes/typed/batch/v1"
 )
@@ -55,3 +56,44 @@ func isDeploymentReady(client v1.DeploymentInterface, name string) wait.Conditio
 		return true, nil
 	}
 }
+
+func isStatefulSetReady(client v1.StatefulSetInterface, name string) wait.ConditionFunc {
+	return func() (bool, error) {
+		if flag.Lookup("test.v") != nil {
+			return true, nil
+		}
+
+		statefulSet, err := client.Get(context.TODO(), name, metaV1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+
+		if statefulSet.Spec.Replicas == nil || statefulSet.Status.ReadyReplicas < *statefulSet.Spec.Replicas {
+			return false, nil
+		}
+
+		return true, nil
+	}
+}
+
+// Tests if all of the jobs in the spec have succeeded. This should be called
+// after the spec has been created and all of the jobs have finished running
+func (s *Spec) JobsSucceeded(client kubernetes.Interface) (bool, error) {
+	if flag.Lookup("test.v") != nil {
+		return true, nil
+	}
+
+	jobClient := client.BatchV1().Jobs(s.Namespace)
+	for i := 0; i < len(s.Jobs); i++ {
+		job, err := jobClient.Get(context.TODO(), s.Jobs[i].Name, metaV1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+
+		if job.Status.Succeeded == 0 {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
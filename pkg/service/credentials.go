@@ -0,0 +1,116 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/AdeAttwood/service-broker/pkg/kube"
+)
+
+// The character classes the generated passwords can be made from. The symbols
+// are limited to the characters that don't need to be escaped in urls, shell
+// scripts or sql strings
+var credentialCharacterClasses = map[string]string{
+	"lower":   "abcdefghijklmnopqrstuvwxyz",
+	"upper":   "ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+	"digits":  "0123456789",
+	"symbols": "-_.~",
+}
+
+// The characters of the random part of the generated usernames, these are
+// lower case so they can be used by all of the services
+const usernameCharacters = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+// The policy the credentials of a service are generated with. Any options that
+// are not set use the defaults of the service
+type CredentialPolicy struct {
+	// The length of the generated passwords
+	Length int `yaml:"length"`
+	// The character classes of the passwords, "lower", "upper", "digits" and
+	// "symbols". Every password has at least one character of each class, this
+	// defaults to "lower", "upper" and "digits"
+	CharacterClasses []string `yaml:"characterClasses"`
+	// The format of the generated usernames, the "%s" is replaced with random
+	// characters e.g. "app-%s"
+	UsernameFormat string `yaml:"usernameFormat"`
+	// The number of random characters in the usernames
+	UsernameLength int `yaml:"usernameLength"`
+}
+
+// Validates the policy so invalid policies are found when the broker starts
+func (p CredentialPolicy) Validate() error {
+	for _, class := range p.CharacterClasses {
+		if _, ok := credentialCharacterClasses[class]; !ok {
+			return fmt.Errorf("Invalid character class '%s' in the credential policy", class)
+		}
+	}
+
+	if p.Length < 0 || (p.Length > 0 && p.Length < len(p.classes())) {
+		return fmt.Errorf("Invalid password length '%d', this must fit all of the character classes", p.Length)
+	}
+
+	if p.UsernameFormat != "" && strings.Count(p.UsernameFormat, "%s") != 1 {
+		return fmt.Errorf("Invalid username format '%s', this must have one '%%s'", p.UsernameFormat)
+	}
+
+	if p.UsernameLength < 0 {
+		return fmt.Errorf("Invalid username length '%d'", p.UsernameLength)
+	}
+
+	return nil
+}
+
+// Gets the character classes of the passwords with the default classes when
+// the policy has none
+func (p CredentialPolicy) classes() []string {
+	if len(p.CharacterClasses) == 0 {
+		return []string{"lower", "upper", "digits"}
+	}
+
+	return p.CharacterClasses
+}
+
+// Generates a password with the policy, the length of the service is used
+// when the policy has no length
+func (p CredentialPolicy) Password(length int) string {
+	if p.Length > 0 {
+		length = p.Length
+	}
+
+	classes := p.classes()
+
+	// One character of each class is added first so every class is in the
+	// password, the rest can be from any class
+	charset := ""
+	password := []byte{}
+	for _, class := range classes {
+		charset += credentialCharacterClasses[class]
+		password = append(password, kube.RandString(credentialCharacterClasses[class], 1)...)
+	}
+
+	if len(password) < length {
+		password = append(password, kube.RandString(charset, length-len(password))...)
+	}
+
+	for i := len(password) - 1; i > 0; i-- {
+		j := kube.RandIntn(i + 1)
+		password[i], password[j] = password[j], password[i]
+	}
+
+	return string(password[:length])
+}
+
+// Generates a username with the policy, the format of the service is used
+// when the policy has no format
+func (p CredentialPolicy) Username(format string) string {
+	if p.UsernameFormat != "" {
+		format = p.UsernameFormat
+	}
+
+	length := 8
+	if p.UsernameLength > 0 {
+		length = p.UsernameLength
+	}
+
+	return fmt.Sprintf(format, kube.RandString(usernameCharacters, length))
+}
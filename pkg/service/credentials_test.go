@@ -0,0 +1,73 @@
+package service
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCredentialPolicyPassword(t *testing.T) {
+	policy := CredentialPolicy{Length: 24, CharacterClasses: []string{"lower", "digits", "symbols"}}
+
+	passwords := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		password := policy.Password(16)
+		if len(password) != 24 {
+			t.Errorf("The password should have the length of the policy not %d", len(password))
+		}
+
+		for _, class := range policy.CharacterClasses {
+			if !strings.ContainsAny(password, credentialCharacterClasses[class]) {
+				t.Errorf("The password '%s' should have a character from the class '%s'", password, class)
+			}
+		}
+
+		if strings.ContainsAny(password, credentialCharacterClasses["upper"]) {
+			t.Errorf("The password '%s' should only have characters from the policy classes", password)
+		}
+
+		passwords[password] = true
+	}
+
+	if len(passwords) != 20 {
+		t.Errorf("The passwords should be different every time they are generated")
+	}
+
+	if password := (CredentialPolicy{}).Password(18); len(password) != 18 {
+		t.Errorf("The length of the service should be used without a policy length")
+	}
+}
+
+func TestCredentialPolicyUsername(t *testing.T) {
+	policy := CredentialPolicy{UsernameFormat: "app-%s", UsernameLength: 12}
+
+	username := policy.Username("user-%s")
+	if !strings.HasPrefix(username, "app-") || len(username) != 16 {
+		t.Errorf("Invalid username '%s'", username)
+	}
+
+	if username == policy.Username("user-%s") {
+		t.Errorf("The usernames should be different every time they are generated")
+	}
+
+	if username := (CredentialPolicy{}).Username("user_%s"); !strings.HasPrefix(username, "user_") || len(username) != 13 {
+		t.Errorf("The format of the service should be used without a policy format not '%s'", username)
+	}
+}
+
+func TestCredentialPolicyValidate(t *testing.T) {
+	for _, policy := range []CredentialPolicy{
+		{CharacterClasses: []string{"emoji"}},
+		{Length: 2, CharacterClasses: []string{"lower", "upper", "digits"}},
+		{Length: 2},
+		{UsernameFormat: "user"},
+		{UsernameFormat: "%s-%s"},
+	} {
+		if err := policy.Validate(); err == nil {
+			t.Errorf("The policy '%v' should not be valid", policy)
+		}
+	}
+
+	if err := (CredentialPolicy{Length: 32, CharacterClasses: []string{"lower", "symbols"}, UsernameFormat: "app_%s"}).Validate(); err != nil {
+		t.Errorf("Valid policies should not return an error: %v", err)
+	}
+}
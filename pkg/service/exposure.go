@@ -0,0 +1,386 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	coreV1 "k8s.io/api/core/v1"
+	networkingV1 "k8s.io/api/networking/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// How the service of an instance is exposed to its clients
+const (
+	ExposeClusterIP    = "ClusterIP"
+	ExposeNodePort     = "NodePort"
+	ExposeLoadBalancer = "LoadBalancer"
+	ExposeIngress      = "Ingress"
+)
+
+// The annotation on the instance service that holds the host the clients
+// connect to when it is not the cluster host of the service
+const exposedHostAnnotation = "service-exposed-host"
+
+// The exposure of the instances of a plan. When the plan allows it the type
+// can be overridden with the "expose" parameter and the source ranges with the
+// "expose_source_ranges" parameter
+type ExposureConfig struct {
+	// "ClusterIP", "NodePort", "LoadBalancer" or "Ingress", this defaults to
+	// "ClusterIP". Ingresses are only available for http services
+	Type string `yaml:"type"`
+	// The client ranges that can connect to a load balancer e.g. "10.0.0.0/8"
+	SourceRanges []string `yaml:"sourceRanges"`
+	// The annotations of the service, or the ingress with the ingress type
+	Annotations map[string]string `yaml:"annotations"`
+	// The host the clients connect to, the "%s" is replaced with the instance
+	// id e.g. "%s.s3.example.com". This is required for ingresses, for node
+	// ports and load balancers this is the dns name of the nodes or the load
+	// balancer
+	Host string `yaml:"host"`
+	// The class of the ingress
+	IngressClass string `yaml:"ingressClass"`
+	// A secret in the instance namespace with the certificate of the ingress
+	// host, the clients connect with https when this is set
+	TLSSecret string `yaml:"tlsSecret"`
+	// The namespace of the ingress controller, the network policy of the
+	// instance allows it to connect. This defaults to "ingress-nginx"
+	IngressNamespace string `yaml:"ingressNamespace"`
+	// If the parameters can override the type and source ranges. The source
+	// ranges of the parameters must be within the source ranges of the plan
+	AllowOverride bool `yaml:"allowOverride"`
+}
+
+// Validates the exposure of a plan
+func (e ExposureConfig) Validate() error {
+	switch e.Type {
+	case "", ExposeClusterIP, ExposeNodePort, ExposeLoadBalancer:
+	case ExposeIngress:
+		if e.Host == "" {
+			return fmt.Errorf("The ingress exposure needs a host")
+		}
+	default:
+		return fmt.Errorf("Invalid exposure type '%s', this must be '%s', '%s', '%s' or '%s'", e.Type, ExposeClusterIP, ExposeNodePort, ExposeLoadBalancer, ExposeIngress)
+	}
+
+	if strings.Count(e.Host, "%s") > 1 {
+		return fmt.Errorf("Invalid exposure host '%s', this can only have one '%%s'", e.Host)
+	}
+
+	if len(e.SourceRanges) > 0 && e.Type != ExposeLoadBalancer {
+		return fmt.Errorf("The source ranges can only be set on load balancers")
+	}
+
+	return nil
+}
+
+// Validates the exposure parameters of an instance against its plan. The
+// parameters can only be used when the plan allows them to override the
+// exposure and can't open the instance to more addresses than the plan
+func validateExposureParameters(plan PlanConfig, parameters map[string]interface{}) error {
+	_, hasType := parameters["expose"]
+	_, hasRanges := parameters["expose_source_ranges"]
+	if !hasType && !hasRanges {
+		return nil
+	}
+
+	if !plan.Expose.AllowOverride {
+		return fmt.Errorf("The exposure of the plan '%s' can't be overridden", plan.Name)
+	}
+
+	if len(plan.Expose.SourceRanges) == 0 {
+		return nil
+	}
+
+	// Node ports and ingresses can't be limited to the source ranges
+	exposure := instanceExposure(plan, parameters)
+	if exposure.Type == ExposeClusterIP {
+		return nil
+	}
+
+	if exposure.Type != ExposeLoadBalancer || len(exposure.SourceRanges) == 0 {
+		return fmt.Errorf("Instances of the plan '%s' can only be exposed to its source ranges", plan.Name)
+	}
+
+	for _, cidr := range exposure.SourceRanges {
+		if !cidrWithin(cidr, plan.Expose.SourceRanges) {
+			return fmt.Errorf("The source range '%s' is not within the source ranges of the plan '%s'", cidr, plan.Name)
+		}
+	}
+
+	return nil
+}
+
+// Validates the exposure of an instance of a service that is not served over
+// http, these can't be exposed with an ingress
+func validateTCPExposure(name string, plan PlanConfig, parameters map[string]interface{}) error {
+	if err := validateExposureParameters(plan, parameters); err != nil {
+		return err
+	}
+
+	exposure := instanceExposure(plan, parameters)
+	if err := exposure.Validate(); err != nil {
+		return err
+	}
+
+	if exposure.Type == ExposeIngress {
+		return fmt.Errorf("%s instances can't be exposed with an ingress", name)
+	}
+
+	return nil
+}
+
+// Checks if a cidr is within any of the ranges
+func cidrWithin(cidr string, ranges []string) bool {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return false
+	}
+
+	size, _ := network.Mask.Size()
+	for _, value := range ranges {
+		_, allowed, err := net.ParseCIDR(value)
+		if err != nil {
+			continue
+		}
+
+		allowedSize, _ := allowed.Mask.Size()
+		if allowed.Contains(network.IP) && allowedSize <= size && len(allowed.IP) == len(network.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Gets the exposure of an instance from its plan and parameters. The
+// parameters are only used when the plan allows them to override it
+func instanceExposure(plan PlanConfig, parameters map[string]interface{}) ExposureConfig {
+	exposure := plan.Expose
+	if !exposure.AllowOverride {
+		parameters = nil
+	}
+
+	exposure.Type = stringParam(parameters, "expose", exposure.Type)
+	if exposure.Type == "" {
+		exposure.Type = ExposeClusterIP
+	}
+
+	switch ranges := parameters["expose_source_ranges"].(type) {
+	case []interface{}:
+		exposure.SourceRanges = []string{}
+		for _, value := range ranges {
+			exposure.SourceRanges = append(exposure.SourceRanges, fmt.Sprint(value))
+		}
+	case string:
+		exposure.SourceRanges = strings.Split(ranges, ",")
+	}
+
+	// The ranges are copied so the ranges of the plan are not changed
+	ranges := make([]string, 0, len(exposure.SourceRanges))
+	for _, cidr := range exposure.SourceRanges {
+		ranges = append(ranges, strings.TrimSpace(cidr))
+	}
+
+	if exposure.SourceRanges != nil {
+		exposure.SourceRanges = ranges
+	}
+
+	return exposure
+}
+
+// Gets the host the clients connect to, this is empty when the clients use
+// the cluster host of the service
+func (e ExposureConfig) host(instanceID string) string {
+	if strings.Contains(e.Host, "%s") {
+		return fmt.Sprintf(e.Host, instanceID)
+	}
+
+	return e.Host
+}
+
+// Sets the type, source ranges and annotations of an instance service. The
+// service of an instance with an ingress is only exposed in the cluster
+func (e ExposureConfig) exposeService(service *coreV1.Service, instanceID string) {
+	service.Spec.Type = coreV1.ServiceTypeClusterIP
+	if e.Type == ExposeIngress {
+		return
+	}
+
+	if e.Type == ExposeNodePort || e.Type == ExposeLoadBalancer {
+		service.Spec.Type = coreV1.ServiceType(e.Type)
+	}
+
+	if e.Type == ExposeLoadBalancer {
+		service.Spec.LoadBalancerSourceRanges = e.SourceRanges
+	}
+
+	// The client addresses are kept so the network policy of the instance
+	// can allow the source ranges
+	if e.Type == ExposeNodePort || e.Type == ExposeLoadBalancer {
+		service.Spec.ExternalTrafficPolicy = coreV1.ServiceExternalTrafficPolicyTypeLocal
+	}
+
+	annotations := map[string]string{}
+	for name, value := range e.Annotations {
+		annotations[name] = value
+	}
+
+	if host := e.host(instanceID); host != "" {
+		annotations[exposedHostAnnotation] = host
+	}
+
+	if len(annotations) > 0 {
+		service.Annotations = annotations
+	}
+}
+
+// Gets the ingress of an instance that sends the requests for the exposed
+// host to the instance service. There is no ingress unless the instance is
+// exposed with one
+func (e ExposureConfig) ingresses(name string, instanceID string, port int32) []networkingV1.Ingress {
+	if e.Type != ExposeIngress {
+		return nil
+	}
+
+	pathType := networkingV1.PathTypePrefix
+	ingress := networkingV1.Ingress{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name:        name,
+			Annotations: e.Annotations,
+		},
+		Spec: networkingV1.IngressSpec{
+			Rules: []networkingV1.IngressRule{
+				{
+					Host: e.host(instanceID),
+					IngressRuleValue: networkingV1.IngressRuleValue{
+						HTTP: &networkingV1.HTTPIngressRuleValue{
+							Paths: []networkingV1.HTTPIngressPath{
+								{
+									Path:     "/",
+									PathType: &pathType,
+									Backend: networkingV1.IngressBackend{
+										Service: &networkingV1.IngressServiceBackend{
+											Name: name,
+											Port: networkingV1.ServiceBackendPort{Number: port},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	if e.IngressClass != "" {
+		ingress.Spec.IngressClassName = &e.IngressClass
+	}
+
+	if e.TLSSecret != "" {
+		ingress.Spec.TLS = []networkingV1.IngressTLS{
+			{Hosts: []string{e.host(instanceID)}, SecretName: e.TLSSecret},
+		}
+	}
+
+	return []networkingV1.Ingress{ingress}
+}
+
+// Gets the peers outside of the cluster that can connect to an exposed
+// instance. Node ports and load balancers allow their source ranges or any
+// address, ingresses allow the pods of the ingress controller
+func (e ExposureConfig) networkPolicyPeers() []networkingV1.NetworkPolicyPeer {
+	peers := []networkingV1.NetworkPolicyPeer{}
+	switch e.Type {
+	case ExposeNodePort, ExposeLoadBalancer:
+		ranges := e.SourceRanges
+		if len(ranges) == 0 || e.Type == ExposeNodePort {
+			ranges = []string{"0.0.0.0/0"}
+		}
+
+		for _, cidr := range ranges {
+			peers = append(peers, networkingV1.NetworkPolicyPeer{
+				IPBlock: &networkingV1.IPBlock{CIDR: cidr},
+			})
+		}
+	case ExposeIngress:
+		namespace := e.IngressNamespace
+		if namespace == "" {
+			namespace = "ingress-nginx"
+		}
+
+		peers = append(peers, networkingV1.NetworkPolicyPeer{
+			NamespaceSelector: &metaV1.LabelSelector{
+				MatchLabels: map[string]string{namespaceNameLabel: namespace},
+			},
+		})
+	}
+
+	return peers
+}
+
+// The address the clients of an instance connect to
+type exposedAddress struct {
+	Host string
+	Port int32
+	// If the clients connect with https
+	TLS bool
+	// If the clients connect through an ingress
+	Ingress bool
+}
+
+// Gets the address of an instance service from the resources in the cluster
+// so it is the same as what is running. The ingress host is used when there
+// is an ingress, node ports use the allocated port and load balancers use the
+// allocated address when no host has been set. The cluster host of the
+// service is used when the address can't be found
+func getExposedAddress(client kubernetes.Interface, namespace string, name string, clusterHost string, port int32) exposedAddress {
+	address := exposedAddress{Host: clusterHost, Port: port}
+	if client == nil {
+		return address
+	}
+
+	ingress, err := client.NetworkingV1().Ingresses(namespace).Get(context.TODO(), name, metaV1.GetOptions{})
+	if err == nil && len(ingress.Spec.Rules) > 0 {
+		address = exposedAddress{Host: ingress.Spec.Rules[0].Host, Port: 80, Ingress: true}
+		if len(ingress.Spec.TLS) > 0 {
+			address.Port = 443
+			address.TLS = true
+		}
+
+		return address
+	}
+
+	service, err := client.CoreV1().Services(namespace).Get(context.TODO(), name, metaV1.GetOptions{})
+	if err != nil {
+		return address
+	}
+
+	host, hasHost := service.Annotations[exposedHostAnnotation]
+	if hasHost {
+		address.Host = host
+	}
+
+	// The node port is only used with the host of the nodes, the cluster
+	// host of the service only accepts the service port
+	switch service.Spec.Type {
+	case coreV1.ServiceTypeNodePort:
+		if hasHost && len(service.Spec.Ports) > 0 && service.Spec.Ports[0].NodePort > 0 {
+			address.Port = service.Spec.Ports[0].NodePort
+		}
+	case coreV1.ServiceTypeLoadBalancer:
+		if !hasHost && len(service.Status.LoadBalancer.Ingress) > 0 {
+			allocated := service.Status.LoadBalancer.Ingress[0]
+			if allocated.Hostname != "" {
+				address.Host = allocated.Hostname
+			} else if allocated.IP != "" {
+				address.Host = allocated.IP
+			}
+		}
+	}
+
+	return address
+}
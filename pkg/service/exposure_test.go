@@ -0,0 +1,128 @@
+package service
+
+import (
+	"testing"
+
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestMysqlExposure(t *testing.T) {
+	mysql := NewMysqlInstance(InstanceConfig{
+		Plans: []PlanConfig{
+			{Name: "default", ID: "default-id", Storage: "2Gi"},
+			{Name: "internal", ID: "internal-id", Storage: "2Gi", Expose: ExposureConfig{AllowOverride: true, Type: ExposeLoadBalancer, SourceRanges: []string{"10.0.0.0/8"}}},
+		},
+	}, nil)
+	options := ServiceOptions{ID: "test-id", Namespace: "test-ns", PlanID: "default-id"}
+
+	if service := mysql.GetProvisionSpec(options).Services[0]; service.Spec.Type != coreV1.ServiceTypeClusterIP {
+		t.Errorf("Instances should only be exposed in the cluster by default, got '%s'", service.Spec.Type)
+	}
+
+	options.Parameters = map[string]interface{}{
+		"expose":               "LoadBalancer",
+		"expose_source_ranges": []interface{}{"10.1.0.0/16"},
+	}
+
+	if err := mysql.ValidateProvision(options); err == nil {
+		t.Errorf("Plans that don't allow overriding the exposure should not accept the parameters")
+	}
+
+	if service := mysql.GetProvisionSpec(options).Services[0]; service.Spec.Type != coreV1.ServiceTypeClusterIP {
+		t.Errorf("The parameters should be ignored when the plan doesn't allow them, got '%s'", service.Spec.Type)
+	}
+
+	options.PlanID = "internal-id"
+	service := mysql.GetProvisionSpec(options).Services[0]
+	if service.Spec.Type != coreV1.ServiceTypeLoadBalancer || len(service.Spec.LoadBalancerSourceRanges) != 1 || service.Spec.LoadBalancerSourceRanges[0] != "10.1.0.0/16" {
+		t.Errorf("Invalid load balancer '%v'", service.Spec)
+	}
+
+	if err := mysql.ValidateProvision(options); err != nil {
+		t.Errorf("The load balancer should be valid, got '%v'", err)
+	}
+
+	policy := mysql.GetNetworkPolicy(options, nil)
+	if peers := policy.Spec.Ingress[0].From; peers[len(peers)-1].IPBlock == nil || peers[len(peers)-1].IPBlock.CIDR != "10.1.0.0/16" {
+		t.Errorf("The network policy should allow the source ranges")
+	}
+
+	for _, parameters := range []map[string]interface{}{
+		{"expose_source_ranges": "0.0.0.0/0"},
+		{"expose": "NodePort"},
+		{"expose": "Ingress"},
+	} {
+		options.Parameters = parameters
+		if err := mysql.ValidateProvision(options); err == nil {
+			t.Errorf("The parameters '%v' should not expose the instance outside of the plan ranges", parameters)
+		}
+	}
+}
+
+func TestMinioIngress(t *testing.T) {
+	config := InstanceConfig{
+		Plans: []PlanConfig{
+			{
+				Name:    "default",
+				ID:      "ingress-plan",
+				Storage: "2Gi",
+				Expose: ExposureConfig{
+					Type:      ExposeIngress,
+					Host:      "%s.s3.example.com",
+					TLSSecret: "s3-tls",
+				},
+			},
+		},
+	}
+
+	client := fake.NewSimpleClientset()
+	minio := NewMinioInstance(config, client)
+	spec := minio.GetProvisionSpec(ServiceOptions{ID: "test-id", Namespace: "test-ns", PlanID: "ingress-plan"})
+
+	if len(spec.Ingresses) != 1 || spec.Ingresses[0].Spec.Rules[0].Host != "test-id.s3.example.com" {
+		t.Fatalf("Invalid ingresses '%v'", spec.Ingresses)
+	}
+
+	if spec.Services[0].Spec.Type != coreV1.ServiceTypeClusterIP {
+		t.Errorf("The service behind the ingress should be a cluster ip")
+	}
+
+	if err := spec.Create(client); err != nil {
+		t.Fatal(err)
+	}
+
+	binding := minio.GetBindSpec(BindOptions{ID: "binding-id", InstanceID: "test-id", Namespace: "test-ns", PlanID: "ingress-plan"}).Secrets[0]
+	if string(binding.Data["host"]) != "test-id.s3.example.com" || string(binding.Data["endpoint"]) != "https://test-id.s3.example.com:443" {
+		t.Errorf("The binding should use the ingress host, got '%s' '%s'", binding.Data["host"], binding.Data["endpoint"])
+	}
+
+	if alias := string(spec.Secrets[0].Data["minioalias"]); alias[:7] != "http://" {
+		t.Errorf("The admin alias should use the cluster host, got '%s'", alias)
+	}
+}
+
+func TestNodePortAddress(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	config := InstanceConfig{
+		Plans: []PlanConfig{
+			{Name: "default", ID: "node-port-plan", Storage: "2Gi", Expose: ExposureConfig{Type: ExposeNodePort}},
+		},
+	}
+
+	service := NewMysqlInstance(config, nil).GetProvisionSpec(ServiceOptions{
+		ID:        "test-id",
+		Namespace: "test-ns",
+		PlanID:    "node-port-plan",
+	}).Services[0]
+
+	service.Namespace = "test-ns"
+	service.Annotations = map[string]string{exposedHostAnnotation: "nodes.example.com"}
+	service.Spec.Ports[0].NodePort = 31306
+	client.Tracker().Add(&service)
+
+	address := getExposedAddress(client, "test-ns", "mysql-instance-test-id", "mysql-instance-test-id.test-ns.svc.cluster.local", 3306)
+	if address.Host != "nodes.example.com" || address.Port != 31306 {
+		t.Errorf("Invalid node port address '%v'", address)
+	}
+}
@@ -0,0 +1,303 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+
+	"github.com/AdeAttwood/service-broker/pkg/kube"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The config of a service where the instances and bindings are created by an
+// external backend over http
+type ExternalConfig struct {
+	Name        string `yaml:"name"`
+	ID          string `yaml:"id"`
+	Description string `yaml:"description"`
+	Bindable    bool   `yaml:"bindable"`
+	// The base url of the backend, the instance and binding paths are added to
+	// this e.g. "https://dns-backend.example.com/v1"
+	URL string `yaml:"url"`
+	// The bearer token that is sent to the backend with every request
+	Token string       `yaml:"token"`
+	Plans []PlanConfig `yaml:"plans"`
+}
+
+// The body that is sent to the backend when an instance is created
+type externalInstanceRequest struct {
+	ServiceID  string                 `json:"service_id"`
+	PlanID     string                 `json:"plan_id"`
+	Namespace  string                 `json:"namespace"`
+	Parameters map[string]interface{} `json:"parameters"`
+}
+
+// The body the backend returns when the state of an instance is requested
+type externalInstanceResponse struct {
+	State       osb.LastOperationState `json:"state"`
+	Description string                 `json:"description"`
+}
+
+// The body that is sent to the backend when a binding is created
+type externalBindingRequest struct {
+	ServiceID          string                 `json:"service_id"`
+	PlanID             string                 `json:"plan_id"`
+	Namespace          string                 `json:"namespace"`
+	Parameters         map[string]interface{} `json:"parameters"`
+	InstanceParameters map[string]interface{} `json:"instance_parameters"`
+}
+
+// The body the backend returns when a binding is created
+type externalBindingResponse struct {
+	Credentials map[string]string `json:"credentials"`
+}
+
+func NewExternalService(config ExternalConfig) (*ExternalService, error) {
+	if config.Name == "" || config.ID == "" || config.URL == "" {
+		return nil, fmt.Errorf("External services must have a name, id and url")
+	}
+
+	if len(config.Plans) == 0 {
+		return nil, fmt.Errorf("The external service '%s' must have at least one plan", config.Name)
+	}
+
+	for _, plan := range config.Plans {
+		if err := plan.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	return &ExternalService{
+		config: config,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// A service that forwards the instances and bindings to an external backend.
+// The backend can create instances asynchronously by returning "202 Accepted",
+// the state is then polled by the platform through the last operation
+// endpoint
+type ExternalService struct {
+	config ExternalConfig
+	client *http.Client
+}
+
+var _ InstanceManager = &ExternalService{}
+var _ BindingManager = &ExternalService{}
+var _ OperationReporter = &ExternalService{}
+
+func (s *ExternalService) Definition() osb.Service {
+	return osb.Service{
+		Name:                s.config.Name,
+		ID:                  s.config.ID,
+		Description:         s.config.Description,
+		Bindable:            s.config.Bindable,
+		BindingsRetrievable: s.config.Bindable,
+		Metadata: map[string]interface{}{
+			"displayName": s.config.Name,
+		},
+		Plans: planDefinitions(s.config.Plans),
+	}
+}
+
+// The instances are not in the cluster so the host is the backend
+func (s *ExternalService) GetHost(instanceID string, namespace string) string {
+	backend, err := url.Parse(s.config.URL)
+	if err != nil {
+		return s.config.URL
+	}
+
+	return backend.Host
+}
+
+func externalInstancePath(instanceID string) string {
+	return fmt.Sprintf("/instances/%s", url.PathEscape(instanceID))
+}
+
+func externalBindingPath(instanceID string, bindingID string) string {
+	return fmt.Sprintf("%s/bindings/%s", externalInstancePath(instanceID), url.PathEscape(bindingID))
+}
+
+// Sends a request to the backend and decodes the response into result. The
+// status code is returned so the callers can handle the statuses that are not
+// errors for them
+func (s *ExternalService) request(method string, path string, body interface{}, result interface{}) (int, error) {
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			return 0, err
+		}
+	}
+
+	req, err := http.NewRequest(method, s.config.URL+path, &payload)
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if s.config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.config.Token)
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return res.StatusCode, fmt.Errorf("%s %s returned %s", method, path, res.Status)
+	}
+
+	if result != nil && res.StatusCode != http.StatusNoContent {
+		if err := json.NewDecoder(res.Body).Decode(result); err != nil {
+			return res.StatusCode, fmt.Errorf("Invalid response from %s %s: %v", method, path, err)
+		}
+	}
+
+	return res.StatusCode, nil
+}
+
+func (s *ExternalService) CreateInstance(options ServiceOptions) error {
+	_, err := s.request(http.MethodPut, externalInstancePath(options.ID), externalInstanceRequest{
+		ServiceID:  s.config.ID,
+		PlanID:     options.PlanID,
+		Namespace:  options.Namespace,
+		Parameters: options.Parameters,
+	}, nil)
+
+	return err
+}
+
+// Deletes the instance from the backend, an instance that has already been
+// removed is not an error
+func (s *ExternalService) DeleteInstance(options ServiceOptions) error {
+	status, err := s.request(http.MethodDelete, externalInstancePath(options.ID), nil, nil)
+	if status == http.StatusNotFound || status == http.StatusGone {
+		return nil
+	}
+
+	return err
+}
+
+// Gets the state of an instance from the backend. When the instance is not
+// found a provision has failed and a deprovision has succeeded
+func (s *ExternalService) LastOperation(options ServiceOptions, operation osb.OperationKey) (*osb.LastOperationResponse, error) {
+	instance := externalInstanceResponse{}
+	status, err := s.request(http.MethodGet, externalInstancePath(options.ID), nil, &instance)
+	if status == http.StatusNotFound || status == http.StatusGone {
+		if operation == DeprovisionOperation {
+			return &osb.LastOperationResponse{State: osb.StateSucceeded}, nil
+		}
+
+		return &osb.LastOperationResponse{State: osb.StateFailed}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Deprovisioned instances can still be returned while they are being
+	// removed
+	if operation == DeprovisionOperation && instance.State == osb.StateSucceeded {
+		instance.State = osb.StateInProgress
+	}
+
+	response := &osb.LastOperationResponse{State: instance.State}
+	if instance.Description != "" {
+		response.Description = &instance.Description
+	}
+
+	return response, nil
+}
+
+// Creates the binding in the backend, the credentials it returns are stored
+// in the binding secret
+func (s *ExternalService) CreateBinding(options BindOptions, credentials map[string][]byte) error {
+	binding := externalBindingResponse{}
+	_, err := s.request(http.MethodPut, externalBindingPath(options.InstanceID, options.ID), externalBindingRequest{
+		ServiceID:          s.config.ID,
+		PlanID:             options.PlanID,
+		Namespace:          options.Namespace,
+		Parameters:         options.Parameters,
+		InstanceParameters: options.InstanceParameters,
+	}, &binding)
+	if err != nil {
+		return err
+	}
+
+	for key, value := range binding.Credentials {
+		credentials[key] = []byte(value)
+	}
+
+	return nil
+}
+
+func (s *ExternalService) DeleteBinding(options BindOptions) error {
+	status, err := s.request(http.MethodDelete, externalBindingPath(options.InstanceID, options.ID), nil, nil)
+	if status == http.StatusNotFound || status == http.StatusGone {
+		return nil
+	}
+
+	return err
+}
+
+func (s *ExternalService) GetBindSpec(options BindOptions) *kube.Spec {
+	return &kube.Spec{
+		Namespace: options.Namespace,
+		Lables: map[string]string{
+			"service-binding-id":  options.ID,
+			"service-instance-id": options.InstanceID,
+			"service-id":          s.Definition().ID,
+			"service-name":        s.Definition().Name,
+		},
+		Secrets: []coreV1.Secret{
+			{
+				ObjectMeta: metaV1.ObjectMeta{
+					Name: fmt.Sprintf("binding-secret-%s", options.ID),
+				},
+				Type: "Opaque",
+				Data: map[string][]byte{},
+			},
+		},
+	}
+}
+
+func (s *ExternalService) GetDebindSpec(options BindOptions) *kube.Spec {
+	return &kube.Spec{Namespace: options.Namespace}
+}
+
+func (s *ExternalService) GetDeprovisionSpec(options ServiceOptions) *kube.Spec {
+	return &kube.Spec{Namespace: options.Namespace}
+}
+
+// The provision spec only holds a secret to keep track of the instance
+func (s *ExternalService) GetProvisionSpec(options ServiceOptions) *kube.Spec {
+	return &kube.Spec{
+		Namespace: options.Namespace,
+		Lables: map[string]string{
+			"service-instance-id": options.ID,
+			"service-id":          s.Definition().ID,
+			"service-name":        s.Definition().Name,
+			"service-plan":        options.PlanID,
+		},
+		Secrets: []coreV1.Secret{
+			{
+				ObjectMeta: metaV1.ObjectMeta{
+					Name: fmt.Sprintf("instance-%s-broker", options.ID),
+				},
+				Type: "Opaque",
+				Data: map[string][]byte{
+					"backend": []byte(s.config.URL),
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,121 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+// A backend that keeps the instances in memory. Instances are created
+// asynchronously and stay "in progress" until they are marked as ready
+type externalStubBackend struct {
+	sync.Mutex
+	instances map[string]string
+	bindings  map[string]bool
+}
+
+func (b *externalStubBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.Lock()
+	defer b.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer test-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/instances/"), "/bindings/")
+	instanceID := parts[0]
+	if _, ok := b.instances[instanceID]; !ok && r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if len(parts) == 2 {
+		switch r.Method {
+		case http.MethodPut:
+			b.bindings[parts[1]] = true
+			json.NewEncoder(w).Encode(externalBindingResponse{
+				Credentials: map[string]string{"token": "token-" + parts[1]},
+			})
+		case http.MethodDelete:
+			delete(b.bindings, parts[1])
+		}
+
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		b.instances[instanceID] = string(osb.StateInProgress)
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(map[string]string{"state": b.instances[instanceID]})
+	case http.MethodDelete:
+		delete(b.instances, instanceID)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestExternalServiceInstance(t *testing.T) {
+	backend := &externalStubBackend{instances: map[string]string{}, bindings: map[string]bool{}}
+	server := httptest.NewServer(backend)
+	defer server.Close()
+
+	external, err := NewExternalService(ExternalConfig{
+		Name:     "dns",
+		ID:       "external-service-id",
+		Bindable: true,
+		URL:      server.URL,
+		Token:    "test-token",
+		Plans:    []PlanConfig{{Name: "default", ID: "default-id"}},
+	})
+	if err != nil {
+		t.Fatalf("Unable to create the external service: %v", err)
+	}
+
+	options := ServiceOptions{ID: "test-id", PlanID: "default-id", Namespace: "test"}
+	if err := external.CreateInstance(options); err != nil {
+		t.Fatalf("Unable to create the instance: %v", err)
+	}
+
+	state, err := external.LastOperation(options, ProvisionOperation)
+	if err != nil || state.State != osb.StateInProgress {
+		t.Errorf("The instance should be in progress: %v", err)
+	}
+
+	backend.instances["test-id"] = string(osb.StateSucceeded)
+	if state, _ := external.LastOperation(options, ProvisionOperation); state.State != osb.StateSucceeded {
+		t.Errorf("The instance should have succeeded not '%s'", state.State)
+	}
+
+	bindOptions := BindOptions{ID: "binding-id", InstanceID: "test-id", Namespace: "test"}
+	credentials := external.GetBindSpec(bindOptions).Secrets[0].Data
+	if err := external.CreateBinding(bindOptions, credentials); err != nil {
+		t.Fatalf("Unable to create the binding: %v", err)
+	}
+
+	if string(credentials["token"]) != "token-binding-id" {
+		t.Errorf("Invalid token '%s'", credentials["token"])
+	}
+
+	if err := external.DeleteBinding(bindOptions); err != nil || len(backend.bindings) != 0 {
+		t.Errorf("Unable to delete the binding: %v", err)
+	}
+
+	if err := external.DeleteInstance(options); err != nil {
+		t.Fatalf("Unable to delete the instance: %v", err)
+	}
+
+	if state, _ := external.LastOperation(options, DeprovisionOperation); state.State != osb.StateSucceeded {
+		t.Errorf("The deprovision should have succeeded not '%s'", state.State)
+	}
+
+	if err := external.DeleteInstance(options); err != nil {
+		t.Errorf("Deleting an instance that has already been removed should not fail: %v", err)
+	}
+}
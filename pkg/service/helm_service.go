@@ -0,0 +1,430 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/golang/glog"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/storage/driver"
+
+	"github.com/AdeAttwood/service-broker/pkg/kube"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+	"k8s.io/client-go/kubernetes"
+)
+
+// The config of a service that installs a helm chart for each instance
+type HelmConfig struct {
+	Name        string `yaml:"name"`
+	ID          string `yaml:"id"`
+	Description string `yaml:"description"`
+	// The chart to install, this can be the path to a local chart or the name
+	// of a chart in the repository
+	Chart      string `yaml:"chart"`
+	Repository string `yaml:"repository"`
+	Version    string `yaml:"version"`
+	// The values that are passed to every release of the chart
+	Values map[string]interface{} `yaml:"values"`
+	Plans  []HelmPlanConfig       `yaml:"plans"`
+	// The values that can be set with the provision parameters e.g.
+	// "replicas" or "master.persistence", a value allows all of the values
+	// under it. No values can be set by the parameters when this is empty
+	Parameters []string `yaml:"parameters"`
+	// The credentials that are returned when an instance is bound to
+	Credentials map[string]HelmCredential `yaml:"credentials"`
+}
+
+// A plan of a helm service, the plan values are merged over the service
+// values
+type HelmPlanConfig struct {
+	Name        string                 `yaml:"name"`
+	ID          string                 `yaml:"id"`
+	Description string                 `yaml:"description"`
+	Free        *bool                  `yaml:"free"`
+	Values      map[string]interface{} `yaml:"values"`
+}
+
+// A credential of a binding. This is either a value or the key of a secret
+// that was created by the release. The value and the secret name are go
+// templates that get the "Release", "Namespace" and "InstanceID"
+type HelmCredential struct {
+	Value  string `yaml:"value"`
+	Secret string `yaml:"secret"`
+	Key    string `yaml:"key"`
+}
+
+// Creates the helm action config to manage the releases in a namespace
+type HelmActionConfig func(namespace string) (*action.Configuration, error)
+
+// Gets the helm action config that uses the same kube config as the broker,
+// an empty path will use the in cluster config
+func NewHelmActionConfig(kubeConfigPath string) HelmActionConfig {
+	return func(namespace string) (*action.Configuration, error) {
+		flags := genericclioptions.NewConfigFlags(false)
+		flags.Namespace = &namespace
+		if kubeConfigPath != "" {
+			flags.KubeConfig = &kubeConfigPath
+		}
+
+		config := &action.Configuration{}
+		if err := config.Init(flags, namespace, "secret", glog.Infof); err != nil {
+			return nil, err
+		}
+
+		return config, nil
+	}
+}
+
+func NewHelmService(config HelmConfig, client kubernetes.Interface, actionConfig HelmActionConfig) (*HelmService, error) {
+	if config.Name == "" || config.ID == "" || config.Chart == "" {
+		return nil, fmt.Errorf("Helm services must have a name, id and chart")
+	}
+
+	if len(config.Plans) == 0 {
+		return nil, fmt.Errorf("The helm service '%s' must have at least one plan", config.Name)
+	}
+
+	chartPath, err := (&action.ChartPathOptions{
+		RepoURL: config.Repository,
+		Version: config.Version,
+	}).LocateChart(config.Chart, cli.New())
+	if err != nil {
+		return nil, err
+	}
+
+	helmChart, err := loader.Load(chartPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Version != "" && helmChart.Metadata.Version != config.Version {
+		return nil, fmt.Errorf("The chart '%s' is version '%s' not '%s'", config.Chart, helmChart.Metadata.Version, config.Version)
+	}
+
+	credentials := map[string]helmCredentialTemplates{}
+	for name, credential := range config.Credentials {
+		templates := helmCredentialTemplates{key: credential.Key}
+		if templates.value, err = template.New(name).Parse(credential.Value); err != nil {
+			return nil, err
+		}
+
+		if templates.secret, err = template.New(name).Parse(credential.Secret); err != nil {
+			return nil, err
+		}
+
+		credentials[name] = templates
+	}
+
+	return &HelmService{
+		config:       config,
+		chart:        helmChart,
+		credentials:  credentials,
+		client:       client,
+		actionConfig: actionConfig,
+	}, nil
+}
+
+// A service that installs a helm chart into the instance namespace. The
+// release is managed with the helm sdk so the provision spec only holds a
+// secret to keep track of the instance
+type HelmService struct {
+	config       HelmConfig
+	chart        *chart.Chart
+	credentials  map[string]helmCredentialTemplates
+	client       kubernetes.Interface
+	actionConfig HelmActionConfig
+}
+
+var _ InstanceManager = &HelmService{}
+var _ ProvisionValidator = &HelmService{}
+var _ BindingManager = &HelmService{}
+
+type helmCredentialTemplates struct {
+	value  *template.Template
+	secret *template.Template
+	key    string
+}
+
+// The data that is passed into the credential templates
+type helmTemplateData struct {
+	Release    string
+	Namespace  string
+	InstanceID string
+}
+
+func (s *HelmService) Definition() osb.Service {
+	plans := make([]osb.Plan, 0, len(s.config.Plans))
+	for _, plan := range s.config.Plans {
+		free := plan.Free
+		if free == nil {
+			free = truePtr()
+		}
+
+		plans = append(plans, osb.Plan{
+			Name:        plan.Name,
+			ID:          plan.ID,
+			Description: plan.Description,
+			Free:        free,
+		})
+	}
+
+	return osb.Service{
+		Name:                s.config.Name,
+		ID:                  s.config.ID,
+		Description:         s.config.Description,
+		Bindable:            len(s.config.Credentials) > 0,
+		BindingsRetrievable: len(s.config.Credentials) > 0,
+		Metadata: map[string]interface{}{
+			"displayName":  s.config.Name,
+			"chart":        s.chart.Metadata.Name,
+			"chartVersion": s.chart.Metadata.Version,
+		},
+		Plans: plans,
+	}
+}
+
+// Gets the name of the helm release of an instance
+func helmReleaseName(instanceID string) string {
+	return fmt.Sprintf("instance-%s", instanceID)
+}
+
+func (s *HelmService) GetHost(instanceID string, namespace string) string {
+	return fmt.Sprintf("%s.%s.svc.cluster.local", helmReleaseName(instanceID), namespace)
+}
+
+// Gets the values to install the chart with. The plan values are merged over
+// the service values and the allowed provision parameters are merged over both
+func (s *HelmService) values(options ServiceOptions) map[string]interface{} {
+	values := helmStringKeys(s.config.Values).(map[string]interface{})
+	for _, plan := range s.config.Plans {
+		if plan.ID == options.PlanID {
+			values = chartutil.CoalesceTables(helmStringKeys(plan.Values).(map[string]interface{}), values)
+		}
+	}
+
+	parameters, _ := helmAllowedValues(helmStringKeys(options.Parameters).(map[string]interface{}), s.config.Parameters, "")
+	return chartutil.CoalesceTables(parameters, values)
+}
+
+// The parameters can only set the values the config allows, anything else
+// could change the resources of the release e.g. the image or the security
+// context
+func (s *HelmService) ValidateProvision(options ServiceOptions) error {
+	_, rejected := helmAllowedValues(helmStringKeys(options.Parameters).(map[string]interface{}), s.config.Parameters, "")
+	if len(rejected) > 0 {
+		sort.Strings(rejected)
+		return fmt.Errorf("The parameters '%s' can't be set", strings.Join(rejected, "', '"))
+	}
+
+	return nil
+}
+
+// Gets the values that are in the allowed paths and the paths of the values
+// that are not
+func helmAllowedValues(values map[string]interface{}, allowed []string, prefix string) (map[string]interface{}, []string) {
+	result := map[string]interface{}{}
+	rejected := []string{}
+
+	for key, value := range values {
+		path := prefix + key
+
+		allowedPath, allowedChild := false, false
+		for _, allow := range allowed {
+			allowedPath = allowedPath || allow == path
+			allowedChild = allowedChild || strings.HasPrefix(allow, path+".")
+		}
+
+		child, isMap := value.(map[string]interface{})
+		switch {
+		case allowedPath:
+			result[key] = value
+		case allowedChild && isMap:
+			childValues, childRejected := helmAllowedValues(child, allowed, path+".")
+			if len(childValues) > 0 {
+				result[key] = childValues
+			}
+
+			rejected = append(rejected, childRejected...)
+		default:
+			rejected = append(rejected, path)
+		}
+	}
+
+	return result, rejected
+}
+
+// Helper function to convert the maps that are decoded from the yaml config
+// into maps with string keys that can be used as helm values
+func helmStringKeys(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		result := map[string]interface{}{}
+		for key, item := range v {
+			result[fmt.Sprintf("%v", key)] = helmStringKeys(item)
+		}
+		return result
+	case map[string]interface{}:
+		result := map[string]interface{}{}
+		for key, item := range v {
+			result[key] = helmStringKeys(item)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			result[i] = helmStringKeys(item)
+		}
+		return result
+	case nil:
+		return map[string]interface{}{}
+	}
+
+	return value
+}
+
+// Installs the release of an instance and waits for its resources to be ready
+func (s *HelmService) CreateInstance(options ServiceOptions) error {
+	config, err := s.actionConfig(options.Namespace)
+	if err != nil {
+		return err
+	}
+
+	install := action.NewInstall(config)
+	install.ReleaseName = helmReleaseName(options.ID)
+	install.Namespace = options.Namespace
+	install.Wait = true
+	install.Timeout = 5 * time.Minute
+
+	_, err = install.Run(s.chart, s.values(options))
+	return err
+}
+
+// Uninstalls the release of an instance. If the release has already been
+// removed there is nothing to do
+func (s *HelmService) DeleteInstance(options ServiceOptions) error {
+	config, err := s.actionConfig(options.Namespace)
+	if err != nil {
+		return err
+	}
+
+	_, err = action.NewUninstall(config).Run(helmReleaseName(options.ID))
+	if errors.Is(err, driver.ErrReleaseNotFound) {
+		return nil
+	}
+
+	return err
+}
+
+// Reads the credentials of a binding from the config. The credentials are
+// added to the binding secret, the secrets of the release are read from the
+// instance namespace as the binding can be in another namespace
+func (s *HelmService) CreateBinding(options BindOptions, credentials map[string][]byte) error {
+	data := helmTemplateData{
+		Release:    helmReleaseName(options.InstanceID),
+		Namespace:  options.InstanceNamespace(),
+		InstanceID: options.InstanceID,
+	}
+
+	for name, templates := range s.credentials {
+		var value bytes.Buffer
+		if err := templates.value.Execute(&value, data); err != nil {
+			return err
+		}
+
+		var secretName bytes.Buffer
+		if err := templates.secret.Execute(&secretName, data); err != nil {
+			return err
+		}
+
+		if secretName.Len() == 0 {
+			credentials[name] = value.Bytes()
+			continue
+		}
+
+		secret, err := s.client.CoreV1().Secrets(data.Namespace).Get(context.TODO(), secretName.String(), metaV1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		secretValue, ok := secret.Data[templates.key]
+		if !ok {
+			return fmt.Errorf("The secret '%s' has no key '%s'", secretName.String(), templates.key)
+		}
+
+		credentials[name] = secretValue
+	}
+
+	return nil
+}
+
+// The credentials come from the release so there is nothing to remove
+func (s *HelmService) DeleteBinding(options BindOptions) error {
+	return nil
+}
+
+func (s *HelmService) GetBindSpec(options BindOptions) *kube.Spec {
+	return &kube.Spec{
+		Namespace: options.Namespace,
+		Lables: map[string]string{
+			"service-binding-id":  options.ID,
+			"service-instance-id": options.InstanceID,
+			"service-id":          s.Definition().ID,
+			"service-name":        s.Definition().Name,
+		},
+		Secrets: []coreV1.Secret{
+			{
+				ObjectMeta: metaV1.ObjectMeta{
+					Name: fmt.Sprintf("binding-secret-%s", options.ID),
+				},
+				Type: "Opaque",
+				Data: map[string][]byte{},
+			},
+		},
+	}
+}
+
+func (s *HelmService) GetDebindSpec(options BindOptions) *kube.Spec {
+	return &kube.Spec{Namespace: options.Namespace}
+}
+
+func (s *HelmService) GetDeprovisionSpec(options ServiceOptions) *kube.Spec {
+	return &kube.Spec{Namespace: options.Namespace}
+}
+
+func (s *HelmService) GetProvisionSpec(options ServiceOptions) *kube.Spec {
+	return &kube.Spec{
+		Namespace: options.Namespace,
+		Lables: map[string]string{
+			"service-instance-id": options.ID,
+			"service-id":          s.Definition().ID,
+			"service-name":        s.Definition().Name,
+			"service-plan":        options.PlanID,
+		},
+		Secrets: []coreV1.Secret{
+			{
+				ObjectMeta: metaV1.ObjectMeta{
+					Name: fmt.Sprintf("%s-broker", helmReleaseName(options.ID)),
+				},
+				Type: "Opaque",
+				Data: map[string][]byte{
+					"release": []byte(helmReleaseName(options.ID)),
+					"chart":   []byte(fmt.Sprintf("%s-%s", s.chart.Metadata.Name, s.chart.Metadata.Version)),
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,135 @@
+package service
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chartutil"
+	kubefake "helm.sh/helm/v3/pkg/kube/fake"
+	"helm.sh/helm/v3/pkg/storage"
+	"helm.sh/helm/v3/pkg/storage/driver"
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var helmTestConfig = HelmConfig{
+	Name:       "test-chart",
+	ID:         "helm-service-id",
+	Chart:      "testdata/test-chart",
+	Values:     map[string]interface{}{"password": "service-password"},
+	Parameters: []string{"password"},
+	Plans: []HelmPlanConfig{
+		{Name: "small", ID: "small-id"},
+		{Name: "large", ID: "large-id", Values: map[string]interface{}{"replicas": 3}},
+	},
+	Credentials: map[string]HelmCredential{
+		"host":     {Value: "{{ .Release }}.{{ .Namespace }}.svc.cluster.local"},
+		"password": {Secret: "{{ .Release }}", Key: "password"},
+	},
+}
+
+// Gets an action config that stores the releases in memory and doesn't talk
+// to a cluster
+func helmMemoryConfig() HelmActionConfig {
+	config := &action.Configuration{
+		Releases:     storage.Init(driver.NewMemory()),
+		KubeClient:   &kubefake.PrintingKubeClient{Out: ioutil.Discard},
+		Capabilities: chartutil.DefaultCapabilities,
+		Log:          func(format string, v ...interface{}) {},
+	}
+
+	return func(namespace string) (*action.Configuration, error) {
+		return config, nil
+	}
+}
+
+func TestHelmServiceInstance(t *testing.T) {
+	actionConfig := helmMemoryConfig()
+	helm, err := NewHelmService(helmTestConfig, fake.NewSimpleClientset(), actionConfig)
+	if err != nil {
+		t.Fatalf("Unable to create the helm service: %v", err)
+	}
+
+	if len(helm.Definition().Plans) != 2 {
+		t.Errorf("Invalid number of plans '%d'", len(helm.Definition().Plans))
+	}
+
+	options := ServiceOptions{
+		ID:         "test-id",
+		PlanID:     "large-id",
+		Namespace:  "test",
+		Parameters: map[string]interface{}{"password": "parameter-password"},
+	}
+
+	if err := helm.ValidateProvision(options); err != nil {
+		t.Fatalf("The allowed parameters should be valid, got '%v'", err)
+	}
+
+	if err := helm.CreateInstance(options); err != nil {
+		t.Fatalf("Unable to install the release: %v", err)
+	}
+
+	config, _ := actionConfig("test")
+	release, err := action.NewGet(config).Run("instance-test-id")
+	if err != nil {
+		t.Fatalf("Unable to get the release: %v", err)
+	}
+
+	if release.Config["replicas"] != 3 || release.Config["password"] != "parameter-password" {
+		t.Errorf("Invalid release values '%v'", release.Config)
+	}
+
+	if err := helm.DeleteInstance(options); err != nil {
+		t.Fatalf("Unable to uninstall the release: %v", err)
+	}
+
+	options.Parameters = map[string]interface{}{"replicas": 10, "image": map[string]interface{}{"repository": "evil"}}
+	if err := helm.ValidateProvision(options); err == nil {
+		t.Errorf("Parameters that are not allowed should not be valid")
+	}
+
+	if values := helm.values(options); values["replicas"] != 3 || values["image"] != nil {
+		t.Errorf("Only the allowed parameters should be merged, got '%v'", values)
+	}
+
+	if err := helm.DeleteInstance(options); err != nil {
+		t.Errorf("Deleting a release that has already been removed should not fail: %v", err)
+	}
+}
+
+func TestHelmServiceBinding(t *testing.T) {
+	client := fake.NewSimpleClientset(&coreV1.Secret{
+		ObjectMeta: metaV1.ObjectMeta{Name: "instance-test-id", Namespace: "test"},
+		Data:       map[string][]byte{"password": []byte("release-password")},
+	})
+
+	helm, err := NewHelmService(helmTestConfig, client, helmMemoryConfig())
+	if err != nil {
+		t.Fatalf("Unable to create the helm service: %v", err)
+	}
+
+	instance := helm.GetProvisionSpec(ServiceOptions{ID: "test-id", Namespace: "test"}).Secrets[0]
+	instance.Namespace = "test"
+
+	options := BindOptions{ID: "binding-id", InstanceID: "test-id", Namespace: "app", InstanceSecrets: []coreV1.Secret{instance}}
+	credentials := helm.GetBindSpec(options).Secrets[0].Data
+	if err := helm.CreateBinding(options, credentials); err != nil {
+		t.Fatalf("Unable to create the binding: %v", err)
+	}
+
+	if string(credentials["host"]) != "instance-test-id.test.svc.cluster.local" {
+		t.Errorf("Invalid host '%s'", credentials["host"])
+	}
+
+	if string(credentials["password"]) != "release-password" {
+		t.Errorf("Invalid password '%s'", credentials["password"])
+	}
+
+	config := helmTestConfig
+	config.Version = "1.0.0"
+	if _, err := NewHelmService(config, client, helmMemoryConfig()); err == nil {
+		t.Errorf("Charts with a different version should not be valid")
+	}
+}
@@ -2,7 +2,10 @@ package service
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 
+	"github.com/golang/glog"
 	osb "github.com/pmorie/go-open-service-broker-client/v2"
 
 	"github.com/AdeAttwood/service-broker/pkg/kube"
@@ -10,49 +13,121 @@ import (
 	appsV1 "k8s.io/api/apps/v1"
 	batchV1 "k8s.io/api/batch/v1"
 	coreV1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/api/resource"
 	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
 )
 
-func NewMinioInstance() *MinioInstance {
-	return &MinioInstance{}
+// The plan that is used when no plans have been configured for the minio
+// instance
+var minioDefaultPlan = PlanConfig{
+	Name:        "default",
+	ID:          "2f931eba-c3cc-4d41-8702-e63cd5ee9a5c",
+	Description: "The default plan",
+	Storage:     "2Gi",
 }
 
-type MinioInstance struct{}
+func NewMinioInstance(config InstanceConfig, client kubernetes.Interface) *MinioInstance {
+	return &MinioInstance{
+		plans:       config.plans(minioDefaultPlan),
+		credentials: config.Credentials,
+		tls:         config.TLS,
+		client:      client,
+	}
+}
+
+type MinioInstance struct {
+	plans       []PlanConfig
+	credentials CredentialPolicy
+	tls         TLSConfig
+	// The client is used to read the address of the instances from their
+	// services and ingresses
+	client kubernetes.Interface
+}
 
 // Get the service definition of the minio instance
 func (s *MinioInstance) Definition() osb.Service {
 	return osb.Service{
-		Name:        "minio-instance",
-		ID:          "2a661d27-20a0-40f1-9320-15ea144a694c",
-		Description: "A minio instance deployment",
-		Bindable:    true,
+		Name:                "minio-instance",
+		ID:                  "2a661d27-20a0-40f1-9320-15ea144a694c",
+		Description:         "A minio instance deployment",
+		Bindable:            true,
+		BindingsRetrievable: true,
 		Metadata: map[string]interface{}{
 			"displayName": "Minio Instance",
 			"imageUrl":    "htps://avatars2.githubusercontent.com/u/19862012?s=200&v=4",
 		},
-		Plans: []osb.Plan{
-			{
-				Name:        "default",
-				ID:          "2f931eba-c3cc-4d41-8702-e63cd5ee9a5c",
-				Description: "The default plan",
-				Free:        truePtr(),
-			},
-		},
+		Plans: planDefinitions(s.plans),
 	}
 }
 
+// Gets the host the clients connect to, this depends on how the instance is
+// exposed
 func (s *MinioInstance) GetHost(instanceID string, namespace string) string {
+	return s.address(instanceID, namespace).Host
+}
+
+// Gets the address of the instance the clients connect to
+func (s *MinioInstance) address(instanceID string, namespace string) exposedAddress {
+	name := fmt.Sprintf("minio-instance-%s", instanceID)
+	address := getExposedAddress(s.client, namespace, name, s.serviceHost(instanceID, namespace), 9000)
+
+	// The clients connect to the server with https when it has a certificate
+	tls := instanceTLSData(s.client, nil, namespace, minioTLSSecretName(instanceID))
+	if !address.Ingress && len(tls["tls.crt"]) > 0 {
+		address.TLS = true
+	}
+
+	return address
+}
+
+// Gets the cluster host of the instance service, the admin alias the jobs use
+// always connects with this
+func (s *MinioInstance) serviceHost(instanceID string, namespace string) string {
 	return fmt.Sprintf("minio-instance-%s.%s.svc.cluster.local", instanceID, namespace)
 }
 
+// Gets the url of the minio api at an address
+func minioEndpoint(address exposedAddress) string {
+	scheme := "http"
+	if address.TLS {
+		scheme = "https"
+	}
+
+	return fmt.Sprintf("%s://%s:%d", scheme, address.Host, address.Port)
+}
+
+// Gets an mc alias that connects to the minio api at an endpoint with a user
+func minioAlias(endpoint string, user string, password string) string {
+	parts := strings.SplitN(endpoint, "://", 2)
+	return fmt.Sprintf("%s://%s:%s@%s", parts[0], user, password, parts[1])
+}
+
+func (s *MinioInstance) ValidateProvision(options ServiceOptions) error {
+	plan := findPlan(s.plans, options.PlanID)
+	if err := validateExposureParameters(plan, options.Parameters); err != nil {
+		return err
+	}
+
+	if err := instanceExposure(plan, options.Parameters).Validate(); err != nil {
+		return err
+	}
+
+	if s.tls.Provider == TLSProviderBroker {
+		if _, err := ensureCA(s.client, options.GlobalNamespace, s.tls.caSecret()); err != nil {
+			return fmt.Errorf("Unable to get the broker ca: %s", err.Error())
+		}
+	}
+
+	return nil
+}
+
 func (s *MinioInstance) GetDebindSpec(options BindOptions) *kube.Spec {
 	deploymentName := fmt.Sprintf("minio-instance-%s", options.InstanceID)
 	adminSecretName := fmt.Sprintf("%s-admin-secret", deploymentName)
 	bindingSecretName := fmt.Sprintf("binding-secret-%s", options.ID)
 
-	return &kube.Spec{
+	spec := &kube.Spec{
 		Namespace: options.Namespace,
 		Lables: map[string]string{
 			"service-binding-id":  options.ID,
@@ -108,18 +183,23 @@ func (s *MinioInstance) GetDebindSpec(options BindOptions) *kube.Spec {
 			},
 		},
 	}
+
+	mountMinioCA(&spec.Jobs[0].Spec.Template.Spec, options.InstanceID)
+
+	return spec
 }
 
 func (s *MinioInstance) GetBindSpec(options BindOptions) *kube.Spec {
-	deploymentHost := s.GetHost(options.InstanceID, options.Namespace)
+	address := s.address(options.InstanceID, options.Namespace)
+	endpoint := minioEndpoint(address)
 	deploymentName := fmt.Sprintf("minio-instance-%s", options.InstanceID)
 	adminSecretName := fmt.Sprintf("%s-admin-secret", deploymentName)
 	bindingSecretName := fmt.Sprintf("binding-secret-%s", options.ID)
 
 	user := fmt.Sprintf("minio-%s", options.ID)
-	password := kube.RandStringBytes(32)
+	password := s.credentials.Password(32)
 
-	return &kube.Spec{
+	spec := &kube.Spec{
 		Namespace: options.Namespace,
 		Lables: map[string]string{
 			"service-binding-id":  options.ID,
@@ -136,9 +216,10 @@ func (s *MinioInstance) GetBindSpec(options BindOptions) *kube.Spec {
 				Data: map[string][]byte{
 					"user":       []byte(user),
 					"password":   []byte(password),
-					"host":       []byte(deploymentHost),
+					"host":       []byte(address.Host),
+					"endpoint":   []byte(endpoint),
 					"bucket":     []byte("my-bucket"),
-					"minioalias": []byte(fmt.Sprintf("http://%s:%s@%s:9000", user, password, deploymentHost)),
+					"minioalias": []byte(minioAlias(endpoint, user, password)),
 				},
 			},
 		},
@@ -192,21 +273,44 @@ func (s *MinioInstance) GetBindSpec(options BindOptions) *kube.Spec {
 			},
 		},
 	}
+
+	mountMinioCA(&spec.Jobs[0].Spec.Template.Spec, options.InstanceID)
+
+	for key, value := range s.bindingTLS(options, address) {
+		spec.Secrets[0].Data[key] = value
+	}
+
+	return spec
 }
 
 func (s *MinioInstance) GetDeprovisionSpec(options ServiceOptions) *kube.Spec {
 	return &kube.Spec{Namespace: options.Namespace}
 }
 
+// Gets the provision spec of an instance, the certificate errors are only
+// logged here because the spec is also used to delete the instance
 func (s *MinioInstance) GetProvisionSpec(options ServiceOptions) *kube.Spec {
+	spec, err := s.BuildProvisionSpec(options)
+	if err != nil {
+		glog.Errorf("Unable to secure instance '%s': %v", options.ID, err)
+	}
+
+	return spec
+}
+
+// Builds the provision spec of an instance and returns the errors of issuing
+// its certificate
+func (s *MinioInstance) BuildProvisionSpec(options ServiceOptions) (*kube.Spec, error) {
 	deploymentName := fmt.Sprintf("minio-instance-%s", options.ID)
 	secretName := fmt.Sprintf("%s-admin-secret", deploymentName)
 	pvcName := fmt.Sprintf("%s-pvc", deploymentName)
+	plan := findPlan(s.plans, options.PlanID)
 
 	user := fmt.Sprintf("minio-%s", options.ID)
-	password := kube.RandStringBytes(32)
+	password := s.credentials.Password(32)
+	exposure := instanceExposure(plan, options.Parameters)
 
-	return &kube.Spec{
+	spec := &kube.Spec{
 		Namespace: options.Namespace,
 		Lables: map[string]string{
 			"service-instance-id": options.ID,
@@ -223,7 +327,7 @@ func (s *MinioInstance) GetProvisionSpec(options ServiceOptions) *kube.Spec {
 				Data: map[string][]byte{
 					"user":       []byte(user),
 					"password":   []byte(password),
-					"minioalias": []byte(fmt.Sprintf("http://%s:%s@%s:9000", user, password, s.GetHost(options.ID, options.Namespace))),
+					"minioalias": []byte(minioAlias(s.adminEndpoint(options), user, password)),
 				},
 			},
 		},
@@ -286,11 +390,7 @@ mc admin policy remove myminio "policy-$MINIO_USER"
 					AccessModes: []coreV1.PersistentVolumeAccessMode{
 						"ReadWriteOnce",
 					},
-					Resources: coreV1.ResourceRequirements{
-						Requests: coreV1.ResourceList{
-							"storage": resource.MustParse("2Gi"),
-						},
-					},
+					Resources: plan.StorageResources(),
 				},
 			},
 		},
@@ -325,10 +425,8 @@ mc admin policy remove myminio "policy-$MINIO_USER"
 											ContainerPort: 9000,
 										},
 									},
-									Env: []coreV1.EnvVar{
-										kube.EnvSecret("MINIO_ACCESS_KEY", secretName, "user"),
-										kube.EnvSecret("MINIO_SECRET_KEY", secretName, "password"),
-									},
+									Env:       minioEnv(secretName, plan),
+									Resources: plan.Resources(),
 									ReadinessProbe: &coreV1.Probe{
 										Handler: coreV1.Handler{
 											TCPSocket: &coreV1.TCPSocketAction{
@@ -376,7 +474,6 @@ mc admin policy remove myminio "policy-$MINIO_USER"
 					Selector: map[string]string{
 						"app": deploymentName,
 					},
-					Type: "LoadBalancer",
 					Ports: []coreV1.ServicePort{
 						{
 							Port: 9000,
@@ -389,5 +486,28 @@ mc admin policy remove myminio "policy-$MINIO_USER"
 				},
 			},
 		},
+		Ingresses: exposure.ingresses(deploymentName, options.ID, 9000),
+	}
+
+	exposure.exposeService(&spec.Services[0], options.ID)
+	err := s.secure(spec, options)
+
+	return spec, err
+}
+
+// Gets the environment of the minio server container for the plan
+func minioEnv(secretName string, plan PlanConfig) []coreV1.EnvVar {
+	env := []coreV1.EnvVar{
+		kube.EnvSecret("MINIO_ACCESS_KEY", secretName, "user"),
+		kube.EnvSecret("MINIO_SECRET_KEY", secretName, "password"),
 	}
+
+	if plan.MaxConnections > 0 {
+		env = append(env, coreV1.EnvVar{
+			Name:  "MINIO_API_REQUESTS_MAX",
+			Value: strconv.Itoa(plan.MaxConnections),
+		})
+	}
+
+	return env
 }
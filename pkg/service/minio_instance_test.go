@@ -6,7 +6,7 @@ import (
 	"k8s.io/client-go/kubernetes/fake"
 )
 
-var minioTestSpec = NewMinioInstance().GetProvisionSpec(ServiceOptions{
+var minioTestSpec = NewMinioInstance(InstanceConfig{}, nil).GetProvisionSpec(ServiceOptions{
 	ID:     "test-id",
 	PlanID: "2f931eba-c3cc-4d41-8702-e63cd5ee9a5c",
 })
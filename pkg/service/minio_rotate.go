@@ -0,0 +1,149 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/AdeAttwood/service-broker/pkg/kube"
+
+	batchV1 "k8s.io/api/batch/v1"
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var minioRotateScript = `
+set -e
+
+until mc ls myminio > /dev/null 2>&1; do
+    echo "Waiting for minio"
+    sleep 5
+done
+
+echo "Applying the new credentials"
+bash /tmp/rotate/rotate.bash
+`
+
+var _ CredentialRotator = &MinioInstance{}
+
+// Gets new secret keys for the admin user and the binding users. The binding
+// users are updated with the admin api, the server gets the new admin key when
+// it is restarted with the updated admin secret. Minio users only have one
+// secret key so the old keys can't be kept for a grace period
+func (s *MinioInstance) RotateCredentials(options RotateOptions) (*CredentialRotation, error) {
+	if options.GracePeriod > 0 {
+		return nil, errors.New("Minio instances can't keep the old credentials, rotate the credentials without a grace period")
+	}
+
+	deploymentName := fmt.Sprintf("minio-instance-%s", options.ID)
+	endpoint := minioEndpoint(s.address(options.ID, options.Namespace))
+	rotation := &CredentialRotation{}
+	commands := []string{}
+
+	for _, binding := range options.Bindings {
+		secret := binding.DeepCopy()
+		password := s.credentials.Password(32)
+		secret.Data["password"] = []byte(password)
+		secret.Data["endpoint"] = []byte(endpoint)
+		secret.Data["minioalias"] = []byte(minioAlias(endpoint, string(secret.Data["user"]), password))
+
+		commands = append(commands, fmt.Sprintf("mc admin user add myminio '%s' '%s'", secret.Data["user"], password))
+		rotation.Secrets = append(rotation.Secrets, *secret)
+	}
+
+	if options.Instance {
+		admin, err := rotationSecret(options.InstanceSecrets, fmt.Sprintf("%s-admin-secret", deploymentName))
+		if err != nil {
+			return nil, err
+		}
+
+		password := s.credentials.Password(32)
+		admin.Data["password"] = []byte(password)
+		admin.Data["minioalias"] = []byte(minioAlias(s.adminEndpoint(options.ServiceOptions), string(admin.Data["user"]), password))
+
+		rotation.Secrets = append(rotation.Secrets, *admin)
+		rotation.Restart = []string{deploymentName}
+	}
+
+	// The secret holding the commands is not labelled with the instance so
+	// it is never read back as one of the instance secrets
+	rotation.Spec = &kube.Spec{
+		Namespace: options.Namespace,
+		Lables: map[string]string{
+			"service-id":   s.Definition().ID,
+			"service-name": s.Definition().Name,
+		},
+	}
+
+	// Only the binding users are changed by a job, the admin key is changed
+	// when the server restarts
+	if len(commands) == 0 {
+		return rotation, nil
+	}
+
+	name := fmt.Sprintf("%s-rotate-%s", deploymentName, strings.ToLower(kube.RandStringBytes(5)))
+	rotation.Spec.Secrets = []coreV1.Secret{
+		{
+			ObjectMeta: metaV1.ObjectMeta{
+				Name: name,
+			},
+			Type: "Opaque",
+			Data: map[string][]byte{
+				"rotate.bash": []byte(strings.Join(commands, "\n")),
+			},
+		},
+	}
+
+	rotation.Spec.Jobs = []batchV1.Job{
+		{
+			ObjectMeta: metaV1.ObjectMeta{
+				Name: name,
+			},
+			Spec: batchV1.JobSpec{
+				Template: coreV1.PodTemplateSpec{
+					ObjectMeta: metaV1.ObjectMeta{
+						Labels: map[string]string{"service-instance-id": options.ID},
+					},
+					Spec: coreV1.PodSpec{
+						RestartPolicy:         coreV1.RestartPolicyOnFailure,
+						ActiveDeadlineSeconds: int64Ptr(120),
+						Containers: []coreV1.Container{
+							{
+								Name:    "mc",
+								Image:   "minio/mc:latest",
+								Command: []string{"bash", "-c", minioRotateScript},
+								Env: []coreV1.EnvVar{
+									kube.EnvSecret("MC_HOST_myminio", fmt.Sprintf("%s-admin-secret", deploymentName), "minioalias"),
+								},
+								VolumeMounts: []coreV1.VolumeMount{
+									{
+										Name:      "rotate",
+										MountPath: "/tmp/rotate",
+										ReadOnly:  true,
+									},
+								},
+							},
+						},
+						Volumes: []coreV1.Volume{
+							{
+								Name: "rotate",
+								VolumeSource: coreV1.VolumeSource{
+									Secret: &coreV1.SecretVolumeSource{SecretName: name},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	mountMinioCA(&rotation.Spec.Jobs[0].Spec.Template.Spec, options.ID)
+
+	return rotation, nil
+}
+
+// There is nothing to expire as minio rotations don't have a grace period
+func (s *MinioInstance) GetExpireSpec(options RotateOptions) *kube.Spec {
+	return &kube.Spec{Namespace: options.Namespace}
+}
@@ -0,0 +1,39 @@
+package service
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestMinioRotateCredentials(t *testing.T) {
+	admin := coreV1.Secret{
+		ObjectMeta: metaV1.ObjectMeta{Name: "minio-instance-test-id-admin-secret"},
+		Data:       map[string][]byte{"user": []byte("minio-test-id"), "password": []byte("old-admin")},
+	}
+
+	minio := NewMinioInstance(InstanceConfig{}, nil)
+	options := rotateTestOptions(nil, admin)
+	options.GracePeriod = time.Hour
+	if _, err := minio.RotateCredentials(options); err == nil {
+		t.Errorf("Minio instances should not have a grace period")
+	}
+
+	options.GracePeriod = 0
+	rotation, err := minio.RotateCredentials(options)
+	if err != nil {
+		t.Fatalf("Unable to rotate the credentials: %v", err)
+	}
+
+	if len(rotation.Restart) != 1 || rotation.Restart[0] != "minio-instance-test-id" {
+		t.Errorf("The server should be restarted with the new admin key")
+	}
+
+	binding := rotation.Secrets[0]
+	if !strings.Contains(string(binding.Data["minioalias"]), string(binding.Data["password"])) {
+		t.Errorf("The alias of the binding should have the new password")
+	}
+}
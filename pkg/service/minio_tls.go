@@ -0,0 +1,125 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/AdeAttwood/service-broker/pkg/kube"
+
+	coreV1 "k8s.io/api/core/v1"
+)
+
+// Where the server certificate is mounted in the minio container
+const minioCertsPath = "/etc/minio/certs"
+
+// Where mc reads the cas it trusts from
+const mcCAsPath = mcConfigDir + "/certs/CAs"
+
+// Gets the name of the secret with the server certificate of an instance
+func minioTLSSecretName(instanceID string) string {
+	return fmt.Sprintf("minio-instance-%s-tls", instanceID)
+}
+
+// If the server of an instance serves https. New instances serve https when
+// tls is enabled, existing instances keep the scheme of the admin alias the
+// jobs use as it is never changed
+func (s *MinioInstance) serveTLS(options ServiceOptions) bool {
+	admin := secretData(options.InstanceSecrets, fmt.Sprintf("minio-instance-%s-admin-secret", options.ID))
+	if alias := string(admin["minioalias"]); alias != "" {
+		return strings.HasPrefix(alias, "https://")
+	}
+
+	return s.tls.Enabled()
+}
+
+// Gets the endpoint of the instance service the jobs connect to
+func (s *MinioInstance) adminEndpoint(options ServiceOptions) string {
+	scheme := "http"
+	if s.serveTLS(options) {
+		scheme = "https"
+	}
+
+	return fmt.Sprintf("%s://%s:9000", scheme, s.serviceHost(options.ID, options.Namespace))
+}
+
+// Adds the server certificate of an instance to the provision spec and starts
+// the server with it. The server is started with the certificate even when it
+// can't be issued so it doesn't serve http to clients expecting https
+func (s *MinioInstance) secure(spec *kube.Spec, options ServiceOptions) error {
+	if !s.tls.Enabled() || !s.serveTLS(options) {
+		return nil
+	}
+
+	deploymentName := fmt.Sprintf("minio-instance-%s", options.ID)
+	secretName := minioTLSSecretName(options.ID)
+	plan := findPlan(s.plans, options.PlanID)
+
+	hosts := serviceHosts(deploymentName, options.Namespace)
+	if host := instanceExposure(plan, options.Parameters).host(options.ID); host != "" {
+		hosts = append(hosts, host)
+	}
+
+	secrets, resources, err := s.tls.serverCertificate(s.client, options, secretName, hosts)
+	spec.Secrets = append(spec.Secrets, secrets...)
+	spec.CustomResources = append(spec.CustomResources, resources...)
+
+	// Minio reads the certificate from the file names it expects in the
+	// certs dir, the ca is trusted so the server can connect to itself
+	podSpec := &spec.Deployments[0].Spec.Template.Spec
+	mountTLSSecret(podSpec, "minio", secretName, minioCertsPath,
+		coreV1.KeyToPath{Key: "tls.crt", Path: "public.crt"},
+		coreV1.KeyToPath{Key: "tls.key", Path: "private.key"},
+		coreV1.KeyToPath{Key: "ca.crt", Path: "CAs/ca.crt"},
+	)
+
+	podSpec.Containers[0].Command = append(podSpec.Containers[0].Command, "--certs-dir", minioCertsPath)
+
+	if err != nil {
+		return fmt.Errorf("Unable to get the server certificate of instance '%s': %v", options.ID, err)
+	}
+
+	return nil
+}
+
+// Gets the tls fields of a binding. The ssl mode is "REQUIRED" when the
+// clients connect with https and "DISABLED" when they connect with http
+func (s *MinioInstance) bindingTLS(options BindOptions, address exposedAddress) map[string][]byte {
+	data := map[string][]byte{"ssl-mode": []byte(SSLModeDisabled)}
+	if address.TLS {
+		data["ssl-mode"] = []byte(SSLModeRequired)
+	}
+
+	// The ca is only returned when the clients connect to the instance server,
+	// the ingresses have their own certificates
+	tls := instanceTLSData(s.client, options.InstanceSecrets, options.InstanceNamespace(), minioTLSSecretName(options.InstanceID))
+	if !address.Ingress && len(tls["ca.crt"]) > 0 {
+		data["ca.crt"] = tls["ca.crt"]
+	}
+
+	return data
+}
+
+// Trusts the ca of a minio instance in the mc containers of a pod. The secret
+// is optional so the pods still start for instances without tls
+func mountMinioCA(podSpec *coreV1.PodSpec, instanceID string) {
+	optional := true
+	podSpec.Volumes = append(podSpec.Volumes, coreV1.Volume{
+		Name: "minio-ca",
+		VolumeSource: coreV1.VolumeSource{
+			Secret: &coreV1.SecretVolumeSource{
+				SecretName: minioTLSSecretName(instanceID),
+				Items:      []coreV1.KeyToPath{{Key: "ca.crt", Path: "ca.crt"}},
+				Optional:   &optional,
+			},
+		},
+	})
+
+	mount := coreV1.VolumeMount{Name: "minio-ca", MountPath: mcCAsPath, ReadOnly: true}
+	for _, containers := range [][]coreV1.Container{podSpec.InitContainers, podSpec.Containers} {
+		for i := range containers {
+			if containers[i].Name == "mc" {
+				containers[i].VolumeMounts = append(containers[i].VolumeMounts, mount)
+			}
+		}
+	}
+}
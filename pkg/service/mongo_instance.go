@@ -0,0 +1,413 @@
+package service
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+
+	"github.com/AdeAttwood/service-broker/pkg/kube"
+
+	appsV1 "k8s.io/api/apps/v1"
+	batchV1 "k8s.io/api/batch/v1"
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+)
+
+// The plan that is used when no plans have been configured for the mongo
+// instance
+var mongoDefaultPlan = PlanConfig{
+	Name:        "default",
+	ID:          "82f3f567-f856-4596-8519-3b77a3b88616",
+	Description: "The default plan",
+	Storage:     "2Gi",
+}
+
+const mongoBindScript = `
+set -e
+
+until mongo --quiet --host "$MONGO_HOST" -u root -p "$MONGO_ROOT_PASSWORD" --authenticationDatabase admin --eval "db.adminCommand('ping')" > /dev/null 2>&1; do
+	echo "Waiting for host '$MONGO_HOST'"
+	sleep 5
+done
+
+echo "Creating user '$DB_USER' on database '$DB_NAME'"
+mongo --quiet --host "$MONGO_HOST" -u root -p "$MONGO_ROOT_PASSWORD" --authenticationDatabase admin --eval "
+	var database = db.getSiblingDB('$DB_NAME');
+	if (!database.getUser('$DB_USER')) {
+		database.createUser({user: '$DB_USER', pwd: '$DB_PASSWORD', roles: [{role: 'readWrite', db: '$DB_NAME'}]});
+	}
+"
+`
+
+const mongoDebindScript = `
+set -e
+
+until mongo --quiet --host "$MONGO_HOST" -u root -p "$MONGO_ROOT_PASSWORD" --authenticationDatabase admin --eval "db.adminCommand('ping')" > /dev/null 2>&1; do
+	echo "Waiting for host '$MONGO_HOST'"
+	sleep 5
+done
+
+echo "Removing user '$DB_USER'"
+mongo --quiet --host "$MONGO_HOST" -u root -p "$MONGO_ROOT_PASSWORD" --authenticationDatabase admin --eval "db.getSiblingDB('$DB_NAME').dropUser('$DB_USER')"
+`
+
+func NewMongoInstance(config InstanceConfig, client kubernetes.Interface) *MongoInstance {
+	return &MongoInstance{
+		plans:       config.plans(mongoDefaultPlan),
+		credentials: config.Credentials,
+		client:      client,
+	}
+}
+
+type MongoInstance struct {
+	plans       []PlanConfig
+	credentials CredentialPolicy
+	client      kubernetes.Interface
+}
+
+var _ ProvisionValidator = &MongoInstance{}
+
+// Get the service definition of the mongo instance
+func (s *MongoInstance) Definition() osb.Service {
+	return osb.Service{
+		Name:                "mongo-instance",
+		ID:                  "8819dd20-d6f7-427c-bf61-575144f40f3c",
+		Description:         "A mongodb instance deployment",
+		Bindable:            true,
+		BindingsRetrievable: true,
+		Metadata: map[string]interface{}{
+			"displayName": "MongoDB Instance",
+			"imageUrl":    "https://webassets.mongodb.com/_com_assets/cms/mongodb-logo-rgb-j6w271g1xn.jpg",
+		},
+		Plans: planDefinitions(s.plans),
+	}
+}
+
+// Gets the host the clients connect to, this depends on how the instance is
+// exposed
+func (s *MongoInstance) GetHost(instanceID string, namespace string) string {
+	return s.address(instanceID, namespace).Host
+}
+
+// Gets the address of the instance service the clients connect to
+func (s *MongoInstance) address(instanceID string, namespace string) exposedAddress {
+	name := fmt.Sprintf("mongo-instance-%s", instanceID)
+	return getExposedAddress(s.client, namespace, name, s.serviceHost(instanceID, namespace), 27017)
+}
+
+// Gets the cluster host of the instance service, the jobs always connect with
+// this so they are not blocked by the load balancer source ranges
+func (s *MongoInstance) serviceHost(instanceID string, namespace string) string {
+	return fmt.Sprintf("mongo-instance-%s.%s.svc.cluster.local", instanceID, namespace)
+}
+
+// Validates the exposure of the instance
+func (s *MongoInstance) ValidateProvision(options ServiceOptions) error {
+	return validateTCPExposure("Mongo", findPlan(s.plans, options.PlanID), options.Parameters)
+}
+
+// Gets the image of the mongo server for a plan
+func (s *MongoInstance) image(planID string) string {
+	version := findPlan(s.plans, planID).Version
+	if version == "" {
+		version = "4.4"
+	}
+
+	return fmt.Sprintf("mongo:%s", version)
+}
+
+func (s *MongoInstance) GetDebindSpec(options BindOptions) *kube.Spec {
+	bindingSecretName := fmt.Sprintf("binding-secret-%s", options.ID)
+
+	return &kube.Spec{
+		Namespace: options.Namespace,
+		Lables: map[string]string{
+			"service-binding-id":  options.ID,
+			"service-instance-id": options.InstanceID,
+			"service-id":          s.Definition().ID,
+			"service-name":        s.Definition().Name,
+		},
+		Jobs: []batchV1.Job{
+			s.bindingJob(fmt.Sprintf("debinding-job-%s", options.ID), "debind.bash", options, []coreV1.EnvVar{
+				kube.EnvSecret("DB_NAME", bindingSecretName, "database"),
+				kube.EnvSecret("DB_USER", bindingSecretName, "user"),
+			}),
+		},
+	}
+}
+
+func (s *MongoInstance) GetBindSpec(options BindOptions) *kube.Spec {
+	bindingSecretName := fmt.Sprintf("binding-secret-%s", options.ID)
+
+	address := s.address(options.InstanceID, options.Namespace)
+	user := s.credentials.Username("user-%s")
+	password := s.credentials.Password(18)
+	database := fmt.Sprintf("binding_%s", strings.ReplaceAll(options.ID, "-", "_"))
+
+	uri := url.URL{
+		Scheme: "mongodb",
+		User:   url.UserPassword(user, password),
+		Host:   fmt.Sprintf("%s:%d", address.Host, address.Port),
+		Path:   "/" + database,
+	}
+
+	return &kube.Spec{
+		Namespace: options.Namespace,
+		Lables: map[string]string{
+			"service-binding-id":  options.ID,
+			"service-instance-id": options.InstanceID,
+			"service-id":          s.Definition().ID,
+			"service-name":        s.Definition().Name,
+		},
+		Secrets: []coreV1.Secret{
+			{
+				ObjectMeta: metaV1.ObjectMeta{
+					Name: bindingSecretName,
+				},
+				Type: "Opaque",
+				Data: map[string][]byte{
+					"host":     []byte(address.Host),
+					"port":     []byte(strconv.Itoa(int(address.Port))),
+					"user":     []byte(user),
+					"password": []byte(password),
+					"database": []byte(database),
+					"uri":      []byte(uri.String()),
+				},
+			},
+		},
+		Jobs: []batchV1.Job{
+			s.bindingJob(fmt.Sprintf("binding-job-%s", options.ID), "bind.bash", options, []coreV1.EnvVar{
+				kube.EnvSecret("DB_NAME", bindingSecretName, "database"),
+				kube.EnvSecret("DB_USER", bindingSecretName, "user"),
+				kube.EnvSecret("DB_PASSWORD", bindingSecretName, "password"),
+			}),
+		},
+	}
+}
+
+// Creates a job that runs one of the binding scripts against the instance as
+// the root user
+func (s *MongoInstance) bindingJob(name string, script string, options BindOptions, env []coreV1.EnvVar) batchV1.Job {
+	deploymentName := fmt.Sprintf("mongo-instance-%s", options.InstanceID)
+	rootSecretName := fmt.Sprintf("%s-root-secret", deploymentName)
+
+	return batchV1.Job{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name: name,
+		},
+		Spec: batchV1.JobSpec{
+			Template: coreV1.PodTemplateSpec{
+				Spec: coreV1.PodSpec{
+					RestartPolicy:         coreV1.RestartPolicyOnFailure,
+					ActiveDeadlineSeconds: int64Ptr(120),
+					Containers: []coreV1.Container{
+						{
+							Name:    "mongo",
+							Image:   s.image(options.PlanID),
+							Command: []string{"bash", fmt.Sprintf("/tmp/%s", script)},
+							Env: append([]coreV1.EnvVar{
+								{
+									Name:  "MONGO_HOST",
+									Value: s.serviceHost(options.InstanceID, options.Namespace),
+								},
+								kube.EnvSecret("MONGO_ROOT_PASSWORD", rootSecretName, "password"),
+							}, env...),
+							VolumeMounts: []coreV1.VolumeMount{
+								{
+									Name:      "config-volume",
+									MountPath: fmt.Sprintf("/tmp/%s", script),
+									ReadOnly:  true,
+									SubPath:   script,
+								},
+							},
+						},
+					},
+					Volumes: []coreV1.Volume{
+						{
+							Name: "config-volume",
+							VolumeSource: coreV1.VolumeSource{
+								ConfigMap: &coreV1.ConfigMapVolumeSource{
+									LocalObjectReference: coreV1.LocalObjectReference{
+										Name: deploymentName,
+									},
+									DefaultMode: int32Ptr(500),
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func (s *MongoInstance) GetDeprovisionSpec(options ServiceOptions) *kube.Spec {
+	return &kube.Spec{Namespace: options.Namespace}
+}
+
+func (s *MongoInstance) GetProvisionSpec(options ServiceOptions) *kube.Spec {
+	deploymentName := fmt.Sprintf("mongo-instance-%s", options.ID)
+	secretName := fmt.Sprintf("%s-root-secret", deploymentName)
+	pvcName := fmt.Sprintf("%s-pvc", deploymentName)
+	plan := findPlan(s.plans, options.PlanID)
+
+	args := []string{}
+	if plan.MaxConnections > 0 {
+		args = append(args, fmt.Sprintf("--maxConns=%d", plan.MaxConnections))
+	}
+
+	spec := &kube.Spec{
+		Namespace: options.Namespace,
+		Lables: map[string]string{
+			"service-instance-id": options.ID,
+			"service-id":          s.Definition().ID,
+			"service-name":        s.Definition().Name,
+			"service-plan":        options.PlanID,
+		},
+		Secrets: []coreV1.Secret{
+			{
+				ObjectMeta: metaV1.ObjectMeta{
+					Name: secretName,
+				},
+				Type: "Opaque",
+				Data: map[string][]byte{
+					"user":     []byte("root"),
+					"password": []byte(s.credentials.Password(16)),
+				},
+			},
+		},
+		ConfigMaps: []coreV1.ConfigMap{
+			{
+				ObjectMeta: metaV1.ObjectMeta{
+					Name: deploymentName,
+				},
+				Data: map[string]string{
+					"bind.bash":   mongoBindScript,
+					"debind.bash": mongoDebindScript,
+				},
+			},
+		},
+		PVCS: []coreV1.PersistentVolumeClaim{
+			{
+				ObjectMeta: metaV1.ObjectMeta{
+					Name: pvcName,
+				},
+				Spec: coreV1.PersistentVolumeClaimSpec{
+					AccessModes: []coreV1.PersistentVolumeAccessMode{
+						"ReadWriteOnce",
+					},
+					Resources: plan.StorageResources(),
+				},
+			},
+		},
+		Deployments: []appsV1.Deployment{
+			{
+				ObjectMeta: metaV1.ObjectMeta{
+					Name: deploymentName,
+				},
+				Spec: appsV1.DeploymentSpec{
+					Replicas: int32Ptr(1),
+					// The old pod must be stopped before the new one starts so
+					// two servers never use the same data directory
+					Strategy: appsV1.DeploymentStrategy{
+						Type: appsV1.RecreateDeploymentStrategyType,
+					},
+					Selector: &metaV1.LabelSelector{
+						MatchLabels: map[string]string{
+							"app": deploymentName,
+						},
+					},
+					Template: coreV1.PodTemplateSpec{
+						ObjectMeta: metaV1.ObjectMeta{
+							Labels: map[string]string{
+								"app": deploymentName,
+							},
+						},
+						Spec: coreV1.PodSpec{
+							Containers: []coreV1.Container{
+								{
+									Name:      "mongo",
+									Image:     s.image(options.PlanID),
+									Args:      args,
+									Resources: plan.Resources(),
+									Ports: []coreV1.ContainerPort{
+										{
+											Name:          "tpc",
+											Protocol:      coreV1.ProtocolTCP,
+											ContainerPort: 27017,
+										},
+									},
+									Env: []coreV1.EnvVar{
+										kube.EnvSecret("MONGO_INITDB_ROOT_USERNAME", secretName, "user"),
+										kube.EnvSecret("MONGO_INITDB_ROOT_PASSWORD", secretName, "password"),
+									},
+									ReadinessProbe: &coreV1.Probe{
+										Handler: coreV1.Handler{
+											TCPSocket: &coreV1.TCPSocketAction{
+												Port: intstr.IntOrString{
+													Type:   intstr.Int,
+													IntVal: 27017,
+												},
+											},
+										},
+										FailureThreshold:    1,
+										SuccessThreshold:    1,
+										TimeoutSeconds:      2,
+										InitialDelaySeconds: 10,
+										PeriodSeconds:       10,
+									},
+									VolumeMounts: []coreV1.VolumeMount{
+										{
+											Name:      pvcName,
+											MountPath: "/data/db",
+										},
+									},
+								},
+							},
+							Volumes: []coreV1.Volume{
+								{
+									Name: pvcName,
+									VolumeSource: coreV1.VolumeSource{
+										PersistentVolumeClaim: &coreV1.PersistentVolumeClaimVolumeSource{
+											ClaimName: pvcName,
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		Services: []coreV1.Service{
+			{
+				ObjectMeta: metaV1.ObjectMeta{
+					Name: deploymentName,
+				},
+				Spec: coreV1.ServiceSpec{
+					Selector: map[string]string{
+						"app": deploymentName,
+					},
+					Ports: []coreV1.ServicePort{
+						{
+							Port: 27017,
+							TargetPort: intstr.IntOrString{
+								Type:   intstr.Int,
+								IntVal: 27017,
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	instanceExposure(plan, options.Parameters).exposeService(&spec.Services[0], options.ID)
+
+	return spec
+}
@@ -0,0 +1,131 @@
+package service
+
+import (
+	"testing"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var mongoTestSpec = NewMongoInstance(InstanceConfig{}, nil).GetProvisionSpec(ServiceOptions{
+	ID:     "test-id",
+	PlanID: "82f3f567-f856-4596-8519-3b77a3b88616",
+})
+
+func TestMongoInjectLabels(t *testing.T) {
+	mongoTestSpec.InjectLabels(mongoTestSpec.Lables)
+	if label := mongoTestSpec.Deployments[0].Labels["service-instance-id"]; label != "test-id" {
+		t.Errorf("Invalid service ID label '%s'", label)
+	}
+}
+
+func TestMongoImage(t *testing.T) {
+	image := mongoTestSpec.Deployments[0].Spec.Template.Spec.Containers[0].Image
+	if image != "mongo:4.4" {
+		t.Errorf("Invalid deployment image '%s'", image)
+	}
+}
+
+func TestMongoRootSecret(t *testing.T) {
+	secret := mongoTestSpec.Secrets[0]
+	if secret.Name != "mongo-instance-test-id-root-secret" || len(secret.Data["password"]) == 0 {
+		t.Errorf("Invalid root secret '%s'", secret.Name)
+	}
+
+	env := mongoTestSpec.Deployments[0].Spec.Template.Spec.Containers[0].Env
+	if env[1].Name != "MONGO_INITDB_ROOT_PASSWORD" || env[1].ValueFrom.SecretKeyRef.Name != secret.Name {
+		t.Errorf("The server should use the root password from the root secret")
+	}
+}
+
+func TestMongoStorage(t *testing.T) {
+	pvc := mongoTestSpec.PVCS[0]
+	if storage := pvc.Spec.Resources.Requests["storage"]; pvc.Name != "mongo-instance-test-id-pvc" || storage.String() != "2Gi" {
+		t.Errorf("Invalid pvc '%s' with the storage '%s'", pvc.Name, storage.String())
+	}
+
+	mount := mongoTestSpec.Deployments[0].Spec.Template.Spec.Containers[0].VolumeMounts[0]
+	if mount.Name != pvc.Name || mount.MountPath != "/data/db" {
+		t.Errorf("The data directory should be on the instance pvc")
+	}
+}
+
+func TestApplyMongo(t *testing.T) {
+	if err := mongoTestSpec.Create(fake.NewSimpleClientset()); err != nil {
+		t.Fatalf("error creating the mongo instance: %v", err)
+	}
+}
+
+func TestMongoDeprovisionSpec(t *testing.T) {
+	spec := NewMongoInstance(InstanceConfig{}, nil).GetDeprovisionSpec(ServiceOptions{ID: "test-id", Namespace: "test"})
+	if spec.Namespace != "test" || len(spec.Jobs) != 0 {
+		t.Errorf("The instance resources are removed with the provision spec so the deprovision spec should be empty")
+	}
+}
+
+func TestMongoBindJob(t *testing.T) {
+	options := BindOptions{ID: "binding-id", InstanceID: "test-id", Namespace: "test"}
+	spec := NewMongoInstance(InstanceConfig{}, nil).GetBindSpec(options)
+
+	job := spec.Jobs[0]
+	if job.Name != "binding-job-binding-id" {
+		t.Errorf("Invalid bind job name '%s'", job.Name)
+	}
+
+	container := job.Spec.Template.Spec.Containers[0]
+	if container.Command[1] != "/tmp/bind.bash" || job.Spec.Template.Spec.Volumes[0].ConfigMap.Name != "mongo-instance-test-id" {
+		t.Errorf("The bind job should run the bind script from the instance config map")
+	}
+
+	env := map[string]string{}
+	for _, variable := range container.Env {
+		env[variable.Name] = variable.Value
+		if variable.ValueFrom != nil {
+			env[variable.Name] = variable.ValueFrom.SecretKeyRef.Name + "/" + variable.ValueFrom.SecretKeyRef.Key
+		}
+	}
+
+	if env["MONGO_HOST"] != "mongo-instance-test-id.test.svc.cluster.local" || env["MONGO_ROOT_PASSWORD"] != "mongo-instance-test-id-root-secret/password" {
+		t.Errorf("The bind job should connect to the instance as the root user")
+	}
+
+	if env["DB_NAME"] != "binding-secret-binding-id/database" || env["DB_USER"] != "binding-secret-binding-id/user" || env["DB_PASSWORD"] != "binding-secret-binding-id/password" {
+		t.Errorf("The bind job should create the user from the binding secret")
+	}
+
+	debind := NewMongoInstance(InstanceConfig{}, nil).GetDebindSpec(options).Jobs[0]
+	if debind.Name != "debinding-job-binding-id" || debind.Spec.Template.Spec.Containers[0].Command[1] != "/tmp/debind.bash" {
+		t.Errorf("The debind job should run the debind script")
+	}
+}
+
+func TestMongoBindCredentials(t *testing.T) {
+	spec := NewMongoInstance(InstanceConfig{}, nil).GetBindSpec(BindOptions{
+		ID:         "binding-id",
+		InstanceID: "test-id",
+		Namespace:  "test",
+	})
+
+	data := spec.Secrets[0].Data
+	expected := "mongodb://" + string(data["user"]) + ":" + string(data["password"]) + "@mongo-instance-test-id.test.svc.cluster.local:27017/binding_binding_id"
+	if string(data["uri"]) != expected {
+		t.Errorf("Invalid uri '%s'", data["uri"])
+	}
+
+	if spec.Lables["service-binding-id"] != "binding-id" {
+		t.Errorf("Invalid service binding label '%s'", spec.Lables["service-binding-id"])
+	}
+}
+
+func TestMongoExposure(t *testing.T) {
+	mongo := NewMongoInstance(InstanceConfig{}, nil)
+	options := ServiceOptions{ID: "test-id", PlanID: "82f3f567-f856-4596-8519-3b77a3b88616"}
+
+	if service := mongo.GetProvisionSpec(options).Services[0]; service.Spec.Type != "ClusterIP" {
+		t.Errorf("Instances should only be exposed in the cluster by default, got '%s'", service.Spec.Type)
+	}
+
+	options.Parameters = map[string]interface{}{"expose": "LoadBalancer"}
+	if err := mongo.ValidateProvision(options); err == nil {
+		t.Errorf("Plans that don't allow overriding the exposure should not accept the parameters")
+	}
+}
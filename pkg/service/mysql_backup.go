@@ -0,0 +1,318 @@
+package service
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/AdeAttwood/service-broker/pkg/kube"
+
+	batchV1 "k8s.io/api/batch/v1"
+	batchV1beta1 "k8s.io/api/batch/v1beta1"
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The mount point of the volume the backups are written to before they get
+// uploaded into a bucket
+const mysqlBackupDir = "/backup"
+
+var mysqlBackupScript = `
+set -e
+
+export MYSQL_PWD="$MYSQL_ROOT_PASSWORD"
+
+BACKUP_DIR=${BACKUP_DIR:-/var/lib/mysql/backups};
+BACKUP_NAME=$(date +%Y%m%d%H%M%S);
+BACKUP_RETENTION=${BACKUP_RETENTION:-0};
+test -d "$BACKUP_DIR/$BACKUP_NAME" || mkdir -p "$BACKUP_DIR/$BACKUP_NAME"
+
+trap 'echo "$(date -u +%FT%TZ) $BACKUP_NAME failed" >> "$BACKUP_DIR/backups.log"' ERR
+
+DBS=$(mysql -uroot -h "$MYSQL_HOST" -e 'show databases' -s --skip-column-names | grep -Ev "^(mysql|information_schema|performance_schema|sys|backups)$");
+
+for db in $DBS; do
+	test -d "$BACKUP_DIR/$BACKUP_NAME/$db" || mkdir -p "$BACKUP_DIR/$BACKUP_NAME/$db"
+	for table in $(mysql -uroot -h "$MYSQL_HOST" -e 'show tables' $db -s --skip-column-names); do
+		echo "Backing up '$db/$table'"
+		mysqldump -uroot -h "$MYSQL_HOST" $db $table > "$BACKUP_DIR/$BACKUP_NAME/$db/$table.sql"
+	done
+done
+
+echo "$(date -u +%FT%TZ) $BACKUP_NAME succeeded $(du -sk "$BACKUP_DIR/$BACKUP_NAME" | cut -f1)K" >> "$BACKUP_DIR/backups.log"
+
+if [ "$BACKUP_RETENTION" -gt 0 ]; then
+	for backup in $(ls -1 "$BACKUP_DIR" | grep -E '^[0-9]+$' | sort -r | tail -n +$((BACKUP_RETENTION + 1))); do
+		echo "Removing old backup '$backup'"
+		rm -rf "$BACKUP_DIR/$backup"
+	done
+fi
+`
+
+var mysqlBackupUploadScript = `
+set -e
+
+until mc ls backup > /dev/null 2>&1; do
+    echo "Waiting for backup storage"
+    sleep 5
+done
+
+mc mb "backup/$BACKUP_BUCKET" || true
+
+for backup in $(ls -1 "$BACKUP_DIR" | grep -E '^[0-9]+$'); do
+    echo "Uploading backup '$backup'"
+    mc cp --recursive "$BACKUP_DIR/$backup/" "backup/$BACKUP_BUCKET/$BACKUP_PREFIX/$backup/"
+done
+
+mc cat "backup/$BACKUP_BUCKET/$BACKUP_PREFIX/backups.log" > /tmp/backups.log 2> /dev/null || true
+cat "$BACKUP_DIR/backups.log" >> /tmp/backups.log
+mc cp /tmp/backups.log "backup/$BACKUP_BUCKET/$BACKUP_PREFIX/backups.log"
+
+if [ "$BACKUP_RETENTION" -gt 0 ]; then
+    for backup in $(mc ls "backup/$BACKUP_BUCKET/$BACKUP_PREFIX/" | awk '{print $NF}' | grep -E '^[0-9]+/$' | sort -r | tail -n +$((BACKUP_RETENTION + 1))); do
+        echo "Removing old backup '$backup'"
+        mc rm --recursive --force "backup/$BACKUP_BUCKET/$BACKUP_PREFIX/$backup"
+    done
+fi
+`
+
+// The options for the scheduled backups of a mysql instance. All of these are
+// set from the parameters passed in when the instance is provisioned.
+//
+// Backups can be stored on the instance pvc, in a bucket on a minio-instance in
+// the same namespace or in a bucket on any s3 compatible endpoint
+type mysqlBackupOptions struct {
+	// The cron schedule of the backups, when this is empty no backups will be
+	// scheduled
+	Schedule string
+	// The number of backups to keep, older backups will be removed after a
+	// new one has been taken. Zero will keep all of the backups
+	Retention int
+	// Where the backups will be stored, one of "pvc", "minio-instance" or "s3"
+	Target string
+	// The ID of the minio instance to store the backups on
+	MinioInstance string
+	// The url of the s3 endpoint to store the backups on
+	Endpoint string
+	// The name of the secret that has the "access-key" and "secret-key" of the
+	// s3 endpoint
+	SecretName string
+	// The bucket the backups will be stored in
+	Bucket string
+}
+
+func newMysqlBackupOptions(parameters map[string]interface{}) mysqlBackupOptions {
+	return mysqlBackupOptions{
+		Schedule:      stringParam(parameters, "backup_schedule", ""),
+		Retention:     intParam(parameters, "backup_retention", 7),
+		Target:        stringParam(parameters, "backup_target", "pvc"),
+		MinioInstance: stringParam(parameters, "backup_minio_instance", ""),
+		Endpoint:      stringParam(parameters, "backup_s3_endpoint", ""),
+		SecretName:    stringParam(parameters, "backup_s3_secret", ""),
+		Bucket:        stringParam(parameters, "backup_bucket", "backups"),
+	}
+}
+
+// Gets the prefix in the backup bucket that all of the backups for an instance
+// will be stored under
+func mysqlBackupPrefix(instanceID string) string {
+	return fmt.Sprintf("mysql-instance-%s", instanceID)
+}
+
+// Gets the environment variables to configure the "backup" mc alias for the
+// backup target. If the target dose not use a bucket then nil is returned
+func (o mysqlBackupOptions) aliasEnv() []coreV1.EnvVar {
+	switch o.Target {
+	case "minio-instance":
+		adminSecretName := fmt.Sprintf("minio-instance-%s-admin-secret", o.MinioInstance)
+		return []coreV1.EnvVar{
+			kube.EnvSecret("MC_HOST_backup", adminSecretName, "minioalias"),
+		}
+	case "s3":
+		endpoint, err := url.Parse(o.Endpoint)
+		if err != nil || endpoint.Host == "" {
+			endpoint = &url.URL{Scheme: "https", Host: o.Endpoint}
+		}
+
+		return []coreV1.EnvVar{
+			kube.EnvSecret("S3_ACCESS_KEY", o.SecretName, "access-key"),
+			kube.EnvSecret("S3_SECRET_KEY", o.SecretName, "secret-key"),
+			{
+				Name:  "MC_HOST_backup",
+				Value: fmt.Sprintf("%s://$(S3_ACCESS_KEY):$(S3_SECRET_KEY)@%s", endpoint.Scheme, endpoint.Host),
+			},
+		}
+	}
+
+	return nil
+}
+
+// Trusts the ca of the minio instance backup target in the mc containers of a
+// pod, minio instances with tls serve https with a certificate from the ca
+func (o mysqlBackupOptions) trustCA(podSpec *coreV1.PodSpec) {
+	if o.Target == "minio-instance" {
+		mountMinioCA(podSpec, o.MinioInstance)
+	}
+}
+
+// Gets the cron jobs that will backup the mysql instance. If there is no
+// backup schedule in the options then no cron jobs will be returned
+func (s *MysqlInstance) getBackupCronJobs(options ServiceOptions) []batchV1beta1.CronJob {
+	backup := newMysqlBackupOptions(options.Parameters)
+	if backup.Schedule == "" {
+		return nil
+	}
+
+	return []batchV1beta1.CronJob{
+		{
+			ObjectMeta: metaV1.ObjectMeta{
+				Name: fmt.Sprintf("mysql-instance-%s-backup", options.ID),
+			},
+			Spec: batchV1beta1.CronJobSpec{
+				Schedule:                   backup.Schedule,
+				ConcurrencyPolicy:          batchV1beta1.ForbidConcurrent,
+				SuccessfulJobsHistoryLimit: int32Ptr(3),
+				FailedJobsHistoryLimit:     int32Ptr(3),
+				JobTemplate: batchV1beta1.JobTemplateSpec{
+					Spec: batchV1.JobSpec{
+						Template: coreV1.PodTemplateSpec{
+							Spec: s.getBackupPodSpec(options),
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// Gets the spec of the pod that takes a backup of the instance and stores it
+// in the backup target
+func (s *MysqlInstance) getBackupPodSpec(options ServiceOptions) coreV1.PodSpec {
+	backup := newMysqlBackupOptions(options.Parameters)
+	version := s.version(options.PlanID, options.Parameters)
+	deploymentHost := s.serviceHost(options.ID, options.Namespace)
+	deploymentName := fmt.Sprintf("mysql-instance-%s", options.ID)
+	rootSecretName := fmt.Sprintf("%s-root-secret", deploymentName)
+	pvcName := mysqlDataPVCName(findPlan(s.plans, options.PlanID), options.ID)
+
+	mysqlContainer := coreV1.Container{
+		Name:    "mysql",
+		Image:   version.Image,
+		Command: []string{"bash", "/tmp/backup.bash"},
+		Env: []coreV1.EnvVar{
+			{
+				Name:  "MYSQL_HOST",
+				Value: deploymentHost,
+			},
+			kube.EnvSecret("MYSQL_ROOT_PASSWORD", rootSecretName, "password"),
+		},
+		VolumeMounts: []coreV1.VolumeMount{
+			{
+				Name:      "config-volume",
+				MountPath: "/tmp/backup.bash",
+				ReadOnly:  true,
+				SubPath:   "backup.bash",
+			},
+		},
+	}
+
+	podSpec := coreV1.PodSpec{
+		RestartPolicy: coreV1.RestartPolicyOnFailure,
+		Volumes: []coreV1.Volume{
+			{
+				Name: "config-volume",
+				VolumeSource: coreV1.VolumeSource{
+					ConfigMap: &coreV1.ConfigMapVolumeSource{
+						LocalObjectReference: coreV1.LocalObjectReference{
+							Name: deploymentName,
+						},
+						DefaultMode: int32Ptr(500),
+					},
+				},
+			},
+		},
+	}
+
+	if backup.Target == "pvc" {
+		// The instance pvc is ReadWriteOnce so the backup pod needs to be on the
+		// same node as the mysql pod to be able to mount it
+		mysqlContainer.Env = append(mysqlContainer.Env, coreV1.EnvVar{
+			Name:  "BACKUP_RETENTION",
+			Value: strconv.Itoa(backup.Retention),
+		})
+		mysqlContainer.VolumeMounts = append(mysqlContainer.VolumeMounts, coreV1.VolumeMount{
+			Name:      pvcName,
+			MountPath: "/var/lib/mysql",
+		})
+
+		podSpec.Containers = []coreV1.Container{mysqlContainer}
+		podSpec.Volumes = append(podSpec.Volumes, coreV1.Volume{
+			Name: pvcName,
+			VolumeSource: coreV1.VolumeSource{
+				PersistentVolumeClaim: &coreV1.PersistentVolumeClaimVolumeSource{
+					ClaimName: pvcName,
+				},
+			},
+		})
+		podSpec.Affinity = &coreV1.Affinity{
+			PodAffinity: &coreV1.PodAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: []coreV1.PodAffinityTerm{
+					{
+						LabelSelector: &metaV1.LabelSelector{
+							MatchLabels: mysqlPrimaryLabels(findPlan(s.plans, options.PlanID), options.ID),
+						},
+						TopologyKey: "kubernetes.io/hostname",
+					},
+				},
+			},
+		}
+	} else {
+		// When backing up into a bucket the dump is taken into an empty dir in
+		// an init container and then uploaded by the mc container
+		mysqlContainer.Env = append(mysqlContainer.Env, coreV1.EnvVar{
+			Name:  "BACKUP_DIR",
+			Value: mysqlBackupDir,
+		})
+		mysqlContainer.VolumeMounts = append(mysqlContainer.VolumeMounts, coreV1.VolumeMount{
+			Name:      "backup-volume",
+			MountPath: mysqlBackupDir,
+		})
+
+		podSpec.InitContainers = []coreV1.Container{mysqlContainer}
+		podSpec.Containers = []coreV1.Container{
+			{
+				Name:    "mc",
+				Image:   "minio/mc:latest",
+				Command: []string{"bash", "/tmp/backup-upload.bash"},
+				Env: append(backup.aliasEnv(),
+					coreV1.EnvVar{Name: "BACKUP_DIR", Value: mysqlBackupDir},
+					coreV1.EnvVar{Name: "BACKUP_BUCKET", Value: backup.Bucket},
+					coreV1.EnvVar{Name: "BACKUP_PREFIX", Value: mysqlBackupPrefix(options.ID)},
+					coreV1.EnvVar{Name: "BACKUP_RETENTION", Value: strconv.Itoa(backup.Retention)},
+				),
+				VolumeMounts: []coreV1.VolumeMount{
+					{
+						Name:      "config-volume",
+						MountPath: "/tmp/backup-upload.bash",
+						ReadOnly:  true,
+						SubPath:   "backup-upload.bash",
+					},
+					{
+						Name:      "backup-volume",
+						MountPath: mysqlBackupDir,
+					},
+				},
+			},
+		}
+		podSpec.Volumes = append(podSpec.Volumes, coreV1.Volume{
+			Name: "backup-volume",
+			VolumeSource: coreV1.VolumeSource{
+				EmptyDir: &coreV1.EmptyDirVolumeSource{},
+			},
+		})
+
+		backup.trustCA(&podSpec)
+	}
+
+	return podSpec
+}
@@ -0,0 +1,161 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/AdeAttwood/service-broker/pkg/kube"
+)
+
+// An existing secret in the broker namespace that holds the admin credentials
+// of a shared server
+type MysqlCredentialsSecret struct {
+	Name string `yaml:"name"`
+	// The keys of the user and password in the secret, these default to "user"
+	// and "password"
+	UserKey     string `yaml:"userKey"`
+	PasswordKey string `yaml:"passwordKey"`
+}
+
+// Where the jobs of a shared server read the admin credentials from. When the
+// server has no credentials secret the credentials are set on the jobs
+type mysqlJobCredentials struct {
+	secretName  string
+	userKey     string
+	passwordKey string
+	user        string
+	password    string
+}
+
+// Gets the env vars of the admin credentials for a job
+func (c mysqlJobCredentials) env() []coreV1.EnvVar {
+	if c.secretName == "" {
+		return []coreV1.EnvVar{
+			{Name: "MYSQL_ROOT_PASSWORD", Value: c.password},
+			{Name: "MYSQL_USER", Value: c.user},
+		}
+	}
+
+	return []coreV1.EnvVar{
+		kube.EnvSecret("MYSQL_ROOT_PASSWORD", c.secretName, c.passwordKey),
+		kube.EnvSecret("MYSQL_USER", c.secretName, c.userKey),
+	}
+}
+
+// Checks the admin credentials of a shared server come from one source and
+// that the environment variables and files they are read from exist
+func (c SharedMysqlConfig) ValidateCredentials() error {
+	if c.CredentialsSecret != nil {
+		if c.CredentialsSecret.Name == "" {
+			return fmt.Errorf("The credentials secret of the shared mysql server '%s' must have a name", c.Name)
+		}
+
+		if c.User != "" || c.Password != "" || c.UserEnv != "" || c.PasswordEnv != "" || c.UserFile != "" || c.PasswordFile != "" {
+			return fmt.Errorf("The shared mysql server '%s' can't have a credentials secret and other credentials", c.Name)
+		}
+
+		return nil
+	}
+
+	for _, sources := range [][]string{{c.User, c.UserEnv, c.UserFile}, {c.Password, c.PasswordEnv, c.PasswordFile}} {
+		count := 0
+		for _, source := range sources {
+			if source != "" {
+				count++
+			}
+		}
+
+		if count > 1 {
+			return fmt.Errorf("The credentials of the shared mysql server '%s' can only be read from one of the config, environment or a file", c.Name)
+		}
+	}
+
+	_, _, err := c.credentials(nil, "")
+	return err
+}
+
+// Gets the admin user and password of a shared server. The credentials are
+// read every time they are needed so changes to the secret, environment or
+// files are picked up without restarting the broker
+func (c SharedMysqlConfig) credentials(client kubernetes.Interface, namespace string) (string, string, error) {
+	if c.CredentialsSecret != nil {
+		secret, err := client.CoreV1().Secrets(namespace).Get(context.TODO(), c.CredentialsSecret.Name, metaV1.GetOptions{})
+		if err != nil {
+			return "", "", err
+		}
+
+		source, _ := c.jobCredentials()
+		return string(secret.Data[source.userKey]), string(secret.Data[source.passwordKey]), nil
+	}
+
+	user, err := credentialValue(c.User, c.UserEnv, c.UserFile)
+	if err != nil {
+		return "", "", err
+	}
+
+	password, err := credentialValue(c.Password, c.PasswordEnv, c.PasswordFile)
+	if err != nil {
+		return "", "", err
+	}
+
+	return user, password, nil
+}
+
+// Gets where the jobs read the admin credentials from. The jobs read the
+// credentials secret of the server directly, credentials from the config,
+// environment or files are set on the jobs so they are not copied into
+// another secret
+func (c SharedMysqlConfig) jobCredentials() (mysqlJobCredentials, error) {
+	if c.CredentialsSecret == nil {
+		user, password, err := c.credentials(nil, "")
+		return mysqlJobCredentials{user: user, password: password}, err
+	}
+
+	source := mysqlJobCredentials{
+		secretName:  c.CredentialsSecret.Name,
+		userKey:     c.CredentialsSecret.UserKey,
+		passwordKey: c.CredentialsSecret.PasswordKey,
+	}
+
+	if source.userKey == "" {
+		source.userKey = "user"
+	}
+
+	if source.passwordKey == "" {
+		source.passwordKey = "password"
+	}
+
+	return source, nil
+}
+
+// Gets a credential from an environment variable or a file, when neither are
+// set the value from the config is used. Files are trimmed so they can be
+// written with a trailing new line
+func credentialValue(value string, env string, file string) (string, error) {
+	if env != "" {
+		value, ok := os.LookupEnv(env)
+		if !ok {
+			return "", fmt.Errorf("The environment variable '%s' is not set", env)
+		}
+
+		return value, nil
+	}
+
+	if file != "" {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+
+		return strings.TrimSpace(string(content)), nil
+	}
+
+	return value, nil
+}
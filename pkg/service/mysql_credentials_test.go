@@ -0,0 +1,110 @@
+package service
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// Gets the secret and key the env var of the first container in a job is read
+// from
+func jobEnvSecret(t *testing.T, job coreV1.Container, name string) (string, string) {
+	for _, env := range job.Env {
+		if env.Name == name && env.ValueFrom != nil && env.ValueFrom.SecretKeyRef != nil {
+			return env.ValueFrom.SecretKeyRef.Name, env.ValueFrom.SecretKeyRef.Key
+		}
+	}
+
+	t.Fatalf("The env var '%s' is not read from a secret", name)
+	return "", ""
+}
+
+func TestSharedMysqlCredentialsSecret(t *testing.T) {
+	client := fake.NewSimpleClientset(&coreV1.Secret{
+		ObjectMeta: metaV1.ObjectMeta{Name: "mysql-admin", Namespace: "service-broker"},
+		Data:       map[string][]byte{"username": []byte("admin"), "password": []byte("secret")},
+	})
+
+	shared, err := NewSharedMysql(SharedMysqlConfig{
+		Name:              "central",
+		ID:                "shared-mysql-id",
+		CredentialsSecret: &MysqlCredentialsSecret{Name: "mysql-admin", UserKey: "username"},
+	}, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spec := shared.GetProvisionSpec(ServiceOptions{ID: "test-id", GlobalNamespace: "service-broker"})
+	if _, ok := spec.Secrets[0].Data["password"]; ok {
+		t.Errorf("The credentials should not be copied into the instance secret")
+	}
+
+	container := spec.Jobs[0].Spec.Template.Spec.Containers[0]
+	if name, key := jobEnvSecret(t, container, "MYSQL_USER"); name != "mysql-admin" || key != "username" {
+		t.Errorf("The user should be read from the credentials secret not '%s' '%s'", name, key)
+	}
+
+	if user, password, err := shared.config.credentials(client, "service-broker"); err != nil || user != "admin" || password != "secret" {
+		t.Errorf("Invalid credentials '%s' '%s' %v", user, password, err)
+	}
+
+	if err := shared.ValidateProvision(ServiceOptions{GlobalNamespace: "other-ns"}); err == nil {
+		t.Errorf("Provisioning should fail when the credentials secret can't be read")
+	}
+}
+
+func TestSharedMysqlCredentialsSources(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "password")
+	if err := ioutil.WriteFile(file, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("SHARED_MYSQL_TEST_USER", "from-env")
+	defer os.Unsetenv("SHARED_MYSQL_TEST_USER")
+
+	client := fake.NewSimpleClientset()
+	config := SharedMysqlConfig{
+		Name:         "central",
+		ID:           "shared-mysql-id",
+		UserEnv:      "SHARED_MYSQL_TEST_USER",
+		PasswordFile: file,
+	}
+
+	shared, err := NewSharedMysql(config, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job := shared.GetProvisionSpec(ServiceOptions{ID: "test-id", GlobalNamespace: "service-broker"}).Jobs[0]
+	env := map[string]string{}
+	for _, variable := range job.Spec.Template.Spec.Containers[0].Env {
+		env[variable.Name] = variable.Value
+	}
+
+	if env["MYSQL_USER"] != "from-env" || env["MYSQL_ROOT_PASSWORD"] != "from-file" || job.Spec.TTLSecondsAfterFinished == nil {
+		t.Errorf("The credentials should be set on the jobs and removed with them '%v'", env)
+	}
+
+	if secrets, _ := client.CoreV1().Secrets("service-broker").List(context.TODO(), metaV1.ListOptions{}); len(secrets.Items) != 0 {
+		t.Errorf("The credentials should not be copied into a secret")
+	}
+
+	invalid := map[string]SharedMysqlConfig{
+		"missing env":      {Name: "central", UserEnv: "SHARED_MYSQL_TEST_MISSING"},
+		"missing file":     {Name: "central", PasswordFile: filepath.Join(t.TempDir(), "missing")},
+		"multiple sources": {Name: "central", Password: "plain", PasswordFile: file},
+		"secret and env":   {Name: "central", UserEnv: "SHARED_MYSQL_TEST_USER", CredentialsSecret: &MysqlCredentialsSecret{Name: "mysql-admin"}},
+	}
+
+	for name, config := range invalid {
+		if _, err := NewSharedMysql(config, client); err == nil {
+			t.Errorf("The credentials with a %s should be invalid", name)
+		}
+	}
+}
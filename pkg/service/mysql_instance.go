@@ -1,8 +1,11 @@
 package service
 
 import (
+	"errors"
 	"fmt"
+	"strconv"
 
+	"github.com/golang/glog"
 	osb "github.com/pmorie/go-open-service-broker-client/v2"
 
 	"github.com/AdeAttwood/service-broker/pkg/kube"
@@ -10,46 +13,87 @@ import (
 	appsV1 "k8s.io/api/apps/v1"
 	batchV1 "k8s.io/api/batch/v1"
 	coreV1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/api/resource"
 	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
 )
 
-func NewMysqlInstance() *MysqlInstance {
-	return &MysqlInstance{}
+// The plan that is used when no plans have been configured for the mysql
+// instance
+var mysqlDefaultPlan = PlanConfig{
+	Name:        "default",
+	ID:          "86064792-7ea2-467b-af93-ac9694d96d5b",
+	Description: "The default plan",
+	Storage:     "2Gi",
+}
+
+func NewMysqlInstance(config InstanceConfig, client kubernetes.Interface) *MysqlInstance {
+	return &MysqlInstance{
+		plans:       config.plans(mysqlDefaultPlan),
+		credentials: config.Credentials,
+		tls:         config.TLS,
+		client:      client,
+	}
 }
 
 type MysqlInstance struct {
+	plans       []PlanConfig
+	credentials CredentialPolicy
+	tls         TLSConfig
+	// The client is used to read the address of the instances from their
+	// services
+	client kubernetes.Interface
 }
 
 // Get the service definition of the mysql instance
 func (s *MysqlInstance) Definition() osb.Service {
 	return osb.Service{
-		Name:        "mysql-instance",
-		ID:          "4f6e6cf6-ffdd-425f-a2c7-3c9258ad246a",
-		Description: "A mysql instance deployment",
-		Bindable:    true,
+		Name:                "mysql-instance",
+		ID:                  "4f6e6cf6-ffdd-425f-a2c7-3c9258ad246a",
+		Description:         "A mysql instance deployment",
+		Bindable:            true,
+		BindingsRetrievable: true,
+		PlanUpdatable:       truePtr(),
 		Metadata: map[string]interface{}{
 			"displayName": "MySql Instance",
 			"imageUrl":    "https://avatars2.githubusercontent.com/u/19862012?s=200&v=4",
 		},
-		Plans: []osb.Plan{
-			{
-				Name:        "default",
-				ID:          "86064792-7ea2-467b-af93-ac9694d96d5b",
-				Description: "The default plan",
-				Free:        truePtr(),
-			},
-		},
+		Plans: planDefinitions(s.plans),
 	}
 }
 
+// Gets the host the clients connect to, this depends on how the instance is
+// exposed
 func (s *MysqlInstance) GetHost(instanceID string, namespace string) string {
+	return s.address(instanceID, namespace).Host
+}
+
+// Gets the address of the instance service the clients connect to
+func (s *MysqlInstance) address(instanceID string, namespace string) exposedAddress {
+	name := fmt.Sprintf("mysql-instance-%s", instanceID)
+	return getExposedAddress(s.client, namespace, name, s.serviceHost(instanceID, namespace), 3306)
+}
+
+// Gets the cluster host of the instance service, the jobs always connect with
+// this so they are not blocked by the load balancer source ranges
+func (s *MysqlInstance) serviceHost(instanceID string, namespace string) string {
 	return fmt.Sprintf("mysql-instance-%s.%s.svc.cluster.local", instanceID, namespace)
 }
 
+// Gets the host of the read only replicas, if the instance plan has no
+// replicas this is the same as the instance host
+func (s *MysqlInstance) GetReadHost(instanceID string, namespace string, planID string) string {
+	if findPlan(s.plans, planID).Replicas > 0 {
+		name := fmt.Sprintf("mysql-instance-%s-read", instanceID)
+		return getExposedAddress(s.client, namespace, name, fmt.Sprintf("%s.%s.svc.cluster.local", name, namespace), 3306).Host
+	}
+
+	return s.GetHost(instanceID, namespace)
+}
+
 func (s *MysqlInstance) GetDebindSpec(options BindOptions) *kube.Spec {
-	deploymentHost := s.GetHost(options.InstanceID, options.Namespace)
+	version := s.version(options.PlanID, options.InstanceParameters)
+	deploymentHost := s.serviceHost(options.InstanceID, options.Namespace)
 	deploymentName := fmt.Sprintf("mysql-instance-%s", options.InstanceID)
 	rootSecretName := fmt.Sprintf("%s-root-secret", deploymentName)
 	bindingSecretName := fmt.Sprintf("binding-secret-%s", options.ID)
@@ -75,7 +119,7 @@ func (s *MysqlInstance) GetDebindSpec(options BindOptions) *kube.Spec {
 							Containers: []coreV1.Container{
 								{
 									Name:    "mysql",
-									Image:   "mysql:5.7",
+									Image:   version.Image,
 									Command: []string{"bash", "/tmp/debind.bash"},
 									Env: []coreV1.EnvVar{
 										{
@@ -117,12 +161,14 @@ func (s *MysqlInstance) GetDebindSpec(options BindOptions) *kube.Spec {
 }
 
 func (s *MysqlInstance) GetBindSpec(options BindOptions) *kube.Spec {
-	deploymentHost := s.GetHost(options.InstanceID, options.Namespace)
+	version := s.version(options.PlanID, options.InstanceParameters)
+	deploymentHost := s.serviceHost(options.InstanceID, options.Namespace)
 	deploymentName := fmt.Sprintf("mysql-instance-%s", options.InstanceID)
 	rootSecretName := fmt.Sprintf("%s-root-secret", deploymentName)
 	bindingSecretName := fmt.Sprintf("binding-secret-%s", options.ID)
+	address := s.address(options.InstanceID, options.Namespace)
 
-	return &kube.Spec{
+	spec := &kube.Spec{
 		Namespace: options.Namespace,
 		Lables: map[string]string{
 			"service-binding-id":  options.ID,
@@ -137,10 +183,13 @@ func (s *MysqlInstance) GetBindSpec(options BindOptions) *kube.Spec {
 				},
 				Type: "Opaque",
 				Data: map[string][]byte{
-					"host":     []byte(s.GetHost(options.InstanceID, options.Namespace)),
-					"user":     []byte(fmt.Sprintf("user-%s", kube.RandStringBytes(8))),
-					"database": []byte("service_database"),
-					"password": []byte(kube.RandStringBytes(18)),
+					"host":       []byte(address.Host),
+					"port":       []byte(strconv.Itoa(int(address.Port))),
+					"write_host": []byte(address.Host),
+					"read_host":  []byte(s.GetReadHost(options.InstanceID, options.Namespace, options.PlanID)),
+					"user":       []byte(s.credentials.Username("user-%s")),
+					"database":   []byte("service_database"),
+					"password":   []byte(s.credentials.Password(18)),
 				},
 			},
 		},
@@ -157,7 +206,7 @@ func (s *MysqlInstance) GetBindSpec(options BindOptions) *kube.Spec {
 							Containers: []coreV1.Container{
 								{
 									Name:    "mysql",
-									Image:   "mysql:5.7",
+									Image:   version.Image,
 									Command: []string{"bash", "/tmp/bind.bash"},
 									Env: []coreV1.EnvVar{
 										{
@@ -168,6 +217,10 @@ func (s *MysqlInstance) GetBindSpec(options BindOptions) *kube.Spec {
 										kube.EnvSecret("DB_NAME", bindingSecretName, "database"),
 										kube.EnvSecret("DB_USER", bindingSecretName, "user"),
 										kube.EnvSecret("DB_PASSWORD", bindingSecretName, "password"),
+										{
+											Name:  "DB_AUTH_CLAUSE",
+											Value: version.AuthClause,
+										},
 									},
 									VolumeMounts: []coreV1.VolumeMount{
 										{
@@ -198,18 +251,100 @@ func (s *MysqlInstance) GetBindSpec(options BindOptions) *kube.Spec {
 			},
 		},
 	}
+
+	for key, value := range s.bindingTLS(options) {
+		spec.Secrets[0].Data[key] = value
+	}
+
+	return spec
+}
+
+func (s *MysqlInstance) ValidateProvision(options ServiceOptions) error {
+	backup := newMysqlBackupOptions(options.Parameters)
+	restore := newMysqlRestoreOptions(options.Parameters)
+
+	plan := findPlan(s.plans, options.PlanID)
+	if err := validateMysqlVersion(mysqlVersionName(plan, options.Parameters)); err != nil {
+		return err
+	}
+
+	switch backup.Target {
+	case "pvc":
+	case "minio-instance":
+		if backup.MinioInstance == "" {
+			return errors.New("The 'backup_minio_instance' parameter is required with the 'minio-instance' backup target")
+		}
+	case "s3":
+		if backup.Endpoint == "" || backup.SecretName == "" {
+			return errors.New("The 'backup_s3_endpoint' and 'backup_s3_secret' parameters are required with the 's3' backup target")
+		}
+	default:
+		return fmt.Errorf("Invalid backup target '%s'", backup.Target)
+	}
+
+	if plan.Replicas > 0 && mysqlVersions[mysqlVersionName(plan, options.Parameters)].Flavour != "mysql" {
+		return errors.New("Replicas are only available with the mysql versions")
+	}
+
+	if err := validateExposureParameters(plan, options.Parameters); err != nil {
+		return err
+	}
+
+	exposure := instanceExposure(plan, options.Parameters)
+	if err := exposure.Validate(); err != nil {
+		return err
+	}
+
+	if exposure.Type == ExposeIngress {
+		return errors.New("Mysql instances can't be exposed with an ingress")
+	}
+
+	if plan.RequireTLS && mysqlVersions[mysqlVersionName(plan, options.Parameters)].Flavour != "mysql" {
+		return errors.New("Requiring tls is only available with the mysql versions")
+	}
+
+	if s.tls.Provider == TLSProviderBroker {
+		if _, err := ensureCA(s.client, options.GlobalNamespace, s.tls.caSecret()); err != nil {
+			return fmt.Errorf("Unable to get the broker ca: %s", err.Error())
+		}
+	}
+
+	if restore.CloneFrom != "" && restore.BackupInstance != "" {
+		return errors.New("An instance can't be cloned and restored from a backup at the same time")
+	}
+
+	if restore.BackupInstance != "" && backup.Target == "pvc" {
+		return errors.New("Restoring a backup requires a 'backup_target' of 'minio-instance' or 's3'")
+	}
+
+	return nil
 }
 
 func (s *MysqlInstance) GetDeprovisionSpec(options ServiceOptions) *kube.Spec {
 	return &kube.Spec{Namespace: options.Namespace}
 }
 
+// Gets the provision spec of an instance, the certificate errors are only
+// logged here because the spec is also used to delete the instance
 func (s *MysqlInstance) GetProvisionSpec(options ServiceOptions) *kube.Spec {
+	spec, err := s.BuildProvisionSpec(options)
+	if err != nil {
+		glog.Errorf("Unable to secure instance '%s': %v", options.ID, err)
+	}
+
+	return spec
+}
+
+// Builds the provision spec of an instance and returns the errors of issuing
+// its certificate
+func (s *MysqlInstance) BuildProvisionSpec(options ServiceOptions) (*kube.Spec, error) {
 	deploymentName := fmt.Sprintf("mysql-instance-%s", options.ID)
 	secretName := fmt.Sprintf("%s-root-secret", deploymentName)
 	pvcName := fmt.Sprintf("%s-pvc", deploymentName)
+	plan := findPlan(s.plans, options.PlanID)
+	version := s.version(options.PlanID, options.Parameters)
 
-	return &kube.Spec{
+	spec := &kube.Spec{
 		Namespace: options.Namespace,
 		Lables: map[string]string{
 			"service-instance-id": options.ID,
@@ -217,40 +352,29 @@ func (s *MysqlInstance) GetProvisionSpec(options ServiceOptions) *kube.Spec {
 			"service-name":        s.Definition().Name,
 			"service-plan":        options.PlanID,
 		},
-		Secrets: []coreV1.Secret{
+		Secrets: append([]coreV1.Secret{
 			{
 				ObjectMeta: metaV1.ObjectMeta{
 					Name: secretName,
 				},
 				Type: "Opaque",
 				Data: map[string][]byte{
-					"password": []byte(kube.RandStringBytes(16)),
+					"password": []byte(s.credentials.Password(16)),
 				},
 			},
-		},
+		}, s.getCloneSecrets(options)...),
 		ConfigMaps: []coreV1.ConfigMap{
 			{
 				ObjectMeta: metaV1.ObjectMeta{
 					Name: deploymentName,
 				},
 				Data: map[string]string{
-					"backup.bash": `
-set -e
-
-export MYSQL_PWD="$MYSQL_ROOT_PASSWORD"
-DBS=$(mysql -uroot -h "$MYSQL_HOST" -e 'show databases' -s --skip-column-names | grep -Ev "(mysql|information_schema|performance_schema)");
-
-BACKUP_DIR=/var/lib/mysql/backups;
-test -d "$BACKUP_DIR" || mkdir -p "$BACKUP_DIR"
-
-for db in $DBS; do
-	test -d "$BACKUP_DIR/$db" || mkdir -p "$BACKUP_DIR/$db"
-	for table in $(mysql -uroot -h "$MYSQL_HOST" -e 'show tables' $db -s --skip-column-names); do
-		echo "Backing up '$db/$table'"
-		mysqldump -uroot -h "$MYSQL_HOST" $db $table > "$BACKUP_DIR/$db/$table.sql"
-	done
-done
-`,
+					"backup.bash":          mysqlBackupScript,
+					"backup-upload.bash":   mysqlBackupUploadScript,
+					"backup-download.bash": mysqlBackupDownloadScript,
+					"restore.bash":         mysqlRestoreScript,
+					"clone.bash":           mysqlCloneScript,
+					"replication.bash":     mysqlReplicationScript,
 					"bind.bash": `
 set -e
 
@@ -263,7 +387,7 @@ done
 
 echo "Creating databse '$DB_NAME' and granting privileges to '$DB_USER'"
 mysql -uroot -h "$MYSQL_HOST" -e "CREATE SCHEMA IF NOT EXISTS $DB_NAME;"
-mysql -uroot -h "$MYSQL_HOST" -e "CREATE USER IF NOT EXISTS '$DB_USER'@'%' IDENTIFIED BY '$DB_PASSWORD';"
+mysql -uroot -h "$MYSQL_HOST" -e "CREATE USER IF NOT EXISTS '$DB_USER'@'%' IDENTIFIED $DB_AUTH_CLAUSE BY '$DB_PASSWORD';"
 mysql -uroot -h "$MYSQL_HOST" -e "GRANT ALL PRIVILEGES ON $DB_NAME.* TO '$DB_USER'@'%';"
 mysql -uroot -h "$MYSQL_HOST" -e "FLUSH PRIVILEGES;"
 `,
@@ -292,11 +416,7 @@ mysql -uroot -h "$MYSQL_HOST" -e "DROP USER '$DB_USER';"
 					AccessModes: []coreV1.PersistentVolumeAccessMode{
 						"ReadWriteOnce",
 					},
-					Resources: coreV1.ResourceRequirements{
-						Requests: coreV1.ResourceList{
-							"storage": resource.MustParse("2Gi"),
-						},
-					},
+					Resources: plan.StorageResources(),
 				},
 			},
 		},
@@ -307,6 +427,11 @@ mysql -uroot -h "$MYSQL_HOST" -e "DROP USER '$DB_USER';"
 				},
 				Spec: appsV1.DeploymentSpec{
 					Replicas: int32Ptr(1),
+					// The old pod must be stopped before the new one starts so
+					// two servers never use the same data directory
+					Strategy: appsV1.DeploymentStrategy{
+						Type: appsV1.RecreateDeploymentStrategyType,
+					},
 					Selector: &metaV1.LabelSelector{
 						MatchLabels: map[string]string{
 							"app": deploymentName,
@@ -321,8 +446,10 @@ mysql -uroot -h "$MYSQL_HOST" -e "DROP USER '$DB_USER';"
 						Spec: coreV1.PodSpec{
 							Containers: []coreV1.Container{
 								{
-									Name:  "mysql",
-									Image: "mysql:5.7",
+									Name:      "mysql",
+									Image:     version.Image,
+									Args:      mysqlArgs(plan),
+									Resources: plan.Resources(),
 									Ports: []coreV1.ContainerPort{
 										{
 											Name:          "tpc",
@@ -330,7 +457,7 @@ mysql -uroot -h "$MYSQL_HOST" -e "DROP USER '$DB_USER';"
 											ContainerPort: 3306,
 										},
 									},
-									Env: []coreV1.EnvVar{
+									Env: append([]coreV1.EnvVar{
 										{
 											Name: "MYSQL_ROOT_PASSWORD",
 											ValueFrom: &coreV1.EnvVarSource{
@@ -340,7 +467,7 @@ mysql -uroot -h "$MYSQL_HOST" -e "DROP USER '$DB_USER';"
 												},
 											},
 										},
-									},
+									}, version.Env...),
 									ReadinessProbe: &coreV1.Probe{
 										Handler: coreV1.Handler{
 											TCPSocket: &coreV1.TCPSocketAction{
@@ -388,7 +515,6 @@ mysql -uroot -h "$MYSQL_HOST" -e "DROP USER '$DB_USER';"
 					Selector: map[string]string{
 						"app": deploymentName,
 					},
-					Type: "LoadBalancer",
 					Ports: []coreV1.ServicePort{
 						{
 							Port: 3306,
@@ -401,5 +527,29 @@ mysql -uroot -h "$MYSQL_HOST" -e "DROP USER '$DB_USER';"
 				},
 			},
 		},
+		CronJobs: s.getBackupCronJobs(options),
+		Jobs:     s.getRestoreJobs(options),
 	}
+
+	instanceExposure(plan, options.Parameters).exposeService(&spec.Services[0], options.ID)
+
+	// The high availability plans replace the single deployment with a primary
+	// and a replica stateful set
+	if plan.Replicas > 0 {
+		s.replicate(spec, options)
+	}
+
+	err := s.secure(spec, options)
+
+	return spec, err
+}
+
+// Gets the arguments to pass to mysqld to configure the instance for the plan
+func mysqlArgs(plan PlanConfig) []string {
+	args := []string{}
+	if plan.MaxConnections > 0 {
+		args = append(args, fmt.Sprintf("--max-connections=%d", plan.MaxConnections))
+	}
+
+	return args
 }
@@ -3,10 +3,12 @@ package service
 import (
 	"testing"
 
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes/fake"
 )
 
-var spec = NewMysqlInstance().GetProvisionSpec(ServiceOptions{
+var spec = NewMysqlInstance(InstanceConfig{}, nil).GetProvisionSpec(ServiceOptions{
 	ID:     "test-id",
 	PlanID: "86064792-7ea2-467b-af93-ac9694d96d5b",
 })
@@ -35,3 +37,263 @@ func TestApply(t *testing.T) {
 		t.Fatalf("error injecting pod add: %v", err)
 	}
 }
+
+func TestMysqlBackupCronJob(t *testing.T) {
+	if len(spec.CronJobs) != 0 {
+		t.Errorf("Backups should not be scheduled without a 'backup_schedule'")
+	}
+
+	backupSpec := NewMysqlInstance(InstanceConfig{}, nil).GetProvisionSpec(ServiceOptions{
+		ID:     "test-id",
+		PlanID: "86064792-7ea2-467b-af93-ac9694d96d5b",
+		Parameters: map[string]interface{}{
+			"backup_schedule":  "0 2 * * *",
+			"backup_retention": float64(3),
+		},
+	})
+
+	if len(backupSpec.CronJobs) != 1 {
+		t.Fatalf("Invalid number of backup cron jobs '%d'", len(backupSpec.CronJobs))
+	}
+
+	cronJob := backupSpec.CronJobs[0]
+	if cronJob.Spec.Schedule != "0 2 * * *" {
+		t.Errorf("Invalid backup schedule '%s'", cronJob.Spec.Schedule)
+	}
+
+	podSpec := cronJob.Spec.JobTemplate.Spec.Template.Spec
+	if podSpec.Volumes[1].PersistentVolumeClaim.ClaimName != "mysql-instance-test-id-pvc" {
+		t.Errorf("The pvc backup should mount the instance pvc")
+	}
+
+	if podSpec.Containers[0].Env[2].Value != "3" {
+		t.Errorf("Invalid backup retention '%s'", podSpec.Containers[0].Env[2].Value)
+	}
+}
+
+func TestMysqlBackupCronJobMinioTarget(t *testing.T) {
+	backupSpec := NewMysqlInstance(InstanceConfig{}, nil).GetProvisionSpec(ServiceOptions{
+		ID:     "test-id",
+		PlanID: "86064792-7ea2-467b-af93-ac9694d96d5b",
+		Parameters: map[string]interface{}{
+			"backup_schedule":       "@daily",
+			"backup_target":         "minio-instance",
+			"backup_minio_instance": "minio-id",
+		},
+	})
+
+	podSpec := backupSpec.CronJobs[0].Spec.JobTemplate.Spec.Template.Spec
+	if len(podSpec.InitContainers) != 1 || podSpec.InitContainers[0].Image != "mysql:5.7" {
+		t.Fatalf("The dump should be taken in an init container")
+	}
+
+	alias := podSpec.Containers[0].Env[0].ValueFrom.SecretKeyRef
+	if alias.Name != "minio-instance-minio-id-admin-secret" || alias.Key != "minioalias" {
+		t.Errorf("Invalid backup alias secret '%s/%s'", alias.Name, alias.Key)
+	}
+}
+
+func TestMysqlRestoreFromBackup(t *testing.T) {
+	options := ServiceOptions{
+		ID:     "test-id",
+		PlanID: "86064792-7ea2-467b-af93-ac9694d96d5b",
+		Parameters: map[string]interface{}{
+			"restore_from_backup": "source-id/20200101020000",
+		},
+	}
+
+	if err := NewMysqlInstance(InstanceConfig{}, nil).ValidateProvision(options); err == nil {
+		t.Errorf("Restoring a backup should not be valid with the pvc backup target")
+	}
+
+	options.Parameters["backup_target"] = "minio-instance"
+	options.Parameters["backup_minio_instance"] = "minio-id"
+	if err := NewMysqlInstance(InstanceConfig{}, nil).ValidateProvision(options); err != nil {
+		t.Errorf("Invalid restore options '%s'", err.Error())
+	}
+
+	restoreSpec := NewMysqlInstance(InstanceConfig{}, nil).GetProvisionSpec(options)
+	if len(restoreSpec.Jobs) != 1 || restoreSpec.Jobs[0].Name != "mysql-instance-test-id-restore" {
+		t.Fatalf("The restore job should be created")
+	}
+
+	for _, env := range restoreSpec.Jobs[0].Spec.Template.Spec.InitContainers[0].Env {
+		if env.Name == "BACKUP_PREFIX" && env.Value != "mysql-instance-source-id" {
+			t.Errorf("Invalid backup prefix '%s'", env.Value)
+		}
+
+		if env.Name == "RESTORE_BACKUP" && env.Value != "20200101020000" {
+			t.Errorf("Invalid backup name '%s'", env.Value)
+		}
+	}
+}
+
+func TestMysqlCloneInstance(t *testing.T) {
+	cloneSpec := NewMysqlInstance(InstanceConfig{}, nil).GetProvisionSpec(ServiceOptions{
+		ID:         "test-id",
+		PlanID:     "86064792-7ea2-467b-af93-ac9694d96d5b",
+		Parameters: map[string]interface{}{"clone_from_instance": "source-id"},
+		Source: &SourceInstance{
+			ID:        "source-id",
+			Namespace: "production",
+			Secrets: []coreV1.Secret{
+				{
+					ObjectMeta: metaV1.ObjectMeta{Name: "mysql-instance-source-id-root-secret"},
+					Data:       map[string][]byte{"password": []byte("source-password")},
+				},
+			},
+		},
+	})
+
+	cloneSecret := cloneSpec.Secrets[1]
+	if string(cloneSecret.Data["password"]) != "source-password" {
+		t.Errorf("Invalid source password '%s'", cloneSecret.Data["password"])
+	}
+
+	if string(cloneSecret.Data["host"]) != "mysql-instance-source-id.production.svc.cluster.local" {
+		t.Errorf("Invalid source host '%s'", cloneSecret.Data["host"])
+	}
+
+	if len(cloneSpec.Jobs) != 1 || cloneSpec.Jobs[0].Name != "mysql-instance-test-id-clone" {
+		t.Errorf("The clone job should be created")
+	}
+}
+
+func TestMysqlPlans(t *testing.T) {
+	mysql := NewMysqlInstance(InstanceConfig{
+		Plans: []PlanConfig{
+			{Name: "small", ID: "small-id", Storage: "1Gi"},
+			{
+				Name:           "large",
+				ID:             "large-id",
+				Storage:        "20Gi",
+				Requests:       map[string]string{"cpu": "500m", "memory": "1Gi"},
+				Limits:         map[string]string{"memory": "2Gi"},
+				MaxConnections: 500,
+			},
+		},
+	}, nil)
+
+	if len(mysql.Definition().Plans) != 2 {
+		t.Fatalf("Invalid number of plans '%d'", len(mysql.Definition().Plans))
+	}
+
+	largeSpec := mysql.GetProvisionSpec(ServiceOptions{ID: "test-id", PlanID: "large-id"})
+	storage := largeSpec.PVCS[0].Spec.Resources.Requests["storage"]
+	if storage.String() != "20Gi" {
+		t.Errorf("Invalid pvc storage '%s'", storage.String())
+	}
+
+	container := largeSpec.Deployments[0].Spec.Template.Spec.Containers[0]
+	memory := container.Resources.Limits["memory"]
+	if memory.String() != "2Gi" {
+		t.Errorf("Invalid memory limit '%s'", memory.String())
+	}
+
+	if len(container.Args) != 1 || container.Args[0] != "--max-connections=500" {
+		t.Errorf("Invalid mysql args '%v'", container.Args)
+	}
+
+	if err := mysql.ValidateUpdate(ServiceOptions{PlanID: "large-id"}, ServiceOptions{PlanID: "small-id"}); err == nil {
+		t.Errorf("Changing to a plan with different storage should not be valid")
+	}
+
+	if storage := (PlanConfig{Name: "default", ID: "default-id"}).StorageResources().Requests["storage"]; storage.String() != defaultStorage {
+		t.Errorf("Plans without any storage should get the default storage, got '%s'", storage.String())
+	}
+
+	if err := (PlanConfig{Name: "bad", ID: "bad-id", Storage: "lots"}).Validate(); err == nil {
+		t.Errorf("Plans with invalid storage should not be valid")
+	}
+}
+
+func TestMysqlVersion(t *testing.T) {
+	mysql := NewMysqlInstance(InstanceConfig{}, nil)
+	options := ServiceOptions{
+		ID:         "test-id",
+		PlanID:     "86064792-7ea2-467b-af93-ac9694d96d5b",
+		Parameters: map[string]interface{}{"version": "8.0"},
+	}
+
+	versionSpec := mysql.GetProvisionSpec(options)
+	image := versionSpec.Deployments[0].Spec.Template.Spec.Containers[0].Image
+	if image != "mysql:8.0" {
+		t.Errorf("Invalid deployment image '%s'", image)
+	}
+
+	bindSpec := mysql.GetBindSpec(BindOptions{
+		ID:                 "binding-id",
+		InstanceID:         "test-id",
+		InstanceParameters: options.Parameters,
+	})
+	for _, env := range bindSpec.Jobs[0].Spec.Template.Spec.Containers[0].Env {
+		if env.Name == "DB_AUTH_CLAUSE" && env.Value != "WITH mysql_native_password" {
+			t.Errorf("Invalid auth clause '%s'", env.Value)
+		}
+	}
+
+	previous := options
+	previous.Parameters = map[string]interface{}{"version": "5.7"}
+	if err := mysql.ValidateUpdate(options, previous); err != nil {
+		t.Errorf("Upgrading from 5.7 to 8.0 should be valid, got '%s'", err.Error())
+	}
+
+	if err := mysql.ValidateUpdate(previous, options); err == nil {
+		t.Errorf("Downgrading from 8.0 to 5.7 should not be valid")
+	}
+
+	options.Parameters = map[string]interface{}{"version": "mariadb-10.5"}
+	if err := mysql.ValidateUpdate(options, previous); err == nil {
+		t.Errorf("Changing from mysql to mariadb should not be valid")
+	}
+
+	options.Parameters = map[string]interface{}{"version": "9.9"}
+	if err := mysql.ValidateProvision(options); err == nil {
+		t.Errorf("Unknown versions should not be valid")
+	}
+}
+
+func TestMysqlReplicas(t *testing.T) {
+	mysql := NewMysqlInstance(InstanceConfig{
+		Plans: []PlanConfig{
+			{Name: "standalone", ID: "standalone-id", Storage: "1Gi"},
+			{Name: "ha", ID: "ha-id", Storage: "5Gi", Replicas: 2},
+		},
+	}, nil)
+
+	haSpec := mysql.GetProvisionSpec(ServiceOptions{ID: "test-id", Namespace: "test", PlanID: "ha-id"})
+	if len(haSpec.Deployments) != 0 || len(haSpec.StatefulSets) != 2 {
+		t.Fatalf("Invalid number of stateful sets '%d'", len(haSpec.StatefulSets))
+	}
+
+	if *haSpec.StatefulSets[1].Spec.Replicas != 2 {
+		t.Errorf("Invalid number of replicas '%d'", *haSpec.StatefulSets[1].Spec.Replicas)
+	}
+
+	if len(haSpec.PVCS) != 3 || haSpec.PVCS[0].Name != "data-mysql-instance-test-id-primary-0" {
+		t.Errorf("Invalid stateful set pvcs '%v'", haSpec.PVCS)
+	}
+
+	if haSpec.Services[0].Spec.Selector["role"] != "primary" || haSpec.Services[1].Spec.Selector["role"] != "replica" {
+		t.Errorf("The write service must select the primary and the read service the replicas")
+	}
+
+	bindSpec := mysql.GetBindSpec(BindOptions{ID: "binding-id", InstanceID: "test-id", Namespace: "test", PlanID: "ha-id"})
+	readHost := string(bindSpec.Secrets[0].Data["read_host"])
+	if readHost != "mysql-instance-test-id-read.test.svc.cluster.local" {
+		t.Errorf("Invalid read host '%s'", readHost)
+	}
+
+	if err := haSpec.Create(fake.NewSimpleClientset()); err != nil {
+		t.Fatalf("Unable to create the replicated instance: %v", err)
+	}
+
+	options := ServiceOptions{ID: "test-id", PlanID: "ha-id", Parameters: map[string]interface{}{"version": "mariadb-10.5"}}
+	if err := mysql.ValidateProvision(options); err == nil {
+		t.Errorf("Replicas should not be available with mariadb")
+	}
+
+	if err := mysql.ValidateUpdate(ServiceOptions{PlanID: "ha-id"}, ServiceOptions{PlanID: "standalone-id"}); err == nil {
+		t.Errorf("Changing from a standalone plan to a replicated plan should not be valid")
+	}
+}
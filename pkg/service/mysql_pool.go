@@ -0,0 +1,292 @@
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/AdeAttwood/service-broker/pkg/kube"
+	"github.com/golang/glog"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// The strategies a pool can use to choose the server of a new instance
+const (
+	// The server with the fewest databases on it
+	FewestDatabasesStrategy = "fewest-databases"
+	// The server with the fewest databases for its weight, a server with a
+	// weight of two will get twice as many databases as a server with a weight
+	// of one
+	WeightedStrategy = "weighted"
+)
+
+// The config of a pool of shared mysql servers that is offered as one service
+type SharedMysqlPoolConfig struct {
+	Name        string `yaml:"name"`
+	ID          string `yaml:"id"`
+	Description string `yaml:"description"`
+	// How the server of a new instance is chosen, this defaults to
+	// "fewest-databases"
+	Strategy string                  `yaml:"strategy"`
+	Servers  []SharedMysqlPoolServer `yaml:"servers"`
+	Plans    []PlanConfig            `yaml:"plans"`
+	// The policy the binding usernames and passwords are generated with
+	Credentials CredentialPolicy `yaml:"credentials"`
+	// The pod security of the jobs on the pool servers, this overrides the
+	// pod security of the broker
+	PodSecurity PodSecurityConfig `yaml:"podSecurity"`
+}
+
+// A server in a shared mysql pool
+type SharedMysqlPoolServer struct {
+	SharedMysqlConfig `yaml:",inline"`
+	// The capacity of the server compared to the other servers in the pool,
+	// only used by the "weighted" strategy. This defaults to one
+	Weight int `yaml:"weight"`
+	// Instances can be placed on the servers with some labels with the
+	// "server_labels" parameter
+	Labels map[string]string `yaml:"labels"`
+}
+
+func NewSharedMysqlPool(config SharedMysqlPoolConfig, client kubernetes.Interface) (*SharedMysqlPool, error) {
+	if config.Name == "" || config.ID == "" {
+		return nil, fmt.Errorf("Shared mysql pools must have a name and an id")
+	}
+
+	if len(config.Servers) == 0 || len(config.Plans) == 0 {
+		return nil, fmt.Errorf("The shared mysql pool '%s' must have at least one server and plan", config.Name)
+	}
+
+	if config.Strategy == "" {
+		config.Strategy = FewestDatabasesStrategy
+	}
+
+	if config.Strategy != FewestDatabasesStrategy && config.Strategy != WeightedStrategy {
+		return nil, fmt.Errorf("Invalid strategy '%s' in the shared mysql pool '%s'", config.Strategy, config.Name)
+	}
+
+	servers := map[string]bool{}
+	for i, server := range config.Servers {
+		if server.Name == "" || servers[server.Name] {
+			return nil, fmt.Errorf("The servers in the shared mysql pool '%s' must have unique names", config.Name)
+		}
+
+		if err := server.ValidateCredentials(); err != nil {
+			return nil, err
+		}
+
+		if server.Weight < 0 {
+			return nil, fmt.Errorf("Invalid weight '%d' for the server '%s'", server.Weight, server.Name)
+		}
+
+		if server.Weight == 0 {
+			config.Servers[i].Weight = 1
+		}
+
+		servers[server.Name] = true
+	}
+
+	for _, plan := range config.Plans {
+		if err := plan.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := config.Credentials.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &SharedMysqlPool{config: config, client: client}, nil
+}
+
+// A service that creates the databases on a pool of shared mysql servers. The
+// server of each instance is chosen when it is provisioned and is stored in
+// the instance secret so the bindings are created on the same server
+type SharedMysqlPool struct {
+	config SharedMysqlPoolConfig
+	client kubernetes.Interface
+}
+
+var _ ProvisionValidator = &SharedMysqlPool{}
+
+func (s *SharedMysqlPool) Definition() osb.Service {
+	description := s.config.Description
+	if description == "" {
+		description = "A database on a pool of shared mysql servers"
+	}
+
+	return osb.Service{
+		Name:                fmt.Sprintf("mysql-pool-%s", s.config.Name),
+		ID:                  s.config.ID,
+		Description:         description,
+		Bindable:            true,
+		BindingsRetrievable: true,
+		Metadata: map[string]interface{}{
+			"displayName": "Shared Mysql Database",
+			"imageUrl":    "htps://avatars2.githubusercontent.com/u/19862012?s=200&v=4",
+		},
+		Plans: planDefinitions(s.config.Plans),
+	}
+}
+
+// Gets the name of the secret that holds the server of an instance
+func mysqlPoolSecretName(instanceID string) string {
+	return fmt.Sprintf("mysql-pool-instance-%s-secret", instanceID)
+}
+
+// The host depends on the server the instance was placed on so it can't be
+// found from the instance id
+func (s *SharedMysqlPool) GetHost(instanceID string, namespace string) string {
+	return ""
+}
+
+// Gets the servers that have all of the labels in the "server_labels"
+// parameter
+func (s *SharedMysqlPool) candidates(parameters map[string]interface{}) ([]SharedMysqlPoolServer, error) {
+	labels, ok := parameters["server_labels"].(map[string]interface{})
+	if parameters["server_labels"] != nil && !ok {
+		return nil, fmt.Errorf("Invalid server_labels, this must be an object")
+	}
+
+	candidates := []SharedMysqlPoolServer{}
+	for _, server := range s.config.Servers {
+		matches := true
+		for label, value := range labels {
+			if server.Labels[label] != fmt.Sprint(value) {
+				matches = false
+			}
+		}
+
+		if matches {
+			candidates = append(candidates, server)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("No server in the pool '%s' has the labels '%v'", s.config.Name, labels)
+	}
+
+	return candidates, nil
+}
+
+// Counts the instances on each server of the pool from the instance secrets
+func (s *SharedMysqlPool) databaseCounts(namespace string) (map[string]int, error) {
+	list, err := s.client.CoreV1().Secrets(namespace).List(context.TODO(), metaV1.ListOptions{
+		LabelSelector: fmt.Sprintf("service-id=%s", s.config.ID),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	counts := map[string]int{}
+	for _, secret := range list.Items {
+		counts[string(secret.Data["server"])]++
+	}
+
+	return counts, nil
+}
+
+// Chooses the server a new instance will be placed on with the strategy of
+// the pool. When more than one server has the same score the first one in
+// the config is used
+func (s *SharedMysqlPool) place(options ServiceOptions) (SharedMysqlPoolServer, error) {
+	candidates, err := s.candidates(options.Parameters)
+	if err != nil {
+		return SharedMysqlPoolServer{}, err
+	}
+
+	counts, err := s.databaseCounts(options.GlobalNamespace)
+	if err != nil {
+		return SharedMysqlPoolServer{}, err
+	}
+
+	best := candidates[0]
+	bestScore := -1.0
+	for _, server := range candidates {
+		score := float64(counts[server.Name])
+		if s.config.Strategy == WeightedStrategy {
+			score = score / float64(server.Weight)
+		}
+
+		if bestScore < 0 || score < bestScore {
+			best = server
+			bestScore = score
+		}
+	}
+
+	return best, nil
+}
+
+// Checks the instance can be placed on a server so placement errors are
+// returned before the spec is generated
+func (s *SharedMysqlPool) ValidateProvision(options ServiceOptions) error {
+	if _, err := s.place(options); err != nil {
+		return fmt.Errorf("Unable to place the instance in the pool '%s': %v", s.config.Name, err)
+	}
+
+	return nil
+}
+
+// Gets a server of the pool by its name, the first server is used when the
+// server has been removed from the config
+func (s *SharedMysqlPool) server(name string) SharedMysqlPoolServer {
+	for _, server := range s.config.Servers {
+		if server.Name == name {
+			return server
+		}
+	}
+
+	return s.config.Servers[0]
+}
+
+// Gets where the jobs read the admin credentials of a server from
+func (s *SharedMysqlPool) jobCredentials(server SharedMysqlPoolServer) mysqlJobCredentials {
+	credentials, err := server.jobCredentials()
+	if err != nil {
+		glog.Errorf("Unable to read the credentials of the server '%s' in the pool '%s': %v", server.Name, s.config.Name, err)
+	}
+
+	return credentials
+}
+
+func (s *SharedMysqlPool) GetDebindSpec(options BindOptions) *kube.Spec {
+	secretName := mysqlPoolSecretName(options.InstanceID)
+	server := s.server(string(options.InstanceSecretData(secretName)["server"]))
+
+	return sharedMysqlDebindSpec(s.Definition(), options, secretName, s.jobCredentials(server))
+}
+
+func (s *SharedMysqlPool) GetBindSpec(options BindOptions) *kube.Spec {
+	secretName := mysqlPoolSecretName(options.InstanceID)
+	instance := options.InstanceSecretData(secretName)
+	server := s.server(string(instance["server"]))
+
+	return sharedMysqlBindSpec(s.Definition(), options, secretName, s.jobCredentials(server), string(instance["host"]), string(instance["port"]), string(instance["database"]), findPlan(s.config.Plans, options.PlanID), s.config.Credentials)
+}
+
+func (s *SharedMysqlPool) GetDeprovisionSpec(options ServiceOptions) *kube.Spec {
+	secretName := mysqlPoolSecretName(options.ID)
+	server := s.server(string(options.InstanceSecretData(secretName)["server"]))
+
+	return sharedMysqlDeprovisionSpec(s.Definition(), options, secretName, s.jobCredentials(server))
+}
+
+// The instance secret stores the server the instance was placed on. The server
+// is chosen again when the spec is generated to be deleted but only the secret
+// name is needed to remove it. The placement was checked by ValidateProvision
+// so the first server is only used if the instances can't be counted anymore
+func (s *SharedMysqlPool) GetProvisionSpec(options ServiceOptions) *kube.Spec {
+	server, err := s.place(options)
+	if err != nil {
+		glog.Errorf("Unable to place the instance '%s' in the pool '%s': %v", options.ID, s.config.Name, err)
+		server = s.config.Servers[0]
+	}
+
+	return sharedMysqlProvisionSpec(s.Definition(), options, mysqlPoolSecretName(options.ID), s.jobCredentials(server), map[string][]byte{
+		"server": []byte(server.Name),
+		"host":   []byte(server.Host),
+		"port":   []byte(server.Port),
+	})
+}
@@ -0,0 +1,100 @@
+package service
+
+import (
+	"errors"
+	"testing"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8sTesting "k8s.io/client-go/testing"
+)
+
+var mysqlPoolTestConfig = SharedMysqlPoolConfig{
+	Name: "pool",
+	ID:   "mysql-pool-id",
+	Servers: []SharedMysqlPoolServer{
+		{SharedMysqlConfig: SharedMysqlConfig{Name: "small", Host: "small.example.com", Port: "3306"}, Labels: map[string]string{"region": "eu"}},
+		{SharedMysqlConfig: SharedMysqlConfig{Name: "large", Host: "large.example.com", Port: "3306"}, Weight: 3},
+	},
+	Plans: []PlanConfig{{Name: "default", ID: "default-id"}},
+}
+
+// Gets a client with instances already placed on the servers of the pool
+func mysqlPoolClient(servers ...string) *fake.Clientset {
+	client := fake.NewSimpleClientset()
+	for i, server := range servers {
+		client.Tracker().Add(&coreV1.Secret{
+			ObjectMeta: metaV1.ObjectMeta{
+				Name:      mysqlPoolSecretName(string(rune('a' + i))),
+				Namespace: "service-broker",
+				Labels:    map[string]string{"service-id": "mysql-pool-id"},
+			},
+			Data: map[string][]byte{"server": []byte(server)},
+		})
+	}
+
+	return client
+}
+
+func TestMysqlPoolPlacement(t *testing.T) {
+	options := ServiceOptions{ID: "test-id", GlobalNamespace: "service-broker"}
+
+	pool, _ := NewSharedMysqlPool(mysqlPoolTestConfig, mysqlPoolClient("small", "large", "large"))
+	if server, _ := pool.place(options); server.Name != "small" {
+		t.Errorf("The server with the fewest databases should be used not '%s'", server.Name)
+	}
+
+	config := mysqlPoolTestConfig
+	config.Strategy = WeightedStrategy
+	pool, _ = NewSharedMysqlPool(config, mysqlPoolClient("small", "large", "large"))
+	if server, _ := pool.place(options); server.Name != "large" {
+		t.Errorf("The server with the most capacity should be used not '%s'", server.Name)
+	}
+
+	options.Parameters = map[string]interface{}{"server_labels": map[string]interface{}{"region": "eu"}}
+	if server, _ := pool.place(options); server.Name != "small" {
+		t.Errorf("The server with the labels should be used not '%s'", server.Name)
+	}
+
+	options.Parameters = map[string]interface{}{"server_labels": map[string]interface{}{"region": "us"}}
+	if err := pool.ValidateProvision(options); err == nil {
+		t.Errorf("Labels that don't match any server should not be valid")
+	}
+
+	client := mysqlPoolClient()
+	client.PrependReactor("list", "secrets", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("unavailable")
+	})
+
+	pool, _ = NewSharedMysqlPool(mysqlPoolTestConfig, client)
+	if err := pool.ValidateProvision(ServiceOptions{ID: "test-id", GlobalNamespace: "service-broker"}); err == nil {
+		t.Errorf("Instances should not be placed when the instances can't be counted")
+	}
+
+	config.Strategy = "random"
+	if _, err := NewSharedMysqlPool(config, mysqlPoolClient()); err == nil {
+		t.Errorf("Invalid strategies should not be valid")
+	}
+}
+
+func TestMysqlPoolBinding(t *testing.T) {
+	pool, _ := NewSharedMysqlPool(mysqlPoolTestConfig, mysqlPoolClient("small"))
+	instance := pool.GetProvisionSpec(ServiceOptions{ID: "test-id", GlobalNamespace: "service-broker"})
+	if string(instance.Secrets[0].Data["server"]) != "large" {
+		t.Errorf("The instance should be placed on the empty server")
+	}
+
+	spec := pool.GetBindSpec(BindOptions{
+		ID:              "binding-id",
+		InstanceID:      "test-id",
+		Namespace:       "my-app",
+		GlobalNamespace: "service-broker",
+		InstanceSecrets: instance.Secrets,
+	})
+
+	if string(spec.Secrets[0].Data["host"]) != "large.example.com" {
+		t.Errorf("The binding should be on the server of the instance not '%s'", spec.Secrets[0].Data["host"])
+	}
+}
@@ -0,0 +1,283 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/golang/glog"
+
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// The privileges that are removed from the binding users when a database is
+// locked for being over its quota
+var mysqlWritePrivileges = []string{"INSERT", "UPDATE", "CREATE", "ALTER", "INDEX"}
+
+// The annotation on the instance secret with the write privileges that were
+// revoked from each binding user when the database was locked. The database
+// is locked while the annotation is set
+const mysqlRevokedAnnotation = "service-quota-revoked"
+
+func (s *SharedMysql) CheckUsage(instances []coreV1.Secret) []InstanceUsage {
+	return checkSharedMysqlUsage(s.client, s.plans, instances, mysqlSharedSecretName, func(instance coreV1.Secret) (string, string, error) {
+		return s.config.credentials(s.client, instance.Namespace)
+	})
+}
+
+func (s *SharedMysqlPool) CheckUsage(instances []coreV1.Secret) []InstanceUsage {
+	return checkSharedMysqlUsage(s.client, s.config.Plans, instances, mysqlPoolSecretName, func(instance coreV1.Secret) (string, string, error) {
+		return s.server(string(instance.Data["server"])).credentials(s.client, instance.Namespace)
+	})
+}
+
+// Gets the usage of a database from its size and the storage quota of the
+// plan
+func sharedMysqlUsage(instanceID string, plan PlanConfig, size int64) InstanceUsage {
+	usage := InstanceUsage{InstanceID: instanceID, StorageBytes: size}
+	if plan.Storage != "" {
+		if quota, err := resource.ParseQuantity(plan.Storage); err == nil {
+			usage.StorageQuota = quota.Value()
+		}
+	}
+
+	usage.OverQuota = usage.StorageQuota > 0 && usage.StorageBytes > usage.StorageQuota
+	usage.Locked = usage.OverQuota && plan.QuotaAction == QuotaActionLock
+
+	return usage
+}
+
+// Measures the databases of the shared mysql instances and locks or unlocks
+// the databases with the "lock" quota action. The instances are grouped by
+// server so each server is only connected to once with the admin credentials
+// of the server
+func checkSharedMysqlUsage(client kubernetes.Interface, plans []PlanConfig, instances []coreV1.Secret, secretName func(string) string, credentials func(coreV1.Secret) (string, string, error)) []InstanceUsage {
+	servers := map[string][]coreV1.Secret{}
+	for _, instance := range instances {
+		instanceID := instance.Labels["service-instance-id"]
+		if instance.Name != secretName(instanceID) || len(instance.Data["database"]) == 0 {
+			continue
+		}
+
+		address := net.JoinHostPort(string(instance.Data["host"]), string(instance.Data["port"]))
+		servers[address] = append(servers[address], instance)
+	}
+
+	usages := []InstanceUsage{}
+	for address, serverInstances := range servers {
+		user, password, err := credentials(serverInstances[0])
+		if err != nil {
+			glog.Errorf("Unable to get the credentials of the mysql server '%s': %v", address, err)
+			continue
+		}
+
+		config := mysql.NewConfig()
+		config.User = user
+		config.Passwd = password
+		config.Net = "tcp"
+		config.Addr = address
+
+		db, err := sql.Open("mysql", config.FormatDSN())
+		if err != nil {
+			glog.Errorf("Unable to connect to the mysql server '%s': %v", address, err)
+			continue
+		}
+
+		sizes, err := mysqlDatabaseSizes(db)
+		if err != nil {
+			glog.Errorf("Unable to get the database sizes on '%s': %v", address, err)
+			db.Close()
+			continue
+		}
+
+		for _, instance := range serverInstances {
+			plan := findPlan(plans, instance.Labels["service-plan"])
+			database := string(instance.Data["database"])
+			usage := sharedMysqlUsage(instance.Labels["service-instance-id"], plan, sizes[database])
+
+			if plan.QuotaAction == QuotaActionLock {
+				if err := mysqlUpdateLock(client, db, instance, database, usage.Locked); err != nil {
+					glog.Errorf("Unable to update the privileges on '%s': %v", database, err)
+				}
+			}
+
+			usages = append(usages, usage)
+		}
+
+		db.Close()
+	}
+
+	return usages
+}
+
+// Gets the size in bytes of all of the databases on a server
+func mysqlDatabaseSizes(db *sql.DB) (map[string]int64, error) {
+	rows, err := db.Query("SELECT table_schema, COALESCE(SUM(data_length + index_length), 0) FROM information_schema.tables GROUP BY table_schema")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sizes := map[string]int64{}
+	for rows.Next() {
+		var database string
+		var size int64
+		if err := rows.Scan(&database, &size); err != nil {
+			return nil, err
+		}
+
+		sizes[database] = size
+	}
+
+	return sizes, rows.Err()
+}
+
+// Locks or unlocks the database of an instance. Locking revokes the write
+// privileges the binding users have on the database, the revoked privileges
+// are stored on the instance secret before they are revoked so unlocking only
+// gives back exactly those. Nothing is changed when the database is already
+// in the right state
+func mysqlUpdateLock(client kubernetes.Interface, db *sql.DB, instance coreV1.Secret, database string, lock bool) error {
+	value, locked := instance.Annotations[mysqlRevokedAnnotation]
+	if lock == locked {
+		return nil
+	}
+
+	if !lock {
+		revoked := map[string][]string{}
+		if err := json.Unmarshal([]byte(value), &revoked); err != nil {
+			return err
+		}
+
+		for user, privileges := range revoked {
+			if _, err := db.Exec(fmt.Sprintf("GRANT %s ON `%s`.* TO %s", strings.Join(privileges, ", "), database, user)); err != nil {
+				return err
+			}
+		}
+
+		return setMysqlRevoked(client, instance, nil)
+	}
+
+	users, err := mysqlBindingUsers(client, instance)
+	if err != nil {
+		return err
+	}
+
+	revoked, err := mysqlWriteGrants(db, database, users)
+	if err != nil {
+		return err
+	}
+
+	if err := setMysqlRevoked(client, instance, revoked); err != nil {
+		return err
+	}
+
+	for user, privileges := range revoked {
+		if _, err := db.Exec(fmt.Sprintf("REVOKE %s ON `%s`.* FROM %s", strings.Join(privileges, ", "), database, user)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Gets the users the broker created for the bindings of an instance
+func mysqlBindingUsers(client kubernetes.Interface, instance coreV1.Secret) (map[string]bool, error) {
+	list, err := client.CoreV1().Secrets(instance.Namespace).List(context.TODO(), metaV1.ListOptions{
+		LabelSelector: fmt.Sprintf("service-instance-id=%s,service-binding-id", instance.Labels["service-instance-id"]),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	users := map[string]bool{}
+	for _, secret := range list.Items {
+		if user := string(secret.Data["user"]); user != "" {
+			users[user] = true
+		}
+	}
+
+	return users, nil
+}
+
+// Gets the write privileges each of the users has on a database, the users
+// are quoted with their hosts so they can be used in a statement
+func mysqlWriteGrants(db *sql.DB, database string, users map[string]bool) (map[string][]string, error) {
+	columns := []string{}
+	for _, privilege := range mysqlWritePrivileges {
+		columns = append(columns, strings.Title(strings.ToLower(privilege))+"_priv")
+	}
+
+	rows, err := db.Query(fmt.Sprintf("SELECT User, Host, %s FROM mysql.db WHERE Db = ?", strings.Join(columns, ", ")), database)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	grants := map[string][]string{}
+	for rows.Next() {
+		var user, host string
+		values := make([]string, len(mysqlWritePrivileges))
+		dest := []interface{}{&user, &host}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+
+		privileges := []string{}
+		for i, value := range values {
+			if value == "Y" {
+				privileges = append(privileges, mysqlWritePrivileges[i])
+			}
+		}
+
+		if users[user] && len(privileges) > 0 {
+			grants[fmt.Sprintf("%s@%s", mysqlQuote(user), mysqlQuote(host))] = privileges
+		}
+	}
+
+	return grants, rows.Err()
+}
+
+// Stores the revoked privileges on the instance secret, the annotation is
+// removed when there are no revoked privileges
+func setMysqlRevoked(client kubernetes.Interface, instance coreV1.Secret, revoked map[string][]string) error {
+	secrets := client.CoreV1().Secrets(instance.Namespace)
+	secret, err := secrets.Get(context.TODO(), instance.Name, metaV1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	if revoked == nil {
+		delete(secret.Annotations, mysqlRevokedAnnotation)
+	} else {
+		value, err := json.Marshal(revoked)
+		if err != nil {
+			return err
+		}
+
+		if secret.Annotations == nil {
+			secret.Annotations = map[string]string{}
+		}
+
+		secret.Annotations[mysqlRevokedAnnotation] = string(value)
+	}
+
+	_, err = secrets.Update(context.TODO(), secret, metaV1.UpdateOptions{})
+	return err
+}
+
+// Quotes a string so it can be used as a user or host in a statement
+func mysqlQuote(value string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(value) + "'"
+}
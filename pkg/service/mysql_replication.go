@@ -0,0 +1,243 @@
+package service
+
+import (
+	"fmt"
+
+	"github.com/AdeAttwood/service-broker/pkg/kube"
+
+	appsV1 "k8s.io/api/apps/v1"
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Script that runs along side the mysql server in the high availability plans.
+// On the primary it creates the user the replicas connect with, on the
+// replicas it starts the replication from the primary using the gtid
+// auto positioning
+const mysqlReplicationScript = `
+set -e
+
+export MYSQL_PWD="$MYSQL_ROOT_PASSWORD"
+
+until mysql -uroot -h 127.0.0.1 -e ";" > /dev/null 2>&1; do
+	echo "Waiting for mysql to start"
+	sleep 5
+done
+
+if [ "$ROLE" = "primary" ]; then
+	echo "Creating the replication user"
+	mysql -uroot -h 127.0.0.1 -e "CREATE USER IF NOT EXISTS 'replication'@'%' IDENTIFIED $DB_AUTH_CLAUSE BY '$REPLICATION_PASSWORD';"
+	mysql -uroot -h 127.0.0.1 -e "GRANT REPLICATION SLAVE ON *.* TO 'replication'@'%';"
+else
+	until MYSQL_PWD="$REPLICATION_PASSWORD" mysql -ureplication -h "$PRIMARY_HOST" -e ";" > /dev/null 2>&1; do
+		echo "Waiting for primary '$PRIMARY_HOST'"
+		sleep 5
+	done
+
+	if [ -z "$(mysql -uroot -h 127.0.0.1 -s --skip-column-names -e 'SHOW SLAVE STATUS')" ]; then
+		echo "Starting replication from '$PRIMARY_HOST'"
+		mysql -uroot -h 127.0.0.1 -e "CHANGE MASTER TO MASTER_HOST='$PRIMARY_HOST', MASTER_USER='replication', MASTER_PASSWORD='$REPLICATION_PASSWORD', MASTER_AUTO_POSITION=1$MASTER_SSL;"
+		mysql -uroot -h 127.0.0.1 -e "START SLAVE;"
+	fi
+fi
+
+echo "Replication configured"
+exec tail -f /dev/null
+`
+
+// Starts mysqld with a server id that is unique for each pod of the stateful
+// sets. The ordinal of the pod is taken from the end of its hostname
+const mysqlReplicationCommand = `exec docker-entrypoint.sh mysqld --server-id=$((SERVER_ID_OFFSET + ${HOSTNAME##*-})) --log-bin=mysql-bin --log-slave-updates=ON --gtid-mode=ON --enforce-gtid-consistency=ON $READ_ONLY "$@"`
+
+// Gets the name of the pvc the instance data is stored on. With replicas the
+// pvcs are created by the stateful sets so the pvc of the primary is used
+func mysqlDataPVCName(plan PlanConfig, instanceID string) string {
+	if plan.Replicas > 0 {
+		return fmt.Sprintf("data-mysql-instance-%s-primary-0", instanceID)
+	}
+
+	return fmt.Sprintf("mysql-instance-%s-pvc", instanceID)
+}
+
+// Gets the labels that select the pod of the instance that accepts writes
+func mysqlPrimaryLabels(plan PlanConfig, instanceID string) map[string]string {
+	labels := map[string]string{
+		"app": fmt.Sprintf("mysql-instance-%s", instanceID),
+	}
+
+	if plan.Replicas > 0 {
+		labels["role"] = "primary"
+	}
+
+	return labels
+}
+
+// Replaces the single mysql deployment in the spec with a primary stateful set
+// and a stateful set of read only replicas. The instance service will only
+// send traffic to the primary and a new read service is added for the
+// replicas
+func (s *MysqlInstance) replicate(spec *kube.Spec, options ServiceOptions) {
+	deploymentName := fmt.Sprintf("mysql-instance-%s", options.ID)
+	headlessName := fmt.Sprintf("%s-headless", deploymentName)
+	plan := findPlan(s.plans, options.PlanID)
+	version := s.version(options.PlanID, options.Parameters)
+
+	spec.Secrets[0].Data["replication-password"] = []byte(s.credentials.Password(16))
+
+	container := spec.Deployments[0].Spec.Template.Spec.Containers[0]
+	container.VolumeMounts = []coreV1.VolumeMount{
+		{
+			Name:      "data",
+			MountPath: "/var/lib/mysql",
+		},
+	}
+
+	primary := mysqlStatefulSet(deploymentName, "primary", 1, container, plan)
+	replica := mysqlStatefulSet(deploymentName, "replica", int32(plan.Replicas), container, plan)
+
+	spec.Deployments = nil
+	spec.StatefulSets = []appsV1.StatefulSet{primary, replica}
+
+	// The pvcs are created from the volume claim templates. They are added to
+	// the spec so they get removed when the instance is deprovisioned
+	spec.PVCS = []coreV1.PersistentVolumeClaim{}
+	for _, statefulSet := range spec.StatefulSets {
+		for i := 0; i < int(*statefulSet.Spec.Replicas); i++ {
+			spec.PVCS = append(spec.PVCS, coreV1.PersistentVolumeClaim{
+				ObjectMeta: metaV1.ObjectMeta{
+					Name: fmt.Sprintf("data-%s-%d", statefulSet.Name, i),
+				},
+				Spec: statefulSet.Spec.VolumeClaimTemplates[0].Spec,
+			})
+		}
+	}
+
+	for i := range spec.StatefulSets {
+		podSpec := &spec.StatefulSets[i].Spec.Template.Spec
+		podSpec.Containers = append(podSpec.Containers, coreV1.Container{
+			Name:    "replication",
+			Image:   version.Image,
+			Command: []string{"bash", "/tmp/replication.bash"},
+			Env: []coreV1.EnvVar{
+				{
+					Name:  "ROLE",
+					Value: spec.StatefulSets[i].Spec.Template.Labels["role"],
+				},
+				{
+					Name:  "PRIMARY_HOST",
+					Value: s.serviceHost(options.ID, options.Namespace),
+				},
+				{
+					Name:  "DB_AUTH_CLAUSE",
+					Value: version.AuthClause,
+				},
+				kube.EnvSecret("MYSQL_ROOT_PASSWORD", spec.Secrets[0].Name, "password"),
+				kube.EnvSecret("REPLICATION_PASSWORD", spec.Secrets[0].Name, "replication-password"),
+			},
+			VolumeMounts: []coreV1.VolumeMount{
+				{
+					Name:      "config-volume",
+					MountPath: "/tmp/replication.bash",
+					ReadOnly:  true,
+					SubPath:   "replication.bash",
+				},
+			},
+		})
+	}
+
+	writeService := spec.Services[0]
+	writeService.Spec.Selector = mysqlPrimaryLabels(plan, options.ID)
+
+	// The read service is exposed the same way as the instance but the host
+	// of the instance is only for the primary
+	readService := *writeService.DeepCopy()
+	readService.Name = fmt.Sprintf("%s-read", deploymentName)
+	delete(readService.Annotations, exposedHostAnnotation)
+	readService.Spec.Selector = map[string]string{
+		"app":  deploymentName,
+		"role": "replica",
+	}
+
+	headlessService := *writeService.DeepCopy()
+	headlessService.Name = headlessName
+	headlessService.Annotations = nil
+	headlessService.Spec.Type = coreV1.ServiceTypeClusterIP
+	headlessService.Spec.LoadBalancerSourceRanges = nil
+	headlessService.Spec.ClusterIP = coreV1.ClusterIPNone
+	headlessService.Spec.Selector = map[string]string{
+		"app": deploymentName,
+	}
+
+	spec.Services = []coreV1.Service{writeService, readService, headlessService}
+}
+
+// Creates one of the stateful sets of a replicated instance. Each pod gets its
+// own pvc from the "data" volume claim template
+func mysqlStatefulSet(deploymentName string, role string, replicas int32, base coreV1.Container, plan PlanConfig) appsV1.StatefulSet {
+	labels := map[string]string{
+		"app":  deploymentName,
+		"role": role,
+	}
+
+	serverIDOffset := "1"
+	readOnly := ""
+	if role == "replica" {
+		serverIDOffset = "100"
+		readOnly = "--read-only=ON"
+	}
+
+	container := *base.DeepCopy()
+	container.Command = []string{"bash", "-c", mysqlReplicationCommand, "mysqld"}
+	container.Env = append(container.Env,
+		coreV1.EnvVar{Name: "SERVER_ID_OFFSET", Value: serverIDOffset},
+		coreV1.EnvVar{Name: "READ_ONLY", Value: readOnly},
+	)
+
+	return appsV1.StatefulSet{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name: fmt.Sprintf("%s-%s", deploymentName, role),
+		},
+		Spec: appsV1.StatefulSetSpec{
+			Replicas:            int32Ptr(replicas),
+			ServiceName:         fmt.Sprintf("%s-headless", deploymentName),
+			PodManagementPolicy: appsV1.ParallelPodManagement,
+			Selector: &metaV1.LabelSelector{
+				MatchLabels: labels,
+			},
+			Template: coreV1.PodTemplateSpec{
+				ObjectMeta: metaV1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: coreV1.PodSpec{
+					Containers: []coreV1.Container{container},
+					Volumes: []coreV1.Volume{
+						{
+							Name: "config-volume",
+							VolumeSource: coreV1.VolumeSource{
+								ConfigMap: &coreV1.ConfigMapVolumeSource{
+									LocalObjectReference: coreV1.LocalObjectReference{
+										Name: deploymentName,
+									},
+									DefaultMode: int32Ptr(500),
+								},
+							},
+						},
+					},
+				},
+			},
+			VolumeClaimTemplates: []coreV1.PersistentVolumeClaim{
+				{
+					ObjectMeta: metaV1.ObjectMeta{
+						Name: "data",
+					},
+					Spec: coreV1.PersistentVolumeClaimSpec{
+						AccessModes: []coreV1.PersistentVolumeAccessMode{
+							"ReadWriteOnce",
+						},
+						Resources: plan.StorageResources(),
+					},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,290 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/AdeAttwood/service-broker/pkg/kube"
+
+	batchV1 "k8s.io/api/batch/v1"
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var mysqlBackupDownloadScript = `
+set -e
+
+until mc ls backup > /dev/null 2>&1; do
+    echo "Waiting for backup storage"
+    sleep 5
+done
+
+BACKUP_NAME="$RESTORE_BACKUP"
+if [ "$BACKUP_NAME" = "latest" ]; then
+    BACKUP_NAME=$(mc ls "backup/$BACKUP_BUCKET/$BACKUP_PREFIX/" | awk '{print $NF}' | grep -E '^[0-9]+/$' | sort -r | head -n 1 | tr -d /)
+fi
+
+if [ -z "$BACKUP_NAME" ]; then
+    echo "No backups found in '$BACKUP_BUCKET/$BACKUP_PREFIX'"
+    exit 1
+fi
+
+echo "Downloading backup '$BACKUP_NAME'"
+mc cp --recursive "backup/$BACKUP_BUCKET/$BACKUP_PREFIX/$BACKUP_NAME/" "$BACKUP_DIR/"
+`
+
+var mysqlRestoreScript = `
+set -e
+
+export MYSQL_PWD="$MYSQL_ROOT_PASSWORD"
+
+until mysql -uroot -h "$MYSQL_HOST" -e ";" > /dev/null 2>&1; do
+	echo "Waiting for host '$MYSQL_HOST'"
+	sleep 5
+done
+
+for db in $(ls -1 "$BACKUP_DIR"); do
+	test -d "$BACKUP_DIR/$db" || continue
+
+	echo "Restoring database '$db'"
+	mysql -uroot -h "$MYSQL_HOST" -e "CREATE SCHEMA IF NOT EXISTS $db;"
+	for table in "$BACKUP_DIR/$db"/*.sql; do
+		test -f "$table" || continue
+		mysql -uroot -h "$MYSQL_HOST" "$db" < "$table"
+	done
+done
+`
+
+var mysqlCloneScript = `
+set -e
+
+until MYSQL_PWD="$SOURCE_PASSWORD" mysql -uroot -h "$SOURCE_HOST" -e ";" > /dev/null 2>&1; do
+	echo "Waiting for host '$SOURCE_HOST'"
+	sleep 5
+done
+
+until MYSQL_PWD="$MYSQL_ROOT_PASSWORD" mysql -uroot -h "$MYSQL_HOST" -e ";" > /dev/null 2>&1; do
+	echo "Waiting for host '$MYSQL_HOST'"
+	sleep 5
+done
+
+DBS=$(MYSQL_PWD="$SOURCE_PASSWORD" mysql -uroot -h "$SOURCE_HOST" -e 'show databases' -s --skip-column-names | grep -Ev "^(mysql|information_schema|performance_schema|sys|backups)$");
+
+for db in $DBS; do
+	echo "Cloning database '$db'"
+	MYSQL_PWD="$SOURCE_PASSWORD" mysqldump -uroot -h "$SOURCE_HOST" --single-transaction --databases "$db" | MYSQL_PWD="$MYSQL_ROOT_PASSWORD" mysql -uroot -h "$MYSQL_HOST"
+done
+`
+
+// The options for creating a mysql instance from the data of another
+// instance. An instance can either be restored from a backup that is stored in
+// a bucket or cloned from a running instance
+type mysqlRestoreOptions struct {
+	// The instance to clone the data from
+	CloneFrom string
+	// The instance that took the backup that will be restored
+	BackupInstance string
+	// The name of the backup to restore, "latest" will restore the most recent
+	// backup of the instance
+	BackupName string
+}
+
+// Creates the restore options from the provision parameters. The backup to
+// restore is set with the "restore_from_backup" parameter in the format of
+// "<instance-id>/<backup-name>", when the backup name is omitted the latest
+// backup will be restored
+func newMysqlRestoreOptions(parameters map[string]interface{}) mysqlRestoreOptions {
+	options := mysqlRestoreOptions{
+		CloneFrom: stringParam(parameters, "clone_from_instance", ""),
+	}
+
+	backup := strings.SplitN(stringParam(parameters, "restore_from_backup", ""), "/", 2)
+	options.BackupInstance = backup[0]
+	options.BackupName = "latest"
+	if len(backup) == 2 && backup[1] != "" {
+		options.BackupName = backup[1]
+	}
+
+	return options
+}
+
+// Gets the secret that stores the connection details of the instance that is
+// being cloned. The source instance root secret is in another namespace so the
+// clone job can't use it directly
+func (s *MysqlInstance) getCloneSecrets(options ServiceOptions) []coreV1.Secret {
+	restore := newMysqlRestoreOptions(options.Parameters)
+	if restore.CloneFrom == "" {
+		return nil
+	}
+
+	data := map[string][]byte{}
+	if options.Source != nil {
+		rootSecretName := fmt.Sprintf("mysql-instance-%s-root-secret", options.Source.ID)
+		data["host"] = []byte(s.serviceHost(options.Source.ID, options.Source.Namespace))
+		data["password"] = options.Source.SecretData(rootSecretName)["password"]
+	}
+
+	return []coreV1.Secret{
+		{
+			ObjectMeta: metaV1.ObjectMeta{
+				Name: fmt.Sprintf("mysql-instance-%s-clone-secret", options.ID),
+			},
+			Type: "Opaque",
+			Data: data,
+		},
+	}
+}
+
+// Gets the jobs to load the data into a new instance. These will run once the
+// instance deployment is ready
+func (s *MysqlInstance) getRestoreJobs(options ServiceOptions) []batchV1.Job {
+	restore := newMysqlRestoreOptions(options.Parameters)
+	version := s.version(options.PlanID, options.Parameters)
+
+	deploymentHost := s.serviceHost(options.ID, options.Namespace)
+	deploymentName := fmt.Sprintf("mysql-instance-%s", options.ID)
+	rootSecretName := fmt.Sprintf("%s-root-secret", deploymentName)
+
+	configVolume := coreV1.Volume{
+		Name: "config-volume",
+		VolumeSource: coreV1.VolumeSource{
+			ConfigMap: &coreV1.ConfigMapVolumeSource{
+				LocalObjectReference: coreV1.LocalObjectReference{
+					Name: deploymentName,
+				},
+				DefaultMode: int32Ptr(500),
+			},
+		},
+	}
+
+	if restore.CloneFrom != "" {
+		cloneSecretName := fmt.Sprintf("%s-clone-secret", deploymentName)
+
+		return []batchV1.Job{
+			{
+				ObjectMeta: metaV1.ObjectMeta{
+					Name: fmt.Sprintf("%s-clone", deploymentName),
+				},
+				Spec: batchV1.JobSpec{
+					Template: coreV1.PodTemplateSpec{
+						Spec: coreV1.PodSpec{
+							RestartPolicy: coreV1.RestartPolicyOnFailure,
+							Containers: []coreV1.Container{
+								{
+									Name:    "mysql",
+									Image:   version.Image,
+									Command: []string{"bash", "/tmp/clone.bash"},
+									Env: []coreV1.EnvVar{
+										{
+											Name:  "MYSQL_HOST",
+											Value: deploymentHost,
+										},
+										kube.EnvSecret("MYSQL_ROOT_PASSWORD", rootSecretName, "password"),
+										kube.EnvSecret("SOURCE_HOST", cloneSecretName, "host"),
+										kube.EnvSecret("SOURCE_PASSWORD", cloneSecretName, "password"),
+									},
+									VolumeMounts: []coreV1.VolumeMount{
+										{
+											Name:      "config-volume",
+											MountPath: "/tmp/clone.bash",
+											ReadOnly:  true,
+											SubPath:   "clone.bash",
+										},
+									},
+								},
+							},
+							Volumes: []coreV1.Volume{configVolume},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	if restore.BackupInstance != "" {
+		backup := newMysqlBackupOptions(options.Parameters)
+
+		job := batchV1.Job{
+			ObjectMeta: metaV1.ObjectMeta{
+				Name: fmt.Sprintf("%s-restore", deploymentName),
+			},
+			Spec: batchV1.JobSpec{
+				Template: coreV1.PodTemplateSpec{
+					Spec: coreV1.PodSpec{
+						RestartPolicy: coreV1.RestartPolicyOnFailure,
+						InitContainers: []coreV1.Container{
+							{
+								Name:    "mc",
+								Image:   "minio/mc:latest",
+								Command: []string{"bash", "/tmp/backup-download.bash"},
+								Env: append(backup.aliasEnv(),
+									coreV1.EnvVar{Name: "BACKUP_DIR", Value: mysqlBackupDir},
+									coreV1.EnvVar{Name: "BACKUP_BUCKET", Value: backup.Bucket},
+									coreV1.EnvVar{Name: "BACKUP_PREFIX", Value: mysqlBackupPrefix(restore.BackupInstance)},
+									coreV1.EnvVar{Name: "RESTORE_BACKUP", Value: restore.BackupName},
+								),
+								VolumeMounts: []coreV1.VolumeMount{
+									{
+										Name:      "config-volume",
+										MountPath: "/tmp/backup-download.bash",
+										ReadOnly:  true,
+										SubPath:   "backup-download.bash",
+									},
+									{
+										Name:      "backup-volume",
+										MountPath: mysqlBackupDir,
+									},
+								},
+							},
+						},
+						Containers: []coreV1.Container{
+							{
+								Name:    "mysql",
+								Image:   version.Image,
+								Command: []string{"bash", "/tmp/restore.bash"},
+								Env: []coreV1.EnvVar{
+									{
+										Name:  "MYSQL_HOST",
+										Value: deploymentHost,
+									},
+									kube.EnvSecret("MYSQL_ROOT_PASSWORD", rootSecretName, "password"),
+									{
+										Name:  "BACKUP_DIR",
+										Value: mysqlBackupDir,
+									},
+								},
+								VolumeMounts: []coreV1.VolumeMount{
+									{
+										Name:      "config-volume",
+										MountPath: "/tmp/restore.bash",
+										ReadOnly:  true,
+										SubPath:   "restore.bash",
+									},
+									{
+										Name:      "backup-volume",
+										MountPath: mysqlBackupDir,
+									},
+								},
+							},
+						},
+						Volumes: []coreV1.Volume{
+							configVolume,
+							{
+								Name: "backup-volume",
+								VolumeSource: coreV1.VolumeSource{
+									EmptyDir: &coreV1.EmptyDirVolumeSource{},
+								},
+							},
+						},
+					},
+				},
+			},
+		}
+
+		backup.trustCA(&job.Spec.Template.Spec)
+
+		return []batchV1.Job{job}
+	}
+
+	return nil
+}
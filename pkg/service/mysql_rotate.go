@@ -0,0 +1,204 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/AdeAttwood/service-broker/pkg/kube"
+
+	batchV1 "k8s.io/api/batch/v1"
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var mysqlRotateScript = `
+set -e
+
+export MYSQL_PWD="$MYSQL_ROOT_PASSWORD"
+
+until mysql -uroot -h "$MYSQL_HOST" -e ";" > /dev/null 2>&1; do
+	echo "Waiting for host '$MYSQL_HOST'"
+	sleep 5
+done
+
+echo "Applying the new credentials"
+mysql -uroot -h "$MYSQL_HOST" < /tmp/rotate/rotate.sql
+`
+
+var mysqlExpireScript = `
+set -e
+
+export MYSQL_PWD="$MYSQL_ROOT_PASSWORD"
+
+until mysql -uroot -h "$MYSQL_HOST" -e ";" > /dev/null 2>&1; do
+	echo "Waiting for host '$MYSQL_HOST'"
+	sleep 5
+done
+
+echo "Removing the old credentials"
+mysql -uroot -h "$MYSQL_HOST" -e "$EXPIRE_SQL"
+`
+
+var _ CredentialRotator = &MysqlInstance{}
+
+// Gets new passwords for the root user and the binding users. The passwords
+// are changed with a sql file in a secret so they are never in the job spec,
+// the root password is changed last so a failed rotation can be run again
+// with the old root password
+func (s *MysqlInstance) RotateCredentials(options RotateOptions) (*CredentialRotation, error) {
+	versionName := mysqlVersionName(findPlan(s.plans, options.PlanID), options.Parameters)
+	retain := ""
+	if options.GracePeriod > 0 {
+		if !s.version(options.PlanID, options.Parameters).DualPasswords {
+			return nil, fmt.Errorf("The version '%s' can't keep the old passwords, rotate the credentials without a grace period", versionName)
+		}
+
+		retain = " RETAIN CURRENT PASSWORD"
+	}
+
+	rootSecretName := fmt.Sprintf("mysql-instance-%s-root-secret", options.ID)
+	rotation := &CredentialRotation{}
+	statements := []string{}
+
+	for _, binding := range options.Bindings {
+		secret := binding.DeepCopy()
+		password := s.credentials.Password(18)
+		secret.Data["password"] = []byte(password)
+
+		statements = append(statements, fmt.Sprintf("ALTER USER IF EXISTS '%s'@'%%' IDENTIFIED BY '%s'%s;", secret.Data["user"], password, retain))
+		rotation.Secrets = append(rotation.Secrets, *secret)
+	}
+
+	if options.Instance {
+		root, err := rotationSecret(options.InstanceSecrets, rootSecretName)
+		if err != nil {
+			return nil, err
+		}
+
+		password := s.credentials.Password(16)
+		root.Data["password"] = []byte(password)
+
+		for _, host := range []string{"%", "localhost"} {
+			statements = append(statements, fmt.Sprintf("ALTER USER IF EXISTS 'root'@'%s' IDENTIFIED BY '%s'%s;", host, password, retain))
+		}
+
+		rotation.Secrets = append(rotation.Secrets, *root)
+	}
+
+	statements = append(statements, "FLUSH PRIVILEGES;")
+	name := fmt.Sprintf("mysql-instance-%s-rotate-%s", options.ID, strings.ToLower(kube.RandStringBytes(5)))
+
+	// The secret holding the statements is not labelled with the instance so
+	// it is never read back as one of the instance secrets, the job pods get
+	// the label from the job so the network policy still allows them
+	rotation.Spec = &kube.Spec{
+		Namespace: options.Namespace,
+		Lables: map[string]string{
+			"service-id":   s.Definition().ID,
+			"service-name": s.Definition().Name,
+		},
+		Secrets: []coreV1.Secret{
+			{
+				ObjectMeta: metaV1.ObjectMeta{
+					Name: name,
+				},
+				Type: "Opaque",
+				Data: map[string][]byte{
+					"rotate.sql": []byte(strings.Join(statements, "\n")),
+				},
+			},
+		},
+		Jobs: []batchV1.Job{s.sqlJob(options.ServiceOptions, name, mysqlRotateScript, name)},
+	}
+
+	return rotation, nil
+}
+
+// Gets the spec that removes the old passwords of the root and binding users
+// once the grace period of a rotation is over
+func (s *MysqlInstance) GetExpireSpec(options RotateOptions) *kube.Spec {
+	statements := []string{}
+	for _, binding := range options.Bindings {
+		statements = append(statements, fmt.Sprintf("ALTER USER IF EXISTS '%s'@'%%' DISCARD OLD PASSWORD;", binding.Data["user"]))
+	}
+
+	for _, host := range []string{"%", "localhost"} {
+		statements = append(statements, fmt.Sprintf("ALTER USER IF EXISTS 'root'@'%s' DISCARD OLD PASSWORD;", host))
+	}
+
+	name := fmt.Sprintf("mysql-instance-%s-expire-%s", options.ID, strings.ToLower(kube.RandStringBytes(5)))
+	job := s.sqlJob(options.ServiceOptions, name, mysqlExpireScript, "", coreV1.EnvVar{
+		Name:  "EXPIRE_SQL",
+		Value: strings.Join(statements, " "),
+	})
+
+	return &kube.Spec{
+		Namespace: options.Namespace,
+		Lables: map[string]string{
+			"service-instance-id": options.ID,
+			"service-id":          s.Definition().ID,
+			"service-name":        s.Definition().Name,
+		},
+		Jobs: []batchV1.Job{job},
+	}
+}
+
+// Gets a job that runs a script against the instance as the root user. The sql
+// secret is mounted in "/tmp/rotate" when it is set
+func (s *MysqlInstance) sqlJob(options ServiceOptions, name string, script string, sqlSecretName string, env ...coreV1.EnvVar) batchV1.Job {
+	rootSecretName := fmt.Sprintf("mysql-instance-%s-root-secret", options.ID)
+	container := coreV1.Container{
+		Name:    "mysql",
+		Image:   s.version(options.PlanID, options.Parameters).Image,
+		Command: []string{"bash", "-c", script},
+		Env: append([]coreV1.EnvVar{
+			{
+				Name:  "MYSQL_HOST",
+				Value: s.serviceHost(options.ID, options.Namespace),
+			},
+			kube.EnvSecret("MYSQL_ROOT_PASSWORD", rootSecretName, "password"),
+		}, env...),
+	}
+
+	volumes := []coreV1.Volume{}
+	if sqlSecretName != "" {
+		container.VolumeMounts = []coreV1.VolumeMount{{Name: "rotate", MountPath: "/tmp/rotate", ReadOnly: true}}
+		volumes = append(volumes, coreV1.Volume{
+			Name: "rotate",
+			VolumeSource: coreV1.VolumeSource{
+				Secret: &coreV1.SecretVolumeSource{SecretName: sqlSecretName},
+			},
+		})
+	}
+
+	return batchV1.Job{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name: name,
+		},
+		Spec: batchV1.JobSpec{
+			Template: coreV1.PodTemplateSpec{
+				ObjectMeta: metaV1.ObjectMeta{
+					Labels: map[string]string{"service-instance-id": options.ID},
+				},
+				Spec: coreV1.PodSpec{
+					RestartPolicy:         coreV1.RestartPolicyOnFailure,
+					ActiveDeadlineSeconds: int64Ptr(120),
+					Containers:            []coreV1.Container{container},
+					Volumes:               volumes,
+				},
+			},
+		},
+	}
+}
+
+// Gets a copy of one of the secrets of an instance so the credentials can be
+// changed without changing the secrets the broker read
+func rotationSecret(secrets []coreV1.Secret, name string) (*coreV1.Secret, error) {
+	for _, secret := range secrets {
+		if secret.Name == name {
+			return secret.DeepCopy(), nil
+		}
+	}
+
+	return nil, fmt.Errorf("The secret '%s' of the instance can't be found", name)
+}
@@ -0,0 +1,66 @@
+package service
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func rotateTestOptions(parameters map[string]interface{}, secrets ...coreV1.Secret) RotateOptions {
+	return RotateOptions{
+		ServiceOptions: ServiceOptions{ID: "test-id", Namespace: "test-ns", Parameters: parameters, InstanceSecrets: secrets},
+		Instance:       true,
+		Bindings: []coreV1.Secret{
+			{
+				ObjectMeta: metaV1.ObjectMeta{Name: "binding-secret-binding-id", Namespace: "app-ns"},
+				Data:       map[string][]byte{"user": []byte("user-binding"), "password": []byte("old-password")},
+			},
+		},
+	}
+}
+
+func TestMysqlRotateCredentials(t *testing.T) {
+	root := coreV1.Secret{
+		ObjectMeta: metaV1.ObjectMeta{Name: "mysql-instance-test-id-root-secret"},
+		Data:       map[string][]byte{"password": []byte("old-root")},
+	}
+
+	mysql := NewMysqlInstance(InstanceConfig{}, nil)
+	options := rotateTestOptions(map[string]interface{}{"version": "5.7"}, root)
+	options.GracePeriod = time.Hour
+	if _, err := mysql.RotateCredentials(options); err == nil {
+		t.Errorf("Versions without dual passwords should not have a grace period")
+	}
+
+	options.Parameters["version"] = "8.0"
+	rotation, err := mysql.RotateCredentials(options)
+	if err != nil {
+		t.Fatalf("Unable to rotate the credentials: %v", err)
+	}
+
+	sql := string(rotation.Spec.Secrets[0].Data["rotate.sql"])
+	if !strings.Contains(sql, "ALTER USER IF EXISTS 'user-binding'@'%'") || !strings.Contains(sql, "RETAIN CURRENT PASSWORD") {
+		t.Errorf("The binding user should keep the old password '%s'", sql)
+	}
+
+	rotation.Spec.InjectLabels(rotation.Spec.Lables)
+	if _, ok := rotation.Spec.Secrets[0].Labels["service-instance-id"]; ok || rotation.Spec.Jobs[0].Spec.Template.Labels["service-instance-id"] != "test-id" {
+		t.Errorf("Only the rotation job pods should have the instance label")
+	}
+
+	if strings.Index(sql, "'root'") < strings.Index(sql, "'user-binding'") {
+		t.Errorf("The root password should be changed last")
+	}
+
+	if len(rotation.Secrets) != 2 || string(rotation.Secrets[1].Data["password"]) == "old-root" || string(options.InstanceSecrets[0].Data["password"]) != "old-root" {
+		t.Errorf("The rotation should have copies of the secrets with new passwords")
+	}
+
+	expire := mysql.GetExpireSpec(options).Jobs[0].Spec.Template.Spec.Containers[0].Env
+	if !strings.Contains(expire[len(expire)-1].Value, "DISCARD OLD PASSWORD") {
+		t.Errorf("The expire spec should remove the old passwords")
+	}
+}
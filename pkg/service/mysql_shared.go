@@ -2,14 +2,17 @@ package service
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 
 	"github.com/AdeAttwood/service-broker/pkg/kube"
+	"github.com/golang/glog"
 	osb "github.com/pmorie/go-open-service-broker-client/v2"
 
 	batchV1 "k8s.io/api/batch/v1"
 	coreV1 "k8s.io/api/core/v1"
 	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
 )
 
 type SharedMysqlConfig struct {
@@ -19,17 +22,42 @@ type SharedMysqlConfig struct {
 	Password string `yaml:"password"`
 	Host     string `yaml:"host"`
 	Port     string `yaml:"port"`
+	// The admin credentials can be read from an existing secret in the broker
+	// namespace, environment variables or files instead of the plain text user
+	// and password
+	CredentialsSecret *MysqlCredentialsSecret `yaml:"credentialsSecret"`
+	UserEnv           string                  `yaml:"userEnv"`
+	PasswordEnv       string                  `yaml:"passwordEnv"`
+	UserFile          string                  `yaml:"userFile"`
+	PasswordFile      string                  `yaml:"passwordFile"`
+	// The plans set the limits of the databases and users, when there are no
+	// plans the service has one plan with the same id as the service
+	Plans []PlanConfig `yaml:"plans"`
+	// The policy the binding usernames and passwords are generated with
+	Credentials CredentialPolicy `yaml:"credentials"`
+	// Overrides the pod security of the broker for the database jobs
+	PodSecurity PodSecurityConfig `yaml:"podSecurity"`
 }
 
-func NewSharedMysql(config SharedMysqlConfig) *SharedMysql {
-	return &SharedMysql{
-		name:     config.Name,
-		id:       config.ID,
-		user:     config.User,
-		password: config.Password,
-		port:     config.Port,
-		host:     config.Host,
+func NewSharedMysql(config SharedMysqlConfig, client kubernetes.Interface) (*SharedMysql, error) {
+	if err := config.ValidateCredentials(); err != nil {
+		return nil, err
+	}
+
+	plans := config.Plans
+	if len(plans) == 0 {
+		plans = []PlanConfig{{Name: "default", ID: config.ID, Description: "The default plan"}}
 	}
+
+	return &SharedMysql{
+		name:   config.Name,
+		id:     config.ID,
+		port:   config.Port,
+		host:   config.Host,
+		plans:  plans,
+		config: config,
+		client: client,
+	}, nil
 }
 
 var mysqlDatabaseBindScript = `
@@ -42,13 +70,50 @@ until mysql -u "$MYSQL_USER" -h "$MYSQL_HOST" -P "$MYSQL_PORT" -e ";" > /dev/nul
 	sleep 5
 done
 
+# The name is quoted so databases named after namespaces are valid identifiers
+printf -v DB_SCHEMA '\x60%s\x60' "$DB_NAME"
+
 echo "Creating databse '$DB_NAME' and granting privileges to '$DB_USER'"
-mysql -u "$MYSQL_USER" -h "$MYSQL_HOST" -P "$MYSQL_PORT" -e "CREATE SCHEMA IF NOT EXISTS $DB_NAME;"
-mysql -u "$MYSQL_USER" -h "$MYSQL_HOST" -P "$MYSQL_PORT" -e "CREATE USER IF NOT EXISTS '$DB_USER'@'%' IDENTIFIED BY '$DB_PASSWORD';"
-mysql -u "$MYSQL_USER" -h "$MYSQL_HOST" -P "$MYSQL_PORT" -e "GRANT ALL PRIVILEGES ON $DB_NAME.* TO '$DB_USER'@'%';"
+mysql -u "$MYSQL_USER" -h "$MYSQL_HOST" -P "$MYSQL_PORT" -e "CREATE SCHEMA IF NOT EXISTS $DB_SCHEMA;"
+mysql -u "$MYSQL_USER" -h "$MYSQL_HOST" -P "$MYSQL_PORT" -e "CREATE USER IF NOT EXISTS '$DB_USER'@'%' IDENTIFIED BY '$DB_PASSWORD' WITH MAX_USER_CONNECTIONS ${DB_MAX_USER_CONNECTIONS:-0} MAX_QUERIES_PER_HOUR ${DB_MAX_QUERIES_PER_HOUR:-0};"
+mysql -u "$MYSQL_USER" -h "$MYSQL_HOST" -P "$MYSQL_PORT" -e "GRANT ALL PRIVILEGES ON $DB_SCHEMA.* TO '$DB_USER'@'%';"
 mysql -u "$MYSQL_USER" -h "$MYSQL_HOST" -P "$MYSQL_PORT" -e "FLUSH PRIVILEGES;"
 `
 
+var mysqlDatabaseCreateScript = `
+set -ex
+
+export MYSQL_PWD="$MYSQL_ROOT_PASSWORD"
+
+until mysql -u "$MYSQL_USER" -h "$MYSQL_HOST" -P "$MYSQL_PORT" -e ";" > /dev/null 2>&1; do
+	echo "Waiting for host '$MYSQL_HOST'"
+	sleep 5
+done
+
+# The name is quoted so databases named after namespaces are valid identifiers
+printf -v DB_SCHEMA '\x60%s\x60' "$DB_NAME"
+
+echo "Creating databse '$DB_NAME'"
+mysql -u "$MYSQL_USER" -h "$MYSQL_HOST" -P "$MYSQL_PORT" -e "CREATE SCHEMA IF NOT EXISTS $DB_SCHEMA;"
+`
+
+var mysqlDatabaseDropScript = `
+set -ex
+
+export MYSQL_PWD="$MYSQL_ROOT_PASSWORD"
+
+until mysql -u "$MYSQL_USER" -h "$MYSQL_HOST" -P "$MYSQL_PORT" -e ";" > /dev/null 2>&1; do
+	echo "Waiting for host '$MYSQL_HOST'"
+	sleep 5
+done
+
+# The name is quoted so databases named after namespaces are valid identifiers
+printf -v DB_SCHEMA '\x60%s\x60' "$DB_NAME"
+
+echo "Dropping databse '$DB_NAME'"
+mysql -u "$MYSQL_USER" -h "$MYSQL_HOST" -P "$MYSQL_PORT" -e "DROP SCHEMA IF EXISTS $DB_SCHEMA;"
+`
+
 var mysqlDatabaseDebindScript = `
 set -ex
 
@@ -64,32 +129,27 @@ mysql -u "$MYSQL_USER" -h "$MYSQL_HOST" -P "$MYSQL_PORT" -e "DROP USER '$DB_USER
 `
 
 type SharedMysql struct {
-	name     string `yaml:"name"`
-	id       string `yaml:"id"`
-	user     string `yaml:"user"`
-	password string `yaml:"password"`
-	host     string `yaml:"host"`
-	port     string `yaml:"port"`
+	name   string `yaml:"name"`
+	id     string `yaml:"id"`
+	host   string `yaml:"host"`
+	port   string `yaml:"port"`
+	plans  []PlanConfig
+	config SharedMysqlConfig
+	client kubernetes.Interface
 }
 
 func (s *SharedMysql) Definition() osb.Service {
 	return osb.Service{
-		Name:        fmt.Sprintf("mysql-shared-%s", s.name),
-		ID:          s.id,
-		Description: "A database on a shared mysql instance",
-		Bindable:    true,
+		Name:                fmt.Sprintf("mysql-shared-%s", s.name),
+		ID:                  s.id,
+		Description:         "A database on a shared mysql instance",
+		Bindable:            true,
+		BindingsRetrievable: true,
 		Metadata: map[string]interface{}{
 			"displayName": "Shared Mysql Database",
 			"imageUrl":    "htps://avatars2.githubusercontent.com/u/19862012?s=200&v=4",
 		},
-		Plans: []osb.Plan{
-			{
-				Name:        "default",
-				ID:          s.id,
-				Description: "The default plan",
-				Free:        truePtr(),
-			},
-		},
+		Plans: planDefinitions(s.plans),
 	}
 }
 
@@ -97,43 +157,114 @@ func (s *SharedMysql) GetHost(instanceID string, namespace string) string {
 	return s.host
 }
 
+// Gets where the jobs read the admin credentials of the server from
+func (s *SharedMysql) jobCredentials() mysqlJobCredentials {
+	credentials, err := s.config.jobCredentials()
+	if err != nil {
+		glog.Errorf("Unable to read the credentials of the shared mysql server '%s': %v", s.name, err)
+	}
+
+	return credentials
+}
+
+// Checks the admin credentials of the server can be read so the instance is
+// not created with jobs that can't log in
+func (s *SharedMysql) ValidateProvision(options ServiceOptions) error {
+	if _, _, err := s.config.credentials(s.client, options.GlobalNamespace); err != nil {
+		return fmt.Errorf("Unable to read the credentials of the shared mysql server '%s': %v", s.name, err)
+	}
+
+	return nil
+}
+
+func (s *SharedMysql) legacySecretName() string {
+	return fmt.Sprintf("mysql-shared-%s-secret", s.name)
+}
+
+// Gets the secret with the server address and the database of an
+// instance. Instances that were provisioned before the database was created
+// with the instance only have the server secret, the bindings of these
+// instances each get their own database
+func (s *SharedMysql) instanceDatabase(options BindOptions) (string, string) {
+	secretName := mysqlSharedSecretName(options.InstanceID)
+	if database := options.InstanceSecretData(secretName)["database"]; len(database) > 0 {
+		return secretName, string(database)
+	}
+
+	return s.legacySecretName(), bindingDatabaseName(options.Namespace, options.ID)
+}
+
 func (s *SharedMysql) GetDebindSpec(options BindOptions) *kube.Spec {
-	secretName := fmt.Sprintf("mysql-shared-%s-secret", s.name)
-	bindingSecretName := fmt.Sprintf("binding-secret-%s", options.ID)
+	secretName, _ := s.instanceDatabase(options)
+	return sharedMysqlDebindSpec(s.Definition(), options, secretName, s.jobCredentials())
+}
 
-	return &kube.Spec{
-		Namespace: options.GlobalNamespace,
-		Lables: map[string]string{
-			"service-binding-id":  options.ID,
-			"service-instance-id": options.InstanceID,
-			"service-id":          s.Definition().ID,
-			"service-name":        s.Definition().Name,
+func (s *SharedMysql) GetBindSpec(options BindOptions) *kube.Spec {
+	secretName, database := s.instanceDatabase(options)
+	return sharedMysqlBindSpec(s.Definition(), options, secretName, s.jobCredentials(), s.host, s.port, database, findPlan(s.plans, options.PlanID), s.config.Credentials)
+}
+
+func (s *SharedMysql) GetDeprovisionSpec(options ServiceOptions) *kube.Spec {
+	return sharedMysqlDeprovisionSpec(s.Definition(), options, mysqlSharedSecretName(options.ID), s.jobCredentials())
+}
+
+func (s *SharedMysql) GetProvisionSpec(options ServiceOptions) *kube.Spec {
+	return sharedMysqlProvisionSpec(s.Definition(), options, mysqlSharedSecretName(options.ID), s.jobCredentials(), map[string][]byte{
+		"host": []byte(s.host),
+		"port": []byte(s.port),
+	})
+}
+
+// Gets the name of the secret that holds the server address and the database
+// of an instance
+func mysqlSharedSecretName(instanceID string) string {
+	return fmt.Sprintf("mysql-shared-instance-%s-secret", instanceID)
+}
+
+// Gets the name of the database of a binding on a shared server from the
+// namespace and the start of the binding id. Ids that are shorter than the
+// start are used as they are
+func bindingDatabaseName(namespace string, bindingID string) string {
+	if len(bindingID) > 8 {
+		bindingID = bindingID[:8]
+	}
+
+	return strings.Replace(fmt.Sprintf("%s_%s", namespace, bindingID), "-", "_", -1)
+}
+
+// Gets the name of the database of an instance on a shared server
+func mysqlSharedDatabaseName(instanceID string) string {
+	return strings.Replace(fmt.Sprintf("instance_%s", instanceID), "-", "_", -1)
+}
+
+// Gets a job that runs a script on the server in the secret as the admin user
+func sharedMysqlJob(name string, secretName string, credentials mysqlJobCredentials, script string, env ...coreV1.EnvVar) batchV1.Job {
+	// Jobs that have the credentials set on them are removed once they are
+	// done so the credentials are not left in the cluster
+	var ttl *int32
+	if credentials.secretName == "" {
+		ttl = int32Ptr(300)
+	}
+
+	return batchV1.Job{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name: name,
 		},
-		Jobs: []batchV1.Job{
-			{
-				ObjectMeta: metaV1.ObjectMeta{
-					Name: fmt.Sprintf("debinding-job-%s", options.ID),
-				},
-				Spec: batchV1.JobSpec{
-					Template: coreV1.PodTemplateSpec{
-						Spec: coreV1.PodSpec{
-							RestartPolicy:         coreV1.RestartPolicyOnFailure,
-							ActiveDeadlineSeconds: int64Ptr(120),
-							Containers: []coreV1.Container{
-								{
-									Name:    "mysql",
-									Image:   "mysql:5.7",
-									Command: []string{"bash", "-c", mysqlDatabaseDebindScript},
-									Env: []coreV1.EnvVar{
-										kube.EnvSecret("MYSQL_ROOT_PASSWORD", secretName, "password"),
-										kube.EnvSecret("MYSQL_USER", secretName, "user"),
-										kube.EnvSecret("MYSQL_HOST", secretName, "host"),
-										kube.EnvSecret("MYSQL_PORT", secretName, "port"),
-
-										kube.EnvSecret("DB_USER", bindingSecretName, "user"),
-									},
-								},
-							},
+		Spec: batchV1.JobSpec{
+			TTLSecondsAfterFinished: ttl,
+			Template: coreV1.PodTemplateSpec{
+				Spec: coreV1.PodSpec{
+					RestartPolicy:         coreV1.RestartPolicyOnFailure,
+					ActiveDeadlineSeconds: int64Ptr(120),
+					Containers: []coreV1.Container{
+						{
+							Name:    "mysql",
+							Image:   "mysql:5.7",
+							Command: []string{"bash", "-c", script},
+							Env: append(append(credentials.env(),
+								kube.EnvSecret("MYSQL_HOST", secretName, "host"),
+								kube.EnvSecret("MYSQL_PORT", secretName, "port"),
+							), env...),
 						},
 					},
 				},
@@ -142,97 +273,136 @@ func (s *SharedMysql) GetDebindSpec(options BindOptions) *kube.Spec {
 	}
 }
 
-func (s *SharedMysql) GetBindSpec(options BindOptions) *kube.Spec {
-	secretName := fmt.Sprintf("mysql-shared-%s-secret", s.name)
-	bindingSecretName := fmt.Sprintf("binding-secret-%s", options.ID)
-	databaseName := strings.Replace(fmt.Sprintf("%s_%s", options.Namespace, options.ID[0:8]), "-", "_", -1)
+// Gets the spec that creates the database of an instance. The instance secret
+// holds the server address and the name of the database so the bindings can
+// be created on the same database
+func sharedMysqlProvisionSpec(definition osb.Service, options ServiceOptions, secretName string, credentials mysqlJobCredentials, data map[string][]byte) *kube.Spec {
+	data["database"] = []byte(mysqlSharedDatabaseName(options.ID))
 
 	return &kube.Spec{
 		Namespace: options.GlobalNamespace,
 		Lables: map[string]string{
-			"service-binding-id":  options.ID,
-			"service-instance-id": options.InstanceID,
-			"service-id":          s.Definition().ID,
-			"service-name":        s.Definition().Name,
+			"service-instance-id": options.ID,
+			"service-id":          definition.ID,
+			"service-name":        definition.Name,
+			"service-plan":        options.PlanID,
 		},
 		Secrets: []coreV1.Secret{
 			{
 				ObjectMeta: metaV1.ObjectMeta{
-					Name: bindingSecretName,
+					Name: secretName,
 				},
 				Type: "Opaque",
-				Data: map[string][]byte{
-					"host":     []byte(s.GetHost(options.InstanceID, options.Namespace)),
-					"user":     []byte(fmt.Sprintf("user-%s", kube.RandStringBytes(8))),
-					"port":     []byte(s.port),
-					"database": []byte(databaseName),
-					"password": []byte(kube.RandStringBytes(18)),
-				},
+				Data: data,
 			},
 		},
 		Jobs: []batchV1.Job{
-			{
-				ObjectMeta: metaV1.ObjectMeta{
-					Name: fmt.Sprintf("binding-job-%s", options.ID),
-				},
-				Spec: batchV1.JobSpec{
-					Template: coreV1.PodTemplateSpec{
-						Spec: coreV1.PodSpec{
-							RestartPolicy:         coreV1.RestartPolicyOnFailure,
-							ActiveDeadlineSeconds: int64Ptr(120),
-							Containers: []coreV1.Container{
-								{
-									Name:    "mysql",
-									Image:   "mysql:5.7",
-									Command: []string{"bash", "-c", mysqlDatabaseBindScript},
-									Env: []coreV1.EnvVar{
-										kube.EnvSecret("MYSQL_ROOT_PASSWORD", secretName, "password"),
-										kube.EnvSecret("MYSQL_USER", secretName, "user"),
-										kube.EnvSecret("MYSQL_HOST", secretName, "host"),
-										kube.EnvSecret("MYSQL_PORT", secretName, "port"),
-
-										kube.EnvSecret("DB_NAME", bindingSecretName, "database"),
-										kube.EnvSecret("DB_USER", bindingSecretName, "user"),
-										kube.EnvSecret("DB_PASSWORD", bindingSecretName, "password"),
-									},
-								},
-							},
-						},
-					},
-				},
-			},
+			sharedMysqlJob(
+				fmt.Sprintf("provision-job-%s", options.ID),
+				secretName,
+				credentials,
+				mysqlDatabaseCreateScript,
+				kube.EnvSecret("DB_NAME", secretName, "database"),
+			),
 		},
 	}
 }
 
-func (s *SharedMysql) GetDeprovisionSpec(options ServiceOptions) *kube.Spec {
-	return &kube.Spec{Namespace: options.Namespace}
+// Gets the spec that drops the database of an instance, this is created before
+// the instance secret is removed. Instances that were provisioned before the
+// database was created with the instance have no secret to read the database
+// from so there is nothing to drop
+func sharedMysqlDeprovisionSpec(definition osb.Service, options ServiceOptions, secretName string, credentials mysqlJobCredentials) *kube.Spec {
+	spec := &kube.Spec{
+		Namespace: options.GlobalNamespace,
+		Lables: map[string]string{
+			"service-instance-id": options.ID,
+			"service-id":          definition.ID,
+			"service-name":        definition.Name,
+		},
+	}
+
+	if len(options.InstanceSecretData(secretName)["database"]) == 0 {
+		return spec
+	}
+
+	spec.Jobs = []batchV1.Job{
+		sharedMysqlJob(
+			fmt.Sprintf("deprovision-job-%s", options.ID),
+			secretName,
+			credentials,
+			mysqlDatabaseDropScript,
+			kube.EnvSecret("DB_NAME", secretName, "database"),
+		),
+	}
+
+	return spec
 }
 
-func (s *SharedMysql) GetProvisionSpec(options ServiceOptions) *kube.Spec {
-	secretName := fmt.Sprintf("mysql-shared-%s-secret", s.name)
+// Gets the spec that removes the user of a binding
+func sharedMysqlDebindSpec(definition osb.Service, options BindOptions, secretName string, credentials mysqlJobCredentials) *kube.Spec {
+	bindingSecretName := fmt.Sprintf("binding-secret-%s", options.ID)
 
 	return &kube.Spec{
 		Namespace: options.GlobalNamespace,
 		Lables: map[string]string{
-			"service-instance-id": options.ID,
-			"service-id":          s.Definition().ID,
-			"service-name":        s.Definition().Name,
-			"service-plan":        options.PlanID,
+			"service-binding-id":  options.ID,
+			"service-instance-id": options.InstanceID,
+			"service-id":          definition.ID,
+			"service-name":        definition.Name,
+		},
+		Jobs: []batchV1.Job{
+			sharedMysqlJob(
+				fmt.Sprintf("debinding-job-%s", options.ID),
+				secretName,
+				credentials,
+				mysqlDatabaseDebindScript,
+				kube.EnvSecret("DB_USER", bindingSecretName, "user"),
+			),
+		},
+	}
+}
+
+// Gets the spec that creates the user of a binding and gives it access to the
+// database
+func sharedMysqlBindSpec(definition osb.Service, options BindOptions, secretName string, credentials mysqlJobCredentials, host string, port string, database string, plan PlanConfig, policy CredentialPolicy) *kube.Spec {
+	bindingSecretName := fmt.Sprintf("binding-secret-%s", options.ID)
+
+	return &kube.Spec{
+		Namespace: options.GlobalNamespace,
+		Lables: map[string]string{
+			"service-binding-id":  options.ID,
+			"service-instance-id": options.InstanceID,
+			"service-id":          definition.ID,
+			"service-name":        definition.Name,
 		},
 		Secrets: []coreV1.Secret{
 			{
 				ObjectMeta: metaV1.ObjectMeta{
-					Name: secretName,
+					Name: bindingSecretName,
 				},
 				Type: "Opaque",
 				Data: map[string][]byte{
-					"user":     []byte(s.user),
-					"password": []byte(s.password),
-					"host":     []byte(s.host),
-					"port":     []byte(s.port),
+					"host":     []byte(host),
+					"user":     []byte(policy.Username("user-%s")),
+					"port":     []byte(port),
+					"database": []byte(database),
+					"password": []byte(policy.Password(18)),
 				},
 			},
 		},
+		Jobs: []batchV1.Job{
+			sharedMysqlJob(
+				fmt.Sprintf("binding-job-%s", options.ID),
+				secretName,
+				credentials,
+				mysqlDatabaseBindScript,
+				kube.EnvSecret("DB_NAME", bindingSecretName, "database"),
+				kube.EnvSecret("DB_USER", bindingSecretName, "user"),
+				kube.EnvSecret("DB_PASSWORD", bindingSecretName, "password"),
+				coreV1.EnvVar{Name: "DB_MAX_USER_CONNECTIONS", Value: strconv.Itoa(plan.MaxUserConnections)},
+				coreV1.EnvVar{Name: "DB_MAX_QUERIES_PER_HOUR", Value: strconv.Itoa(plan.MaxQueriesPerHour)},
+			),
+		},
 	}
 }
@@ -0,0 +1,115 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSharedMysqlInstanceDatabase(t *testing.T) {
+	shared, _ := NewSharedMysql(SharedMysqlConfig{Name: "central", ID: "shared-mysql-id", Host: "mysql.example.com", Port: "3306"}, fake.NewSimpleClientset())
+
+	instance := shared.GetProvisionSpec(ServiceOptions{ID: "test-id", GlobalNamespace: "service-broker"})
+	if string(instance.Secrets[0].Data["database"]) != "instance_test_id" {
+		t.Errorf("Invalid database '%s'", instance.Secrets[0].Data["database"])
+	}
+
+	if len(instance.Jobs) != 1 || len(shared.GetDeprovisionSpec(ServiceOptions{ID: "test-id", InstanceSecrets: instance.Secrets}).Jobs) != 1 {
+		t.Errorf("The database should be created and dropped with the instance")
+	}
+
+	if len(shared.GetDeprovisionSpec(ServiceOptions{ID: "legacy-id"}).Jobs) != 0 {
+		t.Errorf("Instances without a database should not drop anything")
+	}
+
+	for _, bindingID := range []string{"binding-a", "binding-b"} {
+		spec := shared.GetBindSpec(BindOptions{
+			ID:              bindingID,
+			InstanceID:      "test-id",
+			Namespace:       "my-app",
+			GlobalNamespace: "service-broker",
+			InstanceSecrets: instance.Secrets,
+		})
+
+		if string(spec.Secrets[0].Data["database"]) != "instance_test_id" {
+			t.Errorf("All of the bindings should use the instance database not '%s'", spec.Secrets[0].Data["database"])
+		}
+	}
+
+	legacy := shared.GetBindSpec(BindOptions{ID: "6b1f0c2a-binding", InstanceID: "legacy-id", Namespace: "my-app"})
+	if string(legacy.Secrets[0].Data["database"]) != "my_app_6b1f0c2a" {
+		t.Errorf("Instances without a database should get a database per binding not '%s'", legacy.Secrets[0].Data["database"])
+	}
+}
+
+func TestSharedMysqlQuotas(t *testing.T) {
+	plan := PlanConfig{Name: "small", ID: "small-id", Storage: "1Mi", MaxUserConnections: 5, MaxQueriesPerHour: 1000, QuotaAction: QuotaActionLock}
+	shared, _ := NewSharedMysql(SharedMysqlConfig{Name: "central", ID: "shared-mysql-id", Plans: []PlanConfig{plan}}, fake.NewSimpleClientset())
+
+	spec := shared.GetBindSpec(BindOptions{ID: "binding-id", InstanceID: "test-id", PlanID: "small-id"})
+	env := map[string]string{}
+	for _, variable := range spec.Jobs[0].Spec.Template.Spec.Containers[0].Env {
+		env[variable.Name] = variable.Value
+	}
+
+	if env["DB_MAX_USER_CONNECTIONS"] != "5" || env["DB_MAX_QUERIES_PER_HOUR"] != "1000" {
+		t.Errorf("The binding user should have the plan limits")
+	}
+
+	if usage := sharedMysqlUsage("test-id", plan, 1024); usage.OverQuota || usage.StorageQuota != 1048576 {
+		t.Errorf("Invalid usage under the quota '%v'", usage)
+	}
+
+	if usage := sharedMysqlUsage("test-id", plan, 2097152); !usage.OverQuota || !usage.Locked {
+		t.Errorf("Databases over the quota should be locked '%v'", usage)
+	}
+
+	plan.QuotaAction = QuotaActionFlag
+	if usage := sharedMysqlUsage("test-id", plan, 2097152); !usage.OverQuota || usage.Locked {
+		t.Errorf("Databases over the quota should only be flagged '%v'", usage)
+	}
+
+	plan.QuotaAction = "delete"
+	if err := plan.Validate(); err == nil {
+		t.Errorf("Invalid quota actions should not be valid")
+	}
+}
+
+func TestSharedMysqlLockState(t *testing.T) {
+	labels := map[string]string{"service-instance-id": "test-id"}
+	instance := coreV1.Secret{ObjectMeta: metaV1.ObjectMeta{Name: "shared-mysql-test-id", Namespace: "broker-ns", Labels: labels}}
+	client := fake.NewSimpleClientset(&instance, &coreV1.Secret{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name:      "binding-secret-binding-id",
+			Namespace: "broker-ns",
+			Labels:    map[string]string{"service-instance-id": "test-id", "service-binding-id": "binding-id"},
+		},
+		Data: map[string][]byte{"user": []byte("user-abc")},
+	})
+
+	users, err := mysqlBindingUsers(client, instance)
+	if err != nil || len(users) != 1 || !users["user-abc"] {
+		t.Errorf("Only the binding users should be changed, got '%v'", users)
+	}
+
+	if err := setMysqlRevoked(client, instance, map[string][]string{"'user-abc'@'%'": {"INSERT"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	locked, _ := client.CoreV1().Secrets("broker-ns").Get(context.TODO(), "shared-mysql-test-id", metaV1.GetOptions{})
+	if locked.Annotations[mysqlRevokedAnnotation] != `{"'user-abc'@'%'":["INSERT"]}` {
+		t.Errorf("Invalid revoked privileges '%s'", locked.Annotations[mysqlRevokedAnnotation])
+	}
+
+	// The database is not touched again while it stays locked
+	if err := mysqlUpdateLock(client, nil, *locked, "test_db", true); err != nil {
+		t.Errorf("Locked databases should not be locked again: %v", err)
+	}
+
+	if err := mysqlUpdateLock(client, nil, instance, "test_db", false); err != nil {
+		t.Errorf("Unlocked databases should not be unlocked again: %v", err)
+	}
+}
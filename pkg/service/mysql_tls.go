@@ -0,0 +1,104 @@
+package service
+
+import (
+	"fmt"
+
+	"github.com/AdeAttwood/service-broker/pkg/kube"
+
+	coreV1 "k8s.io/api/core/v1"
+)
+
+// Where the server certificate is mounted in the mysql containers
+const mysqlTLSPath = "/etc/mysql/tls"
+
+// Gets the name of the secret with the server certificate of an instance
+func mysqlTLSSecretName(instanceID string) string {
+	return fmt.Sprintf("mysql-instance-%s-tls", instanceID)
+}
+
+// Adds the server certificate of an instance to the provision spec and starts
+// the servers with it. Plans that require tls stop the clients connecting
+// without it, the replicas connect to the primary with tls. When the
+// certificate can't be issued the servers are still started with it so they
+// don't start until it exists instead of starting without tls
+func (s *MysqlInstance) secure(spec *kube.Spec, options ServiceOptions) error {
+	if !s.tls.Enabled() {
+		return nil
+	}
+
+	deploymentName := fmt.Sprintf("mysql-instance-%s", options.ID)
+	secretName := mysqlTLSSecretName(options.ID)
+	plan := findPlan(s.plans, options.PlanID)
+
+	hosts := serviceHosts(deploymentName, options.Namespace)
+	if plan.Replicas > 0 {
+		hosts = append(hosts, serviceHosts(fmt.Sprintf("%s-read", deploymentName), options.Namespace)...)
+	}
+
+	if host := instanceExposure(plan, options.Parameters).host(options.ID); host != "" {
+		hosts = append(hosts, host)
+	}
+
+	secrets, resources, err := s.tls.serverCertificate(s.client, options, secretName, hosts)
+	spec.Secrets = append(spec.Secrets, secrets...)
+	spec.CustomResources = append(spec.CustomResources, resources...)
+
+	args := []string{
+		fmt.Sprintf("--ssl-ca=%s/ca.crt", mysqlTLSPath),
+		fmt.Sprintf("--ssl-cert=%s/tls.crt", mysqlTLSPath),
+		fmt.Sprintf("--ssl-key=%s/tls.key", mysqlTLSPath),
+	}
+
+	if plan.RequireTLS {
+		args = append(args, "--require-secure-transport=ON")
+	}
+
+	podSpecs := []*coreV1.PodSpec{}
+	for i := range spec.Deployments {
+		podSpecs = append(podSpecs, &spec.Deployments[i].Spec.Template.Spec)
+	}
+
+	for i := range spec.StatefulSets {
+		podSpecs = append(podSpecs, &spec.StatefulSets[i].Spec.Template.Spec)
+	}
+
+	for _, podSpec := range podSpecs {
+		mountTLSSecret(podSpec, "mysql", secretName, mysqlTLSPath)
+		for i := range podSpec.Containers {
+			container := &podSpec.Containers[i]
+			switch container.Name {
+			case "mysql":
+				container.Args = append(container.Args, args...)
+			case "replication":
+				container.Env = append(container.Env, coreV1.EnvVar{Name: "MASTER_SSL", Value: ", MASTER_SSL=1"})
+			}
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("Unable to get the server certificate of instance '%s': %v", options.ID, err)
+	}
+
+	return nil
+}
+
+// Gets the tls fields of a binding. The ssl mode is "VERIFY_CA" when the plan
+// requires tls, "PREFERRED" when the instance has a certificate and
+// "DISABLED" for instances without one. The certificate is read from the
+// instance namespace as the binding can be in another namespace
+func (s *MysqlInstance) bindingTLS(options BindOptions) map[string][]byte {
+	tls := instanceTLSData(s.client, options.InstanceSecrets, options.InstanceNamespace(), mysqlTLSSecretName(options.InstanceID))
+
+	data := map[string][]byte{"ssl-mode": []byte(SSLModeDisabled)}
+	if findPlan(s.plans, options.PlanID).RequireTLS {
+		data["ssl-mode"] = []byte(SSLModeVerifyCA)
+	} else if len(tls["tls.crt"]) > 0 {
+		data["ssl-mode"] = []byte(SSLModePreferred)
+	}
+
+	if len(tls["ca.crt"]) > 0 {
+		data["ca.crt"] = tls["ca.crt"]
+	}
+
+	return data
+}
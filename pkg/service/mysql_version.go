@@ -0,0 +1,179 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/AdeAttwood/service-broker/pkg/kube"
+
+	batchV1 "k8s.io/api/batch/v1"
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The version of mysql that is used when no version is set in the plan or the
+// parameters
+const mysqlDefaultVersion = "5.7"
+
+// A version of mysql or mariadb that can be deployed as a mysql instance
+type mysqlVersion struct {
+	Image string
+	// Instances can only be upgraded to a version of the same flavour
+	Flavour string
+	// The order of the versions in a flavour, instances can't be downgraded
+	Order int
+	// Added to the "CREATE USER" statement after "IDENTIFIED" when users are
+	// bound to the instance
+	AuthClause string
+	// Extra environment variables for the server container
+	Env []coreV1.EnvVar
+	// If users can have a second password so the old password keeps working
+	// for a grace period when the credentials are rotated
+	DualPasswords bool
+}
+
+var mysqlVersions = map[string]mysqlVersion{
+	"5.7": {
+		Image:   "mysql:5.7",
+		Flavour: "mysql",
+		Order:   1,
+	},
+	// Mysql 8.0 uses caching_sha2_password by default that a lot of client
+	// libraries don't support yet so users are created with the native
+	// password plugin. The data directory is upgraded when the server starts
+	"8.0": {
+		Image:         "mysql:8.0",
+		Flavour:       "mysql",
+		Order:         2,
+		AuthClause:    "WITH mysql_native_password",
+		DualPasswords: true,
+	},
+	"mariadb-10.4": {
+		Image:   "mariadb:10.4",
+		Flavour: "mariadb",
+		Order:   1,
+		Env:     []coreV1.EnvVar{{Name: "MARIADB_AUTO_UPGRADE", Value: "1"}},
+	},
+	"mariadb-10.5": {
+		Image:   "mariadb:10.5",
+		Flavour: "mariadb",
+		Order:   2,
+		Env:     []coreV1.EnvVar{{Name: "MARIADB_AUTO_UPGRADE", Value: "1"}},
+	},
+	"mariadb-10.6": {
+		Image:   "mariadb:10.6",
+		Flavour: "mariadb",
+		Order:   3,
+		Env:     []coreV1.EnvVar{{Name: "MARIADB_AUTO_UPGRADE", Value: "1"}},
+	},
+}
+
+// Gets the name of the version to deploy. The "version" parameter takes
+// priority over the version in the plan
+func mysqlVersionName(plan PlanConfig, parameters map[string]interface{}) string {
+	version := plan.Version
+	if version == "" {
+		version = mysqlDefaultVersion
+	}
+
+	return stringParam(parameters, "version", version)
+}
+
+// Gets the version to deploy, unknown versions will fall back to the default
+// version. Versions should be validated before the instance is provisioned
+func (s *MysqlInstance) version(planID string, parameters map[string]interface{}) mysqlVersion {
+	name := mysqlVersionName(findPlan(s.plans, planID), parameters)
+	if version, ok := mysqlVersions[name]; ok {
+		return version
+	}
+
+	return mysqlVersions[mysqlDefaultVersion]
+}
+
+func validateMysqlVersion(name string) error {
+	if _, ok := mysqlVersions[name]; ok {
+		return nil
+	}
+
+	names := make([]string, 0, len(mysqlVersions))
+	for name := range mysqlVersions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return fmt.Errorf("Invalid version '%s', the available versions are %s", name, strings.Join(names, ", "))
+}
+
+// Validates an instance can be updated. The version of an instance can only be
+// upgraded to a newer version of the same flavour, mysql can't be downgraded
+// or changed to mariadb once the data directory has been created
+func (s *MysqlInstance) ValidateUpdate(options ServiceOptions, previous ServiceOptions) error {
+	if err := s.ValidateProvision(options); err != nil {
+		return err
+	}
+
+	if (findPlan(s.plans, previous.PlanID).Replicas > 0) != (findPlan(s.plans, options.PlanID).Replicas > 0) {
+		return errors.New("The plan can't be changed between a plan with replicas and one without")
+	}
+
+	// Updates don't change the pvcs so the plan can only be changed to one
+	// with the same storage
+	fromStorage := findPlan(s.plans, previous.PlanID).StorageResources().Requests["storage"]
+	toStorage := findPlan(s.plans, options.PlanID).StorageResources().Requests["storage"]
+	if fromStorage.Cmp(toStorage) != 0 {
+		return fmt.Errorf("The storage can't be changed from '%s' to '%s'", fromStorage.String(), toStorage.String())
+	}
+
+	from := mysqlVersionName(findPlan(s.plans, previous.PlanID), previous.Parameters)
+	to := mysqlVersionName(findPlan(s.plans, options.PlanID), options.Parameters)
+	if from == to {
+		return nil
+	}
+
+	if mysqlVersions[from].Flavour != mysqlVersions[to].Flavour {
+		return fmt.Errorf("The version can't be changed from '%s' to '%s'", from, to)
+	}
+
+	if mysqlVersions[to].Order < mysqlVersions[from].Order {
+		return fmt.Errorf("The version can't be downgraded from '%s' to '%s'", from, to)
+	}
+
+	return nil
+}
+
+// Gets the spec to take a backup of the instance before the version is
+// upgraded. The backup is taken with the previous version and stored in the
+// backup target of the instance
+func (s *MysqlInstance) GetPreUpdateSpec(options ServiceOptions, previous ServiceOptions) *kube.Spec {
+	spec := &kube.Spec{
+		Namespace: options.Namespace,
+		Lables: map[string]string{
+			"service-instance-id": options.ID,
+			"service-id":          s.Definition().ID,
+			"service-name":        s.Definition().Name,
+		},
+	}
+
+	from := mysqlVersionName(findPlan(s.plans, previous.PlanID), previous.Parameters)
+	to := mysqlVersionName(findPlan(s.plans, options.PlanID), options.Parameters)
+	if from == to {
+		return spec
+	}
+
+	spec.Jobs = []batchV1.Job{
+		{
+			ObjectMeta: metaV1.ObjectMeta{
+				Name: fmt.Sprintf("mysql-instance-%s-upgrade-%s", options.ID, strings.ToLower(kube.RandStringBytes(5))),
+			},
+			Spec: batchV1.JobSpec{
+				Template: coreV1.PodTemplateSpec{
+					Spec: s.getBackupPodSpec(previous),
+				},
+			},
+		},
+	}
+
+	return spec
+}
@@ -0,0 +1,113 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+
+	networkingV1 "k8s.io/api/networking/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The label kubernetes adds to every namespace with the name of the namespace
+const namespaceNameLabel = "kubernetes.io/metadata.name"
+
+var _ NetworkIsolator = &MysqlInstance{}
+var _ NetworkIsolator = &MinioInstance{}
+
+func (s *MysqlInstance) GetNetworkPolicy(options ServiceOptions, namespaces []string) networkingV1.NetworkPolicy {
+	policy := instanceNetworkPolicy(fmt.Sprintf("mysql-instance-%s", options.ID), options, namespaces)
+	exposure := instanceExposure(findPlan(s.plans, options.PlanID), options.Parameters)
+	policy.Spec.Ingress[0].From = append(policy.Spec.Ingress[0].From, exposure.networkPolicyPeers()...)
+
+	return policy
+}
+
+func (s *MinioInstance) GetNetworkPolicy(options ServiceOptions, namespaces []string) networkingV1.NetworkPolicy {
+	policy := instanceNetworkPolicy(fmt.Sprintf("minio-instance-%s", options.ID), options, namespaces)
+	exposure := instanceExposure(findPlan(s.plans, options.PlanID), options.Parameters)
+	policy.Spec.Ingress[0].From = append(policy.Spec.Ingress[0].From, exposure.networkPolicyPeers()...)
+
+	return policy
+}
+
+// Gets a network policy for the pods of an instance. Ingress is allowed from
+// the other pods of the instance e.g. the replicas, from the job pods the
+// broker creates for the instance in the instance and broker namespaces and
+// from all the pods in the bound namespaces. The job pods are only matched in
+// those namespaces as any pod can label itself with an instance id
+func instanceNetworkPolicy(deploymentName string, options ServiceOptions, namespaces []string) networkingV1.NetworkPolicy {
+	jobNamespaces := []string{options.Namespace}
+	if options.GlobalNamespace != "" {
+		jobNamespaces = append(jobNamespaces, options.GlobalNamespace)
+	}
+
+	peers := []networkingV1.NetworkPolicyPeer{
+		{
+			PodSelector: &metaV1.LabelSelector{
+				MatchLabels: map[string]string{
+					"app": deploymentName,
+				},
+			},
+		},
+		{
+			NamespaceSelector: namespaceSelector(jobNamespaces),
+			PodSelector: &metaV1.LabelSelector{
+				MatchLabels: map[string]string{
+					"service-instance-id": options.ID,
+				},
+			},
+		},
+	}
+
+	if len(namespaces) > 0 {
+		peers = append(peers, networkingV1.NetworkPolicyPeer{
+			NamespaceSelector: namespaceSelector(namespaces),
+		})
+	}
+
+	return networkingV1.NetworkPolicy{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name: deploymentName,
+		},
+		Spec: networkingV1.NetworkPolicySpec{
+			PodSelector: metaV1.LabelSelector{
+				MatchLabels: map[string]string{
+					"app": deploymentName,
+				},
+			},
+			PolicyTypes: []networkingV1.PolicyType{networkingV1.PolicyTypeIngress},
+			Ingress: []networkingV1.NetworkPolicyIngressRule{
+				{From: peers},
+			},
+		},
+	}
+}
+
+// Gets a selector of the namespaces with the names
+func namespaceSelector(namespaces []string) *metaV1.LabelSelector {
+	return &metaV1.LabelSelector{
+		MatchExpressions: []metaV1.LabelSelectorRequirement{
+			{
+				Key:      namespaceNameLabel,
+				Operator: metaV1.LabelSelectorOpIn,
+				Values:   uniqueNamespaces(namespaces),
+			},
+		},
+	}
+}
+
+// Removes the duplicate namespaces and sorts them so the policy only changes
+// when the bound namespaces change
+func uniqueNamespaces(namespaces []string) []string {
+	seen := map[string]bool{}
+	unique := []string{}
+	for _, namespace := range namespaces {
+		if !seen[namespace] {
+			seen[namespace] = true
+			unique = append(unique, namespace)
+		}
+	}
+
+	sort.Strings(unique)
+	return unique
+}
@@ -0,0 +1,73 @@
+package service
+
+import (
+	"testing"
+
+	networkingV1 "k8s.io/api/networking/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func TestInstanceNetworkPolicy(t *testing.T) {
+	options := ServiceOptions{ID: "test-id", Namespace: "test-ns", GlobalNamespace: "broker-ns"}
+	policy := instanceNetworkPolicy("mysql-instance-test-id", options, []string{"b-ns", "a-ns", "b-ns"})
+
+	if policy.Spec.PodSelector.MatchLabels["app"] != "mysql-instance-test-id" {
+		t.Errorf("The policy should select the instance pods")
+	}
+
+	peers := policy.Spec.Ingress[0].From
+	if len(peers) != 3 {
+		t.Fatalf("Invalid number of peers '%d'", len(peers))
+	}
+
+	values := peers[2].NamespaceSelector.MatchExpressions[0].Values
+	if len(values) != 2 || values[0] != "a-ns" || values[1] != "b-ns" {
+		t.Errorf("Invalid namespaces '%v'", values)
+	}
+
+	job := map[string]string{"service-instance-id": "test-id"}
+	for _, namespace := range []string{"test-ns", "broker-ns"} {
+		if !admits(t, peers, namespace, job) {
+			t.Errorf("The job pods of the instance should be allowed from '%s'", namespace)
+		}
+	}
+
+	if admits(t, peers, "foreign-ns", job) {
+		t.Errorf("Pods with the instance label in other namespaces should not be allowed")
+	}
+
+	if peers := instanceNetworkPolicy("mysql-instance-test-id", options, nil).Spec.Ingress[0].From; len(peers) != 2 {
+		t.Errorf("There should be no namespace peer without any bindings")
+	}
+}
+
+// Checks if a pod with the labels in a namespace is matched by any of the
+// peers, namespaces are selected by their name label
+func admits(t *testing.T, peers []networkingV1.NetworkPolicyPeer, namespace string, podLabels map[string]string) bool {
+	matches := func(selector *metaV1.LabelSelector, set map[string]string) bool {
+		if selector == nil {
+			return true
+		}
+
+		parsed, err := metaV1.LabelSelectorAsSelector(selector)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return parsed.Matches(labels.Set(set))
+	}
+
+	for _, peer := range peers {
+		// Peers without a namespace selector only match the policy namespace
+		if peer.NamespaceSelector == nil && namespace != "test-ns" {
+			continue
+		}
+
+		if matches(peer.NamespaceSelector, map[string]string{namespaceNameLabel: namespace}) && matches(peer.PodSelector, podLabels) {
+			return true
+		}
+	}
+
+	return false
+}
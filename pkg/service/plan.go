@@ -0,0 +1,221 @@
+package service
+
+import (
+	"fmt"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// The size of the instance pvc when the plan has no storage
+const defaultStorage = "2Gi"
+
+// The config for a service that is deployed into the instance namespace like
+// the mysql and minio instances
+type InstanceConfig struct {
+	Plans []PlanConfig `yaml:"plans"`
+	// The policy the passwords and usernames of the instances and bindings are
+	// generated with
+	Credentials CredentialPolicy `yaml:"credentials"`
+	// Where the server certificates of the instances come from, only used by
+	// the mysql and minio instances
+	TLS TLSConfig `yaml:"tls"`
+	// Overrides the pod security of the broker for the instance pods and jobs
+	PodSecurity PodSecurityConfig `yaml:"podSecurity"`
+}
+
+// The config of a plan of an instance service. This sets the size of the
+// instance that gets deployed
+type PlanConfig struct {
+	Name        string `yaml:"name"`
+	ID          string `yaml:"id"`
+	Description string `yaml:"description"`
+	Free        *bool  `yaml:"free"`
+	// The version of the service that will be deployed, this can be
+	// overridden with the "version" parameter
+	Version string `yaml:"version"`
+	// The size of the pvc the instance data is stored on
+	Storage string `yaml:"storage"`
+	// If the instance data is stored on a pvc, only used by the services that
+	// can run without persistence like the redis instance
+	Persistence bool `yaml:"persistence"`
+	// The resource requests of the instance container, e.g. "cpu" and "memory"
+	Requests map[string]string `yaml:"requests"`
+	// The resource limits of the instance container
+	Limits map[string]string `yaml:"limits"`
+	// The number of read replicas, when this is set the instance will be
+	// deployed as a primary with replicas. Only used by the mysql instance
+	Replicas int `yaml:"replicas"`
+	// The maximum number of client connections the instance will accept, zero
+	// will use the default of the instance image
+	MaxConnections int `yaml:"maxConnections"`
+	// The limits of the users that are created for the bindings of the shared
+	// mysql services, zero is unlimited
+	MaxUserConnections int `yaml:"maxUserConnections"`
+	MaxQueriesPerHour  int `yaml:"maxQueriesPerHour"`
+	// What happens when a shared mysql database is bigger than the plan
+	// storage. "flag" only reports it and "lock" removes the write privileges
+	// of the binding users until the database is under the quota again
+	QuotaAction string `yaml:"quotaAction"`
+	// How the instance service is exposed to the clients, only used by the
+	// mysql and minio instances
+	Expose ExposureConfig `yaml:"expose"`
+	// If the clients must connect with tls, this needs the tls of the service
+	// to be configured. Minio instances always require tls when they have a
+	// certificate
+	RequireTLS bool `yaml:"requireTLS"`
+}
+
+// The actions that can be taken when a database is over its storage quota
+const (
+	QuotaActionFlag = "flag"
+	QuotaActionLock = "lock"
+)
+
+// Validates all of the values in the plan can be used to create the resources
+func (p PlanConfig) Validate() error {
+	if p.Name == "" || p.ID == "" {
+		return fmt.Errorf("Plans must have a name and an id")
+	}
+
+	if _, err := resource.ParseQuantity(p.storage()); err != nil {
+		return fmt.Errorf("Invalid storage '%s' in plan '%s'", p.Storage, p.Name)
+	}
+
+	for _, resources := range []map[string]string{p.Requests, p.Limits} {
+		for name, value := range resources {
+			if _, err := resource.ParseQuantity(value); err != nil {
+				return fmt.Errorf("Invalid %s '%s' in plan '%s'", name, value, p.Name)
+			}
+		}
+	}
+
+	if p.QuotaAction != "" && p.QuotaAction != QuotaActionFlag && p.QuotaAction != QuotaActionLock {
+		return fmt.Errorf("Invalid quota action '%s' in plan '%s'", p.QuotaAction, p.Name)
+	}
+
+	if err := p.Expose.Validate(); err != nil {
+		return fmt.Errorf("%s in plan '%s'", err.Error(), p.Name)
+	}
+
+	return nil
+}
+
+// Gets the osb plan to add to the service definition
+func (p PlanConfig) Definition() osb.Plan {
+	free := p.Free
+	if free == nil {
+		free = truePtr()
+	}
+
+	return osb.Plan{
+		Name:        p.Name,
+		ID:          p.ID,
+		Description: p.Description,
+		Free:        free,
+		Metadata: map[string]interface{}{
+			"version":            p.Version,
+			"storage":            p.Storage,
+			"persistence":        p.Persistence,
+			"requests":           p.Requests,
+			"limits":             p.Limits,
+			"maxConnections":     p.MaxConnections,
+			"replicas":           p.Replicas,
+			"maxUserConnections": p.MaxUserConnections,
+			"maxQueriesPerHour":  p.MaxQueriesPerHour,
+			"expose":             p.Expose.Type,
+			"requireTLS":         p.RequireTLS,
+		},
+	}
+}
+
+// Gets the resources for the instance container
+func (p PlanConfig) Resources() coreV1.ResourceRequirements {
+	resources := coreV1.ResourceRequirements{}
+	if len(p.Requests) > 0 {
+		resources.Requests = resourceList(p.Requests)
+	}
+
+	if len(p.Limits) > 0 {
+		resources.Limits = resourceList(p.Limits)
+	}
+
+	return resources
+}
+
+// Gets the resources for the instance pvc
+func (p PlanConfig) StorageResources() coreV1.ResourceRequirements {
+	return coreV1.ResourceRequirements{
+		Requests: coreV1.ResourceList{
+			"storage": resource.MustParse(p.storage()),
+		},
+	}
+}
+
+// Gets the size of the instance pvc with a fallback for plans that don't set
+// the storage
+func (p PlanConfig) storage() string {
+	if p.Storage == "" {
+		return defaultStorage
+	}
+
+	return p.Storage
+}
+
+func resourceList(values map[string]string) coreV1.ResourceList {
+	list := coreV1.ResourceList{}
+	for name, value := range values {
+		list[coreV1.ResourceName(name)] = resource.MustParse(value)
+	}
+
+	return list
+}
+
+// Validates the tls config of an instance service and that the plans that
+// require tls have a certificate
+func (c InstanceConfig) ValidateTLS() error {
+	if err := c.TLS.Validate(); err != nil {
+		return err
+	}
+
+	for _, plan := range c.Plans {
+		if plan.RequireTLS && !c.TLS.Enabled() {
+			return fmt.Errorf("The plan '%s' requires tls but there is no tls provider", plan.Name)
+		}
+	}
+
+	return nil
+}
+
+// Gets the plans of an instance service. If no plans have been configured then
+// the default plan will be used so the service always has a plan
+func (c InstanceConfig) plans(defaultPlan PlanConfig) []PlanConfig {
+	if len(c.Plans) == 0 {
+		return []PlanConfig{defaultPlan}
+	}
+
+	return c.Plans
+}
+
+// Finds a plan by its ID. The first plan is used if the plan can't be found
+// so instances provisioned before a plan was removed can still be managed
+func findPlan(plans []PlanConfig, planID string) PlanConfig {
+	for _, plan := range plans {
+		if plan.ID == planID {
+			return plan
+		}
+	}
+
+	return plans[0]
+}
+
+func planDefinitions(plans []PlanConfig) []osb.Plan {
+	definitions := make([]osb.Plan, 0, len(plans))
+	for _, plan := range plans {
+		definitions = append(definitions, plan.Definition())
+	}
+
+	return definitions
+}
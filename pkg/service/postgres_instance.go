@@ -0,0 +1,460 @@
+package service
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+
+	"github.com/AdeAttwood/service-broker/pkg/kube"
+
+	appsV1 "k8s.io/api/apps/v1"
+	batchV1 "k8s.io/api/batch/v1"
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+)
+
+// The version of postgres that is deployed when the plan has no version
+const postgresDefaultVersion = "13"
+
+// The plan that is used when no plans have been configured for the postgres
+// instance
+var postgresDefaultPlan = PlanConfig{
+	Name:        "default",
+	ID:          "acfe8f83-143d-4571-a458-3eed6f3100e1",
+	Description: "The default plan",
+	Storage:     "2Gi",
+}
+
+// Script to create the role and database of a binding. The connection to the
+// server is configured with the libpq "PG*" environment variables so the same
+// script can be used for any postgres server
+const postgresBindScript = `
+set -e
+
+until psql -d postgres -c "SELECT 1" > /dev/null 2>&1; do
+	echo "Waiting for host '$PGHOST'"
+	sleep 5
+done
+
+if [ -z "$(psql -d postgres -tAc "SELECT 1 FROM pg_roles WHERE rolname = '$DB_USER'")" ]; then
+	echo "Creating role '$DB_USER'"
+	psql -v ON_ERROR_STOP=1 -d postgres -c "CREATE ROLE \"$DB_USER\" WITH LOGIN PASSWORD '$DB_PASSWORD';"
+fi
+
+if [ -z "$(psql -d postgres -tAc "SELECT 1 FROM pg_database WHERE datname = '$DB_NAME'")" ]; then
+	echo "Creating database '$DB_NAME'"
+	psql -v ON_ERROR_STOP=1 -d postgres -c "GRANT \"$DB_USER\" TO CURRENT_USER;"
+	psql -v ON_ERROR_STOP=1 -d postgres -c "CREATE DATABASE \"$DB_NAME\" OWNER \"$DB_USER\";"
+	psql -v ON_ERROR_STOP=1 -d postgres -c "REVOKE ALL ON DATABASE \"$DB_NAME\" FROM PUBLIC;"
+fi
+`
+
+// Script to remove the role and database of a binding
+const postgresDebindScript = `
+set -e
+
+until psql -d postgres -c "SELECT 1" > /dev/null 2>&1; do
+	echo "Waiting for host '$PGHOST'"
+	sleep 5
+done
+
+echo "Removing database '$DB_NAME' and role '$DB_USER'"
+psql -v ON_ERROR_STOP=1 -d postgres -c "SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = '$DB_NAME';"
+psql -v ON_ERROR_STOP=1 -d postgres -c "DROP DATABASE IF EXISTS \"$DB_NAME\";"
+psql -v ON_ERROR_STOP=1 -d postgres -c "DROP ROLE IF EXISTS \"$DB_USER\";"
+`
+
+func NewPostgresInstance(config InstanceConfig, client kubernetes.Interface) *PostgresInstance {
+	return &PostgresInstance{
+		plans:       config.plans(postgresDefaultPlan),
+		credentials: config.Credentials,
+		client:      client,
+	}
+}
+
+type PostgresInstance struct {
+	plans       []PlanConfig
+	credentials CredentialPolicy
+	client      kubernetes.Interface
+}
+
+var _ ProvisionValidator = &PostgresInstance{}
+
+// Get the service definition of the postgres instance
+func (s *PostgresInstance) Definition() osb.Service {
+	return osb.Service{
+		Name:                "postgres-instance",
+		ID:                  "ea59c88c-b904-4e9f-8c72-f22c86ae9258",
+		Description:         "A postgres instance deployment",
+		Bindable:            true,
+		BindingsRetrievable: true,
+		Metadata: map[string]interface{}{
+			"displayName": "PostgreSQL Instance",
+			"imageUrl":    "https://www.postgresql.org/media/img/about/press/elephant.png",
+		},
+		Plans: planDefinitions(s.plans),
+	}
+}
+
+// Gets the host the clients connect to, this depends on how the instance is
+// exposed
+func (s *PostgresInstance) GetHost(instanceID string, namespace string) string {
+	return s.address(instanceID, namespace).Host
+}
+
+// Gets the address of the instance service the clients connect to
+func (s *PostgresInstance) address(instanceID string, namespace string) exposedAddress {
+	name := fmt.Sprintf("postgres-instance-%s", instanceID)
+	return getExposedAddress(s.client, namespace, name, s.serviceHost(instanceID, namespace), 5432)
+}
+
+// Gets the cluster host of the instance service, the jobs always connect with
+// this so they are not blocked by the load balancer source ranges
+func (s *PostgresInstance) serviceHost(instanceID string, namespace string) string {
+	return fmt.Sprintf("postgres-instance-%s.%s.svc.cluster.local", instanceID, namespace)
+}
+
+// Validates the exposure of the instance
+func (s *PostgresInstance) ValidateProvision(options ServiceOptions) error {
+	return validateTCPExposure("Postgres", findPlan(s.plans, options.PlanID), options.Parameters)
+}
+
+// Gets the image of the postgres server for a plan
+func (s *PostgresInstance) image(planID string) string {
+	version := findPlan(s.plans, planID).Version
+	if version == "" {
+		version = postgresDefaultVersion
+	}
+
+	return fmt.Sprintf("postgres:%s", version)
+}
+
+func (s *PostgresInstance) GetDebindSpec(options BindOptions) *kube.Spec {
+	deploymentName := fmt.Sprintf("postgres-instance-%s", options.InstanceID)
+	bindingSecretName := fmt.Sprintf("binding-secret-%s", options.ID)
+
+	return &kube.Spec{
+		Namespace: options.Namespace,
+		Lables: map[string]string{
+			"service-binding-id":  options.ID,
+			"service-instance-id": options.InstanceID,
+			"service-id":          s.Definition().ID,
+			"service-name":        s.Definition().Name,
+		},
+		Jobs: []batchV1.Job{
+			postgresBindingJob(
+				fmt.Sprintf("debinding-job-%s", options.ID),
+				s.image(options.PlanID),
+				"debind.bash",
+				deploymentName,
+				append(s.adminEnv(options.InstanceID, options.Namespace),
+					kube.EnvSecret("DB_NAME", bindingSecretName, "database"),
+					kube.EnvSecret("DB_USER", bindingSecretName, "user"),
+				),
+			),
+		},
+	}
+}
+
+func (s *PostgresInstance) GetBindSpec(options BindOptions) *kube.Spec {
+	deploymentName := fmt.Sprintf("postgres-instance-%s", options.InstanceID)
+	bindingSecretName := fmt.Sprintf("binding-secret-%s", options.ID)
+
+	address := s.address(options.InstanceID, options.Namespace)
+	user := s.credentials.Username("user_%s")
+	password := s.credentials.Password(18)
+	database := postgresDatabaseName(options.ID)
+
+	return &kube.Spec{
+		Namespace: options.Namespace,
+		Lables: map[string]string{
+			"service-binding-id":  options.ID,
+			"service-instance-id": options.InstanceID,
+			"service-id":          s.Definition().ID,
+			"service-name":        s.Definition().Name,
+		},
+		Secrets: []coreV1.Secret{
+			{
+				ObjectMeta: metaV1.ObjectMeta{
+					Name: bindingSecretName,
+				},
+				Type: "Opaque",
+				Data: map[string][]byte{
+					"host":     []byte(address.Host),
+					"port":     []byte(strconv.Itoa(int(address.Port))),
+					"user":     []byte(user),
+					"password": []byte(password),
+					"database": []byte(database),
+					"uri":      []byte(postgresURI(address.Host, int(address.Port), user, password, database, nil)),
+				},
+			},
+		},
+		Jobs: []batchV1.Job{
+			postgresBindingJob(
+				fmt.Sprintf("binding-job-%s", options.ID),
+				s.image(options.PlanID),
+				"bind.bash",
+				deploymentName,
+				append(s.adminEnv(options.InstanceID, options.Namespace),
+					kube.EnvSecret("DB_NAME", bindingSecretName, "database"),
+					kube.EnvSecret("DB_USER", bindingSecretName, "user"),
+					kube.EnvSecret("DB_PASSWORD", bindingSecretName, "password"),
+				),
+			),
+		},
+	}
+}
+
+// Gets the environment to connect to the instance as the postgres super user
+func (s *PostgresInstance) adminEnv(instanceID string, namespace string) []coreV1.EnvVar {
+	rootSecretName := fmt.Sprintf("postgres-instance-%s-root-secret", instanceID)
+
+	return []coreV1.EnvVar{
+		{Name: "PGHOST", Value: s.serviceHost(instanceID, namespace)},
+		{Name: "PGPORT", Value: "5432"},
+		{Name: "PGUSER", Value: "postgres"},
+		kube.EnvSecret("PGPASSWORD", rootSecretName, "password"),
+	}
+}
+
+func (s *PostgresInstance) GetDeprovisionSpec(options ServiceOptions) *kube.Spec {
+	return &kube.Spec{Namespace: options.Namespace}
+}
+
+func (s *PostgresInstance) GetProvisionSpec(options ServiceOptions) *kube.Spec {
+	deploymentName := fmt.Sprintf("postgres-instance-%s", options.ID)
+	secretName := fmt.Sprintf("%s-root-secret", deploymentName)
+	pvcName := fmt.Sprintf("%s-pvc", deploymentName)
+	plan := findPlan(s.plans, options.PlanID)
+
+	args := []string{}
+	if plan.MaxConnections > 0 {
+		args = append(args, "-c", fmt.Sprintf("max_connections=%d", plan.MaxConnections))
+	}
+
+	spec := &kube.Spec{
+		Namespace: options.Namespace,
+		Lables: map[string]string{
+			"service-instance-id": options.ID,
+			"service-id":          s.Definition().ID,
+			"service-name":        s.Definition().Name,
+			"service-plan":        options.PlanID,
+		},
+		Secrets: []coreV1.Secret{
+			{
+				ObjectMeta: metaV1.ObjectMeta{
+					Name: secretName,
+				},
+				Type: "Opaque",
+				Data: map[string][]byte{
+					"password": []byte(s.credentials.Password(16)),
+				},
+			},
+		},
+		ConfigMaps: []coreV1.ConfigMap{
+			{
+				ObjectMeta: metaV1.ObjectMeta{
+					Name: deploymentName,
+				},
+				Data: map[string]string{
+					"bind.bash":   postgresBindScript,
+					"debind.bash": postgresDebindScript,
+				},
+			},
+		},
+		PVCS: []coreV1.PersistentVolumeClaim{
+			{
+				ObjectMeta: metaV1.ObjectMeta{
+					Name: pvcName,
+				},
+				Spec: coreV1.PersistentVolumeClaimSpec{
+					AccessModes: []coreV1.PersistentVolumeAccessMode{
+						"ReadWriteOnce",
+					},
+					Resources: plan.StorageResources(),
+				},
+			},
+		},
+		Deployments: []appsV1.Deployment{
+			{
+				ObjectMeta: metaV1.ObjectMeta{
+					Name: deploymentName,
+				},
+				Spec: appsV1.DeploymentSpec{
+					Replicas: int32Ptr(1),
+					// The old pod must be stopped before the new one starts so
+					// two servers never use the same data directory
+					Strategy: appsV1.DeploymentStrategy{
+						Type: appsV1.RecreateDeploymentStrategyType,
+					},
+					Selector: &metaV1.LabelSelector{
+						MatchLabels: map[string]string{
+							"app": deploymentName,
+						},
+					},
+					Template: coreV1.PodTemplateSpec{
+						ObjectMeta: metaV1.ObjectMeta{
+							Labels: map[string]string{
+								"app": deploymentName,
+							},
+						},
+						Spec: coreV1.PodSpec{
+							Containers: []coreV1.Container{
+								{
+									Name:      "postgres",
+									Image:     s.image(options.PlanID),
+									Args:      args,
+									Resources: plan.Resources(),
+									Ports: []coreV1.ContainerPort{
+										{
+											Name:          "tpc",
+											Protocol:      coreV1.ProtocolTCP,
+											ContainerPort: 5432,
+										},
+									},
+									Env: []coreV1.EnvVar{
+										kube.EnvSecret("POSTGRES_PASSWORD", secretName, "password"),
+										// The data is stored in a sub directory because the
+										// root of a volume can have a "lost+found" directory
+										// in it and postgres will only init an empty directory
+										{
+											Name:  "PGDATA",
+											Value: "/var/lib/postgresql/data/pgdata",
+										},
+									},
+									ReadinessProbe: &coreV1.Probe{
+										Handler: coreV1.Handler{
+											TCPSocket: &coreV1.TCPSocketAction{
+												Port: intstr.IntOrString{
+													Type:   intstr.Int,
+													IntVal: 5432,
+												},
+											},
+										},
+										FailureThreshold:    1,
+										SuccessThreshold:    1,
+										TimeoutSeconds:      2,
+										InitialDelaySeconds: 10,
+										PeriodSeconds:       10,
+									},
+									VolumeMounts: []coreV1.VolumeMount{
+										{
+											Name:      pvcName,
+											MountPath: "/var/lib/postgresql/data",
+										},
+									},
+								},
+							},
+							Volumes: []coreV1.Volume{
+								{
+									Name: pvcName,
+									VolumeSource: coreV1.VolumeSource{
+										PersistentVolumeClaim: &coreV1.PersistentVolumeClaimVolumeSource{
+											ClaimName: pvcName,
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		Services: []coreV1.Service{
+			{
+				ObjectMeta: metaV1.ObjectMeta{
+					Name: deploymentName,
+				},
+				Spec: coreV1.ServiceSpec{
+					Selector: map[string]string{
+						"app": deploymentName,
+					},
+					Ports: []coreV1.ServicePort{
+						{
+							Port: 5432,
+							TargetPort: intstr.IntOrString{
+								Type:   intstr.Int,
+								IntVal: 5432,
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	instanceExposure(plan, options.Parameters).exposeService(&spec.Services[0], options.ID)
+
+	return spec
+}
+
+// Creates a job that runs one of the binding scripts from the config map
+func postgresBindingJob(name string, image string, script string, configMapName string, env []coreV1.EnvVar) batchV1.Job {
+	return batchV1.Job{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name: name,
+		},
+		Spec: batchV1.JobSpec{
+			Template: coreV1.PodTemplateSpec{
+				Spec: coreV1.PodSpec{
+					RestartPolicy:         coreV1.RestartPolicyOnFailure,
+					ActiveDeadlineSeconds: int64Ptr(120),
+					Containers: []coreV1.Container{
+						{
+							Name:    "postgres",
+							Image:   image,
+							Command: []string{"bash", fmt.Sprintf("/tmp/%s", script)},
+							Env:     env,
+							VolumeMounts: []coreV1.VolumeMount{
+								{
+									Name:      "config-volume",
+									MountPath: fmt.Sprintf("/tmp/%s", script),
+									ReadOnly:  true,
+									SubPath:   script,
+								},
+							},
+						},
+					},
+					Volumes: []coreV1.Volume{
+						{
+							Name: "config-volume",
+							VolumeSource: coreV1.VolumeSource{
+								ConfigMap: &coreV1.ConfigMapVolumeSource{
+									LocalObjectReference: coreV1.LocalObjectReference{
+										Name: configMapName,
+									},
+									DefaultMode: int32Ptr(500),
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// Gets the name of the database of a binding. Binding IDs are uuids so the
+// dashes are replaced to give a name that doesn't need to be quoted
+func postgresDatabaseName(bindingID string) string {
+	return fmt.Sprintf("binding_%s", strings.ReplaceAll(bindingID, "-", "_"))
+}
+
+// Builds the "postgres://" connection uri of a binding, any query values like
+// the "sslmode" are added to the end of the uri
+func postgresURI(host string, port int, user string, password string, database string, query url.Values) string {
+	uri := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(user, password),
+		Host:     fmt.Sprintf("%s:%d", host, port),
+		Path:     "/" + database,
+		RawQuery: query.Encode(),
+	}
+
+	return uri.String()
+}
@@ -0,0 +1,138 @@
+package service
+
+import (
+	"strings"
+	"testing"
+
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var postgresTestSpec = NewPostgresInstance(InstanceConfig{}, nil).GetProvisionSpec(ServiceOptions{
+	ID:     "test-id",
+	PlanID: "acfe8f83-143d-4571-a458-3eed6f3100e1",
+})
+
+func TestPostgresInjectLabels(t *testing.T) {
+	postgresTestSpec.InjectLabels(postgresTestSpec.Lables)
+	if label := postgresTestSpec.Deployments[0].Labels["service-instance-id"]; label != "test-id" {
+		t.Errorf("Invalid service ID label '%s'", label)
+	}
+
+	if label := postgresTestSpec.Services[0].Labels["service-plan"]; label != "acfe8f83-143d-4571-a458-3eed6f3100e1" {
+		t.Errorf("Invalid service plan label '%s'", label)
+	}
+}
+
+func TestPostgresImage(t *testing.T) {
+	image := postgresTestSpec.Deployments[0].Spec.Template.Spec.Containers[0].Image
+	if image != "postgres:13" {
+		t.Errorf("Invalid deployment image '%s'", image)
+	}
+}
+
+func TestPostgresStorage(t *testing.T) {
+	pvc := postgresTestSpec.PVCS[0]
+	if pvc.Name != "postgres-instance-test-id-pvc" {
+		t.Errorf("Invalid pvc name '%s'", pvc.Name)
+	}
+
+	if storage := pvc.Spec.Resources.Requests["storage"]; storage.String() != "2Gi" {
+		t.Errorf("Invalid pvc storage '%s'", storage.String())
+	}
+
+	claim := postgresTestSpec.Deployments[0].Spec.Template.Spec.Volumes[0].PersistentVolumeClaim
+	if claim == nil || claim.ClaimName != pvc.Name {
+		t.Errorf("The deployment should mount the instance pvc")
+	}
+}
+
+func TestPostgresService(t *testing.T) {
+	service := postgresTestSpec.Services[0]
+	if service.Name != "postgres-instance-test-id" || service.Spec.Selector["app"] != "postgres-instance-test-id" {
+		t.Errorf("The service should select the instance deployment")
+	}
+
+	if len(service.Spec.Ports) != 1 || service.Spec.Ports[0].Port != 5432 {
+		t.Errorf("Invalid service ports '%v'", service.Spec.Ports)
+	}
+}
+
+func TestApplyPostgres(t *testing.T) {
+	if err := postgresTestSpec.Create(fake.NewSimpleClientset()); err != nil {
+		t.Fatalf("error creating the postgres instance: %v", err)
+	}
+}
+
+func TestPostgresPlanSizing(t *testing.T) {
+	postgres := NewPostgresInstance(InstanceConfig{
+		Plans: []PlanConfig{
+			{
+				Name:           "large",
+				ID:             "large-id",
+				Version:        "14",
+				Storage:        "20Gi",
+				MaxConnections: 200,
+				Requests:       map[string]string{"memory": "1Gi"},
+				Limits:         map[string]string{"memory": "2Gi"},
+			},
+		},
+	}, nil)
+
+	spec := postgres.GetProvisionSpec(ServiceOptions{ID: "test-id", PlanID: "large-id"})
+	container := spec.Deployments[0].Spec.Template.Spec.Containers[0]
+	if container.Image != "postgres:14" {
+		t.Errorf("Invalid deployment image '%s'", container.Image)
+	}
+
+	if args := strings.Join(container.Args, " "); args != "-c max_connections=200" {
+		t.Errorf("Invalid postgres args '%s'", args)
+	}
+
+	if memory := container.Resources.Limits["memory"]; memory.String() != "2Gi" {
+		t.Errorf("Invalid memory limit '%s'", memory.String())
+	}
+
+	if storage := spec.PVCS[0].Spec.Resources.Requests["storage"]; storage.String() != "20Gi" {
+		t.Errorf("Invalid pvc storage '%s'", storage.String())
+	}
+}
+
+func TestPostgresBindCredentials(t *testing.T) {
+	postgres := NewPostgresInstance(InstanceConfig{}, nil)
+	spec := postgres.GetBindSpec(BindOptions{
+		ID:         "binding-id",
+		InstanceID: "test-id",
+		Namespace:  "test",
+	})
+
+	data := spec.Secrets[0].Data
+	if string(data["database"]) != "binding_binding_id" {
+		t.Errorf("Invalid database name '%s'", data["database"])
+	}
+
+	uri := string(data["uri"])
+	expected := "postgres://" + string(data["user"]) + ":" + string(data["password"]) + "@postgres-instance-test-id.test.svc.cluster.local:5432/binding_binding_id"
+	if uri != expected {
+		t.Errorf("Invalid uri '%s'", uri)
+	}
+
+	if !strings.HasPrefix(string(data["user"]), "user_") {
+		t.Errorf("Invalid user '%s'", data["user"])
+	}
+}
+
+func TestPostgresExposure(t *testing.T) {
+	postgres := NewPostgresInstance(InstanceConfig{}, nil)
+	options := ServiceOptions{ID: "test-id", PlanID: "acfe8f83-143d-4571-a458-3eed6f3100e1"}
+
+	service := postgres.GetProvisionSpec(options).Services[0]
+	if service.Spec.Type != coreV1.ServiceTypeClusterIP {
+		t.Errorf("Instances should only be exposed in the cluster by default, got '%s'", service.Spec.Type)
+	}
+
+	options.Parameters = map[string]interface{}{"expose": "LoadBalancer"}
+	if err := postgres.ValidateProvision(options); err == nil {
+		t.Errorf("Plans that don't allow overriding the exposure should not accept the parameters")
+	}
+}
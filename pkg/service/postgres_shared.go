@@ -0,0 +1,282 @@
+package service
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/AdeAttwood/service-broker/pkg/kube"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+
+	batchV1 "k8s.io/api/batch/v1"
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+type SharedPostgresConfig struct {
+	Name     string `yaml:"name"`
+	ID       string `yaml:"id"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	Host     string `yaml:"host"`
+	Port     string `yaml:"port"`
+	// The libpq sslmode the bindings connect with e.g. "require" or
+	// "verify-full". This is added to the binding uri
+	SSLMode string `yaml:"sslmode"`
+	// The pem encoded CA certificate of the server, this is returned in the
+	// binding credentials so clients can verify the server
+	CA string `yaml:"ca"`
+	// The policy the binding users and passwords are generated with
+	Credentials CredentialPolicy `yaml:"credentials"`
+	// Overrides the pod security of the broker for the binding jobs
+	PodSecurity PodSecurityConfig `yaml:"podSecurity"`
+}
+
+func NewSharedPostgres(config SharedPostgresConfig) *SharedPostgres {
+	port := config.Port
+	if port == "" {
+		port = "5432"
+	}
+
+	return &SharedPostgres{
+		name:        config.Name,
+		id:          config.ID,
+		user:        config.User,
+		password:    config.Password,
+		port:        port,
+		host:        config.Host,
+		sslMode:     config.SSLMode,
+		ca:          config.CA,
+		credentials: config.Credentials,
+	}
+}
+
+type SharedPostgres struct {
+	name        string
+	id          string
+	user        string
+	password    string
+	host        string
+	port        string
+	sslMode     string
+	ca          string
+	credentials CredentialPolicy
+}
+
+var _ SharedResourceManager = &SharedPostgres{}
+
+// Gets the secret in the broker namespace with the address and the admin
+// credentials of the server that the jobs of all the instances read
+func (s *SharedPostgres) serverSecretName() string {
+	return fmt.Sprintf("postgres-shared-%s-secret", s.name)
+}
+
+// Creates the server secret when the broker starts, the secret is updated when
+// the config changes
+func (s *SharedPostgres) EnsureSharedResources(client kubernetes.Interface, namespace string) error {
+	return ensureSecret(client, namespace, s.serverSecretName(), map[string][]byte{
+		"user":     []byte(s.user),
+		"password": []byte(s.password),
+		"host":     []byte(s.host),
+		"port":     []byte(s.port),
+		"ca.crt":   []byte(s.ca),
+	})
+}
+
+func (s *SharedPostgres) Definition() osb.Service {
+	return osb.Service{
+		Name:                fmt.Sprintf("postgres-shared-%s", s.name),
+		ID:                  s.id,
+		Description:         "A database on a shared postgres server",
+		Bindable:            true,
+		BindingsRetrievable: true,
+		Metadata: map[string]interface{}{
+			"displayName": "Shared PostgreSQL Database",
+			"imageUrl":    "https://www.postgresql.org/media/img/about/press/elephant.png",
+		},
+		Plans: []osb.Plan{
+			{
+				Name:        "default",
+				ID:          s.id,
+				Description: "The default plan",
+				Free:        truePtr(),
+			},
+		},
+	}
+}
+
+func (s *SharedPostgres) GetHost(instanceID string, namespace string) string {
+	return s.host
+}
+
+func (s *SharedPostgres) GetDebindSpec(options BindOptions) *kube.Spec {
+	bindingSecretName := fmt.Sprintf("binding-secret-%s", options.ID)
+
+	return &kube.Spec{
+		Namespace: options.GlobalNamespace,
+		Lables: map[string]string{
+			"service-binding-id":  options.ID,
+			"service-instance-id": options.InstanceID,
+			"service-id":          s.Definition().ID,
+			"service-name":        s.Definition().Name,
+		},
+		Jobs: []batchV1.Job{
+			s.job(fmt.Sprintf("debinding-job-%s", options.ID), postgresDebindScript, []coreV1.EnvVar{
+				kube.EnvSecret("DB_NAME", bindingSecretName, "database"),
+				kube.EnvSecret("DB_USER", bindingSecretName, "user"),
+			}),
+		},
+	}
+}
+
+func (s *SharedPostgres) GetBindSpec(options BindOptions) *kube.Spec {
+	bindingSecretName := fmt.Sprintf("binding-secret-%s", options.ID)
+	databaseName := bindingDatabaseName(options.Namespace, options.ID)
+	user := s.credentials.Username("user_%s")
+	password := s.credentials.Password(18)
+
+	query := url.Values{}
+	if s.sslMode != "" {
+		query.Set("sslmode", s.sslMode)
+	}
+
+	port, _ := strconv.Atoi(s.port)
+	data := map[string][]byte{
+		"host":     []byte(s.host),
+		"port":     []byte(s.port),
+		"user":     []byte(user),
+		"password": []byte(password),
+		"database": []byte(databaseName),
+		"uri":      []byte(postgresURI(s.host, port, user, password, databaseName, query)),
+	}
+
+	if s.sslMode != "" {
+		data["sslmode"] = []byte(s.sslMode)
+	}
+
+	if s.ca != "" {
+		data["ca.crt"] = []byte(s.ca)
+	}
+
+	return &kube.Spec{
+		Namespace: options.GlobalNamespace,
+		Lables: map[string]string{
+			"service-binding-id":  options.ID,
+			"service-instance-id": options.InstanceID,
+			"service-id":          s.Definition().ID,
+			"service-name":        s.Definition().Name,
+		},
+		Secrets: []coreV1.Secret{
+			{
+				ObjectMeta: metaV1.ObjectMeta{
+					Name: bindingSecretName,
+				},
+				Type: "Opaque",
+				Data: data,
+			},
+		},
+		Jobs: []batchV1.Job{
+			s.job(fmt.Sprintf("binding-job-%s", options.ID), postgresBindScript, []coreV1.EnvVar{
+				kube.EnvSecret("DB_NAME", bindingSecretName, "database"),
+				kube.EnvSecret("DB_USER", bindingSecretName, "user"),
+				kube.EnvSecret("DB_PASSWORD", bindingSecretName, "password"),
+			}),
+		},
+	}
+}
+
+// Creates a job that runs a script against the shared server. The job
+// connects with the same sslmode and CA that is given to the bindings
+func (s *SharedPostgres) job(name string, script string, env []coreV1.EnvVar) batchV1.Job {
+	secretName := s.serverSecretName()
+
+	container := coreV1.Container{
+		Name:    "postgres",
+		Image:   fmt.Sprintf("postgres:%s", postgresDefaultVersion),
+		Command: []string{"bash", "-c", script},
+		Env: append([]coreV1.EnvVar{
+			kube.EnvSecret("PGHOST", secretName, "host"),
+			kube.EnvSecret("PGPORT", secretName, "port"),
+			kube.EnvSecret("PGUSER", secretName, "user"),
+			kube.EnvSecret("PGPASSWORD", secretName, "password"),
+		}, env...),
+	}
+
+	podSpec := coreV1.PodSpec{
+		RestartPolicy:         coreV1.RestartPolicyOnFailure,
+		ActiveDeadlineSeconds: int64Ptr(120),
+	}
+
+	if s.sslMode != "" {
+		container.Env = append(container.Env, coreV1.EnvVar{Name: "PGSSLMODE", Value: s.sslMode})
+	}
+
+	if s.ca != "" {
+		container.Env = append(container.Env, coreV1.EnvVar{Name: "PGSSLROOTCERT", Value: "/etc/postgres/ca.crt"})
+		container.VolumeMounts = []coreV1.VolumeMount{
+			{
+				Name:      "ca",
+				MountPath: "/etc/postgres",
+				ReadOnly:  true,
+			},
+		}
+
+		podSpec.Volumes = []coreV1.Volume{
+			{
+				Name: "ca",
+				VolumeSource: coreV1.VolumeSource{
+					Secret: &coreV1.SecretVolumeSource{
+						SecretName: secretName,
+						Items: []coreV1.KeyToPath{
+							{Key: "ca.crt", Path: "ca.crt"},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	podSpec.Containers = []coreV1.Container{container}
+
+	return batchV1.Job{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name: name,
+		},
+		Spec: batchV1.JobSpec{
+			Template: coreV1.PodTemplateSpec{
+				Spec: podSpec,
+			},
+		},
+	}
+}
+
+func (s *SharedPostgres) GetDeprovisionSpec(options ServiceOptions) *kube.Spec {
+	return &kube.Spec{Namespace: options.Namespace}
+}
+
+// The instances only have a secret with the address of the server so they can
+// be found by the broker, the admin credentials are in the server secret
+func (s *SharedPostgres) GetProvisionSpec(options ServiceOptions) *kube.Spec {
+	return &kube.Spec{
+		Namespace: options.GlobalNamespace,
+		Lables: map[string]string{
+			"service-instance-id": options.ID,
+			"service-id":          s.Definition().ID,
+			"service-name":        s.Definition().Name,
+			"service-plan":        options.PlanID,
+		},
+		Secrets: []coreV1.Secret{
+			{
+				ObjectMeta: metaV1.ObjectMeta{
+					Name: fmt.Sprintf("postgres-shared-instance-%s-secret", options.ID),
+				},
+				Type: "Opaque",
+				Data: map[string][]byte{
+					"host": []byte(s.host),
+					"port": []byte(s.port),
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,81 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSharedPostgresBindCredentials(t *testing.T) {
+	shared := NewSharedPostgres(SharedPostgresConfig{
+		Name:    "central",
+		ID:      "shared-postgres-id",
+		Host:    "postgres.example.com",
+		SSLMode: "verify-full",
+		CA:      "-----BEGIN CERTIFICATE-----",
+	})
+
+	spec := shared.GetBindSpec(BindOptions{
+		ID:              "6b1f0c2a-binding",
+		InstanceID:      "test-id",
+		Namespace:       "my-app",
+		GlobalNamespace: "service-broker",
+	})
+
+	data := spec.Secrets[0].Data
+	if string(data["database"]) != "my_app_6b1f0c2a" {
+		t.Errorf("Invalid database name '%s'", data["database"])
+	}
+
+	if !strings.HasSuffix(string(data["uri"]), "@postgres.example.com:5432/my_app_6b1f0c2a?sslmode=verify-full") {
+		t.Errorf("Invalid uri '%s'", data["uri"])
+	}
+
+	if string(data["ca.crt"]) != "-----BEGIN CERTIFICATE-----" {
+		t.Errorf("The binding credentials should include the CA")
+	}
+
+	container := spec.Jobs[0].Spec.Template.Spec.Containers[0]
+	if len(container.VolumeMounts) != 1 || container.VolumeMounts[0].MountPath != "/etc/postgres" {
+		t.Errorf("The CA should be mounted into the binding job")
+	}
+}
+
+func TestSharedPostgresServerSecret(t *testing.T) {
+	shared := NewSharedPostgres(SharedPostgresConfig{Name: "central", ID: "shared-postgres-id", User: "admin", Password: "secret"})
+	client := fake.NewSimpleClientset()
+	if err := shared.EnsureSharedResources(client, "service-broker"); err != nil {
+		t.Fatalf("Unable to create the server secret: %v", err)
+	}
+
+	secret, err := client.CoreV1().Secrets("service-broker").Get(context.TODO(), "postgres-shared-central-secret", metaV1.GetOptions{})
+	if err != nil || string(secret.Data["password"]) != "secret" {
+		t.Fatalf("The server secret should hold the admin credentials, got '%v'", err)
+	}
+
+	for _, id := range []string{"first-id", "second-id"} {
+		spec := shared.GetProvisionSpec(ServiceOptions{ID: id, GlobalNamespace: "service-broker"})
+		if err := spec.Create(client); err != nil {
+			t.Fatalf("Unable to provision '%s': %v", id, err)
+		}
+
+		if len(spec.Secrets[0].Data["password"]) > 0 {
+			t.Errorf("The admin credentials should not be in the instance secrets")
+		}
+
+		if err := spec.Delete(client); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := client.CoreV1().Secrets("service-broker").Get(context.TODO(), "postgres-shared-central-secret", metaV1.GetOptions{}); err != nil {
+		t.Errorf("Deprovisioning an instance should keep the server secret, got '%v'", err)
+	}
+
+	if database := string(shared.GetBindSpec(BindOptions{ID: "b-1", Namespace: "app"}).Secrets[0].Data["database"]); database != "app_b_1" {
+		t.Errorf("Short binding ids should be used as they are, got '%s'", database)
+	}
+}
@@ -0,0 +1,440 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+
+	"github.com/AdeAttwood/service-broker/pkg/kube"
+
+	appsV1 "k8s.io/api/apps/v1"
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+)
+
+// The plan that is used when no plans have been configured for the rabbitmq
+// instance
+var rabbitMQDefaultPlan = PlanConfig{
+	Name:        "default",
+	ID:          "cca1e58f-2779-4a81-8e2e-b857f870a634",
+	Description: "The default plan",
+	Storage:     "2Gi",
+}
+
+func NewRabbitMQInstance(config InstanceConfig, client kubernetes.Interface) *RabbitMQInstance {
+	s := &RabbitMQInstance{
+		plans:       config.plans(rabbitMQDefaultPlan),
+		credentials: config.Credentials,
+		client:      client,
+		httpClient:  &http.Client{Timeout: 30 * time.Second},
+	}
+
+	s.managementURL = func(instanceID string, namespace string) string {
+		return fmt.Sprintf("http://%s:15672", s.serviceHost(instanceID, namespace))
+	}
+
+	return s
+}
+
+// The rabbitmq instance creates the vhost and user of each binding with the
+// management api from the broker rather than with a job
+type RabbitMQInstance struct {
+	plans       []PlanConfig
+	credentials CredentialPolicy
+	client      kubernetes.Interface
+	httpClient  *http.Client
+	// Gets the url of the management api of an instance
+	managementURL func(instanceID string, namespace string) string
+}
+
+var _ BindingManager = &RabbitMQInstance{}
+var _ ProvisionValidator = &RabbitMQInstance{}
+
+// Get the service definition of the rabbitmq instance
+func (s *RabbitMQInstance) Definition() osb.Service {
+	return osb.Service{
+		Name:                "rabbitmq-instance",
+		ID:                  "2b1e2a2b-3eac-4e17-badb-ff3391657e9a",
+		Description:         "A rabbitmq instance deployment with the management plugin",
+		Bindable:            true,
+		BindingsRetrievable: true,
+		Metadata: map[string]interface{}{
+			"displayName": "RabbitMQ Instance",
+			"imageUrl":    "https://www.rabbitmq.com/img/logo-rabbitmq.svg",
+		},
+		Plans: planDefinitions(s.plans),
+	}
+}
+
+// Gets the host the clients connect to, this depends on how the instance is
+// exposed
+func (s *RabbitMQInstance) GetHost(instanceID string, namespace string) string {
+	return s.address(instanceID, namespace).Host
+}
+
+// Gets the address of the amqp service the clients connect to. The amqp
+// service is only created when the instance is exposed outside of the cluster
+// so the management api is never exposed with it
+func (s *RabbitMQInstance) address(instanceID string, namespace string) exposedAddress {
+	name := fmt.Sprintf("rabbitmq-instance-%s-amqp", instanceID)
+	return getExposedAddress(s.client, namespace, name, s.serviceHost(instanceID, namespace), 5672)
+}
+
+// Gets the cluster host of the instance service with the amqp and management
+// ports, the broker always connects to the management api with this
+func (s *RabbitMQInstance) serviceHost(instanceID string, namespace string) string {
+	return fmt.Sprintf("rabbitmq-instance-%s.%s.svc.cluster.local", instanceID, namespace)
+}
+
+// Validates the exposure of the instance
+func (s *RabbitMQInstance) ValidateProvision(options ServiceOptions) error {
+	return validateTCPExposure("Rabbitmq", findPlan(s.plans, options.PlanID), options.Parameters)
+}
+
+// Gets the image of the rabbitmq server for a plan
+func (s *RabbitMQInstance) image(planID string) string {
+	version := findPlan(s.plans, planID).Version
+	if version == "" {
+		version = "3.8"
+	}
+
+	return fmt.Sprintf("rabbitmq:%s-management", version)
+}
+
+// The vhost and user of a binding are named after the binding so they can be
+// found again when the binding is deleted
+func rabbitMQBindingNames(bindingID string) (string, string) {
+	return bindingID, fmt.Sprintf("user-%s", bindingID)
+}
+
+func (s *RabbitMQInstance) GetDebindSpec(options BindOptions) *kube.Spec {
+	return &kube.Spec{Namespace: options.Namespace}
+}
+
+func (s *RabbitMQInstance) GetBindSpec(options BindOptions) *kube.Spec {
+	bindingSecretName := fmt.Sprintf("binding-secret-%s", options.ID)
+
+	address := s.address(options.InstanceID, options.Namespace)
+	vhost, username := rabbitMQBindingNames(options.ID)
+	password := s.credentials.Password(32)
+
+	uri := url.URL{
+		Scheme: "amqp",
+		User:   url.UserPassword(username, password),
+		Host:   fmt.Sprintf("%s:%d", address.Host, address.Port),
+		Path:   "/" + vhost,
+	}
+
+	return &kube.Spec{
+		Namespace: options.Namespace,
+		Lables: map[string]string{
+			"service-binding-id":  options.ID,
+			"service-instance-id": options.InstanceID,
+			"service-id":          s.Definition().ID,
+			"service-name":        s.Definition().Name,
+		},
+		Secrets: []coreV1.Secret{
+			{
+				ObjectMeta: metaV1.ObjectMeta{
+					Name: bindingSecretName,
+				},
+				Type: "Opaque",
+				Data: map[string][]byte{
+					"host":           []byte(address.Host),
+					"port":           []byte(strconv.Itoa(int(address.Port))),
+					"username":       []byte(username),
+					"password":       []byte(password),
+					"vhost":          []byte(vhost),
+					"uri":            []byte(uri.String()),
+					"management_url": []byte(s.managementURL(options.InstanceID, options.Namespace)),
+				},
+			},
+		},
+	}
+}
+
+// Creates the vhost and user of a binding and gives the user full permissions
+// on the vhost
+func (s *RabbitMQInstance) CreateBinding(options BindOptions, credentials map[string][]byte) error {
+	vhost := url.PathEscape(string(credentials["vhost"]))
+	username := url.PathEscape(string(credentials["username"]))
+
+	if err := s.request(options, http.MethodPut, "/api/vhosts/"+vhost, nil); err != nil {
+		return err
+	}
+
+	user := map[string]string{"password": string(credentials["password"]), "tags": ""}
+	if err := s.request(options, http.MethodPut, "/api/users/"+username, user); err != nil {
+		return err
+	}
+
+	permissions := map[string]string{"configure": ".*", "write": ".*", "read": ".*"}
+	return s.request(options, http.MethodPut, fmt.Sprintf("/api/permissions/%s/%s", vhost, username), permissions)
+}
+
+// Removes the vhost and user of a binding, removing the vhost will also remove
+// all of the queues and exchanges in it. The vhosts and users are removed
+// with the instance so the binding is deleted when the admin secret or the
+// deployment of the instance is gone. Any other errors are returned so the
+// platform retries the unbind and the credentials don't keep working
+func (s *RabbitMQInstance) DeleteBinding(options BindOptions) error {
+	if len(options.InstanceSecretData(fmt.Sprintf("rabbitmq-instance-%s-admin-secret", options.InstanceID))) == 0 {
+		return nil
+	}
+
+	vhost, username := rabbitMQBindingNames(options.ID)
+	for _, path := range []string{"/api/users/" + url.PathEscape(username), "/api/vhosts/" + url.PathEscape(vhost)} {
+		err := s.request(options, http.MethodDelete, path, nil)
+		if _, unreachable := err.(*url.Error); unreachable && s.instanceDeleted(options) {
+			glog.Infof("Rabbitmq instance '%s' is gone, removing binding '%s'", options.InstanceID, options.ID)
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Checks if the deployment of an instance has been deleted
+func (s *RabbitMQInstance) instanceDeleted(options BindOptions) bool {
+	if s.client == nil {
+		return false
+	}
+
+	name := fmt.Sprintf("rabbitmq-instance-%s", options.InstanceID)
+	_, err := s.client.AppsV1().Deployments(options.InstanceNamespace()).Get(context.TODO(), name, metaV1.GetOptions{})
+
+	return errors.IsNotFound(err)
+}
+
+// Sends a request to the management api of an instance as the admin user. Not
+// found errors are ignored so deleting a binding that has already been removed
+// will still succeed
+func (s *RabbitMQInstance) request(options BindOptions, method string, path string, body interface{}) error {
+	adminSecret := options.InstanceSecretData(fmt.Sprintf("rabbitmq-instance-%s-admin-secret", options.InstanceID))
+
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, s.managementURL(options.InstanceID, options.Namespace)+path, &payload)
+	if err != nil {
+		return err
+	}
+
+	req.SetBasicAuth(string(adminSecret["user"]), string(adminSecret["password"]))
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 && !(method == http.MethodDelete && res.StatusCode == http.StatusNotFound) {
+		return fmt.Errorf("%s %s returned %s", method, path, res.Status)
+	}
+
+	return nil
+}
+
+func (s *RabbitMQInstance) GetDeprovisionSpec(options ServiceOptions) *kube.Spec {
+	return &kube.Spec{Namespace: options.Namespace}
+}
+
+func (s *RabbitMQInstance) GetProvisionSpec(options ServiceOptions) *kube.Spec {
+	deploymentName := fmt.Sprintf("rabbitmq-instance-%s", options.ID)
+	secretName := fmt.Sprintf("%s-admin-secret", deploymentName)
+	pvcName := fmt.Sprintf("%s-pvc", deploymentName)
+	plan := findPlan(s.plans, options.PlanID)
+
+	spec := &kube.Spec{
+		Namespace: options.Namespace,
+		Lables: map[string]string{
+			"service-instance-id": options.ID,
+			"service-id":          s.Definition().ID,
+			"service-name":        s.Definition().Name,
+			"service-plan":        options.PlanID,
+		},
+		Secrets: []coreV1.Secret{
+			{
+				ObjectMeta: metaV1.ObjectMeta{
+					Name: secretName,
+				},
+				Type: "Opaque",
+				Data: map[string][]byte{
+					"user":     []byte("admin"),
+					"password": []byte(s.credentials.Password(32)),
+				},
+			},
+		},
+		PVCS: []coreV1.PersistentVolumeClaim{
+			{
+				ObjectMeta: metaV1.ObjectMeta{
+					Name: pvcName,
+				},
+				Spec: coreV1.PersistentVolumeClaimSpec{
+					AccessModes: []coreV1.PersistentVolumeAccessMode{
+						"ReadWriteOnce",
+					},
+					Resources: plan.StorageResources(),
+				},
+			},
+		},
+		Deployments: []appsV1.Deployment{
+			{
+				ObjectMeta: metaV1.ObjectMeta{
+					Name: deploymentName,
+				},
+				Spec: appsV1.DeploymentSpec{
+					Replicas: int32Ptr(1),
+					Strategy: appsV1.DeploymentStrategy{
+						Type: appsV1.RecreateDeploymentStrategyType,
+					},
+					Selector: &metaV1.LabelSelector{
+						MatchLabels: map[string]string{
+							"app": deploymentName,
+						},
+					},
+					Template: coreV1.PodTemplateSpec{
+						ObjectMeta: metaV1.ObjectMeta{
+							Labels: map[string]string{
+								"app": deploymentName,
+							},
+						},
+						Spec: coreV1.PodSpec{
+							Containers: []coreV1.Container{
+								{
+									Name:      "rabbitmq",
+									Image:     s.image(options.PlanID),
+									Resources: plan.Resources(),
+									Ports: []coreV1.ContainerPort{
+										{
+											Name:          "amqp",
+											Protocol:      coreV1.ProtocolTCP,
+											ContainerPort: 5672,
+										},
+										{
+											Name:          "management",
+											Protocol:      coreV1.ProtocolTCP,
+											ContainerPort: 15672,
+										},
+									},
+									Env: []coreV1.EnvVar{
+										kube.EnvSecret("RABBITMQ_DEFAULT_USER", secretName, "user"),
+										kube.EnvSecret("RABBITMQ_DEFAULT_PASS", secretName, "password"),
+										// The data directory is named after the node so the
+										// node name must not change with the pod name
+										{
+											Name:  "RABBITMQ_NODENAME",
+											Value: "rabbit@localhost",
+										},
+									},
+									ReadinessProbe: &coreV1.Probe{
+										Handler: coreV1.Handler{
+											TCPSocket: &coreV1.TCPSocketAction{
+												Port: intstr.IntOrString{
+													Type:   intstr.Int,
+													IntVal: 15672,
+												},
+											},
+										},
+										FailureThreshold:    1,
+										SuccessThreshold:    1,
+										TimeoutSeconds:      2,
+										InitialDelaySeconds: 10,
+										PeriodSeconds:       10,
+									},
+									VolumeMounts: []coreV1.VolumeMount{
+										{
+											Name:      pvcName,
+											MountPath: "/var/lib/rabbitmq",
+										},
+									},
+								},
+							},
+							Volumes: []coreV1.Volume{
+								{
+									Name: pvcName,
+									VolumeSource: coreV1.VolumeSource{
+										PersistentVolumeClaim: &coreV1.PersistentVolumeClaimVolumeSource{
+											ClaimName: pvcName,
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		Services: []coreV1.Service{
+			{
+				ObjectMeta: metaV1.ObjectMeta{
+					Name: deploymentName,
+				},
+				Spec: coreV1.ServiceSpec{
+					Selector: map[string]string{
+						"app": deploymentName,
+					},
+					Ports: []coreV1.ServicePort{
+						{
+							Name: "amqp",
+							Port: 5672,
+							TargetPort: intstr.IntOrString{
+								Type:   intstr.Int,
+								IntVal: 5672,
+							},
+						},
+						{
+							Name: "management",
+							Port: 15672,
+							TargetPort: intstr.IntOrString{
+								Type:   intstr.Int,
+								IntVal: 15672,
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	// The instance service has the management port so it is only exposed in
+	// the cluster, a service with only the amqp port is exposed outside of it
+	exposure := instanceExposure(plan, options.Parameters)
+	spec.Services[0].Spec.Type = coreV1.ServiceTypeClusterIP
+	if exposure.Type != ExposeClusterIP {
+		amqpService := coreV1.Service{
+			ObjectMeta: metaV1.ObjectMeta{
+				Name: fmt.Sprintf("%s-amqp", deploymentName),
+			},
+			Spec: coreV1.ServiceSpec{
+				Selector: spec.Services[0].Spec.Selector,
+				Ports:    []coreV1.ServicePort{spec.Services[0].Spec.Ports[0]},
+			},
+		}
+
+		exposure.exposeService(&amqpService, options.ID)
+		spec.Services = append(spec.Services, amqpService)
+	}
+
+	return spec
+}
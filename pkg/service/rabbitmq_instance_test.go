@@ -0,0 +1,212 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	appsV1 "k8s.io/api/apps/v1"
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var rabbitMQTestSpec = NewRabbitMQInstance(InstanceConfig{}, nil).GetProvisionSpec(ServiceOptions{
+	ID:     "test-id",
+	PlanID: "cca1e58f-2779-4a81-8e2e-b857f870a634",
+})
+
+func TestRabbitMQInjectLabels(t *testing.T) {
+	rabbitMQTestSpec.InjectLabels(rabbitMQTestSpec.Lables)
+	if label := rabbitMQTestSpec.Deployments[0].Labels["service-instance-id"]; label != "test-id" {
+		t.Errorf("Invalid service ID label '%s'", label)
+	}
+}
+
+func TestRabbitMQImage(t *testing.T) {
+	image := rabbitMQTestSpec.Deployments[0].Spec.Template.Spec.Containers[0].Image
+	if image != "rabbitmq:3.8-management" {
+		t.Errorf("Invalid deployment image '%s'", image)
+	}
+}
+
+func TestRabbitMQAdminSecret(t *testing.T) {
+	secret := rabbitMQTestSpec.Secrets[0]
+	if secret.Name != "rabbitmq-instance-test-id-admin-secret" || string(secret.Data["user"]) != "admin" || len(secret.Data["password"]) == 0 {
+		t.Errorf("Invalid admin secret '%s'", secret.Name)
+	}
+
+	env := rabbitMQTestSpec.Deployments[0].Spec.Template.Spec.Containers[0].Env
+	if env[0].ValueFrom.SecretKeyRef.Name != secret.Name {
+		t.Errorf("The server should use the admin credentials from the admin secret")
+	}
+}
+
+func TestRabbitMQStorage(t *testing.T) {
+	pvc := rabbitMQTestSpec.PVCS[0]
+	if storage := pvc.Spec.Resources.Requests["storage"]; pvc.Name != "rabbitmq-instance-test-id-pvc" || storage.String() != "2Gi" {
+		t.Errorf("Invalid pvc '%s' with the storage '%s'", pvc.Name, storage.String())
+	}
+
+	mount := rabbitMQTestSpec.Deployments[0].Spec.Template.Spec.Containers[0].VolumeMounts[0]
+	if mount.Name != pvc.Name || mount.MountPath != "/var/lib/rabbitmq" {
+		t.Errorf("The data directory should be on the instance pvc")
+	}
+}
+
+func TestApplyRabbitMQ(t *testing.T) {
+	if err := rabbitMQTestSpec.Create(fake.NewSimpleClientset()); err != nil {
+		t.Fatalf("error creating the rabbitmq instance: %v", err)
+	}
+}
+
+func TestRabbitMQDebindSpec(t *testing.T) {
+	spec := NewRabbitMQInstance(InstanceConfig{}, nil).GetDebindSpec(BindOptions{ID: "binding-id", InstanceID: "test-id", Namespace: "test"})
+	if spec.Namespace != "test" {
+		t.Errorf("Invalid debind namespace '%s'", spec.Namespace)
+	}
+
+	// The vhost and user are removed with the management api so the debind
+	// spec has nothing to create
+	if len(spec.Jobs) != 0 || len(spec.Secrets) != 0 {
+		t.Errorf("The debind spec should not create any resources")
+	}
+}
+
+func TestRabbitMQExposure(t *testing.T) {
+	rabbitmq := NewRabbitMQInstance(InstanceConfig{
+		Plans: []PlanConfig{
+			{Name: "internal", ID: "internal-id", Storage: "2Gi"},
+			{Name: "public", ID: "public-id", Storage: "2Gi", Expose: ExposureConfig{Type: ExposeLoadBalancer}},
+		},
+	}, nil)
+
+	services := rabbitmq.GetProvisionSpec(ServiceOptions{ID: "test-id", PlanID: "internal-id"}).Services
+	if len(services) != 1 || services[0].Spec.Type != coreV1.ServiceTypeClusterIP {
+		t.Errorf("Instances should only be exposed in the cluster by default")
+	}
+
+	services = rabbitmq.GetProvisionSpec(ServiceOptions{ID: "test-id", PlanID: "public-id"}).Services
+	if len(services) != 2 || services[0].Spec.Type != coreV1.ServiceTypeClusterIP {
+		t.Fatalf("The instance service with the management port should not be exposed")
+	}
+
+	amqp := services[1]
+	if amqp.Name != "rabbitmq-instance-test-id-amqp" || amqp.Spec.Type != coreV1.ServiceTypeLoadBalancer {
+		t.Errorf("Invalid amqp service '%s' of type '%s'", amqp.Name, amqp.Spec.Type)
+	}
+
+	if len(amqp.Spec.Ports) != 1 || amqp.Spec.Ports[0].Port != 5672 {
+		t.Errorf("Only the amqp port should be exposed, got '%v'", amqp.Spec.Ports)
+	}
+
+	if err := rabbitmq.ValidateProvision(ServiceOptions{PlanID: "internal-id", Parameters: map[string]interface{}{"expose": "Ingress"}}); err == nil {
+		t.Errorf("Plans that don't allow overriding the exposure should not accept the parameters")
+	}
+}
+
+func TestRabbitMQBinding(t *testing.T) {
+	requests := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ := r.BasicAuth()
+		if user != "admin" || password != "admin-password" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if r.Method == http.MethodPut && r.URL.Path == "/api/users/user-binding-id" {
+			body := map[string]string{}
+			json.NewDecoder(r.Body).Decode(&body)
+			if body["password"] == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		if r.Method == http.MethodDelete && r.URL.Path == "/api/vhosts/binding-id" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	client := fake.NewSimpleClientset(&appsV1.Deployment{
+		ObjectMeta: metaV1.ObjectMeta{Name: "rabbitmq-instance-test-id", Namespace: "test"},
+	})
+
+	rabbitmq := NewRabbitMQInstance(InstanceConfig{}, client)
+	rabbitmq.managementURL = func(instanceID string, namespace string) string {
+		return server.URL
+	}
+
+	options := BindOptions{
+		ID:         "binding-id",
+		InstanceID: "test-id",
+		Namespace:  "test",
+		InstanceSecrets: []coreV1.Secret{
+			{
+				ObjectMeta: metaV1.ObjectMeta{Name: "rabbitmq-instance-test-id-admin-secret", Namespace: "test"},
+				Data: map[string][]byte{
+					"user":     []byte("admin"),
+					"password": []byte("admin-password"),
+				},
+			},
+		},
+	}
+
+	data := rabbitmq.GetBindSpec(options).Secrets[0].Data
+	expected := "amqp://user-binding-id:" + string(data["password"]) + "@rabbitmq-instance-test-id.test.svc.cluster.local:5672/binding-id"
+	if string(data["uri"]) != expected {
+		t.Errorf("Invalid uri '%s'", data["uri"])
+	}
+
+	if err := rabbitmq.CreateBinding(options, data); err != nil {
+		t.Fatalf("Unable to create the binding: %v", err)
+	}
+
+	if err := rabbitmq.DeleteBinding(options); err != nil {
+		t.Fatalf("Unable to delete the binding: %v", err)
+	}
+
+	expectedRequests := []string{
+		"PUT /api/vhosts/binding-id",
+		"PUT /api/users/user-binding-id",
+		"PUT /api/permissions/binding-id/user-binding-id",
+		"DELETE /api/users/user-binding-id",
+		"DELETE /api/vhosts/binding-id",
+	}
+
+	if len(requests) != len(expectedRequests) {
+		t.Fatalf("Invalid management api requests '%v'", requests)
+	}
+
+	for i, request := range expectedRequests {
+		if requests[i] != request {
+			t.Errorf("Invalid request '%s' expected '%s'", requests[i], request)
+		}
+	}
+
+	server.Close()
+	if err := rabbitmq.DeleteBinding(options); err == nil {
+		t.Errorf("Bindings of running instances that can't be reached should not be deleted")
+	}
+
+	client.AppsV1().Deployments("test").Delete(context.TODO(), "rabbitmq-instance-test-id", metaV1.DeleteOptions{})
+	if err := rabbitmq.DeleteBinding(options); err != nil {
+		t.Errorf("Bindings of instances that have been deleted should be deleted: %v", err)
+	}
+
+	options.InstanceSecrets = nil
+	if err := rabbitmq.CreateBinding(options, data); err == nil {
+		t.Errorf("Requests without the admin credentials should fail")
+	}
+
+	if err := rabbitmq.DeleteBinding(options); err != nil {
+		t.Errorf("Bindings of instances that are gone should be deleted: %v", err)
+	}
+}
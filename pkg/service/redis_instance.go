@@ -0,0 +1,579 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+
+	"github.com/AdeAttwood/service-broker/pkg/kube"
+
+	appsV1 "k8s.io/api/apps/v1"
+	batchV1 "k8s.io/api/batch/v1"
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+)
+
+// The plan that is used when no plans have been configured for the redis
+// instance. Redis is mostly used as a cache so the data is not persisted
+var redisDefaultPlan = PlanConfig{
+	Name:        "default",
+	ID:          "14bf1e0d-99e9-488d-8e2e-6ee2c66a8c93",
+	Description: "The default plan, the data is not persisted",
+}
+
+// Starts the redis server with the users from the acl file. The file is
+// created with the default user on the first start so the default user is
+// protected with the root password. The users of the bindings are added from
+// the acl secret so they are kept when the data is not persisted
+const redisStartScript = `
+set -e
+
+if [ ! -f /data/users.acl ]; then
+	echo "user default on >$REDIS_PASSWORD ~* &* +@all" > /data/users.acl
+	for file in /etc/redis/acl/*.acl; do
+		[ -f "$file" ] && cat "$file" >> /data/users.acl
+	done
+fi
+
+exec redis-server --aclfile /data/users.acl "$@"
+`
+
+// Creates the acl user of a binding. The user can only access the keys and
+// channels that start with the binding key prefix and can't run any of the
+// dangerous commands like "FLUSHALL" that would affect other bindings
+const redisBindScript = `
+set -e
+
+export REDISCLI_AUTH="$REDIS_PASSWORD"
+
+until [ "$(redis-cli -h "$REDIS_HOST" PING)" = "PONG" ]; do
+	echo "Waiting for host '$REDIS_HOST'"
+	sleep 5
+done
+
+echo "Creating user '$REDIS_USER' with the key prefix '$REDIS_KEY_PREFIX'"
+[ "$(redis-cli -h "$REDIS_HOST" ACL SETUSER "$REDIS_USER" reset on ">$REDIS_USER_PASSWORD" "~$REDIS_KEY_PREFIX*" "&$REDIS_KEY_PREFIX*" +@all -@dangerous)" = "OK" ]
+[ "$(redis-cli -h "$REDIS_HOST" ACL SAVE)" = "OK" ]
+`
+
+const redisDebindScript = `
+set -e
+
+export REDISCLI_AUTH="$REDIS_PASSWORD"
+
+until [ "$(redis-cli -h "$REDIS_HOST" PING)" = "PONG" ]; do
+	echo "Waiting for host '$REDIS_HOST'"
+	sleep 5
+done
+
+echo "Removing user '$REDIS_USER'"
+redis-cli -h "$REDIS_HOST" ACL DELUSER "$REDIS_USER"
+[ "$(redis-cli -h "$REDIS_HOST" ACL SAVE)" = "OK" ]
+`
+
+func NewRedisInstance(config InstanceConfig, client kubernetes.Interface) *RedisInstance {
+	return &RedisInstance{
+		plans:       config.plans(redisDefaultPlan),
+		credentials: config.Credentials,
+		client:      client,
+	}
+}
+
+type RedisInstance struct {
+	plans       []PlanConfig
+	credentials CredentialPolicy
+	client      kubernetes.Interface
+}
+
+var _ BindingManager = &RedisInstance{}
+var _ BindValidator = &RedisInstance{}
+var _ ProvisionValidator = &RedisInstance{}
+
+// Gets the name of the secret with the acl users of the bindings of an
+// instance
+func redisACLSecretName(instanceID string) string {
+	return fmt.Sprintf("redis-instance-%s-acl", instanceID)
+}
+
+// Checks the key prefix of a binding can be used in the acl patterns. An empty
+// prefix or a glob would give the binding the keys of the other bindings
+func validateRedisKeyPrefix(keyPrefix string) error {
+	if keyPrefix == "" {
+		return fmt.Errorf("The key prefix can't be empty")
+	}
+
+	if strings.ContainsAny(keyPrefix, " \t\r\n") {
+		return fmt.Errorf("The key prefix can't have any white space")
+	}
+
+	if strings.ContainsAny(keyPrefix, "*?[]\\") {
+		return fmt.Errorf("The key prefix can't have any of the glob characters '*?[]\\'")
+	}
+
+	return nil
+}
+
+// Validates the key prefix parameter before the bind job is created
+func (s *RedisInstance) ValidateBind(options BindOptions) error {
+	return validateRedisKeyPrefix(redisKeyPrefix(options))
+}
+
+// Gets the key prefix of a binding, the binding id is used by default
+func redisKeyPrefix(options BindOptions) string {
+	return stringParam(options.Parameters, "key_prefix", fmt.Sprintf("%s:", options.ID))
+}
+
+// Adds the user of a binding to the acl secret of the instance so the user is
+// created again when the server starts without the acl file. The password is
+// stored as a hash
+func (s *RedisInstance) CreateBinding(options BindOptions, credentials map[string][]byte) error {
+	keyPrefix := string(credentials["key_prefix"])
+	if err := validateRedisKeyPrefix(keyPrefix); err != nil {
+		return err
+	}
+
+	hash := sha256.Sum256(credentials["password"])
+	user := fmt.Sprintf("user %s on #%x ~%s* &%s* +@all -@dangerous\n", credentials["username"], hash, keyPrefix, keyPrefix)
+
+	return s.updateACL(options, func(data map[string][]byte) {
+		data[fmt.Sprintf("%s.acl", options.ID)] = []byte(user)
+	})
+}
+
+// Removes the user of a binding from the acl secret of the instance
+func (s *RedisInstance) DeleteBinding(options BindOptions) error {
+	return s.updateACL(options, func(data map[string][]byte) {
+		delete(data, fmt.Sprintf("%s.acl", options.ID))
+	})
+}
+
+// Updates the acl secret of an instance. The secret is created for the
+// instances that were provisioned before it was added to the provision spec
+func (s *RedisInstance) updateACL(options BindOptions, update func(data map[string][]byte)) error {
+	secrets := s.client.CoreV1().Secrets(options.InstanceNamespace())
+	secret, err := secrets.Get(context.TODO(), redisACLSecretName(options.InstanceID), metaV1.GetOptions{})
+	if errors.IsNotFound(err) {
+		secret = &coreV1.Secret{
+			ObjectMeta: metaV1.ObjectMeta{Name: redisACLSecretName(options.InstanceID)},
+			Type:       "Opaque",
+			Data:       map[string][]byte{},
+		}
+
+		update(secret.Data)
+		_, err = secrets.Create(context.TODO(), secret, metaV1.CreateOptions{})
+		return err
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+
+	update(secret.Data)
+	_, err = secrets.Update(context.TODO(), secret, metaV1.UpdateOptions{})
+	return err
+}
+
+// Get the service definition of the redis instance
+func (s *RedisInstance) Definition() osb.Service {
+	return osb.Service{
+		Name:                "redis-instance",
+		ID:                  "fa81f298-361c-43c6-9e23-03f96c271452",
+		Description:         "A redis instance deployment",
+		Bindable:            true,
+		BindingsRetrievable: true,
+		Metadata: map[string]interface{}{
+			"displayName": "Redis Instance",
+			"imageUrl":    "https://redis.io/images/redis-white.png",
+		},
+		Plans: planDefinitions(s.plans),
+	}
+}
+
+// Gets the host the clients connect to, this depends on how the instance is
+// exposed
+func (s *RedisInstance) GetHost(instanceID string, namespace string) string {
+	return s.address(instanceID, namespace).Host
+}
+
+// Gets the address of the instance service the clients connect to
+func (s *RedisInstance) address(instanceID string, namespace string) exposedAddress {
+	name := fmt.Sprintf("redis-instance-%s", instanceID)
+	return getExposedAddress(s.client, namespace, name, s.serviceHost(instanceID, namespace), 6379)
+}
+
+// Gets the cluster host of the instance service, the jobs always connect with
+// this so they are not blocked by the load balancer source ranges
+func (s *RedisInstance) serviceHost(instanceID string, namespace string) string {
+	return fmt.Sprintf("redis-instance-%s.%s.svc.cluster.local", instanceID, namespace)
+}
+
+// Validates the exposure of the instance
+func (s *RedisInstance) ValidateProvision(options ServiceOptions) error {
+	return validateTCPExposure("Redis", findPlan(s.plans, options.PlanID), options.Parameters)
+}
+
+// Gets the image of the redis server for a plan. The acl users need at least
+// redis 6.2 for the channel permissions
+func (s *RedisInstance) image(planID string) string {
+	version := findPlan(s.plans, planID).Version
+	if version == "" {
+		version = "6.2"
+	}
+
+	return fmt.Sprintf("redis:%s", version)
+}
+
+func (s *RedisInstance) GetDebindSpec(options BindOptions) *kube.Spec {
+	bindingSecretName := fmt.Sprintf("binding-secret-%s", options.ID)
+
+	return &kube.Spec{
+		Namespace: options.Namespace,
+		Lables: map[string]string{
+			"service-binding-id":  options.ID,
+			"service-instance-id": options.InstanceID,
+			"service-id":          s.Definition().ID,
+			"service-name":        s.Definition().Name,
+		},
+		Jobs: []batchV1.Job{
+			s.bindingJob(fmt.Sprintf("debinding-job-%s", options.ID), "debind.bash", options, []coreV1.EnvVar{
+				kube.EnvSecret("REDIS_USER", bindingSecretName, "username"),
+			}),
+		},
+	}
+}
+
+func (s *RedisInstance) GetBindSpec(options BindOptions) *kube.Spec {
+	bindingSecretName := fmt.Sprintf("binding-secret-%s", options.ID)
+
+	address := s.address(options.InstanceID, options.Namespace)
+	username := s.credentials.Username("user-%s")
+	password := s.credentials.Password(32)
+	keyPrefix := redisKeyPrefix(options)
+
+	uri := url.URL{
+		Scheme: "redis",
+		User:   url.UserPassword(username, password),
+		Host:   fmt.Sprintf("%s:%d", address.Host, address.Port),
+	}
+
+	return &kube.Spec{
+		Namespace: options.Namespace,
+		Lables: map[string]string{
+			"service-binding-id":  options.ID,
+			"service-instance-id": options.InstanceID,
+			"service-id":          s.Definition().ID,
+			"service-name":        s.Definition().Name,
+		},
+		Secrets: []coreV1.Secret{
+			{
+				ObjectMeta: metaV1.ObjectMeta{
+					Name: bindingSecretName,
+				},
+				Type: "Opaque",
+				Data: map[string][]byte{
+					"host":       []byte(address.Host),
+					"port":       []byte(strconv.Itoa(int(address.Port))),
+					"username":   []byte(username),
+					"password":   []byte(password),
+					"key_prefix": []byte(keyPrefix),
+					"uri":        []byte(uri.String()),
+				},
+			},
+		},
+		Jobs: []batchV1.Job{
+			s.bindingJob(fmt.Sprintf("binding-job-%s", options.ID), "bind.bash", options, []coreV1.EnvVar{
+				kube.EnvSecret("REDIS_USER", bindingSecretName, "username"),
+				kube.EnvSecret("REDIS_USER_PASSWORD", bindingSecretName, "password"),
+				kube.EnvSecret("REDIS_KEY_PREFIX", bindingSecretName, "key_prefix"),
+			}),
+		},
+	}
+}
+
+// Creates a job that runs one of the binding scripts against the instance as
+// the default user
+func (s *RedisInstance) bindingJob(name string, script string, options BindOptions, env []coreV1.EnvVar) batchV1.Job {
+	deploymentName := fmt.Sprintf("redis-instance-%s", options.InstanceID)
+	rootSecretName := fmt.Sprintf("%s-root-secret", deploymentName)
+
+	return batchV1.Job{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name: name,
+		},
+		Spec: batchV1.JobSpec{
+			Template: coreV1.PodTemplateSpec{
+				Spec: coreV1.PodSpec{
+					RestartPolicy:         coreV1.RestartPolicyOnFailure,
+					ActiveDeadlineSeconds: int64Ptr(120),
+					Containers: []coreV1.Container{
+						{
+							Name:    "redis",
+							Image:   s.image(options.PlanID),
+							Command: []string{"bash", fmt.Sprintf("/tmp/%s", script)},
+							Env: append([]coreV1.EnvVar{
+								{
+									Name:  "REDIS_HOST",
+									Value: s.serviceHost(options.InstanceID, options.Namespace),
+								},
+								kube.EnvSecret("REDIS_PASSWORD", rootSecretName, "password"),
+							}, env...),
+							VolumeMounts: []coreV1.VolumeMount{
+								{
+									Name:      "config-volume",
+									MountPath: fmt.Sprintf("/tmp/%s", script),
+									ReadOnly:  true,
+									SubPath:   script,
+								},
+							},
+						},
+					},
+					Volumes: []coreV1.Volume{
+						{
+							Name: "config-volume",
+							VolumeSource: coreV1.VolumeSource{
+								ConfigMap: &coreV1.ConfigMapVolumeSource{
+									LocalObjectReference: coreV1.LocalObjectReference{
+										Name: deploymentName,
+									},
+									DefaultMode: int32Ptr(500),
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func (s *RedisInstance) GetDeprovisionSpec(options ServiceOptions) *kube.Spec {
+	return &kube.Spec{Namespace: options.Namespace}
+}
+
+func (s *RedisInstance) GetProvisionSpec(options ServiceOptions) *kube.Spec {
+	deploymentName := fmt.Sprintf("redis-instance-%s", options.ID)
+	secretName := fmt.Sprintf("%s-root-secret", deploymentName)
+	pvcName := fmt.Sprintf("%s-pvc", deploymentName)
+	plan := findPlan(s.plans, options.PlanID)
+
+	// Without persistence the data is kept on an empty dir so it will only
+	// survive restarts of the container and not the pod
+	pvcs := []coreV1.PersistentVolumeClaim{}
+	dataVolume := coreV1.VolumeSource{EmptyDir: &coreV1.EmptyDirVolumeSource{}}
+	if plan.Persistence {
+		pvcs = append(pvcs, coreV1.PersistentVolumeClaim{
+			ObjectMeta: metaV1.ObjectMeta{
+				Name: pvcName,
+			},
+			Spec: coreV1.PersistentVolumeClaimSpec{
+				AccessModes: []coreV1.PersistentVolumeAccessMode{
+					"ReadWriteOnce",
+				},
+				Resources: plan.StorageResources(),
+			},
+		})
+
+		dataVolume = coreV1.VolumeSource{
+			PersistentVolumeClaim: &coreV1.PersistentVolumeClaimVolumeSource{
+				ClaimName: pvcName,
+			},
+		}
+	}
+
+	spec := &kube.Spec{
+		Namespace: options.Namespace,
+		Lables: map[string]string{
+			"service-instance-id": options.ID,
+			"service-id":          s.Definition().ID,
+			"service-name":        s.Definition().Name,
+			"service-plan":        options.PlanID,
+		},
+		Secrets: []coreV1.Secret{
+			{
+				ObjectMeta: metaV1.ObjectMeta{
+					Name: secretName,
+				},
+				Type: "Opaque",
+				Data: map[string][]byte{
+					"password": []byte(s.credentials.Password(32)),
+				},
+			},
+			{
+				ObjectMeta: metaV1.ObjectMeta{
+					Name: redisACLSecretName(options.ID),
+				},
+				Type: "Opaque",
+				Data: map[string][]byte{},
+			},
+		},
+		ConfigMaps: []coreV1.ConfigMap{
+			{
+				ObjectMeta: metaV1.ObjectMeta{
+					Name: deploymentName,
+				},
+				Data: map[string]string{
+					"start.bash":  redisStartScript,
+					"bind.bash":   redisBindScript,
+					"debind.bash": redisDebindScript,
+				},
+			},
+		},
+		PVCS: pvcs,
+		Deployments: []appsV1.Deployment{
+			{
+				ObjectMeta: metaV1.ObjectMeta{
+					Name: deploymentName,
+				},
+				Spec: appsV1.DeploymentSpec{
+					Replicas: int32Ptr(1),
+					Strategy: appsV1.DeploymentStrategy{
+						Type: appsV1.RecreateDeploymentStrategyType,
+					},
+					Selector: &metaV1.LabelSelector{
+						MatchLabels: map[string]string{
+							"app": deploymentName,
+						},
+					},
+					Template: coreV1.PodTemplateSpec{
+						ObjectMeta: metaV1.ObjectMeta{
+							Labels: map[string]string{
+								"app": deploymentName,
+							},
+						},
+						Spec: coreV1.PodSpec{
+							Containers: []coreV1.Container{
+								{
+									Name:      "redis",
+									Image:     s.image(options.PlanID),
+									Command:   []string{"bash", "/tmp/start.bash"},
+									Args:      redisArgs(plan),
+									Resources: plan.Resources(),
+									Ports: []coreV1.ContainerPort{
+										{
+											Name:          "tpc",
+											Protocol:      coreV1.ProtocolTCP,
+											ContainerPort: 6379,
+										},
+									},
+									Env: []coreV1.EnvVar{
+										kube.EnvSecret("REDIS_PASSWORD", secretName, "password"),
+									},
+									ReadinessProbe: &coreV1.Probe{
+										Handler: coreV1.Handler{
+											TCPSocket: &coreV1.TCPSocketAction{
+												Port: intstr.IntOrString{
+													Type:   intstr.Int,
+													IntVal: 6379,
+												},
+											},
+										},
+										FailureThreshold:    1,
+										SuccessThreshold:    1,
+										TimeoutSeconds:      2,
+										InitialDelaySeconds: 5,
+										PeriodSeconds:       10,
+									},
+									VolumeMounts: []coreV1.VolumeMount{
+										{
+											Name:      "data",
+											MountPath: "/data",
+										},
+										{
+											Name:      "config-volume",
+											MountPath: "/tmp/start.bash",
+											ReadOnly:  true,
+											SubPath:   "start.bash",
+										},
+										{
+											Name:      "acl",
+											MountPath: "/etc/redis/acl",
+											ReadOnly:  true,
+										},
+									},
+								},
+							},
+							Volumes: []coreV1.Volume{
+								{
+									Name:         "data",
+									VolumeSource: dataVolume,
+								},
+								{
+									Name: "config-volume",
+									VolumeSource: coreV1.VolumeSource{
+										ConfigMap: &coreV1.ConfigMapVolumeSource{
+											LocalObjectReference: coreV1.LocalObjectReference{
+												Name: deploymentName,
+											},
+											DefaultMode: int32Ptr(500),
+										},
+									},
+								},
+								{
+									Name: "acl",
+									VolumeSource: coreV1.VolumeSource{
+										Secret: &coreV1.SecretVolumeSource{
+											SecretName: redisACLSecretName(options.ID),
+											Optional:   truePtr(),
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		Services: []coreV1.Service{
+			{
+				ObjectMeta: metaV1.ObjectMeta{
+					Name: deploymentName,
+				},
+				Spec: coreV1.ServiceSpec{
+					Selector: map[string]string{
+						"app": deploymentName,
+					},
+					Ports: []coreV1.ServicePort{
+						{
+							Port: 6379,
+							TargetPort: intstr.IntOrString{
+								Type:   intstr.Int,
+								IntVal: 6379,
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	instanceExposure(plan, options.Parameters).exposeService(&spec.Services[0], options.ID)
+
+	return spec
+}
+
+// Gets the arguments to pass to redis-server to configure the instance for
+// the plan
+func redisArgs(plan PlanConfig) []string {
+	args := []string{"--appendonly", "no", "--save", ""}
+	if plan.Persistence {
+		args = []string{"--appendonly", "yes"}
+	}
+
+	if plan.MaxConnections > 0 {
+		args = append(args, "--maxclients", strconv.Itoa(plan.MaxConnections))
+	}
+
+	return args
+}
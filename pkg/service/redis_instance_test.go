@@ -0,0 +1,99 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRedisPersistence(t *testing.T) {
+	redis := NewRedisInstance(InstanceConfig{
+		Plans: []PlanConfig{
+			{Name: "cache", ID: "cache-id"},
+			{Name: "persistent", ID: "persistent-id", Storage: "5Gi", Persistence: true},
+		},
+	}, nil)
+
+	cacheSpec := redis.GetProvisionSpec(ServiceOptions{ID: "test-id", PlanID: "cache-id"})
+	if len(cacheSpec.PVCS) != 0 {
+		t.Errorf("Plans without persistence should not have a pvc")
+	}
+
+	persistentSpec := redis.GetProvisionSpec(ServiceOptions{ID: "test-id", PlanID: "persistent-id"})
+	if len(persistentSpec.PVCS) != 1 {
+		t.Fatalf("Plans with persistence should have a pvc")
+	}
+
+	args := persistentSpec.Deployments[0].Spec.Template.Spec.Containers[0].Args
+	if len(args) != 2 || args[1] != "yes" {
+		t.Errorf("Invalid redis args '%v'", args)
+	}
+
+	if service := persistentSpec.Services[0]; service.Spec.Type != coreV1.ServiceTypeClusterIP {
+		t.Errorf("Instances should only be exposed in the cluster by default, got '%s'", service.Spec.Type)
+	}
+}
+
+func TestRedisBindCredentials(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	redis := NewRedisInstance(InstanceConfig{}, client)
+	spec := redis.GetBindSpec(BindOptions{
+		ID:         "binding-id",
+		InstanceID: "test-id",
+		Namespace:  "test",
+		Parameters: map[string]interface{}{"key_prefix": "app:"},
+	})
+
+	data := spec.Secrets[0].Data
+	if string(data["key_prefix"]) != "app:" {
+		t.Errorf("Invalid key prefix '%s'", data["key_prefix"])
+	}
+
+	expected := "redis://" + string(data["username"]) + ":" + string(data["password"]) + "@redis-instance-test-id.test.svc.cluster.local:6379"
+	if string(data["uri"]) != expected {
+		t.Errorf("Invalid uri '%s'", data["uri"])
+	}
+
+	options := BindOptions{ID: "binding-id", InstanceID: "test-id", Namespace: "test"}
+	if err := redis.CreateBinding(options, data); err != nil {
+		t.Fatalf("Unable to add the binding user: %v", err)
+	}
+
+	acl, _ := client.CoreV1().Secrets("test").Get(context.TODO(), "redis-instance-test-id-acl", metaV1.GetOptions{})
+	user := string(acl.Data["binding-id.acl"])
+	if !strings.HasPrefix(user, "user "+string(data["username"])+" on #") || strings.Contains(user, string(data["password"])) {
+		t.Errorf("The acl secret should have the user with a hashed password, got '%s'", user)
+	}
+
+	if err := redis.DeleteBinding(options); err != nil {
+		t.Fatalf("Unable to remove the binding user: %v", err)
+	}
+
+	acl, _ = client.CoreV1().Secrets("test").Get(context.TODO(), "redis-instance-test-id-acl", metaV1.GetOptions{})
+	if len(acl.Data) != 0 {
+		t.Errorf("The binding user should be removed from the acl secret")
+	}
+
+	if err := redis.CreateBinding(options, map[string][]byte{"key_prefix": []byte("app:\nuser evil on nopass ~* +@all")}); err == nil {
+		t.Errorf("Key prefixes with white space should not be valid")
+	}
+}
+
+func TestRedisValidateBind(t *testing.T) {
+	redis := NewRedisInstance(InstanceConfig{}, nil)
+	if err := redis.ValidateBind(BindOptions{ID: "binding-id"}); err != nil {
+		t.Errorf("The default key prefix should be valid, got '%v'", err)
+	}
+
+	for _, keyPrefix := range []string{"", "*", "app:*", "app?", "[a-z]", "app\\", "app: x"} {
+		options := BindOptions{ID: "binding-id", Parameters: map[string]interface{}{"key_prefix": keyPrefix}}
+		if err := redis.ValidateBind(options); err == nil {
+			t.Errorf("The key prefix '%s' should not be valid", keyPrefix)
+		}
+	}
+}
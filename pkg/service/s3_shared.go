@@ -0,0 +1,326 @@
+package service
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/AdeAttwood/service-broker/pkg/kube"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+
+	batchV1 "k8s.io/api/batch/v1"
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+type SharedS3Config struct {
+	Name string `yaml:"name"`
+	ID   string `yaml:"id"`
+	// The url of the storage server e.g. "https://minio.example.com"
+	Endpoint  string `yaml:"endpoint"`
+	AccessKey string `yaml:"accessKey"`
+	SecretKey string `yaml:"secretKey"`
+	Region    string `yaml:"region"`
+	// The policy the binding access and secret keys are generated with
+	Credentials CredentialPolicy `yaml:"credentials"`
+	// Overrides the pod security of the broker for the mc jobs
+	PodSecurity PodSecurityConfig `yaml:"podSecurity"`
+}
+
+func NewSharedS3(config SharedS3Config) *SharedS3 {
+	return &SharedS3{
+		name:        config.Name,
+		id:          config.ID,
+		endpoint:    config.Endpoint,
+		accessKey:   config.AccessKey,
+		secretKey:   config.SecretKey,
+		region:      config.Region,
+		credentials: config.Credentials,
+	}
+}
+
+var s3BucketCreateScript = `
+set -e
+
+until mc ls s3 > /dev/null 2>&1; do
+    echo "Waiting for the storage server"
+    sleep 5
+done
+
+echo "Creating bucket '$S3_BUCKET'"
+mc mb --ignore-existing "s3/$S3_BUCKET"
+`
+
+var s3BucketRemoveScript = `
+set -e
+
+until mc ls s3 > /dev/null 2>&1; do
+    echo "Waiting for the storage server"
+    sleep 5
+done
+
+echo "Removing bucket '$S3_BUCKET'"
+mc rb --force "s3/$S3_BUCKET" || true
+`
+
+var s3BindScript = `
+set -e
+
+until mc ls s3 > /dev/null 2>&1; do
+    echo "Waiting for the storage server"
+    sleep 5
+done
+
+cat > /tmp/policy.json <<EOF
+{
+ "Version": "2012-10-17",
+ "Statement": [
+  {
+   "Effect": "Allow",
+   "Action": [
+    "s3:*"
+   ],
+   "Resource": [
+     "arn:aws:s3:::$S3_BUCKET",
+     "arn:aws:s3:::$S3_BUCKET/*"
+   ]
+  }
+ ]
+}
+EOF
+
+echo "Creating access key '$S3_ACCESS_KEY' for bucket '$S3_BUCKET'"
+mc admin user add s3 "$S3_ACCESS_KEY" "$S3_SECRET_KEY"
+mc admin policy add s3 "policy-$S3_ACCESS_KEY" /tmp/policy.json
+mc admin policy set s3 "policy-$S3_ACCESS_KEY" user=$S3_ACCESS_KEY
+`
+
+var s3DebindScript = `
+set -e
+
+until mc ls s3 > /dev/null 2>&1; do
+    echo "Waiting for the storage server"
+    sleep 5
+done
+
+echo "Removing access key '$S3_ACCESS_KEY'"
+mc admin user remove s3 "$S3_ACCESS_KEY"
+mc admin policy remove s3 "policy-$S3_ACCESS_KEY"
+`
+
+// A bucket on an existing minio server. Each instance gets its own bucket and
+// each binding gets an access key with a policy that only allows access to
+// the bucket of the instance
+type SharedS3 struct {
+	name        string
+	id          string
+	endpoint    string
+	accessKey   string
+	secretKey   string
+	region      string
+	credentials CredentialPolicy
+}
+
+var _ SharedResourceManager = &SharedS3{}
+
+// Gets the secret in the broker namespace with the admin alias of the server
+// that the jobs of all the instances read
+func (s *SharedS3) serverSecretName() string {
+	return fmt.Sprintf("s3-shared-%s-secret", s.name)
+}
+
+// Creates the server secret when the broker starts, the secret is updated when
+// the config changes
+func (s *SharedS3) EnsureSharedResources(client kubernetes.Interface, namespace string) error {
+	return ensureSecret(client, namespace, s.serverSecretName(), map[string][]byte{
+		"alias": []byte(s.alias()),
+	})
+}
+
+func (s *SharedS3) Definition() osb.Service {
+	return osb.Service{
+		Name:                fmt.Sprintf("s3-shared-%s", s.name),
+		ID:                  s.id,
+		Description:         "A bucket on a shared s3 server",
+		Bindable:            true,
+		BindingsRetrievable: true,
+		Metadata: map[string]interface{}{
+			"displayName": "Shared S3 Bucket",
+			"imageUrl":    "htps://avatars2.githubusercontent.com/u/19862012?s=200&v=4",
+		},
+		Plans: []osb.Plan{
+			{
+				Name:        "default",
+				ID:          s.id,
+				Description: "The default plan",
+				Free:        truePtr(),
+			},
+		},
+	}
+}
+
+func (s *SharedS3) GetHost(instanceID string, namespace string) string {
+	endpoint, err := url.Parse(s.endpoint)
+	if err != nil {
+		return s.endpoint
+	}
+
+	return endpoint.Host
+}
+
+// Gets the name of the bucket of an instance
+func s3BucketName(instanceID string) string {
+	return fmt.Sprintf("instance-%s", instanceID)
+}
+
+// Gets the mc alias of the server with the admin credentials added to the
+// endpoint
+func (s *SharedS3) alias() string {
+	endpoint, err := url.Parse(s.endpoint)
+	if err != nil {
+		return s.endpoint
+	}
+
+	endpoint.User = url.UserPassword(s.accessKey, s.secretKey)
+	return endpoint.String()
+}
+
+// Gets the name of the secret of an instance. Each instance has its own secret
+// so the instances can be found and removed on their own
+func s3SecretName(instanceID string) string {
+	return fmt.Sprintf("s3-instance-%s-secret", instanceID)
+}
+
+// Gets a job that runs an mc script against the shared server
+func (s *SharedS3) job(name string, script string, env ...coreV1.EnvVar) batchV1.Job {
+	return batchV1.Job{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name: name,
+		},
+		Spec: batchV1.JobSpec{
+			Template: coreV1.PodTemplateSpec{
+				Spec: coreV1.PodSpec{
+					RestartPolicy:         coreV1.RestartPolicyOnFailure,
+					ActiveDeadlineSeconds: int64Ptr(120),
+					Containers: []coreV1.Container{
+						{
+							Name:    "mc",
+							Image:   "minio/mc:latest",
+							Command: []string{"bash", "-c", script},
+							Env:     append([]coreV1.EnvVar{kube.EnvSecret("MC_HOST_s3", s.serverSecretName(), "alias")}, env...),
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func (s *SharedS3) GetDebindSpec(options BindOptions) *kube.Spec {
+	bindingSecretName := fmt.Sprintf("binding-secret-%s", options.ID)
+
+	return &kube.Spec{
+		Namespace: options.GlobalNamespace,
+		Lables: map[string]string{
+			"service-binding-id":  options.ID,
+			"service-instance-id": options.InstanceID,
+			"service-id":          s.Definition().ID,
+			"service-name":        s.Definition().Name,
+		},
+		Jobs: []batchV1.Job{
+			s.job(
+				fmt.Sprintf("debinding-job-%s", options.ID),
+				s3DebindScript,
+				kube.EnvSecret("S3_ACCESS_KEY", bindingSecretName, "access_key"),
+			),
+		},
+	}
+}
+
+func (s *SharedS3) GetBindSpec(options BindOptions) *kube.Spec {
+	bindingSecretName := fmt.Sprintf("binding-secret-%s", options.ID)
+
+	return &kube.Spec{
+		Namespace: options.GlobalNamespace,
+		Lables: map[string]string{
+			"service-binding-id":  options.ID,
+			"service-instance-id": options.InstanceID,
+			"service-id":          s.Definition().ID,
+			"service-name":        s.Definition().Name,
+		},
+		Secrets: []coreV1.Secret{
+			{
+				ObjectMeta: metaV1.ObjectMeta{
+					Name: bindingSecretName,
+				},
+				Type: "Opaque",
+				Data: map[string][]byte{
+					"endpoint":   []byte(s.endpoint),
+					"host":       []byte(s.GetHost(options.InstanceID, options.Namespace)),
+					"region":     []byte(s.region),
+					"bucket":     []byte(s3BucketName(options.InstanceID)),
+					"access_key": []byte(s.credentials.Username("key-%s")),
+					"secret_key": []byte(s.credentials.Password(32)),
+				},
+			},
+		},
+		Jobs: []batchV1.Job{
+			s.job(
+				fmt.Sprintf("binding-job-%s", options.ID),
+				s3BindScript,
+				kube.EnvSecret("S3_BUCKET", bindingSecretName, "bucket"),
+				kube.EnvSecret("S3_ACCESS_KEY", bindingSecretName, "access_key"),
+				kube.EnvSecret("S3_SECRET_KEY", bindingSecretName, "secret_key"),
+			),
+		},
+	}
+}
+
+// Removes the bucket and everything in it before the instance is deleted
+func (s *SharedS3) GetDeprovisionSpec(options ServiceOptions) *kube.Spec {
+	return &kube.Spec{
+		Namespace: options.GlobalNamespace,
+		Lables: map[string]string{
+			"service-instance-id": options.ID,
+			"service-id":          s.Definition().ID,
+			"service-name":        s.Definition().Name,
+		},
+		Jobs: []batchV1.Job{
+			s.job(
+				fmt.Sprintf("deprovision-job-%s", options.ID),
+				s3BucketRemoveScript,
+				coreV1.EnvVar{Name: "S3_BUCKET", Value: s3BucketName(options.ID)},
+			),
+		},
+	}
+}
+
+func (s *SharedS3) GetProvisionSpec(options ServiceOptions) *kube.Spec {
+	return &kube.Spec{
+		Namespace: options.GlobalNamespace,
+		Lables: map[string]string{
+			"service-instance-id": options.ID,
+			"service-id":          s.Definition().ID,
+			"service-name":        s.Definition().Name,
+			"service-plan":        options.PlanID,
+		},
+		Secrets: []coreV1.Secret{
+			{
+				ObjectMeta: metaV1.ObjectMeta{
+					Name: s3SecretName(options.ID),
+				},
+				Type: "Opaque",
+				Data: map[string][]byte{
+					"endpoint": []byte(s.endpoint),
+				},
+			},
+		},
+		Jobs: []batchV1.Job{
+			s.job(
+				fmt.Sprintf("provision-job-%s", options.ID),
+				s3BucketCreateScript,
+				coreV1.EnvVar{Name: "S3_BUCKET", Value: s3BucketName(options.ID)},
+			),
+		},
+	}
+}
@@ -0,0 +1,170 @@
+package service
+
+import (
+	"fmt"
+
+	"github.com/AdeAttwood/service-broker/pkg/kube"
+
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// The users of the images the services run. All of these images have a user
+// that isn't root so their pods pass the restricted pod security standard
+var imageUsers = map[string]int64{
+	"mysql":       999,
+	"mariadb":     999,
+	"postgres":    999,
+	"redis":       999,
+	"rabbitmq":    999,
+	"mongo":       999,
+	"minio/minio": 1000,
+	"minio/mc":    1000,
+}
+
+// The resources of the containers that don't set their own
+var defaultPodRequests = map[string]string{
+	"cpu":    "10m",
+	"memory": "32Mi",
+}
+
+// Where mc keeps its config, the home directory of the mc image is only
+// writable by root so the config is kept in an empty dir
+const mcConfigDir = "/tmp/.mc"
+
+// The pod security of a service. The config of the broker sets the defaults
+// for all of the services and the config of each service can override them
+type PodSecurityConfig struct {
+	// Leaves the pods of the service as they are
+	Disabled *bool `yaml:"disabled"`
+	// The user of the containers with images the broker doesn't know, like
+	// the images of the template services. The user of the image is used when
+	// this is not set, the pods won't start if that is root
+	RunAsUser *int64 `yaml:"runAsUser"`
+	// The service account of the pods, the token of the service account is
+	// only mounted when automountServiceAccountToken is true
+	ServiceAccountName           string `yaml:"serviceAccountName"`
+	AutomountServiceAccountToken *bool  `yaml:"automountServiceAccountToken"`
+	// The requests and limits of the containers that don't set their own.
+	// The requests default to "10m" of cpu and "32Mi" of memory
+	Requests map[string]string `yaml:"requests"`
+	Limits   map[string]string `yaml:"limits"`
+}
+
+// Validates the config so invalid resources are found when the broker starts
+func (c PodSecurityConfig) Validate() error {
+	if c.RunAsUser != nil && *c.RunAsUser <= 0 {
+		return fmt.Errorf("Invalid pod security user '%d', the pods can't run as root", *c.RunAsUser)
+	}
+
+	for _, resources := range []map[string]string{c.Requests, c.Limits} {
+		for name, value := range resources {
+			if _, err := resource.ParseQuantity(value); err != nil {
+				return fmt.Errorf("Invalid pod security resource '%s' of '%s'", value, name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Gets the config with the values that are set in the override
+func (c PodSecurityConfig) Merge(override PodSecurityConfig) PodSecurityConfig {
+	if override.Disabled != nil {
+		c.Disabled = override.Disabled
+	}
+
+	if override.RunAsUser != nil {
+		c.RunAsUser = override.RunAsUser
+	}
+
+	if override.ServiceAccountName != "" {
+		c.ServiceAccountName = override.ServiceAccountName
+	}
+
+	if override.AutomountServiceAccountToken != nil {
+		c.AutomountServiceAccountToken = override.AutomountServiceAccountToken
+	}
+
+	if override.Requests != nil {
+		c.Requests = override.Requests
+	}
+
+	if override.Limits != nil {
+		c.Limits = override.Limits
+	}
+
+	return c
+}
+
+// Hardens the pods of a spec. The mc containers always get a writable config
+// dir so they can run as any user
+func (c PodSecurityConfig) Secure(spec *kube.Spec) {
+	for _, podSpec := range specPodSpecs(spec) {
+		configureMc(podSpec)
+	}
+
+	if c.Disabled != nil && *c.Disabled {
+		return
+	}
+
+	requests := c.Requests
+	if requests == nil {
+		requests = defaultPodRequests
+	}
+
+	spec.Harden(kube.PodSecurity{
+		ImageUsers:                   imageUsers,
+		RunAsUser:                    c.RunAsUser,
+		ServiceAccountName:           c.ServiceAccountName,
+		AutomountServiceAccountToken: c.AutomountServiceAccountToken != nil && *c.AutomountServiceAccountToken,
+		Requests:                     resourceList(requests),
+		Limits:                       resourceList(c.Limits),
+	})
+}
+
+// Gets the pods of all the deployments, stateful sets, cron jobs and jobs in a
+// spec
+func specPodSpecs(spec *kube.Spec) []*coreV1.PodSpec {
+	podSpecs := []*coreV1.PodSpec{}
+	for i := range spec.Deployments {
+		podSpecs = append(podSpecs, &spec.Deployments[i].Spec.Template.Spec)
+	}
+
+	for i := range spec.StatefulSets {
+		podSpecs = append(podSpecs, &spec.StatefulSets[i].Spec.Template.Spec)
+	}
+
+	for i := range spec.CronJobs {
+		podSpecs = append(podSpecs, &spec.CronJobs[i].Spec.JobTemplate.Spec.Template.Spec)
+	}
+
+	for i := range spec.Jobs {
+		podSpecs = append(podSpecs, &spec.Jobs[i].Spec.Template.Spec)
+	}
+
+	return podSpecs
+}
+
+// Keeps the config of the mc containers in a pod in an empty dir
+func configureMc(podSpec *coreV1.PodSpec) {
+	configured := false
+	for _, containers := range [][]coreV1.Container{podSpec.InitContainers, podSpec.Containers} {
+		for i := range containers {
+			if kube.ImageRepository(containers[i].Image) != "minio/mc" {
+				continue
+			}
+
+			containers[i].Env = append(containers[i].Env, coreV1.EnvVar{Name: "MC_CONFIG_DIR", Value: mcConfigDir})
+			containers[i].VolumeMounts = append(containers[i].VolumeMounts, coreV1.VolumeMount{Name: "mc-config", MountPath: mcConfigDir})
+			configured = true
+		}
+	}
+
+	if configured {
+		podSpec.Volumes = append(podSpec.Volumes, coreV1.Volume{
+			Name:         "mc-config",
+			VolumeSource: coreV1.VolumeSource{EmptyDir: &coreV1.EmptyDirVolumeSource{}},
+		})
+	}
+}
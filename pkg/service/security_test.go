@@ -0,0 +1,124 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/AdeAttwood/service-broker/pkg/kube"
+
+	coreV1 "k8s.io/api/core/v1"
+)
+
+// Checks a pod against the "restricted" pod security standard
+func restrictedViolation(podSpec coreV1.PodSpec) string {
+	pod := podSpec.SecurityContext
+	if pod == nil || pod.SeccompProfile == nil || pod.SeccompProfile.Type != coreV1.SeccompProfileTypeRuntimeDefault {
+		return "the pod has no seccomp profile"
+	}
+
+	if podSpec.AutomountServiceAccountToken == nil || *podSpec.AutomountServiceAccountToken {
+		return "the service account token is mounted"
+	}
+
+	for _, container := range append(podSpec.InitContainers, podSpec.Containers...) {
+		context := container.SecurityContext
+		if context == nil || context.AllowPrivilegeEscalation == nil || *context.AllowPrivilegeEscalation {
+			return container.Name + " allows privilege escalation"
+		}
+
+		if context.Capabilities == nil || len(context.Capabilities.Drop) != 1 || context.Capabilities.Drop[0] != "ALL" {
+			return container.Name + " doesn't drop all capabilities"
+		}
+
+		if (context.RunAsNonRoot == nil && (pod.RunAsNonRoot == nil || !*pod.RunAsNonRoot)) || context.RunAsUser == nil || *context.RunAsUser == 0 {
+			return container.Name + " can run as root"
+		}
+
+		if _, ok := container.Resources.Requests["memory"]; !ok {
+			return container.Name + " has no memory request"
+		}
+	}
+
+	return ""
+}
+
+func TestPodSecurity(t *testing.T) {
+	options := ServiceOptions{
+		ID:         "test-id",
+		Namespace:  "test-ns",
+		PlanID:     "86064792-7ea2-467b-af93-ac9694d96d5b",
+		Parameters: map[string]interface{}{"backup_schedule": "0 2 * * *", "backup_target": "minio-instance", "backup_minio_instance": "minio-id"},
+	}
+
+	spec := NewMysqlInstance(InstanceConfig{}, nil).GetProvisionSpec(options)
+	PodSecurityConfig{}.Secure(spec)
+
+	for _, podSpec := range specPodSpecs(spec) {
+		if violation := restrictedViolation(*podSpec); violation != "" {
+			t.Errorf("The mysql pods should be restricted, %s", violation)
+		}
+	}
+
+	if group := spec.Deployments[0].Spec.Template.Spec.SecurityContext.FSGroup; group == nil || *group != 999 {
+		t.Errorf("The mysql volumes should be owned by the mysql group")
+	}
+
+	backup := spec.CronJobs[0].Spec.JobTemplate.Spec.Template.Spec
+	if mc := backup.Containers[0]; *mc.SecurityContext.RunAsUser != 1000 || mc.Env[len(mc.Env)-1].Value != mcConfigDir {
+		t.Errorf("The mc container should run with its config in an empty dir")
+	}
+
+	bind := NewMinioInstance(InstanceConfig{}, nil).GetBindSpec(BindOptions{ID: "binding-id", InstanceID: "test-id", Namespace: "test-ns"})
+	disabled := true
+	PodSecurityConfig{}.Merge(PodSecurityConfig{Disabled: &disabled}).Secure(bind)
+
+	if podSpec := bind.Jobs[0].Spec.Template.Spec; podSpec.SecurityContext != nil || podSpec.Volumes[len(podSpec.Volumes)-1].Name != "mc-config" {
+		t.Errorf("Disabled pod security should only configure mc")
+	}
+}
+
+func TestPodSecurityOverride(t *testing.T) {
+	user := int64(101)
+	security := PodSecurityConfig{Requests: map[string]string{"memory": "64Mi"}}.Merge(PodSecurityConfig{RunAsUser: &user})
+
+	spec := &kube.Spec{Deployments: NewMysqlInstance(InstanceConfig{}, nil).GetProvisionSpec(ServiceOptions{ID: "test-id", PlanID: "86064792-7ea2-467b-af93-ac9694d96d5b"}).Deployments}
+	spec.Deployments[0].Spec.Template.Spec.Containers[0].Image = "registry.example.com:5000/nginx@sha256:0123"
+	security.Secure(spec)
+
+	container := spec.Deployments[0].Spec.Template.Spec.Containers[0]
+	if *container.SecurityContext.RunAsUser != 101 || container.Resources.Requests.Memory().String() != "64Mi" {
+		t.Errorf("Unknown images should run as the override user with the configured requests")
+	}
+
+	if _, ok := container.Resources.Requests["cpu"]; ok {
+		t.Errorf("The configured requests should replace the default requests")
+	}
+
+	if err := (PodSecurityConfig{Limits: map[string]string{"memory": "lots"}}).Validate(); err == nil {
+		t.Errorf("Invalid limits should not be valid")
+	}
+
+	for image, repository := range map[string]string{"mysql:5.7": "mysql", "docker.io/library/mariadb:10.6": "mariadb", "minio/mc:latest": "minio/mc", "localhost:5000/redis": "localhost:5000/redis"} {
+		if got := kube.ImageRepository(image); got != repository {
+			t.Errorf("Invalid repository '%s' of '%s'", got, image)
+		}
+	}
+}
+
+func TestPodSecurityKeepsContainerSettings(t *testing.T) {
+	spec := &kube.Spec{Deployments: NewMysqlInstance(InstanceConfig{}, nil).GetProvisionSpec(ServiceOptions{ID: "test-id", PlanID: "86064792-7ea2-467b-af93-ac9694d96d5b"}).Deployments}
+	privileged := true
+	spec.Deployments[0].Spec.Template.Spec.Containers[0].SecurityContext = &coreV1.SecurityContext{
+		Privileged:   &privileged,
+		Capabilities: &coreV1.Capabilities{Add: []coreV1.Capability{"NET_ADMIN"}},
+	}
+	PodSecurityConfig{}.Secure(spec)
+
+	context := spec.Deployments[0].Spec.Template.Spec.Containers[0].SecurityContext
+	if !*context.Privileged || len(context.Capabilities.Add) != 1 || len(context.Capabilities.Drop) != 0 {
+		t.Errorf("The security context a container sets should be kept")
+	}
+
+	if *context.AllowPrivilegeEscalation {
+		t.Errorf("Settings the container doesn't set should be hardened")
+	}
+}
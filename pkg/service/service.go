@@ -1,8 +1,19 @@
 package service
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
 	"github.com/AdeAttwood/service-broker/pkg/kube"
 	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	coreV1 "k8s.io/api/core/v1"
+	networkingV1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
 )
 
 type Service interface {
@@ -14,11 +25,172 @@ type Service interface {
 	GetDebindSpec(options BindOptions) *kube.Spec
 }
 
+// Services can implement this to validate the options of a provision request
+// before any of the resources are created
+type ProvisionValidator interface {
+	ValidateProvision(options ServiceOptions) error
+}
+
+// Services can implement this to validate the options of a bind request
+// before the bind spec is built
+type BindValidator interface {
+	ValidateBind(options BindOptions) error
+}
+
+// Services that can fail to build the provision spec of an instance
+// implement this, like when the certificate of the instance can't be issued.
+// The broker uses this instead of GetProvisionSpec when an instance is
+// provisioned or updated so the error is returned to the platform
+type ProvisionSpecBuilder interface {
+	BuildProvisionSpec(options ServiceOptions) (*kube.Spec, error)
+}
+
+// Services that keep resources in the broker namespace that are shared by all
+// of their instances implement this, like the admin credentials of a shared
+// server. The broker ensures the resources when it starts so they are never
+// part of the spec of an instance and are not deleted with one
+type SharedResourceManager interface {
+	EnsureSharedResources(client kubernetes.Interface, namespace string) error
+}
+
+// Services can implement this to validate the options of a deprovision
+// request before any of the resources are deleted
+type DeprovisionValidator interface {
+	ValidateDeprovision(options ServiceOptions) error
+}
+
+// Services that create their instances outside of the provision spec
+// implement this. The instance is created after the provision spec and is
+// deleted before the provision spec is deleted
+type InstanceManager interface {
+	CreateInstance(options ServiceOptions) error
+	DeleteInstance(options ServiceOptions) error
+}
+
+// Services that manage their bindings through an api of the instance
+// implement this. The binding is created before the bind spec so any errors
+// can be returned to the platform and is deleted before the debind spec. Any
+// credentials that are added by the manager are stored in the binding secret
+type BindingManager interface {
+	CreateBinding(options BindOptions, credentials map[string][]byte) error
+	DeleteBinding(options BindOptions) error
+}
+
+// Services where the instances run in the cluster implement this to only let
+// the namespaces that are bound to an instance connect to it. The policy is
+// created with the instance and updated by the broker when the instance is
+// bound and unbound, the namespaces are the namespaces of all the bindings
+type NetworkIsolator interface {
+	GetNetworkPolicy(options ServiceOptions, namespaces []string) networkingV1.NetworkPolicy
+}
+
+// The operation keys that are returned with asynchronous responses so the
+// state of the right operation is reported
+const (
+	ProvisionOperation   osb.OperationKey = "provision"
+	DeprovisionOperation osb.OperationKey = "deprovision"
+)
+
+// Services where the instances are created asynchronously outside of the
+// cluster implement this to report the state of the last operation of an
+// instance
+type OperationReporter interface {
+	LastOperation(options ServiceOptions, operation osb.OperationKey) (*osb.LastOperationResponse, error)
+}
+
+// Services that can measure the resources used by their instances implement
+// this. The secrets are the provision secrets of all the instances of the
+// service, any quotas of the instance plans are enforced when they are checked
+type UsageReporter interface {
+	CheckUsage(instances []coreV1.Secret) []InstanceUsage
+}
+
+// The resources used by an instance. This is reported in the metrics and when
+// the instance is fetched
+type InstanceUsage struct {
+	InstanceID   string `json:"-"`
+	StorageBytes int64  `json:"storage_bytes"`
+	// The storage quota of the instance plan, zero when there is no quota
+	StorageQuota int64 `json:"storage_quota"`
+	OverQuota    bool  `json:"over_quota"`
+	// If the writes to the instance have been blocked because it is over the
+	// quota
+	Locked bool `json:"locked"`
+}
+
+// Services that can change the credentials of their instances and bindings
+// implement this. The jobs of the rotation spec change the credentials on the
+// backend, once they have succeeded the broker stores the rotated secrets.
+// When there is a grace period the old credentials keep working until the
+// expire spec is created after the grace period is over
+type CredentialRotator interface {
+	RotateCredentials(options RotateOptions) (*CredentialRotation, error)
+	GetExpireSpec(options RotateOptions) *kube.Spec
+}
+
+// The options of a credential rotation
+type RotateOptions struct {
+	ServiceOptions
+	// If the admin credentials of the instance are rotated
+	Instance bool
+	// The secrets of the bindings that get new credentials
+	Bindings []coreV1.Secret
+	// How long the old credentials keep working, zero stops them working as
+	// soon as the new credentials are applied
+	GracePeriod time.Duration
+}
+
+// The new credentials of an instance and the spec that applies them
+type CredentialRotation struct {
+	Spec *kube.Spec
+	// Copies of the instance and binding secrets with the new credentials
+	Secrets []coreV1.Secret
+	// The deployments in the instance namespace that are restarted after the
+	// secrets are updated so they use the new credentials
+	Restart []string
+}
+
+// Services that can update an instance in place implement this. When an
+// instance is updated the pre update spec is created first and then the
+// provision spec is applied to the existing instance resources
+type Updater interface {
+	ValidateUpdate(options ServiceOptions, previous ServiceOptions) error
+	GetPreUpdateSpec(options ServiceOptions, previous ServiceOptions) *kube.Spec
+}
+
 type ServiceOptions struct {
 	ID              string
 	PlanID          string
 	Namespace       string
 	GlobalNamespace string
+	Parameters      map[string]interface{}
+	// The instance this instance is being cloned from. This is resolved by the
+	// broker from the "clone_from_instance" parameter after it has checked the
+	// user has access to the source instance
+	Source *SourceInstance
+	// The secrets that were created when the instance was provisioned, these
+	// are only set when the instance is deprovisioned
+	InstanceSecrets []coreV1.Secret
+}
+
+// Gets the data of one of the secrets of the instance that is being
+// deprovisioned
+func (o ServiceOptions) InstanceSecretData(name string) map[string][]byte {
+	return secretData(o.InstanceSecrets, name)
+}
+
+// An existing instance of the same service that a new instance will be created
+// from
+type SourceInstance struct {
+	ID        string
+	Namespace string
+	// All of the secrets that were created when the source was provisioned
+	Secrets []coreV1.Secret
+}
+
+// Gets the data of one of the source instance secrets
+func (s *SourceInstance) SecretData(name string) map[string][]byte {
+	return secretData(s.Secrets, name)
 }
 
 type BindOptions struct {
@@ -26,6 +198,102 @@ type BindOptions struct {
 	InstanceID      string
 	Namespace       string
 	GlobalNamespace string
+	Parameters      map[string]interface{}
+	// The plan and parameters of the instance that is being bound to
+	PlanID             string
+	InstanceParameters map[string]interface{}
+	// The secrets that were created when the instance was provisioned
+	InstanceSecrets []coreV1.Secret
+}
+
+// Gets the data of one of the secrets of the instance that is being bound to
+func (o BindOptions) InstanceSecretData(name string) map[string][]byte {
+	return secretData(o.InstanceSecrets, name)
+}
+
+// Gets the namespace of the instance that is being bound to, this can be
+// different to the namespace of the binding. The binding namespace is used
+// when the instance secrets are not known
+func (o BindOptions) InstanceNamespace() string {
+	if len(o.InstanceSecrets) > 0 {
+		return o.InstanceSecrets[0].Namespace
+	}
+
+	return o.Namespace
+}
+
+// Helper function to find a secret by name in a list of secrets and return its
+// data. Empty data is returned if the secret can't be found
+func secretData(secrets []coreV1.Secret, name string) map[string][]byte {
+	for _, secret := range secrets {
+		if secret.Name == name {
+			return secret.Data
+		}
+	}
+
+	return map[string][]byte{}
+}
+
+// Creates a secret or updates its data when it has changed
+func ensureSecret(client kubernetes.Interface, namespace string, name string, data map[string][]byte) error {
+	secrets := client.CoreV1().Secrets(namespace)
+	secret, err := secrets.Get(context.TODO(), name, metaV1.GetOptions{})
+	if errors.IsNotFound(err) {
+		_, err = secrets.Create(context.TODO(), &coreV1.Secret{
+			ObjectMeta: metaV1.ObjectMeta{Name: name},
+			Type:       "Opaque",
+			Data:       data,
+		}, metaV1.CreateOptions{})
+
+		return err
+	}
+
+	if err != nil {
+		return err
+	}
+
+	changed := len(secret.Data) != len(data)
+	for key, value := range data {
+		changed = changed || !bytes.Equal(secret.Data[key], value)
+	}
+
+	if !changed {
+		return nil
+	}
+
+	secret.Data = data
+	_, err = secrets.Update(context.TODO(), secret, metaV1.UpdateOptions{})
+
+	return err
+}
+
+// Gets a string parameter from the parameters passed in with a request. If the
+// parameter has not been passed in then the fallback will be returned
+func stringParam(parameters map[string]interface{}, name string, fallback string) string {
+	value, ok := parameters[name]
+	if !ok || value == nil {
+		return fallback
+	}
+
+	return fmt.Sprintf("%v", value)
+}
+
+// Gets an int parameter from the parameters passed in with a request. Numbers
+// will come in as float64 when they are decoded from the json request body and
+// strings can be used from the service catalog so both are handled
+func intParam(parameters map[string]interface{}, name string, fallback int) int {
+	switch value := parameters[name].(type) {
+	case float64:
+		return int(value)
+	case int:
+		return value
+	case string:
+		if i, err := strconv.Atoi(value); err == nil {
+			return i
+		}
+	}
+
+	return fallback
 }
 
 func int32Ptr(i int32) *int32 { return &i }
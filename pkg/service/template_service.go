@@ -0,0 +1,543 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/golang/glog"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+
+	"github.com/AdeAttwood/service-broker/pkg/kube"
+
+	appsV1 "k8s.io/api/apps/v1"
+	batchV1 "k8s.io/api/batch/v1"
+	batchV1beta1 "k8s.io/api/batch/v1beta1"
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+// The files in the template directory. Only the provision template is
+// required, the service is bindable if there is a bind template
+const (
+	templateProvisionFile   = "provision.yaml"
+	templateDeprovisionFile = "deprovision.yaml"
+	templateBindFile        = "bind.yaml"
+	templateUnbindFile      = "unbind.yaml"
+)
+
+// The config of a service that is defined by a directory of templated
+// kubernetes resources
+type TemplateConfig struct {
+	Name        string `yaml:"name"`
+	ID          string `yaml:"id"`
+	Description string `yaml:"description"`
+	// The directory containing the provision, deprovision, bind and unbind
+	// templates
+	Directory string               `yaml:"directory"`
+	Plans     []TemplatePlanConfig `yaml:"plans"`
+	// Overrides the pod security of the broker for the pods in the templates,
+	// e.g. to set the user of images that would run as root
+	PodSecurity PodSecurityConfig `yaml:"podSecurity"`
+	// The policy the passwords of the "password" function are generated with
+	Credentials CredentialPolicy `yaml:"credentials"`
+}
+
+// A plan of a template service, the values are passed into the templates as
+// ".Plan.Values"
+type TemplatePlanConfig struct {
+	Name        string                 `yaml:"name"`
+	ID          string                 `yaml:"id"`
+	Description string                 `yaml:"description"`
+	Free        *bool                  `yaml:"free"`
+	Values      map[string]interface{} `yaml:"values"`
+}
+
+// The data that is passed into the templates
+type templateServiceData struct {
+	ServiceName string
+	InstanceID  string
+	BindingID   string
+	Namespace   string
+	Plan        TemplatePlanConfig
+	// The parameters of the request and for bindings the parameters the
+	// instance was provisioned with
+	Parameters         map[string]interface{}
+	InstanceParameters map[string]interface{}
+}
+
+func NewTemplateService(config TemplateConfig) (*TemplateService, error) {
+	if config.Name == "" || config.ID == "" || config.Directory == "" {
+		return nil, fmt.Errorf("Template services must have a name, id and directory")
+	}
+
+	if len(config.Plans) == 0 {
+		return nil, fmt.Errorf("The template service '%s' must have at least one plan", config.Name)
+	}
+
+	service := &TemplateService{config: config}
+
+	var err error
+	if service.provision, err = parseServiceTemplate(config.Directory, templateProvisionFile); err != nil {
+		return nil, err
+	}
+
+	if service.provision == nil {
+		return nil, fmt.Errorf("The template service '%s' has no %s", config.Name, templateProvisionFile)
+	}
+
+	if service.deprovision, err = parseServiceTemplate(config.Directory, templateDeprovisionFile); err != nil {
+		return nil, err
+	}
+
+	if service.bind, err = parseServiceTemplate(config.Directory, templateBindFile); err != nil {
+		return nil, err
+	}
+
+	if service.unbind, err = parseServiceTemplate(config.Directory, templateUnbindFile); err != nil {
+		return nil, err
+	}
+
+	return service, nil
+}
+
+// Parses one of the templates of a service. A nil template is returned if the
+// file does not exist
+func parseServiceTemplate(directory string, name string) (*template.Template, error) {
+	content, err := ioutil.ReadFile(filepath.Join(directory, name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return template.New(name).Funcs(templateFuncs(nil, CredentialPolicy{})).Option("missingkey=zero").Parse(string(content))
+}
+
+// The functions that are available in the templates. The "password" function
+// returns the same password for the same name within one template so it can
+// be used in more than one resource, the passwords are generated with the
+// credential policy of the service
+func templateFuncs(instanceSecrets []coreV1.Secret, credentials CredentialPolicy) template.FuncMap {
+	passwords := map[string]string{}
+
+	return template.FuncMap{
+		"password": func(name string) string {
+			if _, ok := passwords[name]; !ok {
+				passwords[name] = credentials.Password(32)
+			}
+
+			return passwords[name]
+		},
+		"instanceSecret": func(name string, key string) string {
+			return string(secretData(instanceSecrets, name)[key])
+		},
+		"default": func(fallback interface{}, value interface{}) interface{} {
+			if value == nil || value == "" {
+				return fallback
+			}
+
+			return value
+		},
+		"quote": func(value interface{}) string {
+			return fmt.Sprintf("%q", fmt.Sprint(value))
+		},
+		"toJson": func(value interface{}) (string, error) {
+			content, err := json.Marshal(value)
+			return string(content), err
+		},
+		"b64enc": func(value string) string {
+			return base64.StdEncoding.EncodeToString([]byte(value))
+		},
+	}
+}
+
+// A service where all of the resources are defined in go templated kubernetes
+// yaml. The templates are rendered into a kube spec on every request
+type TemplateService struct {
+	config      TemplateConfig
+	provision   *template.Template
+	deprovision *template.Template
+	bind        *template.Template
+	unbind      *template.Template
+}
+
+var _ ProvisionValidator = &TemplateService{}
+var _ DeprovisionValidator = &TemplateService{}
+var _ BindingManager = &TemplateService{}
+
+func (s *TemplateService) Definition() osb.Service {
+	plans := make([]osb.Plan, 0, len(s.config.Plans))
+	for _, plan := range s.config.Plans {
+		free := plan.Free
+		if free == nil {
+			free = truePtr()
+		}
+
+		plans = append(plans, osb.Plan{
+			Name:        plan.Name,
+			ID:          plan.ID,
+			Description: plan.Description,
+			Free:        free,
+		})
+	}
+
+	return osb.Service{
+		Name:        s.config.Name,
+		ID:          s.config.ID,
+		Description: s.config.Description,
+		Bindable:    s.bind != nil,
+		Metadata: map[string]interface{}{
+			"displayName": s.config.Name,
+		},
+		Plans: plans,
+	}
+}
+
+// Gets the name of the secret that tracks an instance when the provision
+// template does not have any secrets
+func templateInstanceSecretName(instanceID string) string {
+	return fmt.Sprintf("instance-%s-broker", instanceID)
+}
+
+func (s *TemplateService) GetHost(instanceID string, namespace string) string {
+	return fmt.Sprintf("instance-%s.%s.svc.cluster.local", instanceID, namespace)
+}
+
+// Finds the plan with an id, the first plan is used if there is no plan with
+// the id
+func (s *TemplateService) plan(id string) TemplatePlanConfig {
+	for _, plan := range s.config.Plans {
+		if plan.ID == id {
+			return plan
+		}
+	}
+
+	return s.config.Plans[0]
+}
+
+func (s *TemplateService) serviceData(options ServiceOptions) templateServiceData {
+	return templateServiceData{
+		ServiceName: s.config.Name,
+		InstanceID:  options.ID,
+		Namespace:   options.Namespace,
+		Plan:        s.plan(options.PlanID),
+		Parameters:  options.Parameters,
+	}
+}
+
+func (s *TemplateService) bindData(options BindOptions) templateServiceData {
+	return templateServiceData{
+		ServiceName:        s.config.Name,
+		InstanceID:         options.InstanceID,
+		BindingID:          options.ID,
+		Namespace:          options.Namespace,
+		Plan:               s.plan(options.PlanID),
+		Parameters:         options.Parameters,
+		InstanceParameters: options.InstanceParameters,
+	}
+}
+
+// Matches the kinds that are written in the text of a template
+var templateKindPattern = regexp.MustCompile(`(?m)^kind:[ \t]*([A-Za-z]+)[ \t]*$`)
+
+// Gets the kinds of the resources a template declares. Only the kinds in the
+// text of the template are declared, a kind that comes from an action is not
+func templateKinds(serviceTemplate *template.Template) map[string]bool {
+	kinds := map[string]bool{}
+
+	var walk func(node parse.Node)
+	walk = func(node parse.Node) {
+		switch node := node.(type) {
+		case *parse.ListNode:
+			if node == nil {
+				return
+			}
+
+			for _, child := range node.Nodes {
+				walk(child)
+			}
+		case *parse.TextNode:
+			for _, match := range templateKindPattern.FindAllSubmatch(node.Text, -1) {
+				kinds[string(match[1])] = true
+			}
+		case *parse.IfNode:
+			walk(node.List)
+			walk(node.ElseList)
+		case *parse.RangeNode:
+			walk(node.List)
+			walk(node.ElseList)
+		case *parse.WithNode:
+			walk(node.List)
+			walk(node.ElseList)
+		}
+	}
+
+	for _, named := range serviceTemplate.Templates() {
+		if named.Tree != nil {
+			walk(named.Tree.Root)
+		}
+	}
+
+	return kinds
+}
+
+// The characters that can end a quoted yaml string or start a flow mapping or
+// sequence, a template that writes a parameter without quote or toJson could
+// have its resources changed by them
+const templateParameterCharacters = "\"'\\{}[],"
+
+// Checks that none of the parameters have a value over more than one line or
+// with quotes or yaml flow characters. The parameters are written into yaml so
+// a new line could add a document to the rendered template and a quote could
+// add fields to a resource
+func validateTemplateParameters(value interface{}) error {
+	switch value := value.(type) {
+	case string:
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("Parameters can't have more than one line")
+		}
+
+		if strings.ContainsAny(value, templateParameterCharacters) {
+			return fmt.Errorf("Parameters can't contain any of %s", templateParameterCharacters)
+		}
+	case map[string]interface{}:
+		for key, child := range value {
+			if err := validateTemplateParameters(key); err != nil {
+				return err
+			}
+
+			if err := validateTemplateParameters(child); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, child := range value {
+			if err := validateTemplateParameters(child); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Renders a template and decodes all of the yaml documents into a kube spec.
+// A nil template renders an empty spec. The documents must have a kind the
+// template declares so the parameters can't add any other resources
+func renderServiceTemplate(serviceTemplate *template.Template, data templateServiceData, instanceSecrets []coreV1.Secret, credentials CredentialPolicy) (*kube.Spec, error) {
+	spec := &kube.Spec{Namespace: data.Namespace}
+	if serviceTemplate == nil {
+		return spec, nil
+	}
+
+	for _, parameters := range []map[string]interface{}{data.Parameters, data.InstanceParameters} {
+		if err := validateTemplateParameters(parameters); err != nil {
+			return nil, err
+		}
+	}
+
+	// The templates are shared between requests so each render gets its own
+	// copy with the passwords and secrets of the request
+	clone, err := serviceTemplate.Clone()
+	if err != nil {
+		return nil, err
+	}
+
+	var rendered bytes.Buffer
+	if err := clone.Funcs(templateFuncs(instanceSecrets, credentials)).Execute(&rendered, data); err != nil {
+		return nil, err
+	}
+
+	kinds := templateKinds(serviceTemplate)
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(&rendered))
+	for {
+		document, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		content, err := utilyaml.ToJSON(document)
+		if err != nil {
+			return nil, err
+		}
+
+		// Skip the documents that are empty or only have comments
+		if string(content) == "null" {
+			continue
+		}
+
+		object, _, err := scheme.Codecs.UniversalDeserializer().Decode(content, nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to decode '%s': %v", serviceTemplate.Name(), err)
+		}
+
+		if kind := object.GetObjectKind().GroupVersionKind().Kind; !kinds[kind] {
+			return nil, fmt.Errorf("The resource '%s' is not declared in '%s'", kind, serviceTemplate.Name())
+		}
+
+		switch resource := object.(type) {
+		case *coreV1.Secret:
+			// The api server merges the string data into the data. This is
+			// done here so the credentials can be read from the spec
+			if resource.Data == nil {
+				resource.Data = map[string][]byte{}
+			}
+
+			for key, value := range resource.StringData {
+				resource.Data[key] = []byte(value)
+			}
+
+			resource.StringData = nil
+			spec.Secrets = append(spec.Secrets, *resource)
+		case *coreV1.ConfigMap:
+			spec.ConfigMaps = append(spec.ConfigMaps, *resource)
+		case *coreV1.PersistentVolumeClaim:
+			spec.PVCS = append(spec.PVCS, *resource)
+		case *appsV1.Deployment:
+			spec.Deployments = append(spec.Deployments, *resource)
+		case *appsV1.StatefulSet:
+			spec.StatefulSets = append(spec.StatefulSets, *resource)
+		case *coreV1.Service:
+			spec.Services = append(spec.Services, *resource)
+		case *batchV1beta1.CronJob:
+			spec.CronJobs = append(spec.CronJobs, *resource)
+		case *batchV1.Job:
+			spec.Jobs = append(spec.Jobs, *resource)
+		default:
+			return nil, fmt.Errorf("Unsupported resource '%s' in '%s'", object.GetObjectKind().GroupVersionKind().Kind, serviceTemplate.Name())
+		}
+	}
+
+	return spec, nil
+}
+
+// Renders the provision template so any errors in the parameters are returned
+// before the instance is created
+func (s *TemplateService) ValidateProvision(options ServiceOptions) error {
+	_, err := renderServiceTemplate(s.provision, s.serviceData(options), nil, s.config.Credentials)
+	return err
+}
+
+// The credentials come from the bind template. The bind template is rendered
+// here so the errors can be returned to the platform
+func (s *TemplateService) CreateBinding(options BindOptions, credentials map[string][]byte) error {
+	_, err := renderServiceTemplate(s.bind, s.bindData(options), options.InstanceSecrets, s.config.Credentials)
+	return err
+}
+
+// Renders the deprovision template so any errors are returned before the
+// instance is deleted
+func (s *TemplateService) ValidateDeprovision(options ServiceOptions) error {
+	_, err := renderServiceTemplate(s.deprovision, s.serviceData(options), options.InstanceSecrets, s.config.Credentials)
+	return err
+}
+
+// Renders the unbind template so any errors are returned before the binding
+// is deleted
+func (s *TemplateService) DeleteBinding(options BindOptions) error {
+	_, err := renderServiceTemplate(s.unbind, s.bindData(options), options.InstanceSecrets, s.config.Credentials)
+	return err
+}
+
+func (s *TemplateService) GetProvisionSpec(options ServiceOptions) *kube.Spec {
+	spec, err := renderServiceTemplate(s.provision, s.serviceData(options), nil, s.config.Credentials)
+	if err != nil {
+		glog.Errorf("Unable to render the provision template of '%s': %v", s.config.Name, err)
+		spec = &kube.Spec{Namespace: options.Namespace}
+	}
+
+	// The broker finds the instances by their secrets so there must be at
+	// least one secret
+	if len(spec.Secrets) == 0 {
+		spec.Secrets = append(spec.Secrets, coreV1.Secret{
+			ObjectMeta: metaV1.ObjectMeta{
+				Name: templateInstanceSecretName(options.ID),
+			},
+			Type: "Opaque",
+			Data: map[string][]byte{},
+		})
+	}
+
+	spec.Lables = map[string]string{
+		"service-instance-id": options.ID,
+		"service-id":          s.Definition().ID,
+		"service-name":        s.Definition().Name,
+		"service-plan":        options.PlanID,
+	}
+
+	return spec
+}
+
+func (s *TemplateService) GetDeprovisionSpec(options ServiceOptions) *kube.Spec {
+	spec, err := renderServiceTemplate(s.deprovision, s.serviceData(options), options.InstanceSecrets, s.config.Credentials)
+	if err != nil {
+		glog.Errorf("Unable to render the deprovision template of '%s': %v", s.config.Name, err)
+		return &kube.Spec{Namespace: options.Namespace}
+	}
+
+	return spec
+}
+
+// The first secret in the bind template holds the credentials of the binding
+func (s *TemplateService) GetBindSpec(options BindOptions) *kube.Spec {
+	spec, err := renderServiceTemplate(s.bind, s.bindData(options), options.InstanceSecrets, s.config.Credentials)
+	if err != nil {
+		glog.Errorf("Unable to render the bind template of '%s': %v", s.config.Name, err)
+		spec = &kube.Spec{Namespace: options.Namespace}
+	}
+
+	if len(spec.Secrets) == 0 {
+		spec.Secrets = append(spec.Secrets, coreV1.Secret{
+			ObjectMeta: metaV1.ObjectMeta{
+				Name: fmt.Sprintf("binding-secret-%s", options.ID),
+			},
+			Type: "Opaque",
+			Data: map[string][]byte{},
+		})
+	}
+
+	spec.Lables = map[string]string{
+		"service-binding-id":  options.ID,
+		"service-instance-id": options.InstanceID,
+		"service-id":          s.Definition().ID,
+		"service-name":        s.Definition().Name,
+	}
+
+	return spec
+}
+
+func (s *TemplateService) GetDebindSpec(options BindOptions) *kube.Spec {
+	spec, err := renderServiceTemplate(s.unbind, s.bindData(options), options.InstanceSecrets, s.config.Credentials)
+	if err != nil {
+		glog.Errorf("Unable to render the unbind template of '%s': %v", s.config.Name, err)
+		return &kube.Spec{Namespace: options.Namespace}
+	}
+
+	spec.Lables = map[string]string{
+		"service-binding-id":  options.ID,
+		"service-instance-id": options.InstanceID,
+		"service-id":          s.Definition().ID,
+		"service-name":        s.Definition().Name,
+	}
+
+	return spec
+}
@@ -0,0 +1,136 @@
+package service
+
+import (
+	"strings"
+	"testing"
+	"text/template"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var templateTestConfig = TemplateConfig{
+	Name:      "test-template",
+	ID:        "template-service-id",
+	Directory: "testdata/test-template",
+	Plans: []TemplatePlanConfig{
+		{Name: "small", ID: "small-id", Values: map[string]interface{}{"replicas": 1}},
+		{Name: "large", ID: "large-id", Values: map[string]interface{}{"replicas": 3}},
+	},
+}
+
+func TestTemplateServiceProvision(t *testing.T) {
+	templateService, err := NewTemplateService(templateTestConfig)
+	if err != nil {
+		t.Fatalf("Unable to create the template service: %v", err)
+	}
+
+	if !templateService.Definition().Bindable {
+		t.Errorf("Services with a bind template should be bindable")
+	}
+
+	spec := templateService.GetProvisionSpec(ServiceOptions{ID: "test-id", PlanID: "large-id", Namespace: "test"})
+	if len(spec.Secrets) != 1 || len(spec.Deployments) != 1 || len(spec.Services) != 1 {
+		t.Fatalf("Invalid provision spec '%v'", spec)
+	}
+
+	password := string(spec.Secrets[0].Data["password"])
+	if len(password) != 32 || spec.Deployments[0].Spec.Template.Spec.Containers[0].Env[0].Value != password {
+		t.Errorf("The password should be the same in all of the resources")
+	}
+
+	config := templateTestConfig
+	config.Credentials = CredentialPolicy{Length: 12}
+	policyService, _ := NewTemplateService(config)
+	if password := policyService.GetProvisionSpec(ServiceOptions{ID: "test-id", PlanID: "large-id"}).Secrets[0].Data["password"]; len(password) != 12 {
+		t.Errorf("The password should be generated with the credential policy '%s'", password)
+	}
+
+	if *spec.Deployments[0].Spec.Replicas != 3 {
+		t.Errorf("Invalid number of replicas '%d'", *spec.Deployments[0].Spec.Replicas)
+	}
+
+	if spec.Lables["service-instance-id"] != "test-id" {
+		t.Errorf("Invalid service instance label '%s'", spec.Lables["service-instance-id"])
+	}
+
+	if err := spec.Create(fake.NewSimpleClientset()); err != nil {
+		t.Fatalf("error creating the template instance: %v", err)
+	}
+
+	options := ServiceOptions{ID: "test-id", Parameters: map[string]interface{}{"replicas": "two"}}
+	if err := templateService.ValidateProvision(options); err == nil {
+		t.Errorf("Parameters that render an invalid resource should not be valid")
+	}
+}
+
+func TestTemplateServiceBinding(t *testing.T) {
+	templateService, err := NewTemplateService(templateTestConfig)
+	if err != nil {
+		t.Fatalf("Unable to create the template service: %v", err)
+	}
+
+	instance := templateService.GetProvisionSpec(ServiceOptions{ID: "test-id", PlanID: "small-id", Namespace: "test"})
+	options := BindOptions{
+		ID:              "binding-id",
+		InstanceID:      "test-id",
+		Namespace:       "test",
+		InstanceSecrets: instance.Secrets,
+	}
+
+	data := templateService.GetBindSpec(options).Secrets[0].Data
+	if string(data["host"]) != "instance-test-id.test.svc.cluster.local" {
+		t.Errorf("Invalid host '%s'", data["host"])
+	}
+
+	if string(data["password"]) != string(instance.Secrets[0].Data["password"]) {
+		t.Errorf("Invalid password '%s'", data["password"])
+	}
+
+	deprovision := templateService.GetDeprovisionSpec(ServiceOptions{ID: "test-id", Namespace: "test", InstanceSecrets: instance.Secrets})
+	if value := deprovision.Jobs[0].Spec.Template.Spec.Containers[0].Env[0].Value; value != string(instance.Secrets[0].Data["password"]) {
+		t.Errorf("The deprovision template should read the instance secrets, got '%s'", value)
+	}
+
+	if len(templateService.GetDebindSpec(options).Jobs) != 0 {
+		t.Errorf("Services without an unbind template should have an empty debind spec")
+	}
+
+	config := templateTestConfig
+	config.Directory = "testdata"
+	if _, err := NewTemplateService(config); err == nil {
+		t.Errorf("Directories without a provision template should not be valid")
+	}
+}
+
+func TestTemplateServiceInjection(t *testing.T) {
+	templateService, err := NewTemplateService(templateTestConfig)
+	if err != nil {
+		t.Fatalf("Unable to create the template service: %v", err)
+	}
+
+	options := ServiceOptions{ID: "test-id", Parameters: map[string]interface{}{"replicas": "1\n---\napiVersion: v1\nkind: Secret"}}
+	if err := templateService.ValidateProvision(options); err == nil {
+		t.Errorf("Parameters over more than one line should not be valid")
+	}
+
+	if err := templateService.ValidateDeprovision(ServiceOptions{ID: "test-id", Parameters: options.Parameters}); err == nil {
+		t.Errorf("Render errors should be returned before the instance is deleted")
+	}
+
+	quoted := template.Must(template.New("provision.yaml").Parse("apiVersion: v1\nkind: Secret\nmetadata:\n  name: test\nstringData: {\"value\": \"{{ .Parameters.value }}\"}\n"))
+	data := templateServiceData{Parameters: map[string]interface{}{"value": `x", "privileged": true, "y": "`}}
+	if _, err := renderServiceTemplate(quoted, data, nil, CredentialPolicy{}); err == nil || !strings.Contains(err.Error(), "can't contain") {
+		t.Errorf("Parameters with quotes should not be rendered, got '%v'", err)
+	}
+
+	data.Parameters["value"] = map[string]interface{}{"value": "x}, {"}
+	if err := validateTemplateParameters(data.Parameters); err == nil {
+		t.Errorf("Nested parameters with yaml flow characters should not be valid")
+	}
+
+	undeclared := template.Must(template.New("provision.yaml").Funcs(templateFuncs(nil, CredentialPolicy{})).Parse("apiVersion: v1\nkind: {{ .Parameters.kind }}\nmetadata:\n  name: test\n"))
+	data = templateServiceData{Parameters: map[string]interface{}{"kind": "ConfigMap"}}
+	if _, err := renderServiceTemplate(undeclared, data, nil, CredentialPolicy{}); err == nil {
+		t.Errorf("Resources with a kind the template doesn't declare should not be rendered")
+	}
+}
@@ -0,0 +1,398 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/AdeAttwood/service-broker/pkg/kube"
+
+	coreV1 "k8s.io/api/core/v1"
+	apiErrors "k8s.io/apimachinery/pkg/api/errors"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Where the server certificates of the instances come from
+const (
+	TLSProviderBroker      = "broker"
+	TLSProviderCertManager = "cert-manager"
+)
+
+// The ssl modes that are returned with the bindings, these are the mysql
+// client modes so they can be passed straight to the client
+const (
+	SSLModeDisabled  = "DISABLED"
+	SSLModePreferred = "PREFERRED"
+	SSLModeRequired  = "REQUIRED"
+	SSLModeVerifyCA  = "VERIFY_CA"
+)
+
+// How long the broker ca and the server certificates are valid for by default
+const (
+	tlsCADuration     = 10 * 365 * 24 * time.Hour
+	tlsServerDuration = 365 * 24 * time.Hour
+)
+
+// The tls config of an instance service. When a provider is set every new
+// instance gets a server certificate that is mounted into its pods
+type TLSConfig struct {
+	// "broker" to issue the certificates from a ca kept by the broker or
+	// "cert-manager" to create cert-manager certificates, tls is disabled when
+	// this is empty
+	Provider string `yaml:"provider"`
+	// The secret in the broker namespace that holds the broker ca, this is
+	// created when it doesn't exist. Defaults to "service-broker-ca"
+	CASecret string `yaml:"caSecret"`
+	// The cert-manager issuer of the certificates
+	Issuer     string `yaml:"issuer"`
+	IssuerKind string `yaml:"issuerKind"`
+	// How long the server certificates are valid for e.g. "8760h"
+	Duration string `yaml:"duration"`
+}
+
+// Validates the config so invalid tls configs are found when the broker starts
+func (c TLSConfig) Validate() error {
+	switch c.Provider {
+	case "", TLSProviderBroker:
+	case TLSProviderCertManager:
+		if c.Issuer == "" {
+			return errors.New("The cert-manager tls provider needs an issuer")
+		}
+	default:
+		return fmt.Errorf("Invalid tls provider '%s', this must be '%s' or '%s'", c.Provider, TLSProviderBroker, TLSProviderCertManager)
+	}
+
+	if c.Duration != "" {
+		if duration, err := time.ParseDuration(c.Duration); err != nil || duration <= 0 {
+			return fmt.Errorf("Invalid tls duration '%s'", c.Duration)
+		}
+	}
+
+	return nil
+}
+
+// If the new instances of the service get a server certificate
+func (c TLSConfig) Enabled() bool {
+	return c.Provider != ""
+}
+
+func (c TLSConfig) duration() time.Duration {
+	if duration, err := time.ParseDuration(c.Duration); err == nil && duration > 0 {
+		return duration
+	}
+
+	return tlsServerDuration
+}
+
+func (c TLSConfig) caSecret() string {
+	if c.CASecret == "" {
+		return "service-broker-ca"
+	}
+
+	return c.CASecret
+}
+
+// Gets the resources that give an instance its server certificate. With the
+// broker provider this is a secret with the certificate, with cert-manager it
+// is a certificate that cert-manager creates the secret from. Both secrets
+// have the "tls.crt", "tls.key" and "ca.crt" keys
+func (c TLSConfig) instanceCertificate(client kubernetes.Interface, caNamespace string, secretName string, hosts []string) ([]coreV1.Secret, []kube.CustomResource, error) {
+	if c.Provider == TLSProviderCertManager {
+		return nil, []kube.CustomResource{c.certManagerCertificate(secretName, hosts)}, nil
+	}
+
+	ca, err := ensureCA(client, caNamespace, c.caSecret())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certificate, key, err := ca.issue(hosts, c.duration())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	secret := coreV1.Secret{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name: secretName,
+		},
+		Type: coreV1.SecretTypeTLS,
+		Data: map[string][]byte{
+			"tls.crt": certificate,
+			"tls.key": key,
+			"ca.crt":  ca.certificatePEM,
+		},
+	}
+
+	return []coreV1.Secret{secret}, nil, nil
+}
+
+// Gets the server certificate of an instance. The certificate in the instance
+// secrets is reused while it is valid for all of the hosts so a new one isn't
+// issued every time the provision spec is generated
+func (c TLSConfig) serverCertificate(client kubernetes.Interface, options ServiceOptions, secretName string, hosts []string) ([]coreV1.Secret, []kube.CustomResource, error) {
+	if c.Provider == TLSProviderBroker {
+		data := secretData(options.InstanceSecrets, secretName)
+		if certificateValid(data["tls.crt"], hosts) {
+			return []coreV1.Secret{
+				{
+					ObjectMeta: metaV1.ObjectMeta{
+						Name: secretName,
+					},
+					Type: coreV1.SecretTypeTLS,
+					Data: data,
+				},
+			}, nil, nil
+		}
+	}
+
+	return c.instanceCertificate(client, options.GlobalNamespace, secretName, hosts)
+}
+
+// Checks if a pem certificate has not expired and is valid for all the hosts
+func certificateValid(certificatePEM []byte, hosts []string) bool {
+	block, _ := pem.Decode(certificatePEM)
+	if block == nil {
+		return false
+	}
+
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil || time.Now().After(certificate.NotAfter) {
+		return false
+	}
+
+	for _, host := range hosts {
+		if certificate.VerifyHostname(host) != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (c TLSConfig) certManagerCertificate(secretName string, hosts []string) kube.CustomResource {
+	issuerKind := c.IssuerKind
+	if issuerKind == "" {
+		issuerKind = "ClusterIssuer"
+	}
+
+	dnsNames := make([]interface{}, 0, len(hosts))
+	for _, host := range hosts {
+		dnsNames = append(dnsNames, host)
+	}
+
+	return kube.CustomResource{
+		Resource: "certificates",
+		Object: unstructured.Unstructured{
+			Object: map[string]interface{}{
+				"apiVersion": "cert-manager.io/v1",
+				"kind":       "Certificate",
+				"metadata": map[string]interface{}{
+					"name": secretName,
+				},
+				"spec": map[string]interface{}{
+					"secretName": secretName,
+					"duration":   c.duration().String(),
+					"dnsNames":   dnsNames,
+					"issuerRef": map[string]interface{}{
+						"name":  c.Issuer,
+						"kind":  issuerKind,
+						"group": "cert-manager.io",
+					},
+					// Mysql 5.7 can only read pkcs1 rsa keys
+					"privateKey": map[string]interface{}{
+						"algorithm": "RSA",
+						"encoding":  "PKCS1",
+						"size":      int64(2048),
+					},
+				},
+			},
+		},
+	}
+}
+
+// The ca the broker issues the server certificates from
+type brokerCA struct {
+	certificate    *x509.Certificate
+	certificatePEM []byte
+	key            *rsa.PrivateKey
+}
+
+// Gets the broker ca from its secret, a new ca is created when the secret
+// doesn't exist so the broker can issue certificates without any setup
+func ensureCA(client kubernetes.Interface, namespace string, secretName string) (*brokerCA, error) {
+	if client == nil {
+		return nil, errors.New("The broker ca can't be read without a client")
+	}
+
+	secrets := client.CoreV1().Secrets(namespace)
+	secret, err := secrets.Get(context.TODO(), secretName, metaV1.GetOptions{})
+	if apiErrors.IsNotFound(err) {
+		secret, err = newCASecret(secretName)
+		if err != nil {
+			return nil, err
+		}
+
+		secret, err = secrets.Create(context.TODO(), secret, metaV1.CreateOptions{})
+
+		// Another request may have created the ca first
+		if apiErrors.IsAlreadyExists(err) {
+			secret, err = secrets.Get(context.TODO(), secretName, metaV1.GetOptions{})
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return parseCA(secret)
+}
+
+func newCASecret(name string) (*coreV1.Secret, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{CommonName: "service-broker-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(tlsCADuration),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &coreV1.Secret{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name: name,
+		},
+		Type: coreV1.SecretTypeTLS,
+		Data: map[string][]byte{
+			"tls.crt": pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate}),
+			"tls.key": pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
+		},
+	}, nil
+}
+
+func parseCA(secret *coreV1.Secret) (*brokerCA, error) {
+	certificateBlock, _ := pem.Decode(secret.Data["tls.crt"])
+	keyBlock, _ := pem.Decode(secret.Data["tls.key"])
+	if certificateBlock == nil || keyBlock == nil {
+		return nil, fmt.Errorf("The ca secret '%s' must have a pem 'tls.crt' and 'tls.key'", secret.Name)
+	}
+
+	certificate, err := x509.ParseCertificate(certificateBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &brokerCA{certificate: certificate, certificatePEM: secret.Data["tls.crt"], key: key}, nil
+}
+
+// Issues a server certificate for the hosts of an instance. The key is an rsa
+// key in the pkcs1 format so all of the mysql versions can read it
+func (ca *brokerCA) issue(hosts []string, duration time.Duration) ([]byte, []byte, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		DNSNames:     hosts,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(duration),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	certificate, err := x509.CreateCertificate(rand.Reader, template, ca.certificate, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate}),
+		pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
+		nil
+}
+
+func randomSerial() *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		panic(err)
+	}
+
+	return serial
+}
+
+// Gets the hosts the server certificate of an instance service is valid for
+func serviceHosts(name string, namespace string) []string {
+	return []string{
+		fmt.Sprintf("%s.%s.svc.cluster.local", name, namespace),
+		fmt.Sprintf("%s.%s.svc", name, namespace),
+		fmt.Sprintf("%s.%s", name, namespace),
+		name,
+	}
+}
+
+// Gets the tls secret of an instance. The secret is one of the instance
+// secrets with the broker provider, the secrets cert-manager creates are read
+// from the cluster. Empty data is returned when the instance has no tls
+func instanceTLSData(client kubernetes.Interface, secrets []coreV1.Secret, namespace string, name string) map[string][]byte {
+	if data := secretData(secrets, name); len(data) > 0 {
+		return data
+	}
+
+	if client == nil {
+		return map[string][]byte{}
+	}
+
+	secret, err := client.CoreV1().Secrets(namespace).Get(context.TODO(), name, metaV1.GetOptions{})
+	if err != nil {
+		return map[string][]byte{}
+	}
+
+	return secret.Data
+}
+
+// Mounts the tls secret of an instance into the pods of the instance server.
+// The items map the secret keys to the file names the server reads
+func mountTLSSecret(podSpec *coreV1.PodSpec, container string, secretName string, mountPath string, items ...coreV1.KeyToPath) {
+	podSpec.Volumes = append(podSpec.Volumes, coreV1.Volume{
+		Name: "tls",
+		VolumeSource: coreV1.VolumeSource{
+			Secret: &coreV1.SecretVolumeSource{SecretName: secretName, Items: items},
+		},
+	})
+
+	for i := range podSpec.Containers {
+		if podSpec.Containers[i].Name == container {
+			podSpec.Containers[i].VolumeMounts = append(podSpec.Containers[i].VolumeMounts, coreV1.VolumeMount{
+				Name:      "tls",
+				MountPath: mountPath,
+				ReadOnly:  true,
+			})
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package service
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"strings"
+	"testing"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestBrokerCA(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	ca, err := ensureCA(client, "broker-ns", "service-broker-ca")
+	if err != nil {
+		t.Fatalf("Unable to create the ca: %v", err)
+	}
+
+	existing, err := ensureCA(client, "broker-ns", "service-broker-ca")
+	if err != nil || !existing.certificate.Equal(ca.certificate) {
+		t.Fatalf("The existing ca should be used, got '%v'", err)
+	}
+
+	certificate, _, err := ca.issue(serviceHosts("mysql-instance-test-id", "test-ns"), tlsServerDuration)
+	if err != nil {
+		t.Fatalf("Unable to issue a certificate: %v", err)
+	}
+
+	block, _ := pem.Decode(certificate)
+	parsed, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.certificate)
+	if _, err := parsed.Verify(x509.VerifyOptions{Roots: roots, DNSName: "mysql-instance-test-id.test-ns.svc"}); err != nil {
+		t.Errorf("The certificate should be valid for the service host: %v", err)
+	}
+}
+
+func TestMysqlTLS(t *testing.T) {
+	config := InstanceConfig{
+		TLS: TLSConfig{Provider: TLSProviderBroker},
+		Plans: []PlanConfig{
+			{Name: "default", ID: "tls-plan", Storage: "2Gi", RequireTLS: true},
+		},
+	}
+
+	mysql := NewMysqlInstance(config, fake.NewSimpleClientset())
+	options := ServiceOptions{ID: "test-id", Namespace: "test-ns", GlobalNamespace: "broker-ns", PlanID: "tls-plan"}
+	if err := mysql.ValidateProvision(options); err != nil {
+		t.Fatalf("The instance should be valid, got '%v'", err)
+	}
+
+	spec := mysql.GetProvisionSpec(options)
+	if len(spec.Secrets) != 2 || spec.Secrets[1].Name != "mysql-instance-test-id-tls" {
+		t.Fatalf("The instance should have a tls secret")
+	}
+
+	args := strings.Join(spec.Deployments[0].Spec.Template.Spec.Containers[0].Args, " ")
+	if !strings.Contains(args, "--ssl-cert=/etc/mysql/tls/tls.crt") || !strings.Contains(args, "--require-secure-transport=ON") {
+		t.Errorf("The server should require tls, got '%s'", args)
+	}
+
+	spec.Secrets[1].Namespace = "test-ns"
+	options.InstanceSecrets = spec.Secrets
+	if regenerated := mysql.GetProvisionSpec(options); string(regenerated.Secrets[1].Data["tls.crt"]) != string(spec.Secrets[1].Data["tls.crt"]) {
+		t.Errorf("The certificate of the instance should be reused")
+	}
+
+	binding := mysql.GetBindSpec(BindOptions{ID: "binding-id", InstanceID: "test-id", Namespace: "app-ns", PlanID: "tls-plan", InstanceSecrets: spec.Secrets}).Secrets[0]
+	if string(binding.Data["ssl-mode"]) != SSLModeVerifyCA || string(binding.Data["ca.crt"]) != string(spec.Secrets[1].Data["ca.crt"]) {
+		t.Errorf("The binding should verify the ca, got '%s'", binding.Data["ssl-mode"])
+	}
+
+	binding = mysql.GetBindSpec(BindOptions{ID: "binding-id", InstanceID: "test-id", Namespace: "app-ns", PlanID: "tls-plan"}).Secrets[0]
+	if string(binding.Data["ssl-mode"]) != SSLModeVerifyCA {
+		t.Errorf("Bindings of plans that require tls should verify the ca without the certificate, got '%s'", binding.Data["ssl-mode"])
+	}
+
+	broken := NewMysqlInstance(config, nil)
+	brokenOptions := ServiceOptions{ID: "test-id", Namespace: "test-ns", PlanID: "tls-plan"}
+	brokenSpec, err := broken.BuildProvisionSpec(brokenOptions)
+	if err == nil {
+		t.Errorf("Certificate errors should be returned")
+	}
+
+	if args := strings.Join(brokenSpec.Deployments[0].Spec.Template.Spec.Containers[0].Args, " "); !strings.Contains(args, "--require-secure-transport=ON") {
+		t.Errorf("The server should still require tls without the certificate, got '%s'", args)
+	}
+
+	binding = NewMysqlInstance(InstanceConfig{}, nil).GetBindSpec(BindOptions{ID: "binding-id", InstanceID: "test-id", Namespace: "test-ns"}).Secrets[0]
+	if string(binding.Data["ssl-mode"]) != SSLModeDisabled || len(binding.Data["ca.crt"]) > 0 {
+		t.Errorf("Bindings of instances without tls should disable it")
+	}
+}
+
+func TestMinioCertManager(t *testing.T) {
+	config := InstanceConfig{TLS: TLSConfig{Provider: TLSProviderCertManager, Issuer: "internal-ca"}}
+	minio := NewMinioInstance(config, nil)
+	spec := minio.GetProvisionSpec(ServiceOptions{ID: "test-id", Namespace: "test-ns", PlanID: "2f931eba-c3cc-4d41-8702-e63cd5ee9a5c"})
+
+	if len(spec.CustomResources) != 1 || spec.CustomResources[0].Object.GetKind() != "Certificate" {
+		t.Fatalf("The instance should have a certificate")
+	}
+
+	if name := spec.CustomResources[0].Object.Object["spec"].(map[string]interface{})["secretName"]; name != "minio-instance-test-id-tls" {
+		t.Errorf("Invalid certificate secret '%v'", name)
+	}
+
+	if command := strings.Join(spec.Deployments[0].Spec.Template.Spec.Containers[0].Command, " "); !strings.HasSuffix(command, "--certs-dir /etc/minio/certs") {
+		t.Errorf("The server should read the certificate, got '%s'", command)
+	}
+
+	if alias := string(spec.Secrets[0].Data["minioalias"]); !strings.HasPrefix(alias, "https://") {
+		t.Errorf("The admin alias should use https, got '%s'", alias)
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	if err := (TLSConfig{Provider: TLSProviderCertManager}).Validate(); err == nil {
+		t.Errorf("The cert-manager provider should need an issuer")
+	}
+
+	if err := (TLSConfig{Provider: "vault"}).Validate(); err == nil {
+		t.Errorf("Unknown providers should be invalid")
+	}
+
+	if err := (TLSConfig{Provider: TLSProviderBroker, Duration: "720h"}).Validate(); err != nil {
+		t.Errorf("The broker provider should be valid, got '%v'", err)
+	}
+}